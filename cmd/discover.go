@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hyperkit/core/wled"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// discover lists the WLED controllers that answer over mDNS, with the details
+// from their /json/info.
+func discover(args []string) error {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 3*time.Second, "How long to browse for WLED controllers.")
+	_ = fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	var found []wled.Controller
+	if err := wled.Browse(ctx, func(c wled.Controller) { found = append(found, c) }); err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		fmt.Println("No WLED controllers found")
+		return nil
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Instance < found[j].Instance })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tMDNS NAME\tADDRESS\tMAC\tVERSION\tLEDS\tPRODUCT")
+	for _, c := range found {
+		info, err := wled.NewClient(c.Host, wled.Options{}).Info()
+		if err != nil {
+			log.Warnf("Error getting info from %s: %v\n", c.Host, err)
+			fmt.Fprintf(w, "-\t%s\t%s\t%s\t-\t-\t-\n", c.Instance, c.Host, c.MAC)
+			continue
+		}
+		mac := c.MAC
+		if mac == "" {
+			mac = info.MAC
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", info.Name, c.Instance, c.Host, mac, info.Version, info.Leds.Count, info.Product)
+	}
+	return w.Flush()
+}
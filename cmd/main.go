@@ -1,40 +1,107 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"hyperkit/core"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 var (
+	ConfigPath    string
 	AirPlayName   string
 	AudioPipePath string
 	BtDevice      string
+	ResetPairings bool
 )
 
 func init() {
-	flag.StringVar(&AirPlayName, "airPlayName", "HyperKit-Audio", "The advertisement name for the AirPlay2 server. (default: HyperKit-Audio)")
-	flag.StringVar(&AudioPipePath, "audioPipePath", "/home/pi/ledfx/audio/stream", "The fully qualified path to your LedFX audio pipe file. (default: '/home/pi/ledfx/audio/stream')")
-	flag.StringVar(&BtDevice, "bluetoothDevice", "", "The name of the BlueTooth audio device to proxy audio to. (required)")
-
-	flag.Parse()
-
-	if BtDevice == "" {
-		log.Errorln("'-bluetoothDevice' flag is required")
+	flag.StringVar(&ConfigPath, "config", core.DefaultConfigPath, "The path to the HyperKit config file. Values in it can be overridden with HYPERKIT_* environment variables, e.g. HYPERKIT_WLED_IP.")
+	flag.StringVar(&AirPlayName, "airPlayName", "", "The advertisement name for the AirPlay2 server, overrides 'airplay_name'. (default: HyperKit-Audio)")
+	flag.StringVar(&AudioPipePath, "audioPipePath", "", "The fully qualified path to your LedFX audio pipe file, overrides 'audio_pipe_path'. (default: '/home/pi/ledfx/audio/stream')")
+	flag.StringVar(&BtDevice, "bluetoothDevice", "", "The name of the BlueTooth audio device to proxy audio to, overrides 'bluetooth_device'. (required)")
+	flag.BoolVar(&ResetPairings, "resetPairings", false, "Remove all HomeKit pairings so the bridge can be added again, then exit.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n       %s discover [-timeout 3s]\n\nFlags:\n", os.Args[0], os.Args[0])
 		flag.PrintDefaults()
-		os.Exit(1)
 	}
 
+	flag.Parse()
+}
+
+// flagOverrides applies the flags given on the command line to the config.
+func flagOverrides(config *core.Config) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "airPlayName":
+			config.AirPlayName = AirPlayName
+		case "audioPipePath":
+			config.AudioPipePath = AudioPipePath
+		case "bluetoothDevice":
+			config.BtDeviceName = BtDevice
+		}
+	})
 }
 
 func main() {
-	c, err := core.NewCore(AirPlayName, AudioPipePath, BtDevice, [8]uint{6, 9, 6, 9, 4, 2, 0, 0})
+	if flag.Arg(0) == "discover" {
+		if err := discover(flag.Args()[1:]); err != nil {
+			log.Fatalf("Error discovering WLED controllers: %v\n", err)
+		}
+		return
+	}
+
+	config, err := core.LoadConfig(ConfigPath, flagOverrides)
+	if err != nil {
+		log.Fatalf("Error loading config: %v\n", err)
+	}
+
+	if ResetPairings {
+		if err := core.ResetPairings(config.HomeKitStoragePath); err != nil {
+			log.Fatalf("Error resetting pairings: %v\n", err)
+		}
+		return
+	}
+
+	c, err := core.NewCore(config)
 	if err != nil {
 		log.Fatalf("Error creating new core: %v\n", err)
 	}
 	if err := c.LoadPresetsFromWled(); err != nil {
 		log.Fatalf("Error loading presets from WLED: %v\n", err)
 	}
-	log.Fatalln(c.Start())
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	started := make(chan error, 1)
+	go func() {
+		started <- c.Start()
+	}()
+
+	select {
+	case err := <-started:
+		log.Fatalf("Error starting HyperKit: %v\n", err)
+	case sig := <-sigs:
+		log.Infof("Received %v, shutting down...\n", sig)
+	}
+
+	// A second signal skips the graceful shutdown
+	go func() {
+		<-sigs
+		log.Warnln("Received second signal, exiting immediately")
+		os.Exit(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout())
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		log.Errorf("Error shutting down: %v\n", err)
+		cancel()
+		os.Exit(1)
+	}
+	<-started
 }
@@ -0,0 +1,205 @@
+package airplayserver
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The MPEG-4 audio object types AirPlay streams.
+const (
+	aacLC  = 2
+	aacELD = 39
+)
+
+// aacSampleRates are the sample rates by sampling frequency index.
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// aacConfig is what the SDP of an AAC stream announces, in the fmtp
+// parameters of RFC 3640, e.g. "mode=AAC-hbr; sizelength=13; indexlength=3;
+// indexdeltalength=3; config=1210".
+type aacConfig struct {
+	objectType int
+	format     Format
+	// asc is the AudioSpecificConfig the decoder is set up with.
+	asc []byte
+	// sizeLength, indexLength and indexDeltaLength are the widths in bits of
+	// the fields of the AU headers. Without sizeLength, every packet is one
+	// access unit without headers.
+	sizeLength, indexLength, indexDeltaLength int
+}
+
+// name returns the name of the object type.
+func (c aacConfig) name() string {
+	if c.objectType == aacELD {
+		return "AAC-ELD"
+	}
+	return "AAC-LC"
+}
+
+func parseAACConfig(params CodecParams) (aacConfig, error) {
+	var config aacConfig
+	for _, param := range strings.Split(strings.Join(params.Fmtp, " "), ";") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.ToLower(kv[0]), strings.TrimSpace(kv[1])
+		var err error
+		switch key {
+		case "config":
+			config.asc, err = hex.DecodeString(value)
+		case "sizelength":
+			config.sizeLength, err = strconv.Atoi(value)
+		case "indexlength":
+			config.indexLength, err = strconv.Atoi(value)
+		case "indexdeltalength":
+			config.indexDeltaLength, err = strconv.Atoi(value)
+		}
+		if err != nil {
+			return aacConfig{}, fmt.Errorf("invalid fmtp parameter %s: %v", key, err)
+		}
+	}
+	if len(config.asc) == 0 {
+		return aacConfig{}, fmt.Errorf("missing config in fmtp")
+	}
+	for _, n := range []int{config.sizeLength, config.indexLength, config.indexDeltaLength} {
+		if n < 0 || n > 32 {
+			return aacConfig{}, fmt.Errorf("invalid AU header field length %d", n)
+		}
+	}
+
+	r := bitReader{buf: config.asc}
+	config.objectType = int(r.read(5))
+	if config.objectType == 31 {
+		config.objectType = 32 + int(r.read(6))
+	}
+	rate := int(r.read(4))
+	if rate == 15 {
+		rate = int(r.read(24))
+	} else if rate < len(aacSampleRates) {
+		rate = aacSampleRates[rate]
+	} else {
+		return aacConfig{}, fmt.Errorf("invalid sampling frequency index %d", rate)
+	}
+	channels := int(r.read(4))
+	if r.overrun {
+		return aacConfig{}, fmt.Errorf("truncated config %X", config.asc)
+	}
+	if config.objectType != aacLC && config.objectType != aacELD {
+		return aacConfig{}, fmt.Errorf("unsupported audio object type %d, only AAC-LC (%d) and AAC-ELD (%d)", config.objectType, aacLC, aacELD)
+	}
+	// Channel configurations above 2 need a channel map the sinks lack
+	if channels < 1 || channels > 2 {
+		return aacConfig{}, fmt.Errorf("unsupported channel configuration %d, only mono and stereo", channels)
+	}
+	config.format = Format{SampleRate: rate, Channels: channels, BitsPerSample: 16}
+	return config, nil
+}
+
+// accessUnits splits a packet into its access units, which it appends to
+// units.
+func (c aacConfig) accessUnits(packet []byte, units [][]byte) ([][]byte, error) {
+	if c.sizeLength == 0 {
+		return append(units, packet), nil
+	}
+	if len(packet) < 2 {
+		return units, fmt.Errorf("AAC packet of %d bytes has no AU headers", len(packet))
+	}
+	headerBits := int(packet[0])<<8 | int(packet[1])
+	data := 2 + (headerBits+7)/8
+	if data > len(packet) {
+		return units, fmt.Errorf("AU headers of %d bits overrun AAC packet of %d bytes", headerBits, len(packet))
+	}
+	r := bitReader{buf: packet[2:data]}
+	indexLength := c.indexLength
+	for r.pos+c.sizeLength+indexLength <= headerBits {
+		size := int(r.read(c.sizeLength))
+		r.read(indexLength)
+		indexLength = c.indexDeltaLength
+		if size > len(packet)-data {
+			return units, fmt.Errorf("access unit of %d bytes overruns AAC packet", size)
+		}
+		units = append(units, packet[data:data+size])
+		data += size
+	}
+	return units, nil
+}
+
+// bitReader reads big-endian bit fields.
+type bitReader struct {
+	buf     []byte
+	pos     int
+	overrun bool
+}
+
+func (r *bitReader) read(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.buf)*8 {
+			r.overrun = true
+			return 0
+		}
+		v = v<<1 | uint32(r.buf[r.pos/8]>>(7-uint(r.pos%8))&1)
+		r.pos++
+	}
+	return v
+}
+
+// aacDecoder decodes AAC access units into interleaved 16-bit little-endian
+// PCM.
+type aacDecoder interface {
+	// decode appends the PCM of au to pcm.
+	decode(pcm, au []byte) ([]byte, error)
+	Close() error
+}
+
+// aacCodec decodes the AAC-LC or AAC-ELD of a session. The decoding itself
+// needs libfdk-aac, so the codec is only registered by builds with the
+// fdkaac tag.
+type aacCodec struct {
+	config  aacConfig
+	decoder aacDecoder
+	units   [][]byte
+	pcm     []byte
+}
+
+// newAACCodec parses the config of a session and opens a decoder for it.
+func newAACCodec(params CodecParams, open func(aacConfig) (aacDecoder, error)) (Codec, error) {
+	config, err := parseAACConfig(params)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := open(config)
+	if err != nil {
+		return nil, err
+	}
+	return &aacCodec{config: config, decoder: decoder}, nil
+}
+
+func (c *aacCodec) Decode(packet []byte) ([]byte, error) {
+	units, err := c.config.accessUnits(packet, c.units[:0])
+	c.units = units
+	if err != nil {
+		return nil, err
+	}
+	if len(units) == 0 {
+		return nil, fmt.Errorf("AAC packet without access units")
+	}
+	c.pcm = c.pcm[:0]
+	for _, au := range units {
+		if c.pcm, err = c.decoder.decode(c.pcm, au); err != nil {
+			return nil, err
+		}
+	}
+	return c.pcm, nil
+}
+
+func (c *aacCodec) Format() Format {
+	return c.config.format
+}
+
+func (c *aacCodec) Close() error {
+	return c.decoder.Close()
+}
@@ -0,0 +1,95 @@
+//go:build fdkaac
+// +build fdkaac
+
+package airplayserver
+
+/*
+#cgo pkg-config: fdk-aac
+#include <stdlib.h>
+#include <fdk-aac/aacdecoder_lib.h>
+
+// The decoder takes arrays of buffers, which cannot hold Go pointers
+static AAC_DECODER_ERROR config_raw(HANDLE_AACDECODER dec, UCHAR *asc, UINT size) {
+	UCHAR *bufs[1] = {asc};
+	UINT sizes[1] = {size};
+	return aacDecoder_ConfigRaw(dec, bufs, sizes);
+}
+
+static AAC_DECODER_ERROR fill(HANDLE_AACDECODER dec, UCHAR *buf, UINT size, UINT *valid) {
+	UCHAR *bufs[1] = {buf};
+	UINT sizes[1] = {size};
+	*valid = size;
+	return aacDecoder_Fill(dec, bufs, sizes, valid);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// maxAACFrame is the most samples per channel an AAC frame decodes to.
+const maxAACFrame = 2048
+
+// fdkDecoder decodes AAC with libfdk-aac.
+type fdkDecoder struct {
+	handle   C.HANDLE_AACDECODER
+	channels int
+	out      []int16
+}
+
+func init() {
+	RegisterCodec("mpeg4-generic", func(params CodecParams) (Codec, error) {
+		return newAACCodec(params, newFdkDecoder)
+	})
+}
+
+func newFdkDecoder(config aacConfig) (aacDecoder, error) {
+	handle := C.aacDecoder_Open(C.TT_MP4_RAW, 1)
+	if handle == nil {
+		return nil, fmt.Errorf("error opening %s decoder", config.name())
+	}
+	asc := C.CBytes(config.asc)
+	defer C.free(asc)
+	if err := C.config_raw(handle, (*C.UCHAR)(asc), C.UINT(len(config.asc))); err != C.AAC_DEC_OK {
+		C.aacDecoder_Close(handle)
+		return nil, fmt.Errorf("error configuring %s decoder: error 0x%x", config.name(), int(err))
+	}
+	return &fdkDecoder{
+		handle:   handle,
+		channels: config.format.Channels,
+		out:      make([]int16, maxAACFrame*config.format.Channels),
+	}, nil
+}
+
+func (d *fdkDecoder) decode(pcm, au []byte) ([]byte, error) {
+	if len(au) == 0 {
+		return pcm, fmt.Errorf("empty AAC access unit")
+	}
+	var valid C.UINT
+	if err := C.fill(d.handle, (*C.UCHAR)(unsafe.Pointer(&au[0])), C.UINT(len(au)), &valid); err != C.AAC_DEC_OK {
+		return pcm, fmt.Errorf("error buffering AAC access unit: error 0x%x", int(err))
+	}
+	err := C.aacDecoder_DecodeFrame(d.handle, (*C.INT_PCM)(unsafe.Pointer(&d.out[0])), C.INT(len(d.out)), 0)
+	if err != C.AAC_DEC_OK {
+		return pcm, fmt.Errorf("error decoding AAC access unit: error 0x%x", int(err))
+	}
+	info := C.aacDecoder_GetStreamInfo(d.handle)
+	if int(info.numChannels) != d.channels {
+		return pcm, fmt.Errorf("AAC frame decoded to %d channels, expected %d", int(info.numChannels), d.channels)
+	}
+	n := int(info.frameSize) * d.channels
+	if n > len(d.out) {
+		return pcm, fmt.Errorf("AAC frame of %d samples exceeds the buffer", n)
+	}
+	for _, s := range d.out[:n] {
+		pcm = append(pcm, byte(s), byte(uint16(s)>>8))
+	}
+	return pcm, nil
+}
+
+func (d *fdkDecoder) Close() error {
+	C.aacDecoder_Close(d.handle)
+	return nil
+}
@@ -0,0 +1,47 @@
+//go:build fdkaac
+// +build fdkaac
+
+package airplayserver
+
+import (
+	"io"
+	"testing"
+)
+
+func TestFdkDecoder(t *testing.T) {
+	for _, fmtp := range []string{
+		"96 mode=AAC-hbr; sizelength=13; indexlength=3; indexdeltalength=3; config=1210",
+		"96 mode=AAC-eld; constantDuration=480; config=F8E85000",
+	} {
+		codec, err := NewCodec(newSession("96 mpeg4-generic/44100/2", fmtp))
+		if err != nil {
+			t.Fatalf("Error creating codec for %q: %v\n", fmtp, err)
+		}
+		if _, err := codec.Decode(nil); err == nil {
+			t.Fatalf("Expected an empty packet to fail\n")
+		}
+		if err := codec.(io.Closer).Close(); err != nil {
+			t.Fatalf("Error closing codec: %v\n", err)
+		}
+	}
+
+	// A silent stereo AAC-LC frame behind its AU header
+	packet := []byte{0x00, 0x10, 0x00, 0x30, 0x21, 0x00, 0x05, 0x00, 0xa0, 0x1c}
+	codec, err := NewCodec(newSession("96 mpeg4-generic/44100/2", "96 mode=AAC-hbr; sizelength=13; indexlength=3; indexdeltalength=3; config=1210"))
+	if err != nil {
+		t.Fatalf("Error creating AAC-LC codec: %v\n", err)
+	}
+	defer codec.(io.Closer).Close()
+	pcm, err := codec.Decode(packet)
+	if err != nil {
+		t.Fatalf("Error decoding AAC-LC frame: %v\n", err)
+	}
+	if len(pcm) != 1024*2*2 {
+		t.Fatalf("AAC-LC frame decoded to %d bytes, want %d\n", len(pcm), 1024*2*2)
+	}
+	for i, b := range pcm {
+		if b != 0 {
+			t.Fatalf("Silent AAC-LC frame decoded to %d at byte %d\n", b, i)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !fdkaac
+// +build !fdkaac
+
+package airplayserver
+
+// Without the fdkaac build tag, HyperKit does not link libfdk-aac and has no
+// AAC codec.
+func init() {
+	codecHints["mpeg4-generic"] = "AAC-LC and AAC-ELD need HyperKit built with libfdk-aac (go build -tags fdkaac)"
+}
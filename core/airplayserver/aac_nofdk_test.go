@@ -0,0 +1,21 @@
+//go:build !fdkaac
+// +build !fdkaac
+
+package airplayserver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAACNeedsFdk(t *testing.T) {
+	for _, name := range Codecs() {
+		if name == "mpeg4-generic" {
+			t.Fatalf("AAC is registered without a decoder\n")
+		}
+	}
+	_, err := NewCodec(newSession("96 mpeg4-generic/44100/2", "96 mode=AAC-hbr; config=1210"))
+	if err == nil || !strings.Contains(err.Error(), "-tags fdkaac") {
+		t.Fatalf("Creating an AAC codec returned %v, want it to point to the fdkaac tag\n", err)
+	}
+}
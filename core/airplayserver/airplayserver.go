@@ -1,11 +1,17 @@
 package airplayserver
 
 import (
+	"context"
 	"fmt"
 	"github.com/carterpeel/bobcaygeon/raop"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
+	"hyperkit/core/airplayserver/bluetoothproxy"
+	"hyperkit/core/errorTypes"
+	"hyperkit/core/events"
 	"hyperkit/core/ledfx"
+	"hyperkit/core/lifecycle"
+	"io"
 	"os"
 	"sync"
 )
@@ -16,7 +22,14 @@ type AirplayServer struct {
 	ledfxctl       *ledfx.Controller
 	containerMutex *sync.Mutex
 
-	muted bool
+	// enabled is set while the AirPlay switch is on, and running while the
+	// RAOP server goroutine runs; svc.Stop blocks on a server that is not
+	// running.
+	enabled bool
+	running bool
+	muted   bool
+	status  lifecycle.Status
+	group   *lifecycle.Group
 
 	album   string
 	artist  string
@@ -24,56 +37,166 @@ type AirplayServer struct {
 	artwork []byte
 }
 
-func NewAirplayLedFXBridge(advertisementName, pipeFilePath, btDeviceName string) (a *AirplayServer, err error) {
+// NewAirplayLedFXBridge creates the AirPlay server and the LedFX and
+// Bluetooth outputs it feeds. An empty pipeFilePath leaves LedFX out. What
+// they do is published on bus, which may be nil.
+func NewAirplayLedFXBridge(advertisementName, pipeFilePath, btDeviceName string, bus *events.Bus) (a *AirplayServer, err error) {
 	a = &AirplayServer{
 		containerMutex: &sync.Mutex{},
 		muted:          false,
 		artwork:        make([]byte, 0),
 	}
+	a.group = lifecycle.NewGroup(&a.status)
 	log.Infof("Creating local player...\n")
 
-	if a.plyr, err = NewBluetoothPlayer(pipeFilePath, btDeviceName); err != nil {
+	if a.plyr, err = NewBluetoothPlayer(pipeFilePath, btDeviceName, bus); err != nil {
 		return nil, fmt.Errorf("error creating new player: %w", err)
 	}
-	log.Infof("Created local player with hook to named pipe '%s'\n", pipeFilePath)
+	if pipeFilePath != "" {
+		log.Infof("Created local player with hook to named pipe '%s'\n", pipeFilePath)
+		a.ledfxctl = ledfx.NewController(bus)
+	} else {
+		log.Infof("Created local player without LedFX\n")
+	}
 	a.svc = raop.NewAirplayServer(8044, advertisementName, a.plyr)
 	log.Infof("Created AirPlay server with advertisementName '%s'\n", advertisementName)
 
-	if a.ledfxctl, err = ledfx.NewController(); err != nil {
-		return nil, fmt.Errorf("error creating new LedFX controller: %w", err)
+	return
+}
+
+// LedFX returns the controller of the LedFX container the audio is fed to,
+// or nil if LedFX is left out.
+func (a *AirplayServer) LedFX() *ledfx.Controller {
+	return a.ledfxctl
+}
+
+// AddSink adds an output for the AirPlay audio, which is fed from the next
+// stream on.
+func (a *AirplayServer) AddSink(s AudioSink) error {
+	return a.plyr.AddSink(s)
+}
+
+// RemoveSink removes the named output once the stream that plays ends.
+func (a *AirplayServer) RemoveSink(name string) error {
+	return a.plyr.RemoveSink(name)
+}
+
+// SetBufferOptions configures the buffer between decoding and the outputs
+// for the streams that start from now on.
+func (a *AirplayServer) SetBufferOptions(opts BufferOptions) error {
+	return a.plyr.SetBufferOptions(opts)
+}
+
+// BufferStats returns the diagnostic counters of the buffer and the outputs.
+func (a *AirplayServer) BufferStats() BufferStats {
+	return a.plyr.BufferStats()
+}
+
+// SetPCMTap sets the writer that receives the decoded PCM of every AirPlay
+// packet in DefaultFormat, at full volume, or removes it if w is nil. Writes to
+// it must not block.
+func (a *AirplayServer) SetPCMTap(w io.Writer) {
+	a.plyr.SetTap(w)
+}
+
+// Bluetooth returns the Bluetooth device the audio is proxied to.
+func (a *AirplayServer) Bluetooth() *bluetoothproxy.BluetoothProxy {
+	return a.plyr.btpx
+}
+
+// Start readies the player. The RAOP server itself only runs while the
+// AirPlay switch is enabled; after a restart it is brought back up if it was.
+func (a *AirplayServer) Start(ctx context.Context) error {
+	a.plyr.open()
+	a.containerMutex.Lock()
+	enabled := a.enabled
+	a.containerMutex.Unlock()
+	a.status.Set(lifecycle.Running, nil)
+	if enabled {
+		return a.Enable()
 	}
+	return nil
+}
 
-	return
+// Stop stops the RAOP server and the player, which closes the named pipe.
+// LedFX and Bluetooth are separate services.
+func (a *AirplayServer) Stop(ctx context.Context) error {
+	a.status.Set(lifecycle.Stopping, nil)
+	errs := new(errorTypes.MultiError)
+	errs.Append(errorTypes.RunWithContext(ctx, "stopping AirPlay server", a.stopServer))
+	errs.Append(a.plyr.Close(ctx))
+	errs.Append(a.group.Wait(ctx))
+	a.status.Set(lifecycle.Stopped, nil)
+	return errs.ErrorOrNil()
 }
 
-func (a *AirplayServer) Start() error {
-	if err := unix.Mkfifo("/home/pi/ledfx/audio/stream", 0600); err != nil {
-		if !os.IsExist(err) {
-			return fmt.Errorf("error creating FIFO file: %w", err)
+func (a *AirplayServer) Health() lifecycle.Health {
+	return a.status.Health()
+}
+
+// Enable resumes LedFX and starts accepting AirPlay audio.
+func (a *AirplayServer) Enable() error {
+	if a.ledfxctl != nil {
+		if err := unix.Mkfifo(a.plyr.pipeFile, 0600); err != nil {
+			if !os.IsExist(err) {
+				return fmt.Errorf("error creating FIFO file: %w", err)
+			}
 		}
+		a.group.Go("ledfx-resume", func() {
+			a.containerMutex.Lock()
+			defer a.containerMutex.Unlock()
+			log.Infof("Starting LEDfx container...\n")
+			if err := a.ledfxctl.Resume(); err != nil {
+				log.Errorf("Error resuming LedFX Docker container: %v\n", err)
+			}
+		})
+	}
+
+	a.containerMutex.Lock()
+	defer a.containerMutex.Unlock()
+	a.enabled = true
+	if a.running {
+		return nil
 	}
-	go func() {
+	a.running = true
+	a.group.Go("raop", func() {
+		a.svc.Start(false, true)
+		// The server only returns on its own if it could not listen
 		a.containerMutex.Lock()
 		defer a.containerMutex.Unlock()
-		log.Infof("Starting LEDfx container...\n")
-		if err := a.ledfxctl.Resume(); err != nil {
-			log.Errorf("Error resuming LedFX Docker container: %v\n", err)
+		if a.running {
+			a.running = false
+			a.status.Set(lifecycle.Failed, fmt.Errorf("AirPlay server exited"))
 		}
-	}()
-
-	go a.svc.Start(false, true)
-
+	})
 	return nil
 }
 
-func (a *AirplayServer) Stop() error {
-	go func() {
-		a.containerMutex.Lock()
-		defer a.containerMutex.Unlock()
-		if err := a.ledfxctl.Pause(); err != nil {
-			log.Errorf("Error pausing LEDfx Docker container: %v\n", err)
-		}
-	}()
+// Disable stops accepting AirPlay audio and pauses LedFX.
+func (a *AirplayServer) Disable() error {
+	a.containerMutex.Lock()
+	a.enabled = false
+	a.containerMutex.Unlock()
+	if a.ledfxctl != nil {
+		a.group.Go("ledfx-pause", func() {
+			a.containerMutex.Lock()
+			defer a.containerMutex.Unlock()
+			if err := a.ledfxctl.Pause(); err != nil {
+				log.Errorf("Error pausing LEDfx Docker container: %v\n", err)
+			}
+		})
+	}
+	return a.stopServer()
+}
+
+func (a *AirplayServer) stopServer() error {
+	a.containerMutex.Lock()
+	running := a.running
+	a.running = false
+	a.containerMutex.Unlock()
+	if !running {
+		return nil
+	}
 	log.Infof("Stopping AirPlay server...")
 	a.svc.Stop()
 	log.Infof("Stopped AirPlay server successfully.")
@@ -1,17 +1,21 @@
 package airplayserver
 
 import (
+	"context"
 	"testing"
 )
 
 func TestNewAirplayServer(t *testing.T) {
-	srv, err := NewAirplayLedFXBridge("airplayserver_test", "/home/pi/ledfx/audio/stream", "")
+	srv, err := NewAirplayLedFXBridge("airplayserver_test", "/home/pi/ledfx/audio/stream", "", nil)
 	if err != nil {
 		t.Fatalf("Error creating new AirPlay LedFX bridge: %v\n", err)
 	}
 	t.Logf("Created bridge...")
 
-	if err := srv.Start(); err != nil {
+	if err := srv.Start(context.Background()); err != nil {
 		t.Fatalf("Error starting LedFX bridge: %v\n", err)
 	}
+	if err := srv.Enable(); err != nil {
+		t.Fatalf("Error enabling LedFX bridge: %v\n", err)
+	}
 }
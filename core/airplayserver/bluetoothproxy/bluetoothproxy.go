@@ -1,9 +1,15 @@
 package bluetoothproxy
 
 import (
+	"context"
 	"fmt"
 	"hyperkit/core/errorTypes"
+	"hyperkit/core/events"
+	"hyperkit/core/lifecycle"
+	"hyperkit/core/metrics"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/muka/go-bluetooth/api"
 	"github.com/muka/go-bluetooth/bluez/profile/adapter"
@@ -15,17 +21,75 @@ type BluetoothProxy struct {
 	dev        *device.Device1
 	adapter    *adapter.Adapter1
 	deviceName string
+
+	// stop ends the background scanner and connection retries.
+	stop     chan struct{}
+	stopOnce *sync.Once
+	status   lifecycle.Status
+	group    *lifecycle.Group
+	bus      *events.Bus
 }
 
-func ProxyBluetoothDevice(deviceName string) (bt *BluetoothProxy, err error) {
+// retryInterval is the delay between connection attempts to a device that is
+// down.
+const retryInterval = time.Second
+
+func ProxyBluetoothDevice(deviceName string, bus *events.Bus) (bt *BluetoothProxy, err error) {
 	bt = &BluetoothProxy{
 		dev:        new(device.Device1),
 		deviceName: deviceName,
+		stop:       make(chan struct{}),
+		stopOnce:   &sync.Once{},
+		bus:        bus,
 	}
+	bt.group = lifecycle.NewGroup(&bt.status)
 
 	return bt, nil
 }
 
+// Start connects to the audio device. If it is not around yet, it is scanned
+// for or retried in the background and the proxy reports Degraded until it is
+// connected.
+func (bt *BluetoothProxy) Start(ctx context.Context) error {
+	bt.stop, bt.stopOnce = make(chan struct{}), &sync.Once{}
+	bt.status.Set(lifecycle.Starting, nil)
+	if err := errorTypes.RunWithContext(ctx, "connecting Bluetooth audio output", bt.ConnectAudioOutput); err != nil {
+		bt.status.Set(lifecycle.Failed, err)
+		return err
+	}
+	return nil
+}
+
+// Stop disconnects the device and waits for the scanner and connection
+// retries to exit.
+func (bt *BluetoothProxy) Stop(ctx context.Context) error {
+	bt.status.Set(lifecycle.Stopping, nil)
+	errs := new(errorTypes.MultiError)
+	errs.Append(bt.Disconnect())
+	errs.Append(bt.group.Wait(ctx))
+	bt.status.Set(lifecycle.Stopped, nil)
+	return errs.ErrorOrNil()
+}
+
+func (bt *BluetoothProxy) Health() lifecycle.Health {
+	return bt.status.Health()
+}
+
+// DeviceName returns the name of the audio device, which is the full name
+// once a matching device was found.
+func (bt *BluetoothProxy) DeviceName() string {
+	return bt.deviceName
+}
+
+// Connected reports whether the audio device is connected.
+func (bt *BluetoothProxy) Connected() bool {
+	if bt.dev == nil || bt.dev.Client() == nil {
+		return false
+	}
+	connected, err := bt.dev.GetConnected()
+	return err == nil && connected
+}
+
 func (bt *BluetoothProxy) ConnectAudioOutput() (err error) {
 	if bt.adapter, err = adapter.GetDefaultAdapter(); err != nil {
 		return fmt.Errorf("error getting default adapter: %w", err)
@@ -35,20 +99,21 @@ func (bt *BluetoothProxy) ConnectAudioOutput() (err error) {
 	if err := bt.ConnectFromCurrentDeviceList(); err != nil {
 		switch {
 		case err == errorTypes.BtDeviceDoesNotExist:
-			go func() {
-				if err := bt.StartScanner(); err != nil {
-					log.Errorf("Error starting Bluetooth background scanner: %v", err)
-				}
-			}()
+			bt.status.Set(lifecycle.Degraded, err)
+			if err := bt.StartScanner(); err != nil {
+				return fmt.Errorf("error starting Bluetooth background scanner: %w", err)
+			}
 			return nil
 		case err == errorTypes.BtDeviceDown:
+			bt.status.Set(lifecycle.Degraded, err)
 			log.Infof("Indefinitely attempting to connect to device '%s'...\n", bt.dev.Properties.Name)
-			go bt.TryConnect(-1)
+			bt.group.Go("bluetooth-connect", func() { bt.TryConnect(-1) })
 			return nil
 		default:
 			return fmt.Errorf("error attempting to connect from current device list: %w", err)
 		}
 	}
+	bt.connected()
 	return nil
 }
 
@@ -85,6 +150,13 @@ func (bt *BluetoothProxy) ConnectFromCurrentDeviceList() (err error) {
 
 func (bt *BluetoothProxy) TryConnect(retries int) {
 	for i := 0; i != retries; i++ {
+		if i > 0 {
+			select {
+			case <-bt.stop:
+				return
+			case <-time.After(retryInterval):
+			}
+		}
 		if err := bt.dev.Connect(); err != nil {
 			if !errorTypes.IsBtDevDown(err) {
 				log.Warnf("Weird/unexpected error returned during connection attempt %d: %v\n", i, err)
@@ -93,6 +165,7 @@ func (bt *BluetoothProxy) TryConnect(retries int) {
 		}
 		if ok, _ := bt.dev.GetConnected(); ok {
 			log.Infof("Successfully connected to device '%s'\n", bt.dev.Properties.Name)
+			bt.connected()
 			return
 		}
 	}
@@ -104,8 +177,20 @@ func (bt *BluetoothProxy) StartScanner() (err error) {
 	if err != nil {
 		return fmt.Errorf("error running discovery: %w", err)
 	}
-	go func() {
-		defer cancel()
+	var cancelOnce sync.Once
+	stopDiscovery := func() { cancelOnce.Do(cancel) }
+	scanDone := make(chan struct{})
+	stop := bt.stop
+	bt.group.Go("bluetooth-scan-cancel", func() {
+		select {
+		case <-stop:
+			stopDiscovery()
+		case <-scanDone:
+		}
+	})
+	bt.group.Go("bluetooth-scan", func() {
+		defer close(scanDone)
+		defer stopDiscovery()
 		for ev := range discovery {
 			if ev.Type == adapter.DeviceRemoved {
 				continue
@@ -128,15 +213,48 @@ func (bt *BluetoothProxy) StartScanner() (err error) {
 			log.Infoln("Connecting now...")
 			if err := bt.dev.Connect(); err != nil {
 				log.Errorf("Error connecting to device '%s': %v\n", bt.dev.Properties.Name, err)
+				bt.status.Set(lifecycle.Failed, err)
 				return
 			}
 			log.Infoln("BLUETOOTH DEVICE CONNECTED")
+			bt.connected()
 			return
 		}
-	}()
+		select {
+		case <-stop:
+		default:
+			bt.status.Set(lifecycle.Failed, errorTypes.BtDeviceDoesNotExist)
+		}
+	})
+	return nil
+}
+
+// Disconnect stops any background scanning or connection attempts and
+// disconnects the audio device.
+func (bt *BluetoothProxy) Disconnect() error {
+	bt.stopOnce.Do(func() { close(bt.stop) })
+	if bt.dev == nil || bt.dev.Client() == nil {
+		return nil
+	}
+	connected, err := bt.dev.GetConnected()
+	if err != nil || !connected {
+		return nil
+	}
+	log.Infof("Disconnecting Bluetooth device '%s'...\n", bt.dev.Properties.Name)
+	if err := bt.dev.Disconnect(); err != nil {
+		return fmt.Errorf("error disconnecting from '%s': %w", bt.dev.Properties.Name, err)
+	}
+	metrics.BluetoothConnected.Set(0)
+	bt.bus.Publish(events.BluetoothDisconnected, events.Bluetooth{Device: bt.deviceName})
 	return nil
 }
 
+func (bt *BluetoothProxy) connected() {
+	bt.status.Set(lifecycle.Running, nil)
+	metrics.BluetoothConnected.Set(1)
+	bt.bus.Publish(events.BluetoothConnected, events.Bluetooth{Device: bt.deviceName})
+}
+
 // Deprecated
 /*func (bt *BluetoothProxy) Connect() (err error) {
 	log.Infof("Searching for Bluetooth device '%s'...\n", bt.deviceName)
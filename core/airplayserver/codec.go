@@ -1,34 +1,227 @@
 package airplayserver
 
 import (
-	"strings"
-
+	"fmt"
 	"github.com/carterpeel/bobcaygeon/rtsp"
 	"github.com/maghul/alac"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 )
 
-// CodecHandler handler function for receiving raw bytes and decoding them using some codec
-type CodecHandler func(data []byte) ([]byte, error)
+// Codec decodes the audio packets of one session. It is created when the
+// session starts and used for all of its packets. A codec that holds
+// resources implements io.Closer, and is closed when the session ends.
+type Codec interface {
+	// Decode returns the PCM of an audio packet, in Format. The PCM is only
+	// valid until the next call.
+	Decode(packet []byte) ([]byte, error)
+	// Format is the format of the decoded PCM.
+	Format() Format
+}
+
+// CodecParams are what the SDP of a session announces about its audio.
+type CodecParams struct {
+	// Encoding, SampleRate and Channels are from the rtpmap attribute. The
+	// latter two are 0 if it leaves them out.
+	Encoding   string
+	SampleRate int
+	Channels   int
+	// Fmtp are the format parameters, the fields of the fmtp attribute
+	// without the payload type.
+	Fmtp []string
+}
+
+// CodecFactory creates a codec from the parameters of a session.
+type CodecFactory func(params CodecParams) (Codec, error)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]CodecFactory{
+		"AppleLossless": newAlacCodec,
+		"L16":           newL16Codec,
+	}
+	// codecHints explain why an encoding has no codec in this build.
+	codecHints = map[string]string{}
+)
 
-var codecMap = map[string]CodecHandler{
-	"AppleLossless": decodeAlac}
+// RegisterCodec makes factory create the codec of the sessions whose SDP
+// rtpmap attribute names encoding, replacing any codec registered before.
+// Encodings are matched regardless of case.
+func RegisterCodec(encoding string, factory CodecFactory) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	for name := range codecs {
+		if strings.EqualFold(name, encoding) {
+			delete(codecs, name)
+		}
+	}
+	codecs[encoding] = factory
+}
 
-func decodeAlac(data []byte) ([]byte, error) {
-	decoder, err := alac.New()
+// NewCodec creates the codec for the encoding and parameters the SDP of
+// session announces.
+func NewCodec(session *rtsp.Session) (Codec, error) {
+	attrs := session.Description.Attributes
+	// rtpmap is "<payload type> <encoding>[/<clock rate>[/<channels>]]"
+	rtpmap := strings.Fields(attrs["rtpmap"])
+	if len(rtpmap) < 2 {
+		return nil, fmt.Errorf("missing audio encoding in rtpmap %q", attrs["rtpmap"])
+	}
+	var params CodecParams
+	encoding := strings.Split(rtpmap[1], "/")
+	params.Encoding = encoding[0]
+	for i, v := range []*int{&params.SampleRate, &params.Channels} {
+		if len(encoding) <= i+1 {
+			break
+		}
+		n, err := strconv.Atoi(encoding[i+1])
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid rtpmap %q", attrs["rtpmap"])
+		}
+		*v = n
+	}
+	if fields := strings.Fields(attrs["fmtp"]); len(fields) > 0 {
+		params.Fmtp = fields[1:]
+	}
+
+	factory := lookupCodec(params.Encoding)
+	if factory == nil {
+		if hint, ok := codecHints[strings.ToLower(params.Encoding)]; ok {
+			return nil, fmt.Errorf("unsupported audio encoding %s: %s", params.Encoding, hint)
+		}
+		return nil, fmt.Errorf("unsupported audio encoding %s, supported are %s", params.Encoding, strings.Join(Codecs(), ", "))
+	}
+	codec, err := factory(params)
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s codec: %w", params.Encoding, err)
+	}
+	return codec, nil
+}
+
+func lookupCodec(encoding string) CodecFactory {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	for name, factory := range codecs {
+		if strings.EqualFold(name, encoding) {
+			return factory
+		}
+	}
+	return nil
+}
+
+// Codecs returns the encodings a codec is registered for.
+func Codecs() []string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// alacCodec decodes Apple Lossless, which AirPlay streams by default.
+type alacCodec struct {
+	decoder *alac.Alac
+	format  Format
+}
+
+// newAlacCodec parses the ALAC fmtp parameters: frame length, compatible
+// version, bit depth, rice history mult, rice initial history, rice limit,
+// channels, max run, max frame bytes, average bit rate and sample rate.
+// Without parameters, it assumes the AirPlay defaults.
+func newAlacCodec(params CodecParams) (Codec, error) {
+	fmtp := params.Fmtp
+	if len(fmtp) == 0 {
+		decoder, err := alac.New()
+		if err != nil {
+			return nil, err
+		}
+		return &alacCodec{decoder: decoder, format: DefaultFormat}, nil
+	}
+	if len(fmtp) != 11 {
+		return nil, fmt.Errorf("expected 11 fmtp parameters, got %d", len(fmtp))
+	}
+	values := make([]int, len(fmtp))
+	for i, s := range fmtp {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid fmtp parameter %q", s)
+		}
+		values[i] = v
+	}
+	frameLength, bitDepth, channels, sampleRate := values[0], values[2], values[6], values[10]
+	// The decoder always writes 16-bit stereo
+	if bitDepth != 16 || channels != 2 {
+		return nil, fmt.Errorf("unsupported %d-bit audio with %d channels, only 16-bit stereo", bitDepth, channels)
+	}
+	if frameLength == 0 || sampleRate == 0 {
+		return nil, fmt.Errorf("invalid frame length %d or sample rate %d", frameLength, sampleRate)
+	}
+	// NewFromFmtp expects the payload type first, which it ignores
+	decoder, err := alac.NewFromFmtp("96 " + strings.Join(fmtp, " "))
 	if err != nil {
 		return nil, err
 	}
-	return decoder.Decode(data), nil
+	format := Format{SampleRate: sampleRate, Channels: channels, BitsPerSample: bitDepth}
+	return &alacCodec{decoder: decoder, format: format}, nil
 }
 
-// GetCodec determins the appropriate codec from the rtsp session
-func GetCodec(session *rtsp.Session) CodecHandler {
-	var decoder CodecHandler
-	rtpmap := session.Description.Attributes["rtpmap"]
-	if strings.Contains(rtpmap, "AppleLossless") {
-		decoder = codecMap["AppleLossless"]
-	} else {
-		decoder = func(data []byte) ([]byte, error) { return data, nil }
+func (c *alacCodec) Decode(packet []byte) (pcm []byte, err error) {
+	// The decoder indexes past the end of corrupt packets
+	defer func() {
+		if r := recover(); r != nil {
+			pcm, err = nil, fmt.Errorf("corrupt ALAC packet: %v", r)
+		}
+	}()
+	pcm = c.decoder.Decode(packet)
+	if pcm == nil {
+		return nil, fmt.Errorf("unsupported ALAC frame")
+	}
+	return pcm, nil
+}
+
+func (c *alacCodec) Format() Format {
+	return c.format
+}
+
+// maxConcealed is how many packets in a row concealment fades out over
+// before it plays silence.
+const maxConcealed = 4
+
+// concealer hides packets that failed to decode. It repeats the last packet
+// decoded, at half the amplitude each time, and plays silence once that
+// faded out.
+type concealer struct {
+	last []byte
+	lost int
+}
+
+// decoded keeps a copy of pcm to conceal the next losses with.
+func (c *concealer) decoded(pcm []byte) {
+	c.last = append(c.last[:0], pcm...)
+	c.lost = 0
+}
+
+// conceal returns the packet to play in place of a lost one, which is only
+// valid until the next call, or nil if no packet was decoded yet.
+func (c *concealer) conceal() []byte {
+	if len(c.last) == 0 {
+		return nil
+	}
+	c.lost++
+	for i := 0; i+1 < len(c.last); i += 2 {
+		s := int16(uint16(c.last[i]) | uint16(c.last[i+1])<<8)
+		if c.lost > maxConcealed {
+			s = 0
+		} else {
+			s /= 2
+		}
+		c.last[i] = byte(s)
+		c.last[i+1] = byte(uint16(s) >> 8)
 	}
-	return decoder
+	return c.last
 }
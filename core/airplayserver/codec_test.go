@@ -0,0 +1,255 @@
+package airplayserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/carterpeel/bobcaygeon/rtsp"
+	"github.com/carterpeel/bobcaygeon/sdp"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+const airplayFmtp = "96 352 0 16 40 10 14 2 255 0 0 44100"
+
+func newSession(rtpmap, fmtp string) *rtsp.Session {
+	desc := sdp.NewSessionDescription()
+	desc.Attributes["rtpmap"] = rtpmap
+	desc.Attributes["fmtp"] = fmtp
+	return rtsp.NewSession(desc, nil)
+}
+
+// bitWriter packs values most significant bit first, like ALAC reads them.
+type bitWriter struct {
+	buf  []byte
+	bits int
+}
+
+func (w *bitWriter) write(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.bits%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			w.buf[len(w.buf)-1] |= 0x80 >> uint(w.bits%8)
+		}
+		w.bits++
+	}
+}
+
+// verbatimFrame returns an uncompressed stereo ALAC frame of the samples,
+// which alternate left and right.
+func verbatimFrame(samples ...int16) []byte {
+	w := new(bitWriter)
+	w.write(1, 3)  // stereo
+	w.write(0, 16) // unused
+	w.write(1, 1)  // has size
+	w.write(0, 2)  // no uncompressed bytes
+	w.write(1, 1)  // not compressed
+	w.write(uint32(len(samples)/2), 32)
+	for _, s := range samples {
+		w.write(uint32(uint16(s)), 16)
+	}
+	// The decoder reads a few bytes ahead
+	return append(w.buf, 0, 0, 0, 0)
+}
+
+func TestNewCodec(t *testing.T) {
+	codec, err := NewCodec(newSession("96 AppleLossless", airplayFmtp))
+	if err != nil {
+		t.Fatalf("Error creating codec: %v\n", err)
+	}
+	if codec.Format() != DefaultFormat {
+		t.Fatalf("Codec decodes to %v, want %v\n", codec.Format(), DefaultFormat)
+	}
+	codec, err = NewCodec(newSession("96 AppleLossless", "96 352 0 16 40 10 14 2 255 0 0 48000"))
+	if err != nil || codec.Format().SampleRate != 48000 {
+		t.Fatalf("Sample rate was not taken from fmtp: %v\n", err)
+	}
+	if _, err := NewCodec(newSession("96 AppleLossless", "")); err != nil {
+		t.Fatalf("Error creating codec without fmtp: %v\n", err)
+	}
+
+	for _, tt := range []struct {
+		rtpmap, fmtp, err string
+	}{
+		{"96 opus/48000/2", "", "unsupported audio encoding opus"},
+		{"96 L16/x/2", "", "invalid rtpmap"},
+		{"96 L16", "", "missing sample rate"},
+		{"", airplayFmtp, "missing audio encoding"},
+		{"96 AppleLossless", "96 352 0 16", "expected 11 fmtp parameters"},
+		{"96 AppleLossless", "96 352 0 24 40 10 14 2 255 0 0 44100", "unsupported 24-bit audio"},
+		{"96 AppleLossless", "96 352 0 16 40 10 14 x 255 0 0 44100", "invalid fmtp parameter"},
+	} {
+		_, err := NewCodec(newSession(tt.rtpmap, tt.fmtp))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("Creating codec for %q %q returned %v, want %q\n", tt.rtpmap, tt.fmtp, err, tt.err)
+		}
+	}
+}
+
+func TestAlacCodec(t *testing.T) {
+	codec, err := NewCodec(newSession("96 AppleLossless", airplayFmtp))
+	if err != nil {
+		t.Fatalf("Error creating codec: %v\n", err)
+	}
+	// The same decoder decodes every packet of the session
+	for _, samples := range [][]int16{{1, -1, 300, -300}, {-32768, 32767}} {
+		pcm, err := codec.Decode(verbatimFrame(samples...))
+		if err != nil {
+			t.Fatalf("Error decoding packet: %v\n", err)
+		}
+		for i, want := range samples {
+			if got := int16(binary.LittleEndian.Uint16(pcm[2*i:])); got != want {
+				t.Fatalf("Sample %d decoded to %d, want %d\n", i, got, want)
+			}
+		}
+	}
+	if _, err := codec.Decode([]byte{0x20, 0, 0x13, 0xff}); err == nil {
+		t.Fatalf("Expected corrupt packet to fail\n")
+	}
+}
+
+func TestConcealer(t *testing.T) {
+	var plc concealer
+	if plc.conceal() != nil {
+		t.Fatalf("Concealed a loss before any packet was decoded\n")
+	}
+	plc.decoded(packet(1000))
+	for i, want := range []int16{500, 250, 125, 62, 0, 0} {
+		if s := sample(plc.conceal(), 0); s != want {
+			t.Fatalf("Loss %d was concealed with %d, want %d\n", i+1, s, want)
+		}
+	}
+	plc.decoded(packet(1000))
+	if s := sample(plc.conceal(), 0); s != 500 {
+		t.Fatalf("Concealment did not start over after a decoded packet: %d\n", s)
+	}
+}
+
+func TestL16Codec(t *testing.T) {
+	codec, err := NewCodec(newSession("96 l16/48000/2", ""))
+	if err != nil {
+		t.Fatalf("Error creating codec: %v\n", err)
+	}
+	if want := (Format{SampleRate: 48000, Channels: 2, BitsPerSample: 16}); codec.Format() != want {
+		t.Fatalf("Codec decodes to %v, want %v\n", codec.Format(), want)
+	}
+	pcm, err := codec.Decode([]byte{0x12, 0x34, 0xff, 0xfe})
+	if err != nil {
+		t.Fatalf("Error decoding packet: %v\n", err)
+	}
+	if !bytes.Equal(pcm, []byte{0x34, 0x12, 0xfe, 0xff}) {
+		t.Fatalf("Packet decoded to % x, want it byte-swapped\n", pcm)
+	}
+	if _, err := codec.Decode([]byte{0x12, 0x34, 0xff}); err == nil {
+		t.Fatalf("Expected a partial frame to fail\n")
+	}
+}
+
+func TestAACConfig(t *testing.T) {
+	for _, tt := range []struct {
+		fmtp       string
+		objectType int
+		format     Format
+	}{
+		{"mode=AAC-hbr; sizelength=13; indexlength=3; indexdeltalength=3; config=1210", aacLC, DefaultFormat},
+		{"mode=AAC-eld; constantDuration=480; config=F8E85000", aacELD, DefaultFormat},
+		{"config=1188", aacLC, Format{SampleRate: 48000, Channels: 1, BitsPerSample: 16}},
+	} {
+		config, err := parseAACConfig(CodecParams{Fmtp: strings.Fields(tt.fmtp)})
+		if err != nil {
+			t.Fatalf("Error parsing %q: %v\n", tt.fmtp, err)
+		}
+		if config.objectType != tt.objectType || config.format != tt.format {
+			t.Fatalf("Parsed %q as object type %d in %v, want %d in %v\n", tt.fmtp, config.objectType, config.format, tt.objectType, tt.format)
+		}
+	}
+	for _, fmtp := range []string{"config=12", "config=xyz", "config=1690", "config=1230", "config=1210; sizelength=40", "mode=AAC-hbr", "config=2B10"} {
+		if _, err := parseAACConfig(CodecParams{Fmtp: strings.Fields(fmtp)}); err == nil {
+			t.Fatalf("Expected %q to fail\n", fmtp)
+		}
+	}
+}
+
+func TestAccessUnits(t *testing.T) {
+	config := aacConfig{sizeLength: 13, indexLength: 3, indexDeltaLength: 3}
+	// Two AU headers of 16 bits, for units of 3 and 2 bytes
+	packet := []byte{0x00, 0x20, 0x00, 0x18, 0x00, 0x10, 1, 2, 3, 4, 5}
+	units, err := config.accessUnits(packet, nil)
+	if err != nil {
+		t.Fatalf("Error splitting packet: %v\n", err)
+	}
+	if len(units) != 2 || !bytes.Equal(units[0], []byte{1, 2, 3}) || !bytes.Equal(units[1], []byte{4, 5}) {
+		t.Fatalf("Packet split into %v\n", units)
+	}
+	if _, err := config.accessUnits(packet[:8], nil); err == nil {
+		t.Fatalf("Expected a truncated packet to fail\n")
+	}
+	units, _ = aacConfig{}.accessUnits(packet, nil)
+	if len(units) != 1 || len(units[0]) != len(packet) {
+		t.Fatalf("Packet without AU headers was split into %v\n", units)
+	}
+}
+
+func TestUnsupportedCodecDrainsSession(t *testing.T) {
+	lp := new(LocalPlayer)
+	session := newSession("96 opus/48000/2", "")
+	go lp.playStream(session, make(chan struct{}))
+
+	// More packets than the channel buffers, which would block the receiver
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*cap(session.DataChan); i++ {
+			session.DataChan <- []byte{0}
+		}
+		close(session.DataChan)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Receiver blocked on a session that cannot be played\n")
+	}
+}
+
+// fakeAACDecoder decodes every access unit to a frame per byte, of the byte
+// as left and right sample.
+type fakeAACDecoder struct {
+	closed bool
+}
+
+func (d *fakeAACDecoder) decode(pcm, au []byte) ([]byte, error) {
+	for _, b := range au {
+		pcm = append(pcm, b, 0, b, 0)
+	}
+	return pcm, nil
+}
+
+func (d *fakeAACDecoder) Close() error {
+	d.closed = true
+	return nil
+}
+
+func TestAACCodec(t *testing.T) {
+	decoder := new(fakeAACDecoder)
+	open := func(aacConfig) (aacDecoder, error) { return decoder, nil }
+	codec, err := newAACCodec(CodecParams{Fmtp: strings.Fields("mode=AAC-hbr; sizelength=13; indexlength=3; indexdeltalength=3; config=1210")}, open)
+	if err != nil {
+		t.Fatalf("Error creating codec: %v\n", err)
+	}
+	pcm, err := codec.Decode([]byte{0x00, 0x20, 0x00, 0x18, 0x00, 0x10, 1, 2, 3, 4, 5})
+	if err != nil {
+		t.Fatalf("Error decoding packet: %v\n", err)
+	}
+	if len(pcm) != 5*4 || pcm[0] != 1 || pcm[16] != 5 {
+		t.Fatalf("Access units decoded to % x\n", pcm)
+	}
+	if _, err := codec.Decode([]byte{0x00, 0x20}); err == nil {
+		t.Fatalf("Expected a packet without access units to fail\n")
+	}
+	if err := codec.(io.Closer).Close(); err != nil || !decoder.closed {
+		t.Fatalf("Closing the codec did not close the decoder\n")
+	}
+}
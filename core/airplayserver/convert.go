@@ -0,0 +1,69 @@
+package airplayserver
+
+// converter turns decoded 16-bit PCM into DefaultFormat, which the sinks and
+// the PCM tap take. It doubles mono, keeps the first two of more channels and
+// resamples linearly, carrying the interpolation across packets.
+type converter struct {
+	channels int
+	// step is the input frames per output frame.
+	step float64
+	// pos is the position of the next output frame in the input frames of
+	// the packet, where -1 is prev, the last frame of the packet before.
+	pos  float64
+	prev [2]int16
+	buf  []byte
+}
+
+// newConverter returns a converter from the given format, or nil if it is
+// DefaultFormat.
+func newConverter(from Format) *converter {
+	if from == DefaultFormat {
+		return nil
+	}
+	return &converter{
+		channels: from.Channels,
+		step:     float64(from.SampleRate) / float64(DefaultFormat.SampleRate),
+	}
+}
+
+// convert returns pcm in DefaultFormat, in a buffer that stays valid until
+// the next call.
+func (c *converter) convert(pcm []byte) []byte {
+	n := len(pcm) / (2 * c.channels)
+	out := c.buf[:0]
+	if n == 0 {
+		return out
+	}
+	for c.pos < float64(n-1) {
+		i := int(c.pos)
+		if c.pos < 0 {
+			i = -1
+		}
+		frac := c.pos - float64(i)
+		al, ar := c.frame(pcm, i)
+		bl, br := c.frame(pcm, i+1)
+		l := int16(float64(al) + (float64(bl)-float64(al))*frac)
+		r := int16(float64(ar) + (float64(br)-float64(ar))*frac)
+		out = append(out, byte(l), byte(uint16(l)>>8), byte(r), byte(uint16(r)>>8))
+		c.pos += c.step
+	}
+	c.pos -= float64(n)
+	c.prev[0], c.prev[1] = c.frame(pcm, n-1)
+	c.buf = out
+	return out
+}
+
+// frame returns the left and right sample of frame i of pcm, or of the frame
+// before the packet for -1.
+func (c *converter) frame(pcm []byte, i int) (l, r int16) {
+	if i < 0 {
+		return c.prev[0], c.prev[1]
+	}
+	off := i * 2 * c.channels
+	l = int16(uint16(pcm[off]) | uint16(pcm[off+1])<<8)
+	if c.channels == 1 {
+		return l, l
+	}
+	r = int16(uint16(pcm[off+2]) | uint16(pcm[off+3])<<8)
+	return l, r
+}
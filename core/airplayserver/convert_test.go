@@ -0,0 +1,64 @@
+package airplayserver
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// pcmOf returns interleaved PCM of the samples.
+func pcmOf(samples ...int16) []byte {
+	pcm := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(pcm[2*i:], uint16(s))
+	}
+	return pcm
+}
+
+func TestConverter(t *testing.T) {
+	if newConverter(DefaultFormat) != nil {
+		t.Fatalf("Converting DefaultFormat to itself\n")
+	}
+
+	// Mono is doubled to both channels
+	c := newConverter(Format{SampleRate: 44100, Channels: 1, BitsPerSample: 16})
+	out := c.convert(pcmOf(100, -200, 300))
+	if len(out) != 2*4 || sample(out, 0) != 100 || int16(binary.LittleEndian.Uint16(out[2:])) != 100 || sample(out, 1) != -200 {
+		t.Fatalf("Mono converted to % x\n", out)
+	}
+
+	// Of more channels, the first two are kept
+	c = newConverter(Format{SampleRate: 44100, Channels: 4, BitsPerSample: 16})
+	out = c.convert(pcmOf(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12))
+	if sample(out, 1) != 5 || int16(binary.LittleEndian.Uint16(out[6:])) != 6 {
+		t.Fatalf("4 channels converted to % x\n", out)
+	}
+}
+
+func TestConverterResamples(t *testing.T) {
+	c := newConverter(Format{SampleRate: 48000, Channels: 2, BitsPerSample: 16})
+	// A rising ramp has to keep rising across packets
+	var frames int
+	var last int16 = -1
+	for p := 0; p < 10; p++ {
+		in := make([]int16, 2*480)
+		for i := range in {
+			in[i] = int16(p*480 + i/2)
+		}
+		out := c.convert(pcmOf(in...))
+		for f := 0; f < len(out)/4; f++ {
+			if s := sample(out, f); s < last || s > last+2 {
+				t.Fatalf("Resampled ramp went from %d to %d in packet %d\n", last, s, p)
+			}
+			last = sample(out, f)
+		}
+		frames += len(out) / 4
+	}
+	if want := 4800 * 44100 / 48000; frames < want-1 || frames > want+1 {
+		t.Fatalf("Resampled 4800 frames to %d, want %d\n", frames, want)
+	}
+	in := pcmOf(make([]int16, 2*480)...)
+	c.convert(in)
+	if n := testing.AllocsPerRun(100, func() { c.convert(in) }); n != 0 {
+		t.Fatalf("Converting a packet allocated %v times\n", n)
+	}
+}
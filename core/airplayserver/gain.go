@@ -0,0 +1,122 @@
+package airplayserver
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// minVolumeDB is the attenuation of the lowest AirPlay volume above mute.
+	// AirPlay sends volumes from -30 to 0 dB, which bobcaygeon maps linearly
+	// to 0..1.
+	minVolumeDB = -30
+
+	// gainRamp is how long a volume change takes, so the step does not click.
+	gainRamp = 20 * time.Millisecond
+)
+
+// VolumeGain returns the amplitude factor of an AirPlay volume between 0
+// (mute) and 1 (full volume). Volumes in between are spread evenly over
+// -30..0 dB, which sounds even to the ear unlike scaling the samples by the
+// volume itself.
+func VolumeGain(volume float64) float64 {
+	if volume <= 0 {
+		return 0
+	}
+	if volume >= 1 {
+		return 1
+	}
+	db := minVolumeDB * (1 - volume)
+	return math.Pow(10, db/20)
+}
+
+// gainStage scales 16-bit little-endian PCM by the volume. It reuses its
+// buffer, so scaling does not allocate once the buffer has grown to the
+// packet size. Changes of the volume are ramped over gainRamp, and the
+// scaled samples are dithered, which turns the rounding error of quiet
+// volumes into noise instead of distortion.
+type gainStage struct {
+	volume float64
+	// gain ramps towards target by step per frame.
+	gain, target, step float64
+	rampFrames         int
+
+	buf []byte
+	// rand is the state of the xorshift generator of the dither.
+	rand uint32
+}
+
+func newGainStage(format Format) *gainStage {
+	return &gainStage{
+		volume:     1,
+		gain:       1,
+		target:     1,
+		rampFrames: int(time.Duration(format.SampleRate) * gainRamp / time.Second),
+		rand:       0x9e3779b9,
+	}
+}
+
+// setVolume ramps the gain to that of the given volume.
+func (g *gainStage) setVolume(volume float64) {
+	if volume == g.volume {
+		return
+	}
+	g.volume = volume
+	g.target = VolumeGain(volume)
+	g.step = (g.target - g.gain) / float64(g.rampFrames)
+}
+
+// apply returns pcm scaled by the gain, in an interleaved format with
+// channels channels. At full volume it returns pcm itself, otherwise a buffer
+// that stays valid until the next call.
+func (g *gainStage) apply(pcm []byte, channels int) []byte {
+	if g.gain == g.target && g.gain == 1 {
+		return pcm
+	}
+	if cap(g.buf) < len(pcm) {
+		g.buf = make([]byte, len(pcm))
+	}
+	out := g.buf[:len(pcm)]
+	if g.gain == g.target && g.gain == 0 {
+		for i := range out {
+			out[i] = 0
+		}
+		return out
+	}
+
+	frame := 2 * channels
+	for i := 0; i+frame <= len(pcm); i += frame {
+		if g.gain != g.target {
+			g.gain += g.step
+			if (g.step > 0 && g.gain > g.target) || (g.step < 0 && g.gain < g.target) {
+				g.gain = g.target
+			}
+		}
+		for j := i; j < i+frame; j += 2 {
+			s := float64(int16(uint16(pcm[j]) | uint16(pcm[j+1])<<8))
+			v := int32(math.Floor(s*g.gain + g.dither() + 0.5))
+			if v > math.MaxInt16 {
+				v = math.MaxInt16
+			} else if v < math.MinInt16 {
+				v = math.MinInt16
+			}
+			out[j] = byte(v)
+			out[j+1] = byte(v >> 8)
+		}
+	}
+	return out
+}
+
+// dither returns triangular noise of ±1 LSB.
+func (g *gainStage) dither() float64 {
+	return float64(g.next())/(1<<32) - float64(g.next())/(1<<32)
+}
+
+func (g *gainStage) next() uint32 {
+	x := g.rand
+	x ^= x << 13
+	x ^= x >> 17
+	x ^= x << 5
+	g.rand = x
+	return x
+}
@@ -0,0 +1,132 @@
+package airplayserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// packet returns an AirPlay packet of stereo samples all set to v.
+func packet(v int16) []byte {
+	pcm := make([]byte, framesPerPacket*4)
+	for i := 0; i < len(pcm); i += 2 {
+		binary.LittleEndian.PutUint16(pcm[i:], uint16(v))
+	}
+	return pcm
+}
+
+func sample(pcm []byte, frame int) int16 {
+	return int16(binary.LittleEndian.Uint16(pcm[frame*4:]))
+}
+
+func TestVolumeGain(t *testing.T) {
+	for _, tt := range []struct {
+		volume float64
+		db     float64
+	}{
+		{1, 0},
+		{0.5, -15},
+		{0.01, -29.7},
+	} {
+		if db := 20 * math.Log10(VolumeGain(tt.volume)); math.Abs(db-tt.db) > 0.01 {
+			t.Fatalf("Volume %v is %.2f dB, want %.2f dB\n", tt.volume, db, tt.db)
+		}
+	}
+	if g := VolumeGain(0); g != 0 {
+		t.Fatalf("Volume 0 has gain %v, want mute\n", g)
+	}
+}
+
+func TestGainStage(t *testing.T) {
+	g := newGainStage(DefaultFormat)
+	pcm := packet(10000)
+	if out := g.apply(pcm, 2); &out[0] != &pcm[0] {
+		t.Fatalf("Full volume copied the packet\n")
+	}
+
+	// The ramp to mute takes gainRamp, a little over 2 packets
+	g.setVolume(0)
+	var last int16 = 10000
+	for i := 0; i < 3; i++ {
+		out := g.apply(pcm, 2)
+		for f := 0; f < framesPerPacket; f++ {
+			s := sample(out, f)
+			if s > last+2 {
+				t.Fatalf("Ramp rose from %d to %d\n", last, s)
+			}
+			last = s
+		}
+		if i == 0 && last < 5000 {
+			t.Fatalf("Ramp reached %d after one packet, too fast\n", last)
+		}
+	}
+	if !bytes.Equal(g.apply(pcm, 2), make([]byte, len(pcm))) {
+		t.Fatalf("Muted packet is not silent\n")
+	}
+
+	g.setVolume(0.5)
+	for i := 0; i < 3; i++ {
+		g.apply(pcm, 2)
+	}
+	want := 10000 * VolumeGain(0.5)
+	if s := sample(g.apply(pcm, 2), 0); math.Abs(float64(s)-want) > 1 {
+		t.Fatalf("Volume 0.5 scaled 10000 to %d, want %.0f±1\n", s, want)
+	}
+}
+
+func TestGainStageClamps(t *testing.T) {
+	g := newGainStage(DefaultFormat)
+	g.setVolume(0.999)
+	for _, v := range []int16{math.MaxInt16, math.MinInt16} {
+		for i := 0; i < 3; i++ {
+			g.apply(packet(v), 2)
+		}
+		out := g.apply(packet(v), 2)
+		if s := sample(out, 0); (v > 0) != (s > 0) {
+			t.Fatalf("Sample %d wrapped around to %d\n", v, s)
+		}
+	}
+}
+
+func TestGainStageAllocs(t *testing.T) {
+	g := newGainStage(DefaultFormat)
+	g.setVolume(0.7)
+	pcm := packet(1234)
+	g.apply(pcm, 2)
+	if n := testing.AllocsPerRun(100, func() { g.apply(pcm, 2) }); n != 0 {
+		t.Fatalf("Scaling a packet allocated %v times\n", n)
+	}
+}
+
+// adjustAudio is the scaling the gain stage replaced, kept to compare with.
+func adjustAudio(raw []byte, vol float64) []byte {
+	adjusted := new(bytes.Buffer)
+	for i := 0; i < len(raw); i = i + 2 {
+		var val int16
+		_ = binary.Read(bytes.NewReader(raw[i:i+2]), binary.LittleEndian, &val)
+		val = int16(vol * float64(val))
+		_ = binary.Write(adjusted, binary.LittleEndian, val)
+	}
+	return adjusted.Bytes()
+}
+
+func BenchmarkAdjustAudio(b *testing.B) {
+	pcm := packet(1234)
+	b.SetBytes(int64(len(pcm)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		adjustAudio(pcm, 0.7)
+	}
+}
+
+func BenchmarkGainStage(b *testing.B) {
+	g := newGainStage(DefaultFormat)
+	g.setVolume(0.7)
+	pcm := packet(1234)
+	b.SetBytes(int64(len(pcm)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		g.apply(pcm, 2)
+	}
+}
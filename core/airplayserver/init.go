@@ -2,15 +2,63 @@ package airplayserver
 
 import (
 	log "github.com/sirupsen/logrus"
+	"hyperkit/core/metrics"
 	"net/http"
 	"net/http/pprof"
+	"sync"
+	"sync/atomic"
 )
 
-func StartProfiler() {
+var (
+	debugServer   *http.Server
+	debugServerMu sync.Mutex
+	// profiling gates the pprof handlers, so that they can be switched off
+	// without restarting the server.
+	profiling uint32
+)
+
+// StartDebugServer serves the Prometheus metrics on :6060/metrics, and pprof
+// if profile is set. If the server is already running, only profiling is
+// switched.
+func StartDebugServer(profile bool) {
+	debugServerMu.Lock()
+	defer debugServerMu.Unlock()
+	if profile {
+		atomic.StoreUint32(&profiling, 1)
+	} else {
+		atomic.StoreUint32(&profiling, 0)
+	}
+	if debugServer != nil {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/debug/pprof/profile", whileProfiling(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/index", whileProfiling(pprof.Index))
+	srv := &http.Server{Addr: ":6060", Handler: mux}
+	debugServer = srv
 	go func() {
-		mux := http.NewServeMux()
-		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-		mux.HandleFunc("/debug/pprof/index", pprof.Index)
-		log.Debugln(http.ListenAndServe(":6060", mux))
+		log.Debugln(srv.ListenAndServe())
 	}()
 }
+
+// StopDebugServer stops the server started by StartDebugServer.
+func StopDebugServer() {
+	debugServerMu.Lock()
+	defer debugServerMu.Unlock()
+	if debugServer == nil {
+		return
+	}
+	_ = debugServer.Close()
+	debugServer = nil
+}
+
+func whileProfiling(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadUint32(&profiling) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		h(w, r)
+	}
+}
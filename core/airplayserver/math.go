@@ -1,15 +1,8 @@
 package airplayserver
 
-func min(a, b int16) int16 {
+func minInt(a, b int) int {
 	if a < b {
 		return a
 	}
 	return b
 }
-
-func max(a, b int16) int16 {
-	if a > b {
-		return a
-	}
-	return b
-}
@@ -0,0 +1,48 @@
+package airplayserver
+
+import "fmt"
+
+// maxChannels bounds the channels of uncompressed streams.
+const maxChannels = 8
+
+// l16Codec turns the big-endian 16-bit PCM of RFC 3551 into the little-endian
+// PCM the sinks take.
+type l16Codec struct {
+	format Format
+	buf    []byte
+}
+
+// newL16Codec takes the sample rate and channels from the rtpmap, e.g.
+// "L16/44100/2". Without channels, the stream is mono.
+func newL16Codec(params CodecParams) (Codec, error) {
+	if params.SampleRate == 0 {
+		return nil, fmt.Errorf("missing sample rate in rtpmap")
+	}
+	channels := params.Channels
+	if channels == 0 {
+		channels = 1
+	}
+	if channels > maxChannels {
+		return nil, fmt.Errorf("unsupported %d channels, at most %d", channels, maxChannels)
+	}
+	return &l16Codec{format: Format{SampleRate: params.SampleRate, Channels: channels, BitsPerSample: 16}}, nil
+}
+
+func (c *l16Codec) Decode(packet []byte) ([]byte, error) {
+	frame := c.format.Channels * 2
+	if len(packet) == 0 || len(packet)%frame != 0 {
+		return nil, fmt.Errorf("L16 packet of %d bytes is not a whole number of %d-byte frames", len(packet), frame)
+	}
+	if cap(c.buf) < len(packet) {
+		c.buf = make([]byte, len(packet))
+	}
+	pcm := c.buf[:len(packet)]
+	for i := 0; i < len(packet); i += 2 {
+		pcm[i], pcm[i+1] = packet[i+1], packet[i]
+	}
+	return pcm, nil
+}
+
+func (c *l16Codec) Format() Format {
+	return c.format
+}
@@ -1,76 +1,179 @@
 package airplayserver
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
 	"fmt"
 	"github.com/carterpeel/bobcaygeon/player"
 	"github.com/carterpeel/bobcaygeon/rtsp"
 	"github.com/hajimehoshi/oto"
 	log "github.com/sirupsen/logrus"
 	"hyperkit/core/airplayserver/bluetoothproxy"
-	"os"
+	"hyperkit/core/errorTypes"
+	"hyperkit/core/events"
+	"hyperkit/core/metrics"
+	"io"
 	"sync"
 	"sync/atomic"
 )
 
 // LocalPlayer is a player that will just play the audio locally
 type LocalPlayer struct {
+	// written counts the packets buffered. It comes first to stay 64-bit
+	// aligned on 32-bit ARM.
+	written uint64
+
 	volLock sync.RWMutex
 	volume  float64
 
-	pipeFile   string
-	btpx       *bluetoothproxy.BluetoothProxy
-	curSession *rtsp.Session
-	pauseChan  chan struct{}
-	pctx       *oto.Context
+	pipeFile  string
+	btpx      *bluetoothproxy.BluetoothProxy
+	pauseChan chan struct{}
+	pctx      *oto.Context
+	bus       *events.Bus
+
+	// sinks receive the audio of every stream, through a buffer configured
+	// by bufferOpts. readers are the cursors of the sinks into the buffer of
+	// the stream that plays.
+	sinksMu    sync.Mutex
+	sinks      []*registeredSink
+	bufferOpts BufferOptions
+	readers    []*ringReader
+
+	// tap receives the decoded PCM of every packet, before the volume is
+	// applied.
+	tapMu sync.Mutex
+	tap   io.Writer
+
+	// streams tracks the playStream goroutines, which return once closed is
+	// closed.
+	streams   sync.WaitGroup
+	closeMu   sync.Mutex
+	closed    chan struct{}
+	closeOnce *sync.Once
 }
 
 // NewBluetoothPlayer instantiates a new LocalPlayer
-func NewBluetoothPlayer(pipeFile string, bluetoothName string) (lp *LocalPlayer, err error) {
+func NewBluetoothPlayer(pipeFile string, bluetoothName string, bus *events.Bus) (lp *LocalPlayer, err error) {
 	lp = &LocalPlayer{
 		volume:   1,
 		pipeFile: pipeFile,
 		volLock:  sync.RWMutex{},
+		bus:      bus,
 	}
+	lp.open()
 
-	lp.pctx, err = oto.NewContext(44100, 2, 2, 10000)
+	lp.pctx, err = oto.NewContext(DefaultFormat.SampleRate, DefaultFormat.Channels, DefaultFormat.BitsPerSample/8, otoBufferSize)
 	if err != nil {
 		return nil, fmt.Errorf("error initializing player: %v", err)
 	}
+	if err := lp.AddSink(&otoSink{ctx: lp.pctx}); err != nil {
+		return nil, err
+	}
+	// Without a pipe file, LedFX is disabled and nothing is written to a FIFO
+	if pipeFile != "" {
+		if err := lp.AddSink(&fifoSink{path: pipeFile}); err != nil {
+			return nil, err
+		}
+	}
 
 	log.Infof("Attempting to proxy device %v...", bluetoothName)
-	if lp.btpx, err = bluetoothproxy.ProxyBluetoothDevice(bluetoothName); err != nil {
+	if lp.btpx, err = bluetoothproxy.ProxyBluetoothDevice(bluetoothName, bus); err != nil {
 		return nil, fmt.Errorf("error proxying Bluetooth device: %v", err)
 	}
 
-	if err := lp.btpx.ConnectAudioOutput(); err != nil {
-		return nil, fmt.Errorf("error connecting audio in background: %w", err)
-	}
-
 	return lp, nil
 }
 
+// SetTap sets the writer that receives the decoded PCM, or removes it if w
+// is nil. Writes to it must not block.
+func (lp *LocalPlayer) SetTap(w io.Writer) {
+	lp.tapMu.Lock()
+	defer lp.tapMu.Unlock()
+	lp.tap = w
+}
+
+func (lp *LocalPlayer) writeTap(pcm []byte) {
+	lp.tapMu.Lock()
+	tap := lp.tap
+	lp.tapMu.Unlock()
+	if tap != nil {
+		_, _ = tap.Write(pcm)
+	}
+}
+
 // Play will play the packets received on the specified session
 func (lp *LocalPlayer) Play(session *rtsp.Session) {
-	go lp.playStream(session)
+	closed := lp.closedChan()
+	select {
+	case <-closed:
+		log.Warnln("Player is closed, ignoring new AirPlay session")
+		return
+	default:
+	}
+	lp.streams.Add(1)
+	lp.bus.Publish(events.AirPlaySessionStarted, nil)
+	metrics.ActiveSessions.Inc()
+	go func() {
+		defer lp.streams.Done()
+		defer lp.bus.Publish(events.AirPlaySessionEnded, nil)
+		defer metrics.ActiveSessions.Dec()
+		lp.playStream(session, closed)
+	}()
+}
+
+// open lets the player accept sessions again after Close.
+func (lp *LocalPlayer) open() {
+	lp.closeMu.Lock()
+	defer lp.closeMu.Unlock()
+	if lp.closed != nil && lp.closeOnce != nil {
+		select {
+		case <-lp.closed:
+		default:
+			// Still open
+			return
+		}
+	}
+	lp.closed = make(chan struct{})
+	lp.closeOnce = new(sync.Once)
+}
+
+func (lp *LocalPlayer) closedChan() chan struct{} {
+	lp.closeMu.Lock()
+	defer lp.closeMu.Unlock()
+	return lp.closed
+}
+
+// Close stops the current stream, which closes the named pipe, and waits for
+// it to finish until ctx is done. The audio device stays open, as oto only
+// allows one context per process.
+func (lp *LocalPlayer) Close(ctx context.Context) error {
+	lp.closeMu.Lock()
+	closed, once := lp.closed, lp.closeOnce
+	lp.closeMu.Unlock()
+	once.Do(func() { close(closed) })
+	return errorTypes.RunWithContext(ctx, "closing audio stream", func() error {
+		lp.streams.Wait()
+		return nil
+	})
 }
 
 func (lp *LocalPlayer) Pause() {
 	lp.pauseChan <- struct{}{}
 }
 
-// SetVolume accepts a float between 0 (mute) and 1 (full volume)
+// SetVolume accepts a float between 0 (mute) and 1 (full volume), which the
+// stream plays on the dB curve of VolumeGain
 func (lp *LocalPlayer) SetVolume(volume float64) {
 	lp.volLock.Lock()
-	defer lp.volLock.Unlock()
 	lp.volume = volume
-
+	lp.volLock.Unlock()
+	metrics.Volume.Set(volume)
+	lp.bus.Publish(events.VolumeChanged, events.Volume{Volume: volume})
 }
 
-// SetTrack sets the track for the player
+// SetTrack publishes the metadata of the playing track
 func (lp *LocalPlayer) SetTrack(album string, artist string, title string) {
-	// no op for now
+	lp.bus.Publish(events.TrackChanged, events.Track{Album: album, Artist: artist, Title: title})
 }
 
 // SetAlbumArt sets the album art for the player
@@ -93,94 +196,78 @@ func (lp *LocalPlayer) GetTrack() player.Track {
 	return player.Track{}
 }
 
-func (lp *LocalPlayer) QuitCurrentSession() {
-	if lp.curSession != nil {
-		go func() {
-			ch := make(chan struct{})
-			lp.curSession.Close(ch)
-			ch <- struct{}{}
-			close(ch)
-		}()
-	}
-}
-
-func (lp *LocalPlayer) playStream(session *rtsp.Session) {
-	p := lp.pctx.NewPlayer()
-	defer func(p *oto.Player) {
-		_ = p.Close()
-	}(p)
-
-	pipeFd, err := os.OpenFile(lp.pipeFile, os.O_WRONLY, 0600)
+func (lp *LocalPlayer) playStream(session *rtsp.Session, closed chan struct{}) {
+	codec, err := NewCodec(session)
 	if err != nil {
-		log.Errorf("Error opening FIFO pipe: %v\n", err)
+		log.Errorf("Cannot play AirPlay stream: %v\n", err)
+		drain(session)
 		return
 	}
-	defer func(pipeFd *os.File) {
-		log.Infof("Closing FIFO pipe '%v'", lp.pipeFile)
-		_ = pipeFd.Close()
-	}(pipeFd)
+	if c, ok := codec.(io.Closer); ok {
+		defer c.Close()
+	}
+	// Sinks and the tap all take DefaultFormat
+	conv := newConverter(codec.Format())
+	if conv != nil {
+		log.Infof("Playing AirPlay stream of %v as %v\n", codec.Format(), DefaultFormat)
+	} else {
+		log.Infof("Playing AirPlay stream as %v\n", DefaultFormat)
+	}
+	format := DefaultFormat
 
-	log.Debugf("Opened FIFO pipe '%v'", lp.pipeFile)
+	// Every sink reads the buffer from its own goroutine, so one that fails
+	// or falls behind neither holds up decoding nor the other sinks
+	ring := lp.startSinks()
+	defer lp.stopSinks(ring)
+	gain := newGainStage(format)
+	var plc concealer
 
-	decoder := GetCodec(session)
-	for d := range session.DataChan {
+	for {
+		var d []byte
+		select {
+		case <-closed:
+			log.Infoln("Player closed! Closing stream writer...")
+			drain(session)
+			return
+		case packet, ok := <-session.DataChan:
+			if !ok {
+				return
+			}
+			d = packet
+		}
 		lp.volLock.RLock()
 		vol := lp.volume
 		lp.volLock.RUnlock()
-		decoded, err := decoder(d)
+		decoded, err := codec.Decode(d)
 		if err != nil {
 			log.Warnf("Error decoding packet: %v\n", err)
-		}
-
-		// Atomic value indicating failure during write
-		failed := &atomic.Value{}
-		failed.Store(false)
-
-		wg := new(sync.WaitGroup)
-		wg.Add(2)
-
-		adj := AdjustAudio(decoded, vol)
-
-		go func() {
-			defer wg.Done()
-			if _, err = p.Write(adj); err != nil {
-				log.Debugf("Caught EOF on otoctx audio stream: %v\n", err)
-				failed.Store(true)
-			}
-		}()
-		go func() {
-			defer wg.Done()
-			if _, err = pipeFd.Write(adj); err != nil {
-				log.Debugf("Caught EOF on pipeFd write stream: %v\n", err)
-				failed.Store(true)
+			metrics.DecodeErrors.Inc()
+			if decoded = plc.conceal(); decoded == nil {
+				metrics.DroppedFrames.Inc()
+				continue
 			}
-		}()
-		wg.Wait()
-		if failed.Load().(bool) == true {
-			log.Infoln("Data stream ended! Closing stream writer...")
-			return
+			metrics.ConcealedPackets.Inc()
+		} else {
+			metrics.PacketsDecoded.Inc()
+			plc.decoded(decoded)
+		}
+		if conv != nil {
+			decoded = conv.convert(decoded)
 		}
+		lp.writeTap(decoded)
+
+		gain.setVolume(vol)
+		ring.write(format, gain.apply(decoded, format.Channels))
+		atomic.AddUint64(&lp.written, 1)
 	}
 }
 
-func AdjustAudio(raw []byte, vol float64) []byte {
-	if vol == 1 {
-		return raw
-	}
-	adjusted := new(bytes.Buffer)
-	for i := 0; i < len(raw); i = i + 2 {
-		var val int16
-		b := raw[i : i+2]
-		buf := bytes.NewReader(b)
-		if err := binary.Read(buf, binary.LittleEndian, &val); err != nil {
-			log.Warnf("Error reading binary data: %v\n", err)
-			return raw
+// drain discards the packets of a session that is not played until it is torn
+// down. bobcaygeon's receiver blocks once the channel is full, and a blocked
+// receiver never lets the session close.
+func drain(session *rtsp.Session) {
+	go func() {
+		for range session.DataChan {
 		}
-		val = int16(vol * float64(val))
-		val = min(32767, val)
-		val = max(-32767, val)
-		_ = binary.Write(adjusted, binary.LittleEndian, val)
-	}
-
-	return adjusted.Bytes()
+	}()
 }
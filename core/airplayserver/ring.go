@@ -0,0 +1,255 @@
+package airplayserver
+
+import (
+	"fmt"
+	"hyperkit/core/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverrunPolicy is what a sink that fell further behind than the buffer
+// holds skips.
+type OverrunPolicy string
+
+const (
+	// OverrunDropOldest drops the packets that were overwritten and goes on
+	// with the oldest one still buffered.
+	OverrunDropOldest OverrunPolicy = "drop_oldest"
+	// OverrunSkipToNewest drops everything but the newest packet, which
+	// keeps the latency of the sink as low as possible.
+	OverrunSkipToNewest OverrunPolicy = "skip_to_newest"
+)
+
+// UnderrunPolicy is what a sink that caught up with decoding plays while it
+// waits for the next packet.
+type UnderrunPolicy string
+
+const (
+	// UnderrunWait plays nothing until the next packet is decoded.
+	UnderrunWait UnderrunPolicy = "wait"
+	// UnderrunSilence plays silence whenever no packet was decoded for
+	// twice the length of a packet, so a device never runs dry.
+	UnderrunSilence UnderrunPolicy = "insert_silence"
+)
+
+const (
+	// DefaultBufferDepth is about 32 AirPlay packets.
+	DefaultBufferDepth = 250 * time.Millisecond
+
+	// framesPerPacket is the number of frames in an AirPlay packet.
+	framesPerPacket = 352
+)
+
+// BufferOptions configure the buffer between decoding and the sinks.
+type BufferOptions struct {
+	// Depth is how much audio the buffer holds. Defaults to
+	// DefaultBufferDepth.
+	Depth    time.Duration
+	Overrun  OverrunPolicy
+	Underrun UnderrunPolicy
+}
+
+// Validate checks the policies and the depth.
+func (o BufferOptions) Validate() error {
+	switch o.Overrun {
+	case "", OverrunDropOldest, OverrunSkipToNewest:
+	default:
+		return fmt.Errorf("unknown overrun policy %q, must be %q or %q", o.Overrun, OverrunDropOldest, OverrunSkipToNewest)
+	}
+	switch o.Underrun {
+	case "", UnderrunWait, UnderrunSilence:
+	default:
+		return fmt.Errorf("unknown underrun policy %q, must be %q or %q", o.Underrun, UnderrunWait, UnderrunSilence)
+	}
+	if o.Depth < 0 || o.Depth > 10*time.Second {
+		return fmt.Errorf("buffer depth must be between 0 and 10s, got %v", o.Depth)
+	}
+	return nil
+}
+
+// packets returns the depth in AirPlay packets, at least 2.
+func (o BufferOptions) packets() int {
+	depth := o.Depth
+	if depth <= 0 {
+		depth = DefaultBufferDepth
+	}
+	packetLen := time.Duration(framesPerPacket) * time.Second / time.Duration(DefaultFormat.SampleRate)
+	n := int((depth + packetLen - 1) / packetLen)
+	if n < 2 {
+		n = 2
+	}
+	return n
+}
+
+// BufferStats are the diagnostic counters of the buffer and its sinks.
+type BufferStats struct {
+	// Depth is the number of packets the buffer holds.
+	Depth int
+	// Written is the number of packets decoded into the buffer.
+	Written uint64
+	Sinks   []SinkStats
+}
+
+// SinkStats are the diagnostic counters of a sink, since it was added.
+type SinkStats struct {
+	Name string
+	// Buffered is the number of packets waiting for the sink.
+	Buffered int
+	// Played is the number of packets written to the sink.
+	Played uint64
+	// Dropped is the number of packets the sink skipped because it fell
+	// behind, failed or was waiting to be reopened.
+	Dropped uint64
+	// Overruns is how often the sink fell further behind than the buffer
+	// holds, and Underruns how many silent packets it was given.
+	Overruns  uint64
+	Underruns uint64
+	// Errors is how often the sink failed to open or write.
+	Errors uint64
+}
+
+// ringBuffer holds the last packets of a stream for every sink to read at
+// its own pace. Writing never waits for a sink.
+type ringBuffer struct {
+	mu    sync.Mutex
+	slots []ringSlot
+	// next is the sequence number of the next packet; packet n is kept in
+	// slot n % len(slots) until it is overwritten.
+	next  uint64
+	ended bool
+	// wake is closed and replaced whenever a packet is written or the stream
+	// ends.
+	wake chan struct{}
+}
+
+type ringSlot struct {
+	format Format
+	pcm    []byte
+}
+
+func newRingBuffer(depth int) *ringBuffer {
+	return &ringBuffer{slots: make([]ringSlot, depth), wake: make(chan struct{})}
+}
+
+// write copies pcm into the buffer, overwriting the oldest packet if it is
+// full.
+func (b *ringBuffer) write(format Format, pcm []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	slot := &b.slots[b.next%uint64(len(b.slots))]
+	slot.format = format
+	slot.pcm = append(slot.pcm[:0], pcm...)
+	b.next++
+	close(b.wake)
+	b.wake = make(chan struct{})
+}
+
+// end lets the readers return once they read every packet.
+func (b *ringBuffer) end() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ended = true
+	close(b.wake)
+	b.wake = make(chan struct{})
+}
+
+// written returns the sequence number of the next packet.
+func (b *ringBuffer) written() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.next
+}
+
+// oldest returns the sequence number of the oldest packet still buffered.
+// Must be called with b.mu held.
+func (b *ringBuffer) oldest() uint64 {
+	if depth := uint64(len(b.slots)); b.next > depth {
+		return b.next - depth
+	}
+	return 0
+}
+
+// ringReader is the cursor of one sink into the buffer.
+type ringReader struct {
+	ring *ringBuffer
+	opts BufferOptions
+	name string
+	reg  *registeredSink
+
+	// pos is the sequence number of the next packet the sink reads. It is
+	// guarded by ring.mu.
+	pos uint64
+	// buf holds the packet read last, which stays valid until the next read
+	buf    []byte
+	format Format
+	read   bool
+}
+
+// buffered returns the number of packets waiting for the sink.
+func (rd *ringReader) buffered() int {
+	b := rd.ring
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pos := rd.pos
+	if oldest := b.oldest(); pos < oldest {
+		pos = oldest
+	}
+	return int(b.next - pos)
+}
+
+// next returns the next packet for the sink, applying the overrun and
+// underrun policies. It returns false once the stream ended and the sink
+// read everything.
+func (rd *ringReader) next() (Format, []byte, bool) {
+	b := rd.ring
+	for {
+		b.mu.Lock()
+		cursor := rd.pos
+		if oldest := b.oldest(); cursor < oldest {
+			target := oldest
+			if rd.opts.Overrun == OverrunSkipToNewest {
+				target = b.next - 1
+			}
+			missed := target - cursor
+			atomic.AddUint64(&rd.reg.stats.overruns, 1)
+			atomic.AddUint64(&rd.reg.stats.dropped, missed)
+			metrics.OutputOverruns.WithLabelValues(rd.name).Inc()
+			metrics.OutputDroppedPackets.WithLabelValues(rd.name).Add(float64(missed))
+			cursor = target
+		}
+		if cursor < b.next {
+			slot := &b.slots[cursor%uint64(len(b.slots))]
+			rd.buf = append(rd.buf[:0], slot.pcm...)
+			rd.format, rd.read = slot.format, true
+			rd.pos = cursor + 1
+			b.mu.Unlock()
+			return rd.format, rd.buf, true
+		}
+		rd.pos = cursor
+		ended, wake := b.ended, b.wake
+		b.mu.Unlock()
+		if ended {
+			return Format{}, nil, false
+		}
+
+		if rd.opts.Underrun != UnderrunSilence || !rd.read {
+			<-wake
+			continue
+		}
+		timeout := 2 * time.Duration(len(rd.buf)) * time.Second / time.Duration(rd.format.BytesPerSecond())
+		timer := time.NewTimer(timeout)
+		select {
+		case <-wake:
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+		for i := range rd.buf {
+			rd.buf[i] = 0
+		}
+		atomic.AddUint64(&rd.reg.stats.underruns, 1)
+		metrics.OutputUnderruns.WithLabelValues(rd.name).Inc()
+		return rd.format, rd.buf, true
+	}
+}
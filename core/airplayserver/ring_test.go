@@ -0,0 +1,75 @@
+package airplayserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRingOverrun(t *testing.T) {
+	for _, tc := range []struct {
+		policy OverrunPolicy
+		want   byte
+	}{
+		{OverrunDropOldest, 6},
+		{OverrunSkipToNewest, 9},
+	} {
+		ring := newRingBuffer(4)
+		rd := &ringReader{ring: ring, opts: BufferOptions{Overrun: tc.policy}, name: "test", reg: new(registeredSink)}
+		for i := byte(0); i < 10; i++ {
+			ring.write(DefaultFormat, []byte{i, 0, 0, 0})
+		}
+		if n := rd.buffered(); n != 4 {
+			t.Fatalf("%s: got %d packets buffered, want 4\n", tc.policy, n)
+		}
+		_, pcm, ok := rd.next()
+		if !ok || pcm[0] != tc.want {
+			t.Fatalf("%s: read packet %d after an overrun, want %d\n", tc.policy, pcm[0], tc.want)
+		}
+		if rd.reg.stats.overruns != 1 || rd.reg.stats.dropped != uint64(tc.want) {
+			t.Fatalf("%s: unexpected counters %+v\n", tc.policy, rd.reg.stats)
+		}
+		ring.end()
+		for ok {
+			_, _, ok = rd.next()
+		}
+	}
+}
+
+func TestRingUnderrun(t *testing.T) {
+	ring := newRingBuffer(4)
+	rd := &ringReader{ring: ring, opts: BufferOptions{Underrun: UnderrunSilence}, name: "test", reg: new(registeredSink)}
+	// 1408 bytes are 8ms of audio
+	pcm := make([]byte, 1408)
+	pcm[0] = 1
+	ring.write(DefaultFormat, pcm)
+	if _, got, _ := rd.next(); got[0] != 1 {
+		t.Fatalf("Did not read the packet written\n")
+	}
+	start := time.Now()
+	_, got, ok := rd.next()
+	if !ok || got[0] != 0 || len(got) != len(pcm) {
+		t.Fatalf("Did not get a silent packet on underrun\n")
+	}
+	if waited := time.Since(start); waited < 15*time.Millisecond || waited > time.Second {
+		t.Fatalf("Waited %v before inserting silence, want 16ms\n", waited)
+	}
+	if rd.reg.stats.underruns != 1 {
+		t.Fatalf("Got %d underruns, want 1\n", rd.reg.stats.underruns)
+	}
+	ring.end()
+	if _, _, ok := rd.next(); ok {
+		t.Fatalf("Reader did not end with the stream\n")
+	}
+}
+
+func TestBufferOptions(t *testing.T) {
+	if n := (BufferOptions{}).packets(); n != 32 {
+		t.Fatalf("Got a default depth of %d packets, want 32\n", n)
+	}
+	if n := (BufferOptions{Depth: time.Millisecond}).packets(); n != 2 {
+		t.Fatalf("Got a depth of %d packets, want at least 2\n", n)
+	}
+	if err := (BufferOptions{Overrun: "block"}).Validate(); err == nil {
+		t.Fatalf("Expected an unknown overrun policy to be rejected\n")
+	}
+}
@@ -0,0 +1,259 @@
+package airplayserver
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hyperkit/core/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Format describes interleaved little-endian PCM.
+type Format struct {
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+}
+
+// DefaultFormat is the 16-bit stereo PCM AirPlay streams at 44.1 kHz.
+var DefaultFormat = Format{SampleRate: 44100, Channels: 2, BitsPerSample: 16}
+
+// BytesPerSecond returns how many bytes one second of audio takes.
+func (f Format) BytesPerSecond() int {
+	return f.SampleRate * f.Channels * f.BitsPerSample / 8
+}
+
+func (f Format) String() string {
+	return fmt.Sprintf("%d Hz, %d channels, %d bit", f.SampleRate, f.Channels, f.BitsPerSample)
+}
+
+// AudioSink is a destination of the decoded AirPlay audio. Every sink reads
+// the buffer of decoded packets from its own goroutine, so a sink that blocks
+// or fails only loses its own audio. A sink is opened when a stream starts and closed when it ends; one
+// that fails is closed and opened again after a delay.
+type AudioSink interface {
+	// Name identifies the sink in logs and metrics.
+	Name() string
+	// Open readies the sink for audio in the given format.
+	Open(format Format) error
+	// Write plays pcm, a whole number of frames in format, which is the
+	// format the sink was opened with. pcm must not be kept after Write
+	// returns.
+	Write(pcm []byte, format Format) error
+	// Close releases what Open acquired.
+	Close() error
+	// Latency is how far the sink plays behind the audio written to it.
+	Latency() time.Duration
+}
+
+const (
+	minReopenDelay = 500 * time.Millisecond
+	maxReopenDelay = 30 * time.Second
+)
+
+// registeredSink is a sink added to the player. mu is held while a stream
+// uses the sink, so streams ending and starting never use it at once.
+type registeredSink struct {
+	// stats comes first to keep its counters 64-bit aligned on 32-bit ARM
+	stats sinkCounters
+	sink  AudioSink
+	mu    sync.Mutex
+}
+
+// sinkCounters are the counters of SinkStats, updated atomically.
+type sinkCounters struct {
+	played, dropped, overruns, underruns, errors uint64
+}
+
+// AddSink registers s, which receives the audio of the next stream on.
+func (lp *LocalPlayer) AddSink(s AudioSink) error {
+	lp.sinksMu.Lock()
+	defer lp.sinksMu.Unlock()
+	for _, r := range lp.sinks {
+		if r.sink.Name() == s.Name() {
+			return fmt.Errorf("audio sink %s already exists", s.Name())
+		}
+	}
+	lp.sinks = append(lp.sinks, &registeredSink{sink: s})
+	return nil
+}
+
+// RemoveSink unregisters the named sink. A stream that is playing keeps
+// feeding it until it ends.
+func (lp *LocalPlayer) RemoveSink(name string) error {
+	lp.sinksMu.Lock()
+	defer lp.sinksMu.Unlock()
+	for i, r := range lp.sinks {
+		if r.sink.Name() == name {
+			lp.sinks = append(lp.sinks[:i], lp.sinks[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("audio sink %s does not exist", name)
+}
+
+// SetBufferOptions configures the buffer of the streams that start from now
+// on.
+func (lp *LocalPlayer) SetBufferOptions(opts BufferOptions) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	lp.sinksMu.Lock()
+	defer lp.sinksMu.Unlock()
+	lp.bufferOpts = opts
+	return nil
+}
+
+// BufferStats returns the counters of the buffer and of every sink.
+func (lp *LocalPlayer) BufferStats() BufferStats {
+	lp.sinksMu.Lock()
+	defer lp.sinksMu.Unlock()
+	stats := BufferStats{Depth: lp.bufferOpts.packets(), Written: atomic.LoadUint64(&lp.written)}
+	for _, reg := range lp.sinks {
+		c := &reg.stats
+		s := SinkStats{
+			Name:      reg.sink.Name(),
+			Played:    atomic.LoadUint64(&c.played),
+			Dropped:   atomic.LoadUint64(&c.dropped),
+			Overruns:  atomic.LoadUint64(&c.overruns),
+			Underruns: atomic.LoadUint64(&c.underruns),
+			Errors:    atomic.LoadUint64(&c.errors),
+		}
+		for _, rd := range lp.readers {
+			if rd.reg == reg {
+				s.Buffered = rd.buffered()
+			}
+		}
+		stats.Sinks = append(stats.Sinks, s)
+	}
+	return stats
+}
+
+// startSinks creates the buffer of a new stream and starts feeding every
+// registered sink from it. The caller writes the decoded packets to the
+// buffer and ends it with stopSinks.
+func (lp *LocalPlayer) startSinks() *ringBuffer {
+	lp.sinksMu.Lock()
+	defer lp.sinksMu.Unlock()
+	ring := newRingBuffer(lp.bufferOpts.packets())
+	lp.readers = lp.readers[:0]
+	for _, reg := range lp.sinks {
+		r := &sinkRunner{
+			reader: &ringReader{ring: ring, opts: lp.bufferOpts, name: reg.sink.Name(), reg: reg},
+			reg:    reg,
+			name:   reg.sink.Name(),
+		}
+		lp.readers = append(lp.readers, r.reader)
+		lp.streams.Add(1)
+		go func() {
+			defer lp.streams.Done()
+			r.run()
+		}()
+	}
+	return ring
+}
+
+// stopSinks ends ring, which lets every sink play what is buffered and close.
+func (lp *LocalPlayer) stopSinks(ring *ringBuffer) {
+	ring.end()
+	lp.sinksMu.Lock()
+	defer lp.sinksMu.Unlock()
+	if len(lp.readers) > 0 && lp.readers[0].ring == ring {
+		lp.readers = lp.readers[:0]
+	}
+}
+
+// sinkRunner feeds one sink the packets of one stream.
+type sinkRunner struct {
+	reader *ringReader
+	reg    *registeredSink
+	name   string
+
+	open     bool
+	format   Format
+	failures int
+	retryAt  time.Time
+}
+
+func (r *sinkRunner) run() {
+	r.reg.mu.Lock()
+	defer r.reg.mu.Unlock()
+	for {
+		format, pcm, ok := r.reader.next()
+		if !ok {
+			break
+		}
+		r.write(format, pcm)
+	}
+	r.close()
+}
+
+func (r *sinkRunner) write(format Format, pcm []byte) {
+	sink := r.reg.sink
+	if r.open && format != r.format {
+		log.Infof("Audio format changed to %v, reopening audio sink %s\n", format, r.name)
+		r.close()
+	}
+	if !r.open {
+		if time.Now().Before(r.retryAt) {
+			r.drop()
+			return
+		}
+		if err := sink.Open(format); err != nil {
+			r.fail("opening", err)
+			return
+		}
+		r.open, r.format = true, format
+		metrics.OutputLatency.WithLabelValues(r.name).Set(sink.Latency().Seconds())
+		if r.failures > 0 {
+			log.Infof("Reopened audio sink %s\n", r.name)
+		}
+	}
+
+	start := time.Now()
+	err := sink.Write(pcm, format)
+	metrics.WriteLatency.WithLabelValues(r.name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		r.close()
+		r.fail("writing to", err)
+		return
+	}
+	atomic.AddUint64(&r.reg.stats.played, 1)
+	metrics.BytesWritten.WithLabelValues(r.name).Add(float64(len(pcm)))
+	r.failures = 0
+}
+
+func (r *sinkRunner) drop() {
+	atomic.AddUint64(&r.reg.stats.dropped, 1)
+	metrics.OutputDroppedPackets.WithLabelValues(r.name).Inc()
+}
+
+// fail counts a failure of the sink and holds it closed for a delay that
+// grows with every failure in a row.
+func (r *sinkRunner) fail(action string, err error) {
+	atomic.AddUint64(&r.reg.stats.errors, 1)
+	metrics.OutputErrors.WithLabelValues(r.name).Inc()
+	r.drop()
+	delay := minReopenDelay << uint(minInt(r.failures, 6))
+	if delay > maxReopenDelay {
+		delay = maxReopenDelay
+	}
+	r.failures++
+	r.retryAt = time.Now().Add(delay)
+	if r.failures == 1 {
+		log.Warnf("Error %s audio sink %s, retrying in %v: %v\n", action, r.name, delay, err)
+	} else {
+		log.Debugf("Error %s audio sink %s, retrying in %v: %v\n", action, r.name, delay, err)
+	}
+}
+
+func (r *sinkRunner) close() {
+	if !r.open {
+		return
+	}
+	r.open = false
+	if err := r.reg.sink.Close(); err != nil {
+		log.Debugf("Error closing audio sink %s: %v\n", r.name, err)
+	}
+}
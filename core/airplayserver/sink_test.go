@@ -0,0 +1,133 @@
+package airplayserver
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSink records the packets written to it. Writes fail while failing is
+// set, and block while block is not closed.
+type fakeSink struct {
+	name string
+
+	mu      sync.Mutex
+	opens   int
+	packets int
+	failing bool
+	block   chan struct{}
+}
+
+func (s *fakeSink) Name() string { return s.name }
+
+func (s *fakeSink) Open(Format) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opens++
+	return nil
+}
+
+func (s *fakeSink) Write([]byte, Format) error {
+	s.mu.Lock()
+	block, failing := s.block, s.failing
+	s.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+	if failing {
+		return errors.New("broken pipe")
+	}
+	s.mu.Lock()
+	s.packets++
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *fakeSink) Close() error { return nil }
+
+func (s *fakeSink) Latency() time.Duration { return 0 }
+
+func (s *fakeSink) counts() (opens, packets int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.opens, s.packets
+}
+
+func TestSinkIsolation(t *testing.T) {
+	lp := new(LocalPlayer)
+	good := &fakeSink{name: "good"}
+	broken := &fakeSink{name: "broken", failing: true}
+	stuck := &fakeSink{name: "stuck", block: make(chan struct{})}
+	for _, s := range []*fakeSink{good, broken, stuck} {
+		if err := lp.AddSink(s); err != nil {
+			t.Fatalf("Error adding sink: %v\n", err)
+		}
+	}
+	if err := lp.AddSink(&fakeSink{name: "good"}); err == nil {
+		t.Fatalf("Expected a second sink named good to be rejected\n")
+	}
+
+	ring := lp.startSinks()
+	pcm := make([]byte, 1408)
+	for i := 0; i < 100; i++ {
+		ring.write(DefaultFormat, pcm)
+		time.Sleep(time.Millisecond)
+	}
+	close(stuck.block)
+	lp.stopSinks(ring)
+	lp.streams.Wait()
+
+	if opens, packets := good.counts(); opens != 1 || packets != 100 {
+		t.Fatalf("Good sink was opened %d times and got %d packets, want 1 and 100\n", opens, packets)
+	}
+	if opens, _ := broken.counts(); opens != 1 {
+		t.Fatalf("Broken sink was reopened before its delay passed: %d opens\n", opens)
+	}
+	depth := len(ring.slots)
+	if _, packets := stuck.counts(); packets == 0 || packets > depth+1 {
+		t.Fatalf("Stuck sink got %d packets, want at most the %d buffered\n", packets, depth+1)
+	}
+	stats := lp.BufferStats()
+	if stats.Sinks[2].Overruns == 0 || stats.Sinks[2].Played+stats.Sinks[2].Dropped != 100 {
+		t.Fatalf("Unexpected counters %+v\n", stats)
+	}
+}
+
+func TestSinkReopen(t *testing.T) {
+	lp := new(LocalPlayer)
+	s := &fakeSink{name: "flaky", failing: true}
+	if err := lp.AddSink(s); err != nil {
+		t.Fatalf("Error adding sink: %v\n", err)
+	}
+	ring := lp.startSinks()
+	pcm := make([]byte, 1408)
+	ring.write(DefaultFormat, pcm)
+	time.Sleep(10 * time.Millisecond)
+	s.mu.Lock()
+	s.failing = false
+	s.mu.Unlock()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		ring.write(DefaultFormat, pcm)
+		if _, packets := s.counts(); packets > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lp.stopSinks(ring)
+	lp.streams.Wait()
+	if opens, packets := s.counts(); opens != 2 || packets == 0 {
+		t.Fatalf("Sink was opened %d times and got %d packets, want it reopened once\n", opens, packets)
+	}
+
+	if err := lp.RemoveSink("flaky"); err != nil {
+		t.Fatalf("Error removing sink: %v\n", err)
+	}
+	ring = lp.startSinks()
+	defer lp.stopSinks(ring)
+	if len(lp.readers) != 0 {
+		t.Fatalf("Removed sink is still fed\n")
+	}
+}
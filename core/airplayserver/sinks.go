@@ -0,0 +1,91 @@
+package airplayserver
+
+import (
+	"fmt"
+	"github.com/hajimehoshi/oto"
+	"golang.org/x/sys/unix"
+	"os"
+	"time"
+)
+
+// otoBufferSize is the size in bytes of oto's playback buffer.
+const otoBufferSize = 10000
+
+// fifoWriteTimeout bounds a write to the FIFO, so a reader that stopped
+// reading is noticed instead of blocking the sink.
+const fifoWriteTimeout = time.Second
+
+// otoSink plays the audio on the default ALSA device, which the Bluetooth
+// proxy routes to the speaker.
+type otoSink struct {
+	ctx    *oto.Context
+	player *oto.Player
+}
+
+func (s *otoSink) Name() string {
+	return "oto"
+}
+
+// Open only accepts DefaultFormat, as oto only allows one context per
+// process.
+func (s *otoSink) Open(format Format) error {
+	if format != DefaultFormat {
+		return fmt.Errorf("cannot play %v, only %v", format, DefaultFormat)
+	}
+	s.player = s.ctx.NewPlayer()
+	return nil
+}
+
+func (s *otoSink) Write(pcm []byte, _ Format) error {
+	_, err := s.player.Write(pcm)
+	return err
+}
+
+func (s *otoSink) Close() error {
+	err := s.player.Close()
+	s.player = nil
+	return err
+}
+
+func (s *otoSink) Latency() time.Duration {
+	return time.Duration(otoBufferSize) * time.Second / time.Duration(DefaultFormat.BytesPerSecond())
+}
+
+// fifoSink writes the audio to the named pipe LedFX reads.
+type fifoSink struct {
+	path string
+	file *os.File
+}
+
+func (s *fifoSink) Name() string {
+	return "fifo"
+}
+
+// Open fails unless a reader has the FIFO open, rather than waiting for one.
+func (s *fifoSink) Open(Format) error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|unix.O_NONBLOCK, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening FIFO pipe: %w", err)
+	}
+	s.file = f
+	return nil
+}
+
+func (s *fifoSink) Write(pcm []byte, _ Format) error {
+	// Opened non-blocking, the FIFO goes through the runtime poller, which
+	// makes the write deadline work
+	_ = s.file.SetWriteDeadline(time.Now().Add(fifoWriteTimeout))
+	_, err := s.file.Write(pcm)
+	return err
+}
+
+func (s *fifoSink) Close() error {
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Latency is 0, as LedFX reads the audio as soon as it is written.
+func (s *fifoSink) Latency() time.Duration {
+	return 0
+}
@@ -0,0 +1,212 @@
+package core
+
+import (
+	"fmt"
+	"github.com/brutella/hc/characteristic"
+	"hyperkit/core/lifecycle"
+	"hyperkit/core/restapi"
+	"sort"
+	"time"
+)
+
+// The methods below back the HTTP API and the MQTT bridge. They drive the
+// same handlers as the HomeKit accessories and update the characteristics,
+// so the Home app reflects every change. The lights they control are the
+// WLED controller at wled_ip.
+var _ restapi.Controller = (*Core)(nil)
+
+// redactedKeys are config keys whose values are not shown by ConfigValues.
+var redactedKeys = []string{"homekit_pin", "api_token", "mqtt_password"}
+
+// State returns the state of the lights at wled_ip as HomeKit shows it.
+func (c *Core) State() restapi.State {
+	d := c.primary()
+	bulb := d.lightHandler.light.Lightbulb
+	return restapi.State{
+		On:         d.menuOutlet.Outlet.On.GetValue(),
+		Brightness: percentToByte(float64(bulb.Brightness.GetValue())),
+		Speed:      percentToByte(d.lightHandler.rotationSpeed.GetValue()),
+		Preset:     d.activePreset(),
+		AirPlay:    c.AirPlayEnabled(),
+		Wled:       d.wled.ConnState().String(),
+	}
+}
+
+// activePreset returns the ID of the active preset, or -1 if none is.
+func (d *Device) activePreset() int {
+	if !d.menuOutlet.Outlet.On.GetValue() {
+		return -1
+	}
+	if d.tvHandler != nil {
+		d.tvHandler.mu.Lock()
+		defer d.tvHandler.mu.Unlock()
+		id := d.tvHandler.television.ActiveIdentifier.GetValue()
+		if _, ok := d.tvHandler.inputs[id]; ok {
+			return id
+		}
+		return -1
+	}
+	d.presetHandler.mu.Lock()
+	defer d.presetHandler.mu.Unlock()
+	for id, preset := range d.presetHandler.Presets {
+		if preset.On.GetValue() {
+			return id
+		}
+	}
+	return -1
+}
+
+// SetPower switches the lights at wled_ip on or off like the power outlet
+// does.
+func (c *Core) SetPower(on bool) error {
+	return c.primary().setPower(on)
+}
+
+func (d *Device) setPower(on bool) error {
+	err := d.presetHandler.switchPower(on)
+	d.lightHandler.light.Lightbulb.On.SetValue(on)
+	if d.tvHandler != nil {
+		active := characteristic.ActiveInactive
+		if on {
+			active = characteristic.ActiveActive
+		}
+		d.tvHandler.television.Active.SetValue(active)
+	}
+	return err
+}
+
+// SetBrightness sets the brightness at wled_ip like the light does.
+func (c *Core) SetBrightness(brightness uint8) error {
+	return c.primary().setBrightness(brightness)
+}
+
+func (d *Device) setBrightness(brightness uint8) error {
+	err := d.lightHandler.setBrightness(brightness)
+	d.lightHandler.light.Lightbulb.Brightness.SetValue(byteToPercent(brightness))
+	if d.miscHandler != nil {
+		d.miscHandler.syncBrightness(brightness)
+	}
+	return err
+}
+
+// SetSpeed sets the effect speed at wled_ip like the speed fan does.
+func (c *Core) SetSpeed(speed uint8) error {
+	return c.primary().setSpeed(speed)
+}
+
+func (d *Device) setSpeed(speed uint8) error {
+	l := d.lightHandler
+	err := l.setSpeed(speed)
+	percent := float64(byteToPercent(speed))
+	l.mu.Lock()
+	if percent > 0 {
+		l.lastSpeed = percent
+	}
+	l.mu.Unlock()
+	l.rotationSpeed.SetValue(percent)
+	l.speedService.On.SetValue(speed > 0)
+	if d.miscHandler != nil {
+		d.miscHandler.syncSpeed(speed)
+	}
+	return err
+}
+
+// Presets returns the presets of the controller at wled_ip, ordered by ID.
+func (c *Core) Presets() []restapi.Preset {
+	d := c.primary()
+	active := d.activePreset()
+	d.presetMu.Lock()
+	defer d.presetMu.Unlock()
+	presets := make([]restapi.Preset, 0, len(d.presets))
+	for id, preset := range d.presets {
+		presets = append(presets, restapi.Preset{ID: id, Name: preset.name, Active: id == active})
+	}
+	sort.Slice(presets, func(i, j int) bool { return presets[i].ID < presets[j].ID })
+	return presets
+}
+
+// ActivatePreset switches the controller at wled_ip to the given preset like
+// its outlet or television input does.
+func (c *Core) ActivatePreset(id int) error {
+	d := c.primary()
+	d.presetMu.Lock()
+	_, ok := d.presets[id]
+	d.presetMu.Unlock()
+	if !ok {
+		return fmt.Errorf("preset %d: %w", id, restapi.ErrNotFound)
+	}
+	if d.tvHandler != nil {
+		d.tvHandler.activatePreset(id)
+		return nil
+	}
+	d.presetHandler.activatePreset(id)
+	return nil
+}
+
+// AirPlayEnabled reports whether the AirPlay bridge is enabled.
+func (c *Core) AirPlayEnabled() bool {
+	return c.primary().presetHandler.musicIsActive()
+}
+
+// SetAirPlay enables or disables the AirPlay bridge like its switch does.
+func (c *Core) SetAirPlay(enabled bool) error {
+	return c.primary().presetHandler.setMusic(enabled)
+}
+
+func (c *Core) LedFXStatus() restapi.LedFX {
+	ctl := c.airplayServer.LedFX()
+	if ctl == nil {
+		return restapi.LedFX{Container: "disabled", Health: lifecycle.Stopped}
+	}
+	h := ctl.Health()
+	status := restapi.LedFX{Container: ctl.State().String(), Health: h.State}
+	if h.Err != nil {
+		status.Error = h.Err.Error()
+	}
+	return status
+}
+
+func (c *Core) BluetoothStatus() restapi.Bluetooth {
+	bt := c.airplayServer.Bluetooth()
+	h := bt.Health()
+	status := restapi.Bluetooth{Device: bt.DeviceName(), Connected: bt.Connected(), Health: h.State}
+	if h.Err != nil {
+		status.Error = h.Err.Error()
+	}
+	return status
+}
+
+// AudioBuffer returns the counters of the audio buffer and its outputs.
+func (c *Core) AudioBuffer() restapi.AudioBuffer {
+	stats := c.airplayServer.BufferStats()
+	buf := restapi.AudioBuffer{Depth: stats.Depth, Written: stats.Written, Outputs: []restapi.AudioOutput{}}
+	for _, s := range stats.Sinks {
+		buf.Outputs = append(buf.Outputs, restapi.AudioOutput{
+			Name:      s.Name,
+			Buffered:  s.Buffered,
+			Played:    s.Played,
+			Dropped:   s.Dropped,
+			Overruns:  s.Overruns,
+			Underruns: s.Underruns,
+			Errors:    s.Errors,
+		})
+	}
+	return buf
+}
+
+// ConfigValues returns the running config by key, with secrets redacted and
+// durations formatted like in the config file.
+func (c *Core) ConfigValues() map[string]interface{} {
+	values := c.currentConfig().values()
+	for key, value := range values {
+		if d, ok := value.(time.Duration); ok {
+			values[key] = d.String()
+		}
+	}
+	for _, key := range redactedKeys {
+		if values[key] != "" {
+			values[key] = "<redacted>"
+		}
+	}
+	return values
+}
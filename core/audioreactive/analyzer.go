@@ -0,0 +1,308 @@
+package audioreactive
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+)
+
+const (
+	// SampleRate is the rate of the AirPlay audio the analyzer expects.
+	SampleRate = 44100
+
+	// fftSize samples are analysed every hopSize samples, about 86 times a
+	// second.
+	fftSize = 1024
+	hopSize = 512
+
+	minFrequency = 40.0
+	maxFrequency = 16000.0
+	// bassFrequency bounds the bins beats are detected in.
+	bassFrequency = 150.0
+
+	// historyHops is how many hops the beat and onset thresholds average
+	// over, about a second.
+	historyHops = 86
+	// beatSensitivity is how far bass energy has to rise above its average
+	// to count as a beat.
+	beatSensitivity = 1.5
+	// minBeatHops is the shortest time between two beats, 0.3s or 200 BPM.
+	minBeatHops = 26
+
+	// peakDecay lets the loudest level seen fade by half in about two
+	// seconds, so quiet passages are scaled up again.
+	peakDecay = 0.996
+	minPeak   = 1e-3
+	// attack and release smooth the bands when they rise and fall.
+	attack  = 0.7
+	release = 0.2
+)
+
+// Features describe the audio analysed last.
+type Features struct {
+	// Bands are the mel-spaced band levels from low to high frequencies,
+	// between 0 and 1 relative to the loudest level heard recently.
+	Bands []float64
+	// Energy is the RMS level between 0 and 1, relative to the loudest level
+	// heard recently.
+	Energy float64
+	// RMS is the absolute RMS level between 0 and 1 (full scale).
+	RMS float64
+	// Onset is the strength of the latest note onset between 0 and 1.
+	Onset float64
+	// Beat reports whether a beat was detected since the previous call to
+	// Analyzer.Features.
+	Beat bool
+}
+
+// melFilter is a triangular filter over the FFT bins from first on.
+type melFilter struct {
+	first   int
+	weights []float64
+}
+
+// Analyzer extracts Features from 16-bit stereo PCM. It is safe for
+// concurrent use.
+type Analyzer struct {
+	mu sync.Mutex
+
+	fft     *fft
+	window  []float64
+	filters []melFilter
+	bass    int
+
+	// samples is a ring of the last fftSize mono samples, pos where the next
+	// one goes and pending how many arrived since the last analysis.
+	samples []float64
+	pos     int
+	pending int
+	// partial holds the bytes of an incomplete stereo frame.
+	partial []byte
+
+	re, im, mag, prevLog []float64
+	raw                  []float64
+
+	bandPeak   float64
+	energyPeak float64
+	bassHist   []float64
+	fluxHist   []float64
+	histPos    int
+	sinceBeat  int
+
+	features Features
+}
+
+// NewAnalyzer returns an analyzer with the given number of mel bands.
+func NewAnalyzer(bands int) *Analyzer {
+	a := &Analyzer{
+		fft:      newFFT(fftSize),
+		window:   make([]float64, fftSize),
+		samples:  make([]float64, fftSize),
+		re:       make([]float64, fftSize),
+		im:       make([]float64, fftSize),
+		mag:      make([]float64, fftSize/2+1),
+		prevLog:  make([]float64, fftSize/2+1),
+		raw:      make([]float64, bands),
+		bassHist: make([]float64, historyHops),
+		fluxHist: make([]float64, historyHops),
+		features: Features{Bands: make([]float64, bands)},
+	}
+	// Hann window
+	for i := range a.window {
+		a.window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(fftSize-1))
+	}
+	a.filters = melFilters(bands, minFrequency, maxFrequency)
+	a.bass = int(math.Ceil(bassFrequency * fftSize / SampleRate))
+	a.sinceBeat = minBeatHops
+	return a
+}
+
+// Bands returns the number of mel bands.
+func (a *Analyzer) Bands() int {
+	return len(a.raw)
+}
+
+// Write analyses pcm, interleaved 16-bit little-endian stereo samples. It
+// never fails; a frame split across calls is completed by the next one.
+func (a *Analyzer) Write(pcm []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := len(pcm)
+	if len(a.partial) > 0 {
+		need := 4 - len(a.partial)
+		if len(pcm) < need {
+			a.partial = append(a.partial, pcm...)
+			return n, nil
+		}
+		a.partial = append(a.partial, pcm[:need]...)
+		a.add(a.partial)
+		a.partial = a.partial[:0]
+		pcm = pcm[need:]
+	}
+	for ; len(pcm) >= 4; pcm = pcm[4:] {
+		a.add(pcm)
+	}
+	a.partial = append(a.partial, pcm...)
+	return n, nil
+}
+
+// add mixes one stereo frame down to mono and analyses a hop once complete.
+func (a *Analyzer) add(frame []byte) {
+	l := int16(binary.LittleEndian.Uint16(frame))
+	r := int16(binary.LittleEndian.Uint16(frame[2:]))
+	a.samples[a.pos] = (float64(l) + float64(r)) / 65536
+	a.pos = (a.pos + 1) % fftSize
+	a.pending++
+	if a.pending == hopSize {
+		a.pending = 0
+		a.analyse()
+	}
+}
+
+// Features returns the features of the audio analysed last, and resets Beat.
+func (a *Analyzer) Features() Features {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f := a.features
+	f.Bands = append([]float64(nil), a.features.Bands...)
+	a.features.Beat = false
+	return f
+}
+
+func (a *Analyzer) analyse() {
+	// RMS of the hop just completed
+	sum := 0.0
+	for i := 0; i < hopSize; i++ {
+		s := a.samples[(a.pos-hopSize+i+fftSize)%fftSize]
+		sum += s * s
+	}
+	rms := math.Sqrt(sum / hopSize)
+
+	for i := range a.re {
+		a.re[i] = a.samples[(a.pos+i)%fftSize] * a.window[i]
+		a.im[i] = 0
+	}
+	a.fft.transform(a.re, a.im)
+	for k := range a.mag {
+		a.mag[k] = math.Hypot(a.re[k], a.im[k]) / (fftSize / 2)
+	}
+
+	// Spectral flux of the log magnitudes finds onsets, the energy of the
+	// bass bins beats.
+	flux, bass := 0.0, 0.0
+	for k, m := range a.mag {
+		l := math.Log1p(100 * m)
+		if d := l - a.prevLog[k]; d > 0 {
+			flux += d
+		}
+		a.prevLog[k] = l
+		if k > 0 && k <= a.bass {
+			bass += m * m
+		}
+	}
+	flux /= float64(len(a.mag))
+	fluxMean, fluxDev := meanDev(a.fluxHist)
+	bassMean, _ := meanDev(a.bassHist)
+	a.fluxHist[a.histPos], a.bassHist[a.histPos] = flux, bass
+	a.histPos = (a.histPos + 1) % historyHops
+
+	a.sinceBeat++
+	if bass > beatSensitivity*bassMean && bass > 1e-6 && a.sinceBeat >= minBeatHops {
+		a.features.Beat = true
+		a.sinceBeat = 0
+	}
+	a.features.Onset = clamp((flux - fluxMean - fluxDev) / (3*fluxDev + 1e-9))
+
+	// Mel bands, scaled to the loudest band heard recently
+	a.bandPeak = math.Max(a.bandPeak*peakDecay, minPeak)
+	for b, f := range a.filters {
+		level := 0.0
+		for i, w := range f.weights {
+			level += w * a.mag[f.first+i]
+		}
+		a.raw[b] = level
+		a.bandPeak = math.Max(a.bandPeak, level)
+	}
+	for b, level := range a.raw {
+		a.features.Bands[b] = smooth(a.features.Bands[b], level/a.bandPeak)
+	}
+
+	a.energyPeak = math.Max(math.Max(a.energyPeak*peakDecay, minPeak), rms)
+	a.features.RMS = rms
+	a.features.Energy = smooth(a.features.Energy, rms/a.energyPeak)
+}
+
+// smooth moves cur towards next, quickly when rising and slowly when falling.
+func smooth(cur, next float64) float64 {
+	if next > cur {
+		return cur + attack*(next-cur)
+	}
+	return cur + release*(next-cur)
+}
+
+func meanDev(values []float64) (mean, dev float64) {
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	for _, v := range values {
+		dev += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(dev / float64(len(values)))
+}
+
+func clamp(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// melFilters returns bands triangular filters spaced evenly on the mel scale
+// between min and max Hz. Every filter covers at least one bin.
+func melFilters(bands int, min, max float64) []melFilter {
+	mel := func(f float64) float64 { return 2595 * math.Log10(1+f/700) }
+	hz := func(m float64) float64 { return 700 * (math.Pow(10, m/2595) - 1) }
+	bin := func(f float64) float64 { return f * fftSize / SampleRate }
+
+	// Band b rises from edges[b] to edges[b+1] and falls to edges[b+2]
+	edges := make([]float64, bands+2)
+	lo, hi := mel(min), mel(max)
+	for i := range edges {
+		edges[i] = bin(hz(lo + (hi-lo)*float64(i)/float64(bands+1)))
+	}
+	filters := make([]melFilter, bands)
+	for b := range filters {
+		left, center, right := edges[b], edges[b+1], edges[b+2]
+		first := int(math.Ceil(left))
+		last := int(math.Floor(right))
+		if last < first {
+			// Narrower than a bin at low frequencies
+			first, last = int(math.Round(center)), int(math.Round(center))
+		}
+		f := melFilter{first: first}
+		for k := first; k <= last; k++ {
+			w := 1.0
+			switch {
+			case float64(k) < center:
+				w = (float64(k) - left) / (center - left)
+			case float64(k) > center:
+				w = (right - float64(k)) / (right - center)
+			}
+			f.weights = append(f.weights, math.Max(w, 0))
+		}
+		if sum := sumOf(f.weights); sum > 0 {
+			for i := range f.weights {
+				f.weights[i] /= sum
+			}
+		} else {
+			f.weights = []float64{1}
+		}
+		filters[b] = f
+	}
+	return filters
+}
+
+func sumOf(values []float64) (sum float64) {
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
@@ -0,0 +1,108 @@
+package audioreactive
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// pcm returns seconds of stereo PCM with both channels set by sample, which
+// is given the time in seconds.
+func pcm(seconds float64, sample func(t float64) float64) []byte {
+	n := int(seconds * SampleRate)
+	out := make([]byte, 4*n)
+	for i := 0; i < n; i++ {
+		v := int16(32767 * sample(float64(i)/SampleRate))
+		binary.LittleEndian.PutUint16(out[4*i:], uint16(v))
+		binary.LittleEndian.PutUint16(out[4*i+2:], uint16(v))
+	}
+	return out
+}
+
+func sine(freq, amplitude float64) func(float64) float64 {
+	return func(t float64) float64 { return amplitude * math.Sin(2*math.Pi*freq*t) }
+}
+
+func TestFFT(t *testing.T) {
+	f := newFFT(64)
+	re, im := make([]float64, 64), make([]float64, 64)
+	for i := range re {
+		re[i] = math.Cos(2 * math.Pi * 5 * float64(i) / 64)
+	}
+	f.transform(re, im)
+	for k := 0; k < 32; k++ {
+		mag := math.Hypot(re[k], im[k])
+		if k == 5 && math.Abs(mag-32) > 1e-9 {
+			t.Fatalf("Got magnitude %f at bin 5, want 32\n", mag)
+		}
+		if k != 5 && mag > 1e-9 {
+			t.Fatalf("Got magnitude %f at bin %d, want 0\n", mag, k)
+		}
+	}
+}
+
+func TestAnalyzerBands(t *testing.T) {
+	a := NewAnalyzer(DefaultBands)
+	// Odd chunk sizes split frames across writes
+	data := pcm(0.5, sine(1000, 0.5))
+	for len(data) > 0 {
+		n := 1001
+		if n > len(data) {
+			n = len(data)
+		}
+		a.Write(data[:n])
+		data = data[n:]
+	}
+	f := a.Features()
+	loudest := 0
+	for b, level := range f.Bands {
+		if level > f.Bands[loudest] {
+			loudest = b
+		}
+	}
+	filter := a.filters[loudest]
+	lo := float64(filter.first) * SampleRate / fftSize
+	hi := float64(filter.first+len(filter.weights)-1) * SampleRate / fftSize
+	if lo > 1000 || hi < 1000 {
+		t.Fatalf("Loudest band %d covers %.0f to %.0f Hz, want it to cover 1000 Hz\n", loudest, lo, hi)
+	}
+	if math.Abs(f.RMS-0.5/math.Sqrt2) > 0.01 || f.Energy < 0.9 {
+		t.Fatalf("Got RMS %f and energy %f for a steady sine\n", f.RMS, f.Energy)
+	}
+
+	a.Write(pcm(1, func(float64) float64 { return 0 }))
+	if f := a.Features(); f.Energy > 0.01 || f.Bands[loudest] > 0.01 {
+		t.Fatalf("Levels did not fall with silence: energy %f, band %f\n", f.Energy, f.Bands[loudest])
+	}
+}
+
+func TestAnalyzerBeats(t *testing.T) {
+	a := NewAnalyzer(DefaultBands)
+	// A 60 Hz kick lasting 80ms every half second, over quiet hi-hats
+	kick := func(t float64) float64 {
+		v := 0.02 * math.Sin(2*math.Pi*8000*t)
+		if math.Mod(t, 0.5) < 0.08 {
+			v += 0.8 * math.Sin(2*math.Pi*60*t)
+		}
+		return v
+	}
+	data := pcm(4, kick)
+	beats := 0
+	chunk := 4 * hopSize
+	for i := 0; i < len(data); i += chunk {
+		a.Write(data[i:minInt(i+chunk, len(data))])
+		if a.Features().Beat {
+			beats++
+		}
+	}
+	if beats < 7 || beats > 8 {
+		t.Fatalf("Detected %d beats in 8 kicks\n", beats)
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
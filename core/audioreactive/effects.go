@@ -0,0 +1,180 @@
+package audioreactive
+
+import (
+	"fmt"
+	"hyperkit/core/realtime"
+	"math"
+	"time"
+)
+
+// Effect renders analysed audio into frames of pixels. Effects keep state
+// between frames, so every output needs its own.
+type Effect interface {
+	// Render draws the frame for f; dt is the time since the previous
+	// frame.
+	Render(frame []realtime.RGB, f Features, dt time.Duration)
+}
+
+// effects are the available effects by name, in the order they are listed.
+// HyperKit numbers its effect presets in this order, so new effects go last.
+var effects = []struct {
+	name string
+	new  func() Effect
+}{
+	{"Spectrum", func() Effect { return new(spectrum) }},
+	{"Energy Pulse", func() Effect { return new(energyPulse) }},
+	{"Beat Flash", func() Effect { return new(beatFlash) }},
+	{"Scroll", func() Effect { return new(scroll) }},
+}
+
+// Effects returns the names of the available effects.
+func Effects() []string {
+	names := make([]string, len(effects))
+	for i, e := range effects {
+		names[i] = e.name
+	}
+	return names
+}
+
+// NewEffect returns a new instance of the named effect.
+func NewEffect(name string) (Effect, error) {
+	for _, e := range effects {
+		if e.name == name {
+			return e.new(), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown effect %q", name)
+}
+
+// spectrum spreads the bands over the strip, low frequencies first, each
+// lit as bright as its level in a rainbow from red to violet.
+type spectrum struct{}
+
+func (spectrum) Render(frame []realtime.RGB, f Features, _ time.Duration) {
+	for i := range frame {
+		pos := float64(i) / float64(len(frame))
+		frame[i] = hsv(pos*0.8, 1, bandAt(f.Bands, pos))
+	}
+}
+
+// energyPulse fills the strip from its center outwards as far as the energy
+// reaches, shifting from red for bass-heavy to blue for bright sounds.
+type energyPulse struct {
+	level float64
+}
+
+func (e *energyPulse) Render(frame []realtime.RGB, f Features, dt time.Duration) {
+	e.level = follow(e.level, f.Energy, dt, 60*time.Millisecond)
+	hue := 0.66 * balance(f.Bands)
+	center := float64(len(frame)-1) / 2
+	reach := e.level * (center + 1)
+	for i := range frame {
+		d := math.Abs(float64(i) - center)
+		frame[i] = hsv(hue, 1, clamp(reach-d))
+	}
+}
+
+// beatFlash flashes the whole strip on every beat, in the next color of a
+// rotating hue, and lets it fade out.
+type beatFlash struct {
+	hue, level float64
+}
+
+func (b *beatFlash) Render(frame []realtime.RGB, f Features, dt time.Duration) {
+	if f.Beat {
+		b.hue = math.Mod(b.hue+0.17, 1)
+		b.level = 1
+	} else {
+		b.level *= math.Pow(0.5, dt.Seconds()/0.12)
+	}
+	c := hsv(b.hue, 1, b.level)
+	for i := range frame {
+		frame[i] = c
+	}
+}
+
+// scroll moves the strip along by one pixel per frame and adds the current
+// sound at the start, with the bass as red, mids as green and highs as blue.
+type scroll struct{}
+
+func (scroll) Render(frame []realtime.RGB, f Features, _ time.Duration) {
+	if len(frame) == 0 {
+		return
+	}
+	copy(frame[1:], frame)
+	third := len(f.Bands) / 3
+	frame[0] = realtime.RGB{
+		R: level(mean(f.Bands[:third])),
+		G: level(mean(f.Bands[third : 2*third])),
+		B: level(mean(f.Bands[2*third:])),
+	}
+}
+
+// bandAt interpolates the band level at pos between 0 and 1.
+func bandAt(bands []float64, pos float64) float64 {
+	if len(bands) == 0 {
+		return 0
+	}
+	x := pos * float64(len(bands)-1)
+	i := int(x)
+	if i >= len(bands)-1 {
+		return bands[len(bands)-1]
+	}
+	frac := x - float64(i)
+	return bands[i]*(1-frac) + bands[i+1]*frac
+}
+
+// balance returns where the weight of the bands lies, from 0 for all bass to
+// 1 for all treble.
+func balance(bands []float64) float64 {
+	total, weighted := 0.0, 0.0
+	for i, b := range bands {
+		total += b
+		weighted += b * float64(i)
+	}
+	if total == 0 || len(bands) < 2 {
+		return 0
+	}
+	return weighted / total / float64(len(bands)-1)
+}
+
+// follow moves cur towards target at the speed given by the time constant
+// tau, independent of the frame rate.
+func follow(cur, target float64, dt, tau time.Duration) float64 {
+	return cur + (target-cur)*(1-math.Exp(-dt.Seconds()/tau.Seconds()))
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	return sumOf(values) / float64(len(values))
+}
+
+func level(v float64) uint8 {
+	return uint8(math.Round(255 * clamp(v)))
+}
+
+// hsv converts a color with hue, saturation and value between 0 and 1.
+func hsv(h, s, v float64) realtime.RGB {
+	h = math.Mod(h, 1) * 6
+	c := v * s
+	x := c * (1 - math.Abs(math.Mod(h, 2)-1))
+	var r, g, b float64
+	switch int(h) {
+	case 0:
+		r, g = c, x
+	case 1:
+		r, g = x, c
+	case 2:
+		g, b = c, x
+	case 3:
+		g, b = x, c
+	case 4:
+		r, b = x, c
+	default:
+		r, b = c, x
+	}
+	m := v - c
+	return realtime.RGB{R: level(r + m), G: level(g + m), B: level(b + m)}
+}
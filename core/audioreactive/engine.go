@@ -0,0 +1,231 @@
+// Package audioreactive renders music-synchronised effects in process, as a
+// lighter alternative to LedFX. An Analyzer turns PCM into band levels,
+// energy, onsets and beats, an Effect turns those into pixels, and an Engine
+// streams the pixels to WLED with the realtime package.
+package audioreactive
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hyperkit/core/lifecycle"
+	"hyperkit/core/realtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultBands is the number of mel bands the engine analyses.
+	DefaultBands = 24
+
+	// audioQueue is how many PCM packets may wait for analysis; more are
+	// dropped rather than holding up playback.
+	audioQueue = 32
+	// idleAfter is how long without audio the engine renders silence, so
+	// effects fade out when playback stops.
+	idleAfter = 100 * time.Millisecond
+)
+
+// Engine plays one effect at a time from the PCM written to it. It
+// implements lifecycle.Service; effects only play while it runs.
+type Engine struct {
+	analyzer *Analyzer
+	audio    chan []byte
+	// lastAudio is when PCM was last written, in Unix nanoseconds, and
+	// active is 1 while an effect plays.
+	lastAudio int64
+	active    uint32
+	silence   []byte
+
+	status lifecycle.Status
+	group  *lifecycle.Group
+
+	mu      sync.Mutex
+	stop    chan struct{}
+	playing *playback
+}
+
+// playback is an effect streaming to an output.
+type playback struct {
+	name   string
+	output *realtime.Output
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewEngine returns an engine that analyses DefaultBands bands.
+func NewEngine() *Engine {
+	e := &Engine{
+		analyzer: NewAnalyzer(DefaultBands),
+		audio:    make(chan []byte, audioQueue),
+		silence:  make([]byte, 4*hopSize),
+	}
+	e.group = lifecycle.NewGroup(&e.status)
+	return e
+}
+
+func (e *Engine) Start(context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stop != nil {
+		return nil
+	}
+	e.stop = make(chan struct{})
+	stop := e.stop
+	e.group.Go("audio analysis", func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case pcm := <-e.audio:
+				_, _ = e.analyzer.Write(pcm)
+			}
+		}
+	})
+	e.status.Set(lifecycle.Running, nil)
+	return nil
+}
+
+// Stop stops the effect that plays, if any, and the analysis.
+func (e *Engine) Stop(ctx context.Context) error {
+	e.status.Set(lifecycle.Stopping, nil)
+	err := e.Off(ctx)
+	e.mu.Lock()
+	stop := e.stop
+	e.stop = nil
+	e.mu.Unlock()
+	if stop != nil {
+		close(stop)
+	}
+	if waitErr := e.group.Wait(ctx); err == nil {
+		err = waitErr
+	}
+	e.status.Set(lifecycle.Stopped, nil)
+	return err
+}
+
+// Health is the health of the engine, or of the output while an effect plays
+// and the output is not running.
+func (e *Engine) Health() lifecycle.Health {
+	h := e.status.Health()
+	e.mu.Lock()
+	p := e.playing
+	e.mu.Unlock()
+	if h.State == lifecycle.Running && p != nil {
+		if out := p.output.Health(); out.State != lifecycle.Running {
+			return out
+		}
+	}
+	return h
+}
+
+// Write queues pcm, interleaved 16-bit little-endian stereo at SampleRate,
+// for analysis. It never blocks; pcm is dropped while no effect plays or the
+// analysis falls behind.
+func (e *Engine) Write(pcm []byte) (int, error) {
+	if atomic.LoadUint32(&e.active) == 0 {
+		return len(pcm), nil
+	}
+	atomic.StoreInt64(&e.lastAudio, time.Now().UnixNano())
+	select {
+	case e.audio <- append([]byte(nil), pcm...):
+	default:
+	}
+	return len(pcm), nil
+}
+
+// Playing returns the name of the effect that plays, or "" if none does.
+func (e *Engine) Playing() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.playing == nil {
+		return ""
+	}
+	return e.playing.name
+}
+
+// Play switches to the named effect, streamed with opts. The effect that
+// played before is stopped first.
+func (e *Engine) Play(name string, opts realtime.Options) error {
+	effect, err := NewEffect(name)
+	if err != nil {
+		return err
+	}
+	output, err := realtime.NewOutput(opts)
+	if err != nil {
+		return fmt.Errorf("error creating realtime output: %w", err)
+	}
+	// Starting the output only opens a UDP socket
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.Off(ctx); err != nil {
+		log.Warnf("Error stopping effect: %v\n", err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stop == nil {
+		return fmt.Errorf("effect engine is not running")
+	}
+	if err := output.Start(ctx); err != nil {
+		return err
+	}
+	p := &playback{name: name, output: output, stop: make(chan struct{}), done: make(chan struct{})}
+	e.playing = p
+	atomic.StoreUint32(&e.active, 1)
+	fps := opts.FPS
+	if fps <= 0 {
+		fps = realtime.DefaultFPS
+	}
+	e.group.Go("effect "+name, func() {
+		defer close(p.done)
+		e.render(p, effect, time.Second/time.Duration(fps))
+	})
+	log.Infof("Playing audio effect %s on %s\n", name, opts.Host)
+	return nil
+}
+
+// Off stops the effect that plays, if any. WLED goes back to its own effects
+// once its realtime timeout passes.
+func (e *Engine) Off(ctx context.Context) error {
+	e.mu.Lock()
+	p := e.playing
+	e.playing = nil
+	atomic.StoreUint32(&e.active, 0)
+	e.mu.Unlock()
+	if p == nil {
+		return nil
+	}
+	close(p.stop)
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return fmt.Errorf("error stopping effect %s: %w", p.name, ctx.Err())
+	}
+	log.Infof("Stopped audio effect %s\n", p.name)
+	return p.output.Stop(ctx)
+}
+
+// render draws a frame every interval until p is stopped.
+func (e *Engine) render(p *playback, effect Effect, interval time.Duration) {
+	frame := make([]realtime.RGB, p.output.Pixels())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, atomic.LoadInt64(&e.lastAudio))) > idleAfter {
+				_, _ = e.analyzer.Write(e.silence)
+			}
+			effect.Render(frame, e.analyzer.Features(), now.Sub(last))
+			last = now
+			if err := p.output.Send(frame); err != nil {
+				log.Debugf("Error sending frame of effect %s: %v\n", p.name, err)
+			}
+		}
+	}
+}
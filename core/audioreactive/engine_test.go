@@ -0,0 +1,94 @@
+package audioreactive
+
+import (
+	"context"
+	"hyperkit/core/realtime"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEffects(t *testing.T) {
+	if _, err := NewEffect("Disco"); err == nil {
+		t.Fatalf("Expected an unknown effect to be rejected\n")
+	}
+	bass := Features{Bands: make([]float64, DefaultBands), Energy: 1, Beat: true}
+	bass.Bands[0], bass.Bands[1] = 1, 1
+	for _, name := range Effects() {
+		effect, err := NewEffect(name)
+		if err != nil {
+			t.Fatalf("Error creating effect %s: %v\n", name, err)
+		}
+		frame := make([]realtime.RGB, 30)
+		effect.Render(frame, bass, 16*time.Millisecond)
+		if !lit(frame) {
+			t.Fatalf("Effect %s left the strip dark for loud bass\n", name)
+		}
+		silence := Features{Bands: make([]float64, DefaultBands)}
+		for i := 0; i < 100; i++ {
+			effect.Render(frame, silence, 16*time.Millisecond)
+		}
+		if lit(frame) {
+			t.Fatalf("Effect %s left the strip lit after silence: %v\n", name, frame)
+		}
+	}
+
+	// The spectrum shows bass at the start of the strip only
+	frame := make([]realtime.RGB, 30)
+	new(spectrum).Render(frame, bass, 0)
+	if frame[29] != (realtime.RGB{}) {
+		t.Fatalf("Spectrum lit the treble end for bass: %v\n", frame[29])
+	}
+}
+
+func lit(frame []realtime.RGB) bool {
+	for _, p := range frame {
+		if p != (realtime.RGB{}) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEngine(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v\n", err)
+	}
+	defer l.Close()
+	opts := realtime.Options{Host: l.LocalAddr().String(), Protocol: realtime.DDP, LEDCount: 10}
+
+	e := NewEngine()
+	if err := e.Play("Spectrum", opts); err == nil {
+		t.Fatalf("Expected Play to fail before Start\n")
+	}
+	ctx := context.Background()
+	if err := e.Start(ctx); err != nil {
+		t.Fatalf("Error starting engine: %v\n", err)
+	}
+	defer e.Stop(ctx)
+	if err := e.Play("Beat Flash", opts); err != nil {
+		t.Fatalf("Error playing effect: %v\n", err)
+	}
+	if e.Playing() != "Beat Flash" {
+		t.Fatalf("Got playing effect %q, want Beat Flash\n", e.Playing())
+	}
+	e.Write(pcm(0.5, sine(60, 0.8)))
+
+	buf := make([]byte, 1500)
+	_ = l.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := l.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Error reading frame: %v\n", err)
+	}
+	if n != 10+3*10 {
+		t.Fatalf("Got a packet of %d bytes, want a DDP packet of 10 LEDs\n", n)
+	}
+
+	if err := e.Off(ctx); err != nil {
+		t.Fatalf("Error stopping effect: %v\n", err)
+	}
+	if e.Playing() != "" {
+		t.Fatalf("Effect %q still plays after Off\n", e.Playing())
+	}
+}
@@ -0,0 +1,53 @@
+package audioreactive
+
+import (
+	"math"
+	"math/bits"
+)
+
+// fft is an in-place radix-2 FFT of a fixed size, with the twiddle factors
+// and bit reversal precomputed.
+type fft struct {
+	n        int
+	cos, sin []float64
+	rev      []int
+}
+
+func newFFT(n int) *fft {
+	if n <= 0 || n&(n-1) != 0 {
+		panic("FFT size must be a power of 2")
+	}
+	f := &fft{n: n, cos: make([]float64, n/2), sin: make([]float64, n/2), rev: make([]int, n)}
+	for i := range f.cos {
+		f.cos[i] = math.Cos(2 * math.Pi * float64(i) / float64(n))
+		f.sin[i] = -math.Sin(2 * math.Pi * float64(i) / float64(n))
+	}
+	shift := bits.UintSize - bits.Len(uint(n-1))
+	for i := range f.rev {
+		f.rev[i] = int(bits.Reverse(uint(i)) >> shift)
+	}
+	return f
+}
+
+// transform replaces re and im, both of length n, with their DFT.
+func (f *fft) transform(re, im []float64) {
+	for i, j := range f.rev {
+		if i < j {
+			re[i], re[j] = re[j], re[i]
+			im[i], im[j] = im[j], im[i]
+		}
+	}
+	for size := 2; size <= f.n; size <<= 1 {
+		half, step := size/2, f.n/size
+		for start := 0; start < f.n; start += size {
+			for k := 0; k < half; k++ {
+				wr, wi := f.cos[k*step], f.sin[k*step]
+				a, b := start+k, start+k+half
+				tr := re[b]*wr - im[b]*wi
+				ti := re[b]*wi + im[b]*wr
+				re[b], im[b] = re[a]-tr, im[a]-ti
+				re[a], im[a] = re[a]+tr, im[a]+ti
+			}
+		}
+	}
+}
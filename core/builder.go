@@ -1,28 +1,40 @@
 package core
 
 import (
-	"fmt"
+	"hyperkit/core/util"
+	"hyperkit/core/wled"
 )
 
-func buildPresetJson(id int) []byte {
-	return []byte(fmt.Sprintf(`{"ps":%d}`, id))
+func buildPresetState(id int) *wled.State {
+	return &wled.State{Preset: wled.Int(id)}
 }
-func buildSpeedJson(speed uint8) []byte {
-	return []byte(fmt.Sprintf(`{"seg":[{"id":0,"sx":%d}]}`, speed))
+
+func buildSpeedState(speed uint8) *wled.State {
+	return &wled.State{Segments: []wled.Segment{{ID: wled.Int(0), Speed: wled.Int(int(speed))}}}
 }
-func buildBrightnessJson(brightness uint8) []byte {
-	return []byte(fmt.Sprintf("{\"on\":true,\"bri\":%d}", brightness))
+
+func buildBrightnessState(brightness uint8) *wled.State {
+	return &wled.State{On: wled.PowerPtr(wled.PowerOn), Brightness: wled.Int(int(brightness))}
 }
 
-type StateSegment struct {
-	StateSegmentTop State `json:"state"`
+func buildPowerState(on bool) *wled.State {
+	power := wled.PowerOff
+	if on {
+		power = wled.PowerOn
+	}
+	return &wled.State{On: wled.PowerPtr(power), Verbose: wled.Bool(true)}
 }
 
-type State struct {
-	Bri int       `json:"bri,omitempty"`
-	Seg []Segment `json:"seg,omitempty"`
+func buildColorState(r, g, b int) *wled.State {
+	return &wled.State{
+		On:       wled.PowerPtr(wled.PowerOn),
+		Segments: []wled.Segment{{ID: wled.Int(0), Effect: wled.Int(0), Colors: []wled.Color{{r, g, b}}}},
+	}
 }
-type Segment struct {
-	Sx  int `json:"sx,omitempty"`
-	Bri int `json:"bri,omitempty"`
+
+func buildColorTemperatureState(kelvin int) *wled.State {
+	r, g, b := util.KelvinToRGB(kelvin)
+	st := buildColorState(r, g, b)
+	st.Segments[0].CCT = wled.Int(kelvin)
+	return st
 }
@@ -0,0 +1,550 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"hyperkit/core/airplayserver"
+	"hyperkit/core/realtime"
+	"hyperkit/core/util"
+	"hyperkit/core/wled"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultConfigPath is where the config file is read from unless -config is
+// given.
+const DefaultConfigPath = "/etc/hyperkit.conf"
+
+// EnvPrefix prefixes the environment variables that override config file
+// keys, e.g. HYPERKIT_WLED_IP overrides wled_ip.
+const EnvPrefix = "HYPERKIT_"
+
+type Config struct {
+	WledIP string `yaml:"wled_ip,omitempty"`
+	// WledMAC and WledMDNSName find the controller over mDNS, so wled_ip
+	// can be left out or go stale when DHCP hands out another address.
+	WledMAC      string `yaml:"wled_mac,omitempty"`
+	WledMDNSName string `yaml:"wled_mdns_name,omitempty"`
+	// WledName names the controller at wled_ip in groups and events.
+	// Defaults to "HyperCube".
+	WledName string `yaml:"wled_name,omitempty"`
+	// WledDevices are further WLED controllers, each with its own
+	// accessories under the same bridge.
+	WledDevices []WledDevice `yaml:"wled_devices,omitempty"`
+	// WledGroups control several controllers together.
+	WledGroups []WledGroup `yaml:"wled_groups,omitempty"`
+
+	DefaultSolid      bool  `yaml:"use_default_solid,omitempty"`
+	DefaultSpeed      uint8 `yaml:"default_speed,omitempty"`
+	DefaultBrightness uint8 `yaml:"default_brightness,omitempty"`
+	Debug             bool  `yaml:"debug_logging,omitempty"`
+	// MetricsEnabled serves Prometheus metrics on :6060/metrics.
+	MetricsEnabled    bool   `yaml:"metrics_enabled,omitempty"`
+	LogFile           string `yaml:"logfile,omitempty"`
+	BtDeviceName      string `yaml:"bluetooth_device,omitempty"`
+	AirPlayName       string `yaml:"airplay_name,omitempty"`
+	AudioPipePath     string `yaml:"audio_pipe_path,omitempty"`
+	WledQueueCommands bool   `yaml:"wled_queue_commands,omitempty"`
+	// DisableOutletSelectors removes the legacy grid of speed and brightness
+	// outlets in favour of the Lightbulb and Fan accessories.
+	DisableOutletSelectors bool `yaml:"disable_outlet_selectors,omitempty"`
+	// PresetMode selects how presets are shown in HomeKit: one outlet per
+	// preset ("outlets") or the inputs of a Television ("television"). The
+	// television is only supported without wled_devices.
+	PresetMode string `yaml:"preset_mode,omitempty"`
+	// PresetSyncInterval is how often presets are re-read from WLED. Defaults
+	// to 5 minutes; a negative value disables periodic syncing.
+	PresetSyncInterval time.Duration `yaml:"preset_sync_interval,omitempty"`
+
+	// HomeKitPin is the 8 digit setup code, e.g. "696-94-200".
+	HomeKitPin string `yaml:"homekit_pin,omitempty"`
+	// HomeKitSetupID is the 4 character ID encoded in the setup QR code.
+	HomeKitSetupID string `yaml:"homekit_setup_id,omitempty"`
+	// HomeKitStoragePath is where pairings are stored. Defaults to the bridge
+	// name in the working directory.
+	HomeKitStoragePath string `yaml:"homekit_storage_path,omitempty"`
+	// HomeKitPort is the HAP port; 0 picks a free one.
+	HomeKitPort int    `yaml:"homekit_port,omitempty"`
+	BridgeName  string `yaml:"bridge_name,omitempty"`
+
+	// ShutdownTimeout bounds how long a graceful shutdown may take.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout,omitempty"`
+	// WledOffOnShutdown turns WLED off when HyperKit shuts down.
+	WledOffOnShutdown bool `yaml:"wled_off_on_shutdown,omitempty"`
+
+	// APIAddress is the address the HTTP API listens on, e.g. ":8080". The
+	// API is disabled if it is empty.
+	APIAddress string `yaml:"api_address,omitempty"`
+	// APIToken, if set, has to be sent as a bearer token to use the API.
+	APIToken string `yaml:"api_token,omitempty"`
+
+	// MQTTBroker is the MQTT broker to publish to Home Assistant through,
+	// e.g. "tcp://localhost:1883". MQTT is disabled if it is empty.
+	MQTTBroker   string `yaml:"mqtt_broker,omitempty"`
+	MQTTUsername string `yaml:"mqtt_username,omitempty"`
+	MQTTPassword string `yaml:"mqtt_password,omitempty"`
+	// MQTTTopic prefixes HyperKit's state and command topics. Defaults to
+	// "hyperkit".
+	MQTTTopic string `yaml:"mqtt_topic,omitempty"`
+	// MQTTDiscoveryPrefix is Home Assistant's discovery prefix. Defaults to
+	// "homeassistant".
+	MQTTDiscoveryPrefix string `yaml:"mqtt_discovery_prefix,omitempty"`
+
+	// AudioEffects adds the built-in music effects to the presets of the
+	// controller at wled_ip. They react to the AirPlay audio without LedFX
+	// and are streamed to WLED over a realtime protocol.
+	AudioEffects bool `yaml:"audio_effects,omitempty"`
+	// EffectsProtocol is the realtime protocol effects are streamed over:
+	// "ddp", "e131" or "udp". Defaults to "ddp".
+	EffectsProtocol string `yaml:"effects_protocol,omitempty"`
+	// EffectsFPS caps the frames per second of effects. Defaults to 60.
+	EffectsFPS int `yaml:"effects_fps,omitempty"`
+	// EffectsLEDCount is the number of LEDs on the strip; 0 asks WLED.
+	EffectsLEDCount int `yaml:"effects_led_count,omitempty"`
+	// EffectsSegments lay effects out on runs of LEDs, one after the other.
+	// Without them, effects cover the whole strip.
+	EffectsSegments []EffectSegment `yaml:"effects_segments,omitempty"`
+	// DisableLedFX leaves out the LedFX container and the audio pipe it
+	// reads, for setups that only use the built-in effects.
+	DisableLedFX bool `yaml:"disable_ledfx,omitempty"`
+
+	// AudioBuffer is how much decoded audio is held for the outputs, which
+	// each read it at their own pace. Defaults to 250ms.
+	AudioBuffer time.Duration `yaml:"audio_buffer,omitempty"`
+	// AudioOverrun is what an output that fell further behind than
+	// audio_buffer skips: "drop_oldest" or "skip_to_newest". Defaults to
+	// "drop_oldest".
+	AudioOverrun string `yaml:"audio_overrun,omitempty"`
+	// AudioUnderrun is what an output that ran out of audio plays: nothing
+	// ("wait") or silence ("insert_silence"). Defaults to "wait".
+	AudioUnderrun string `yaml:"audio_underrun,omitempty"`
+
+	// path and overrides are what the config was loaded from, for Reload.
+	path      string
+	overrides []func(*Config)
+}
+
+// WledDevice is a WLED controller in addition to the one at wled_ip. Like
+// that one, it is found at IP, over mDNS by MAC or MDNSName, or both.
+type WledDevice struct {
+	Name     string `yaml:"name" json:"name"`
+	IP       string `yaml:"ip,omitempty" json:"ip,omitempty"`
+	MAC      string `yaml:"mac,omitempty" json:"mac,omitempty"`
+	MDNSName string `yaml:"mdns_name,omitempty" json:"mdns_name,omitempty"`
+}
+
+// match returns what finds the controller over mDNS.
+func (dev WledDevice) match() wled.Match {
+	return wled.Match{Name: dev.MDNSName, MAC: dev.MAC}
+}
+
+// wledDevices returns the controller at wled_ip followed by wled_devices.
+func (config *Config) wledDevices() []WledDevice {
+	primary := WledDevice{Name: config.WledName, IP: config.WledIP, MAC: config.WledMAC, MDNSName: config.WledMDNSName}
+	return append([]WledDevice{primary}, config.WledDevices...)
+}
+
+// EffectSegment is a run of LEDs effects are shown on.
+type EffectSegment struct {
+	Start   int  `yaml:"start" json:"start"`
+	Length  int  `yaml:"length" json:"length"`
+	Reverse bool `yaml:"reverse,omitempty" json:"reverse,omitempty"`
+}
+
+// bufferOptions returns the options of the audio buffer.
+func (config *Config) bufferOptions() airplayserver.BufferOptions {
+	return airplayserver.BufferOptions{
+		Depth:    config.AudioBuffer,
+		Overrun:  airplayserver.OverrunPolicy(config.AudioOverrun),
+		Underrun: airplayserver.UnderrunPolicy(config.AudioUnderrun),
+	}
+}
+
+// WledGroup is a light and effect speed control that fan out to the named
+// controllers.
+type WledGroup struct {
+	Name    string   `yaml:"name" json:"name"`
+	Devices []string `yaml:"devices" json:"devices"`
+}
+
+// ConfigError is a config value that is missing or invalid.
+type ConfigError struct {
+	Key string
+	// Source is where the value came from: "file:line", the environment
+	// variable or "command line". It is the config file for missing values.
+	Source string
+	Err    error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Source == "" {
+		return fmt.Sprintf("%s: %v", e.Key, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %v", e.Source, e.Key, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// LoadConfig builds the config from, in increasing order of precedence, the
+// defaults, the YAML file at path, HYPERKIT_* environment variables and the
+// overrides, and validates the result. An empty path skips the file.
+func LoadConfig(path string, overrides ...func(*Config)) (*Config, error) {
+	config := new(Config)
+	sources := make(map[string]string)
+
+	if path != "" {
+		if err := config.readFile(path, sources); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.readEnv(sources); err != nil {
+		return nil, err
+	}
+	for _, override := range overrides {
+		before := config.values()
+		override(config)
+		for key, value := range config.values() {
+			if !reflect.DeepEqual(value, before[key]) {
+				sources[key] = "command line"
+			}
+		}
+	}
+
+	config.setDefaults()
+	if err := config.validate(path, sources); err != nil {
+		return nil, err
+	}
+	config.path, config.overrides = path, overrides
+	return config, nil
+}
+
+// Path returns the config file the config was loaded from.
+func (config *Config) Path() string {
+	return config.path
+}
+
+// Reload loads the config again from the same file, environment and
+// overrides.
+func (config *Config) Reload() (*Config, error) {
+	return LoadConfig(config.path, config.overrides...)
+}
+
+// typeErrorLine matches the "line N: " prefix of yaml.v3 errors.
+var typeErrorLine = regexp.MustCompile(`^line (\d+): `)
+
+func (config *Config) readFile(path string, sources map[string]string) error {
+	configBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %v", err)
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(configBytes, &root); err != nil {
+		return fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+	if len(root.Content) > 0 && root.Content[0].Kind == yaml.MappingNode {
+		mapping := root.Content[0].Content
+		for i := 0; i+1 < len(mapping); i += 2 {
+			sources[mapping[i].Value] = fmt.Sprintf("%s:%d", path, mapping[i].Line)
+		}
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(configBytes))
+	dec.KnownFields(true)
+	if err := dec.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return fmt.Errorf("error parsing config file %s: %v", path, err)
+		}
+		msgs := make([]string, 0, len(typeErr.Errors))
+		for _, msg := range typeErr.Errors {
+			msgs = append(msgs, typeErrorLine.ReplaceAllString(msg, path+":$1: "))
+		}
+		return fmt.Errorf("error parsing config file:\n  %s", strings.Join(msgs, "\n  "))
+	}
+	return nil
+}
+
+// configField is a Config field and the YAML key it is read from.
+type configField struct {
+	key   string
+	value reflect.Value
+}
+
+func (config *Config) fields() []configField {
+	v := reflect.ValueOf(config).Elem()
+	fields := make([]configField, 0, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		tag := v.Type().Field(i).Tag.Get("yaml")
+		key := strings.Split(tag, ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		fields = append(fields, configField{key: key, value: v.Field(i)})
+	}
+	return fields
+}
+
+func (config *Config) values() map[string]interface{} {
+	values := make(map[string]interface{})
+	for _, f := range config.fields() {
+		values[f.key] = f.value.Interface()
+	}
+	return values
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func (config *Config) readEnv(sources map[string]string) error {
+	for _, f := range config.fields() {
+		name := EnvPrefix + strings.ToUpper(f.key)
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(f.value, raw); err != nil {
+			return &ConfigError{Key: f.key, Source: name, Err: err}
+		}
+		sources[f.key] = name
+	}
+	return nil
+}
+
+func setField(field reflect.Value, raw string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", raw)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not an integer between %d and %d", raw, -1<<(field.Type().Bits()-1), 1<<(field.Type().Bits()-1)-1)
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not an integer between 0 and %d", raw, uint64(1)<<field.Type().Bits()-1)
+		}
+		field.SetUint(n)
+	default:
+		return fmt.Errorf("cannot be set from the environment")
+	}
+	return nil
+}
+
+func (config *Config) setDefaults() {
+	if config.DefaultSpeed == 0 {
+		config.DefaultSpeed = 127
+	}
+	if config.DefaultBrightness == 0 {
+		config.DefaultBrightness = 255
+	}
+	if config.LogFile == "" {
+		config.LogFile = "/var/log/hyperkit.log"
+	}
+	if config.AirPlayName == "" {
+		config.AirPlayName = "HyperKit-Audio"
+	}
+	if config.AudioPipePath == "" {
+		config.AudioPipePath = "/home/pi/ledfx/audio/stream"
+	}
+	if config.AudioBuffer == 0 {
+		config.AudioBuffer = airplayserver.DefaultBufferDepth
+	}
+	if config.AudioOverrun == "" {
+		config.AudioOverrun = string(airplayserver.OverrunDropOldest)
+	}
+	if config.AudioUnderrun == "" {
+		config.AudioUnderrun = string(airplayserver.UnderrunWait)
+	}
+	if config.WledName == "" {
+		config.WledName = "HyperCube"
+	}
+	if config.PresetMode == "" {
+		config.PresetMode = PresetModeOutlets
+	}
+	if config.PresetSyncInterval == 0 {
+		config.PresetSyncInterval = 5 * time.Minute
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = 15 * time.Second
+	}
+	if config.HomeKitPin == "" {
+		config.HomeKitPin = "69694200"
+	}
+	if config.HomeKitSetupID == "" {
+		config.HomeKitSetupID = "HOME"
+	}
+	config.HomeKitSetupID = strings.ToUpper(config.HomeKitSetupID)
+	if config.BridgeName == "" {
+		config.BridgeName = "HyperBridge"
+	}
+	if config.HomeKitStoragePath == "" {
+		// hc's default, which keeps existing pairings working
+		config.HomeKitStoragePath = config.BridgeName
+	}
+	if config.MQTTTopic == "" {
+		config.MQTTTopic = "hyperkit"
+	}
+	if config.MQTTDiscoveryPrefix == "" {
+		config.MQTTDiscoveryPrefix = "homeassistant"
+	}
+	if config.EffectsProtocol == "" {
+		config.EffectsProtocol = string(realtime.DDP)
+	}
+	if config.EffectsFPS == 0 {
+		config.EffectsFPS = realtime.DefaultFPS
+	}
+}
+
+var setupIDPattern = regexp.MustCompile(`^[0-9A-Z]{4}$`)
+
+func (config *Config) validate(path string, sources map[string]string) error {
+	invalid := func(key string, format string, args ...interface{}) error {
+		source, ok := sources[key]
+		if !ok {
+			source = path
+		}
+		return &ConfigError{Key: key, Source: source, Err: fmt.Errorf(format, args...)}
+	}
+
+	if config.WledIP == "" && config.WledMAC == "" && config.WledMDNSName == "" {
+		return invalid("wled_ip", "must be set unless wled_mac or wled_mdns_name is")
+	}
+	if config.WledMAC != "" {
+		if _, err := wled.NormalizeMAC(config.WledMAC); err != nil {
+			return invalid("wled_mac", "%v", err)
+		}
+	}
+	devices := map[string]bool{deviceKey(config.WledName): true}
+	for i, dev := range config.WledDevices {
+		switch {
+		case deviceKey(dev.Name) == "":
+			return invalid("wled_devices", "device %d: name must contain a letter or digit", i+1)
+		case dev.IP == "" && dev.match().Empty():
+			return invalid("wled_devices", "device %s: ip, mac or mdns_name must be set", dev.Name)
+		case devices[deviceKey(dev.Name)]:
+			return invalid("wled_devices", "device %s: name is used more than once", dev.Name)
+		}
+		if dev.MAC != "" {
+			if _, err := wled.NormalizeMAC(dev.MAC); err != nil {
+				return invalid("wled_devices", "device %s: %v", dev.Name, err)
+			}
+		}
+		devices[deviceKey(dev.Name)] = true
+	}
+	groups := make(map[string]bool)
+	for i, group := range config.WledGroups {
+		switch {
+		case deviceKey(group.Name) == "":
+			return invalid("wled_groups", "group %d: name must contain a letter or digit", i+1)
+		case groups[deviceKey(group.Name)] || devices[deviceKey(group.Name)]:
+			return invalid("wled_groups", "group %s: name is used more than once", group.Name)
+		case len(group.Devices) < 2:
+			return invalid("wled_groups", "group %s: must have at least 2 devices", group.Name)
+		}
+		groups[deviceKey(group.Name)] = true
+		for _, name := range group.Devices {
+			if !devices[deviceKey(name)] {
+				return invalid("wled_groups", "group %s: unknown device %q", group.Name, name)
+			}
+		}
+	}
+	if config.BtDeviceName == "" {
+		return invalid("bluetooth_device", "must be set")
+	}
+	for key, opts := range map[string]airplayserver.BufferOptions{
+		"audio_buffer":   {Depth: config.AudioBuffer},
+		"audio_overrun":  {Overrun: airplayserver.OverrunPolicy(config.AudioOverrun)},
+		"audio_underrun": {Underrun: airplayserver.UnderrunPolicy(config.AudioUnderrun)},
+	} {
+		if err := opts.Validate(); err != nil {
+			return invalid(key, "%v", err)
+		}
+	}
+	switch config.PresetMode {
+	case PresetModeOutlets, PresetModeTelevision:
+	default:
+		return invalid("preset_mode", "must be either %q or %q, got %q", PresetModeOutlets, PresetModeTelevision, config.PresetMode)
+	}
+	// The Home app shows only one television bridged by a bridge
+	if config.PresetMode == PresetModeTelevision && len(config.WledDevices) > 0 {
+		return invalid("preset_mode", "%q supports only the controller at wled_ip, remove wled_devices or use %q", PresetModeTelevision, PresetModeOutlets)
+	}
+	if _, err := util.ParsePin(config.HomeKitPin); err != nil {
+		return invalid("homekit_pin", "%v", err)
+	}
+	if !setupIDPattern.MatchString(config.HomeKitSetupID) {
+		return invalid("homekit_setup_id", "must be 4 letters or digits, got %q", config.HomeKitSetupID)
+	}
+	if config.HomeKitPort < 0 || config.HomeKitPort > 65535 {
+		return invalid("homekit_port", "must be between 0 and 65535, got %d", config.HomeKitPort)
+	}
+	if config.APIAddress != "" {
+		if _, _, err := net.SplitHostPort(config.APIAddress); err != nil {
+			return invalid("api_address", "%v", err)
+		}
+	}
+	if config.MQTTBroker != "" {
+		u, err := url.Parse(config.MQTTBroker)
+		if err != nil {
+			return invalid("mqtt_broker", "%v", err)
+		}
+		switch u.Scheme {
+		case "tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss":
+		default:
+			return invalid("mqtt_broker", "must be a tcp://, ssl://, ws:// or wss:// URL, got %q", config.MQTTBroker)
+		}
+	}
+	for key, topic := range map[string]string{"mqtt_topic": config.MQTTTopic, "mqtt_discovery_prefix": config.MQTTDiscoveryPrefix} {
+		if strings.ContainsAny(topic, "+#") {
+			return invalid(key, "must not contain wildcards, got %q", topic)
+		}
+	}
+	if _, err := realtime.ParseProtocol(config.EffectsProtocol); err != nil {
+		return invalid("effects_protocol", "%v", err)
+	}
+	if config.EffectsFPS < 1 || config.EffectsFPS > 250 {
+		return invalid("effects_fps", "must be between 1 and 250, got %d", config.EffectsFPS)
+	}
+	if config.EffectsLEDCount < 0 {
+		return invalid("effects_led_count", "must not be negative, got %d", config.EffectsLEDCount)
+	}
+	for i, seg := range config.EffectsSegments {
+		switch {
+		case seg.Start < 0:
+			return invalid("effects_segments", "segment %d: start must not be negative, got %d", i+1, seg.Start)
+		case seg.Length <= 0:
+			return invalid("effects_segments", "segment %d: length must be positive, got %d", i+1, seg.Length)
+		case config.EffectsLEDCount > 0 && seg.Start+seg.Length > config.EffectsLEDCount:
+			return invalid("effects_segments", "segment %d: ends after the %d LEDs of effects_led_count", i+1, config.EffectsLEDCount)
+		}
+	}
+	return nil
+}
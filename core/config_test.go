@@ -0,0 +1,243 @@
+package core
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// baseConfig sets the keys without a default.
+const baseConfig = "wled_ip: 10.0.0.2\nbluetooth_device: Speaker\n"
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "hyperkit.conf")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Error writing config: %v\n", err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		file     string
+		env      map[string]string
+		override func(*Config)
+		key      string
+		want     interface{}
+	}{
+		{name: "default", key: "wled_name", want: "HyperCube"},
+		{name: "file", file: "wled_name: Desk\n", key: "wled_name", want: "Desk"},
+		{
+			name: "env over file", file: "wled_name: Desk\n",
+			env: map[string]string{"HYPERKIT_WLED_NAME": "Shelf"},
+			key: "wled_name", want: "Shelf",
+		},
+		{
+			name: "flag over env", file: "wled_name: Desk\n",
+			env:      map[string]string{"HYPERKIT_WLED_NAME": "Shelf"},
+			override: func(c *Config) { c.WledName = "Flag" },
+			key:      "wled_name", want: "Flag",
+		},
+		{
+			name: "env duration", env: map[string]string{"HYPERKIT_PRESET_SYNC_INTERVAL": "1m"},
+			key: "preset_sync_interval", want: time.Minute,
+		},
+		{
+			name: "env bool", env: map[string]string{"HYPERKIT_DEBUG_LOGGING": "true"},
+			key: "debug_logging", want: true,
+		},
+		{
+			name: "env uint8", file: "default_speed: 10\n", env: map[string]string{"HYPERKIT_DEFAULT_SPEED": "20"},
+			key: "default_speed", want: uint8(20),
+		},
+		{
+			name: "setup ID upper-cased", file: "homekit_setup_id: ab12\n",
+			key: "homekit_setup_id", want: "AB12",
+		},
+		{
+			name: "storage path defaults to bridge name", file: "bridge_name: Bridge\n",
+			key: "homekit_storage_path", want: "Bridge",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			var overrides []func(*Config)
+			if tt.override != nil {
+				overrides = append(overrides, tt.override)
+			}
+			config, err := LoadConfig(writeConfig(t, baseConfig+tt.file), overrides...)
+			if err != nil {
+				t.Fatalf("Error loading config: %v\n", err)
+			}
+			if got := config.values()[tt.key]; got != tt.want {
+				t.Fatalf("%s is %v, want %v\n", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigWithoutFile(t *testing.T) {
+	t.Setenv("HYPERKIT_WLED_IP", "10.0.0.2")
+	t.Setenv("HYPERKIT_BLUETOOTH_DEVICE", "Speaker")
+	config, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("Error loading config from the environment: %v\n", err)
+	}
+	if config.WledIP != "10.0.0.2" || config.Path() != "" {
+		t.Fatalf("Unexpected config %+v\n", config)
+	}
+}
+
+func TestLoadConfigParseErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		file string
+		want []string
+	}{
+		{
+			name: "unknown key",
+			file: baseConfig + "wled_ipp: 10.0.0.3\n",
+			want: []string{":3: field wled_ipp not found"},
+		},
+		{
+			name: "bad types",
+			file: baseConfig + "default_speed: fast\nwled_name: Desk\nhomekit_port: [1]\n",
+			want: []string{":3: cannot unmarshal", ":5: cannot unmarshal"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, tt.file)
+			_, err := LoadConfig(path)
+			if err == nil {
+				t.Fatalf("Expected an error\n")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Fatalf("Error %q does not contain %q\n", err, want)
+				}
+			}
+			if strings.Contains(err.Error(), "line ") {
+				t.Fatalf("Error %q still has yaml's line numbers\n", err)
+			}
+		})
+	}
+	if _, err := LoadConfig(writeConfig(t, "wled_ip: [10.0.0.2\n")); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Fatalf("Invalid YAML returned %v\n", err)
+	}
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.conf")); err == nil {
+		t.Fatalf("Expected a missing config file to fail\n")
+	}
+}
+
+func TestLoadConfigEnvErrors(t *testing.T) {
+	for _, tt := range []struct {
+		env, value, key string
+	}{
+		{"HYPERKIT_DEFAULT_SPEED", "300", "default_speed"},
+		{"HYPERKIT_HOMEKIT_PORT", "port", "homekit_port"},
+		{"HYPERKIT_DEBUG_LOGGING", "maybe", "debug_logging"},
+		{"HYPERKIT_SHUTDOWN_TIMEOUT", "15", "shutdown_timeout"},
+		{"HYPERKIT_WLED_DEVICES", "desk", "wled_devices"},
+	} {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv(tt.env, tt.value)
+			_, err := LoadConfig(writeConfig(t, baseConfig))
+			var configErr *ConfigError
+			if !errors.As(err, &configErr) || configErr.Key != tt.key || configErr.Source != tt.env {
+				t.Fatalf("Loading %s=%s returned %v, want an error for %s from %s\n", tt.env, tt.value, err, tt.key, tt.env)
+			}
+		})
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// file is added to baseConfig, without the keys in omit. Its first
+		// line is line 3, or 2 with one key omitted.
+		file string
+		omit []string
+		key  string
+		// line is where the value is, 0 for missing values.
+		line int
+	}{
+		{name: "wled_ip missing", omit: []string{"wled_ip"}, key: "wled_ip"},
+		{name: "wled_mac", file: "wled_mac: zz\n", key: "wled_mac", line: 3},
+		{name: "device without name", file: "wled_devices:\n  - name: '-'\n    ip: 10.0.0.3\n", key: "wled_devices", line: 3},
+		{name: "device without address", file: "wled_devices:\n  - name: Desk\n", key: "wled_devices", line: 3},
+		{name: "device named like wled_name", file: "wled_devices:\n  - name: hypercube\n    ip: 10.0.0.3\n", key: "wled_devices", line: 3},
+		{name: "device mac", file: "wled_devices:\n  - name: Desk\n    mac: zz\n", key: "wled_devices", line: 3},
+		{name: "group without name", file: "wled_groups:\n  - name: ''\n", key: "wled_groups", line: 3},
+		{name: "group of 1", file: "wled_groups:\n  - name: All\n    devices: [HyperCube]\n", key: "wled_groups", line: 3},
+		{name: "group named like a device", file: "wled_groups:\n  - name: HyperCube\n    devices: [HyperCube, HyperCube]\n", key: "wled_groups", line: 3},
+		{name: "group of unknown device", file: "wled_groups:\n  - name: All\n    devices: [HyperCube, Desk]\n", key: "wled_groups", line: 3},
+		{name: "bluetooth_device missing", omit: []string{"bluetooth_device"}, key: "bluetooth_device"},
+		{name: "audio_buffer", file: "audio_buffer: 11s\n", key: "audio_buffer", line: 3},
+		{name: "audio_overrun", file: "audio_overrun: block\n", key: "audio_overrun", line: 3},
+		{name: "audio_underrun", file: "audio_underrun: repeat\n", key: "audio_underrun", line: 3},
+		{name: "preset_mode", file: "preset_mode: tiles\n", key: "preset_mode", line: 3},
+		{name: "television with devices", file: "preset_mode: television\nwled_devices:\n  - name: Desk\n    ip: 10.0.0.3\n", key: "preset_mode", line: 3},
+		{name: "homekit_pin", file: "homekit_pin: '123'\n", key: "homekit_pin", line: 3},
+		{name: "homekit_setup_id", file: "homekit_setup_id: HOMES\n", key: "homekit_setup_id", line: 3},
+		{name: "homekit_port", file: "homekit_port: 70000\n", key: "homekit_port", line: 3},
+		{name: "api_address", file: "api_address: '8080'\n", key: "api_address", line: 3},
+		{name: "mqtt_broker", file: "mqtt_broker: http://broker\n", key: "mqtt_broker", line: 3},
+		{name: "mqtt_topic", file: "mqtt_topic: hyperkit/#\n", key: "mqtt_topic", line: 3},
+		{name: "mqtt_discovery_prefix", file: "mqtt_discovery_prefix: +\n", key: "mqtt_discovery_prefix", line: 3},
+		{name: "effects_protocol", file: "effects_protocol: artnet\n", key: "effects_protocol", line: 3},
+		{name: "effects_fps", file: "effects_fps: 300\n", key: "effects_fps", line: 3},
+		{name: "effects_led_count", file: "effects_led_count: -1\n", key: "effects_led_count", line: 3},
+		{name: "segment start", file: "effects_segments:\n  - start: -1\n    length: 10\n", key: "effects_segments", line: 3},
+		{name: "segment length", file: "effects_segments:\n  - start: 0\n    length: 0\n", key: "effects_segments", line: 3},
+		{name: "segment past the strip", file: "effects_led_count: 10\neffects_segments:\n  - start: 5\n    length: 10\n", key: "effects_segments", line: 4},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var lines []string
+			for _, line := range strings.SplitAfter(baseConfig, "\n") {
+				omitted := false
+				for _, key := range tt.omit {
+					omitted = omitted || strings.HasPrefix(line, key+":")
+				}
+				if !omitted && line != "" {
+					lines = append(lines, line)
+				}
+			}
+			path := writeConfig(t, strings.Join(lines, "")+tt.file)
+			source := path
+			if tt.line > 0 {
+				source = path + ":" + string(rune('0'+tt.line))
+			}
+
+			_, err := LoadConfig(path)
+			var configErr *ConfigError
+			if !errors.As(err, &configErr) || configErr.Key != tt.key || configErr.Source != source {
+				t.Fatalf("Loading %q returned %v, want an error for %s at %s\n", tt.file, err, tt.key, source)
+			}
+		})
+	}
+}
+
+func TestLoadConfigValidationSources(t *testing.T) {
+	path := writeConfig(t, baseConfig)
+	t.Setenv("HYPERKIT_PRESET_MODE", "tiles")
+	_, err := LoadConfig(path)
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) || configErr.Source != "HYPERKIT_PRESET_MODE" {
+		t.Fatalf("Invalid value from the environment returned %v\n", err)
+	}
+	if !strings.HasPrefix(err.Error(), "HYPERKIT_PRESET_MODE: preset_mode: ") {
+		t.Fatalf("Unexpected error message %q\n", err)
+	}
+
+	t.Setenv("HYPERKIT_PRESET_MODE", "outlets")
+	_, err = LoadConfig(path, func(c *Config) { c.PresetMode = "tiles" })
+	if !errors.As(err, &configErr) || configErr.Source != "command line" {
+		t.Fatalf("Invalid value from a flag returned %v\n", err)
+	}
+}
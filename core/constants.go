@@ -1,5 +0,0 @@
-package core
-
-const (
-	TogglePowerJson string = `{"on":"t","v":true}`
-)
@@ -1,145 +1,387 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"github.com/brutella/hc"
 	"github.com/brutella/hc/accessory"
 	"github.com/brutella/hc/characteristic"
 	"github.com/brutella/hc/service"
-	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
 	"hyperkit/core/airplayserver"
-	"hyperkit/core/apiconn"
+	"hyperkit/core/audioreactive"
+	"hyperkit/core/errorTypes"
+	"hyperkit/core/events"
+	"hyperkit/core/iid"
+	"hyperkit/core/lifecycle"
+	"hyperkit/core/metrics"
+	"hyperkit/core/mqttbridge"
+	"hyperkit/core/restapi"
 	"hyperkit/core/util"
+	"hyperkit/core/wled"
+	"net"
+	"sync"
+	"time"
 )
 
+// startTimeout bounds starting every component in Start.
+const startTimeout = 2 * time.Minute
+
+// eventBuffer is how many events a subscriber may fall behind by before it
+// misses events.
+const eventBuffer = 64
+
 type Core struct {
-	presetHandler *PresetHandler
-	presets       map[string]*Preset
+	// devices are the WLED controllers, the one at wled_ip first
+	devices       []*Device
+	groups        []*GroupHandler
 	airplayServer *airplayserver.AirplayServer
 	airplaySwitch *service.Outlet
-	miscHandler   *MiscHandler
+	// effects plays the built-in audio effects if audio_effects is set
+	effects       *audioreactive.Engine
 	homekitPin    [8]uint
-	socket        *websocket.Conn
 	bridge        *accessory.Bridge
-	menuOutlet    *accessory.Outlet
 	config        *Config
+	configMu      *sync.RWMutex
+	configChanged chan struct{}
+	events        *events.Bus
+
+	ids         *iid.Allocator
+	supervisor  *lifecycle.Supervisor
+	transport   hc.Transport
+	transportMu *sync.Mutex
+	// unpublished is set while the transport is stopped for services to be
+	// added or removed
+	unpublished bool
+	// counted are the characteristics of the published accessories whose
+	// writes are counted already
+	counted    map[*characteristic.Characteristic]bool
+	terminated chan struct{}
+	terminate  sync.Once
 }
 
-func NewCore(airplayName, audioNamedPipePath, bluetoothDevice string, homekitPin [8]uint) (c *Core, err error) {
+// NewCore builds the HomeKit accessories for the given config, which is
+// usually loaded with LoadConfig.
+func NewCore(config *Config) (c *Core, err error) {
 	c = &Core{
-		presets:    make(map[string]*Preset),
-		homekitPin: homekitPin,
-		bridge: accessory.NewBridge(accessory.Info{
-			Name:             "HyperBridge",
-			Manufacturer:     "Carter Peel",
-			Model:            "HyperBridge v1.0.0",
-			FirmwareRevision: "HyperKit v1.0.0",
-			ID:               1,
-		}),
-		menuOutlet: accessory.NewOutlet(accessory.Info{
-			Name:             "WLED-HyperKit",
-			Manufacturer:     "Carter Peel",
-			Model:            "HyperCube v1.0.0",
-			FirmwareRevision: "HyperKit v1.0.0",
-			ID:               2,
-		}),
+		transportMu:   new(sync.Mutex),
+		counted:       make(map[*characteristic.Characteristic]bool),
+		terminated:    make(chan struct{}),
+		events:        events.NewBus(),
+		config:        config,
+		configMu:      new(sync.RWMutex),
+		configChanged: make(chan struct{}, 1),
+	}
+
+	initLogging(c.config)
+
+	if c.homekitPin, err = util.ParsePin(c.config.HomeKitPin); err != nil {
+		return nil, fmt.Errorf("error parsing HomeKit pin: %v", err)
 	}
 
-	// Create a power button
-	menuName := characteristic.NewName()
-	menuName.Value = "Power"
-	c.menuOutlet.Outlet.Service.AddCharacteristic(menuName.Characteristic)
+	c.bridge = accessory.NewBridge(accessory.Info{
+		Name:             c.config.BridgeName,
+		Manufacturer:     "Carter Peel",
+		Model:            "HyperBridge v1.0.0",
+		FirmwareRevision: "HyperKit v1.0.0",
+		ID:               1,
+	})
 
-	// Config file setup
-	if c.config, err = InitConfig(); err != nil {
-		return nil, fmt.Errorf("error initializing config: %v", err)
+	// Persistent HomeKit instance IDs, stored alongside the pairings
+	if c.ids, err = iid.NewAllocator(c.config.HomeKitStoragePath); err != nil {
+		return nil, fmt.Errorf("error loading HomeKit instance IDs: %v", err)
 	}
 
-	if c.socket, err = InitWebSocket(c.config.WledIP); err != nil {
-		return nil, fmt.Errorf("error initializing websocket: %v", err)
+	// WLED controllers
+	for i, dev := range c.config.wledDevices() {
+		d, err := c.newDevice(dev, i == 0)
+		if err != nil {
+			return nil, fmt.Errorf("error creating WLED device %s: %v", dev.Name, err)
+		}
+		c.devices = append(c.devices, d)
 	}
 
-	// Preset Handler (HomeKit)
-	if c.presetHandler, err = c.NewPresetHandler(); err != nil {
-		return nil, fmt.Errorf("error creating preset handler: %v", err)
+	// Groups of WLED controllers
+	for _, group := range c.config.WledGroups {
+		g, err := c.NewGroupHandler(group)
+		if err != nil {
+			return nil, fmt.Errorf("error creating WLED group %s: %v", group.Name, err)
+		}
+		c.groups = append(c.groups, g)
 	}
 
 	// AirPlay2 server (audio proxy)
-	if c.airplayServer, err = airplayserver.NewAirplayLedFXBridge(airplayName, audioNamedPipePath, bluetoothDevice); err != nil {
+	pipePath := c.config.AudioPipePath
+	if c.config.DisableLedFX {
+		pipePath = ""
+	}
+	if c.airplayServer, err = airplayserver.NewAirplayLedFXBridge(c.config.AirPlayName, pipePath, c.config.BtDeviceName, c.events); err != nil {
 		return nil, fmt.Errorf("error creating new AirPlay2 server: %v", err)
 	}
+	if err := c.airplayServer.SetBufferOptions(c.config.bufferOptions()); err != nil {
+		return nil, fmt.Errorf("error configuring audio buffer: %v", err)
+	}
 
-	// Miscellaneous menu
-	c.miscHandler = c.NewMiscHandler()
-	// Set default speed and brightness
-	c.miscHandler.SetSpeed(c.config.DefaultSpeed)
-	c.miscHandler.SetBrightness(c.config.DefaultBrightness)
+	// Built-in audio effects, fed by the AirPlay audio
+	if c.config.AudioEffects {
+		c.effects = audioreactive.NewEngine()
+		c.airplayServer.SetPCMTap(c.effects)
+		if err := c.changeServices(c.primary().addEffectPresets); err != nil {
+			return nil, fmt.Errorf("error adding audio effects: %v", err)
+		}
+	}
 
 	// Create an airplay switch
 	c.airplaySwitch = service.NewOutlet()
 	airplaySwitchName := characteristic.NewName()
 	airplaySwitchName.Value = "AirPlay2"
 	c.airplaySwitch.AddCharacteristic(airplaySwitchName.Characteristic)
+	c.ids.Name(c.airplaySwitch.Service, "airplay")
 
-	c.presetHandler.AddLedFXBridge(c.airplayServer, c.airplaySwitch)
+	c.primary().presetHandler.AddLedFXBridge(c.airplayServer, c.airplaySwitch)
 
-	c.menuOutlet.AddService(c.airplaySwitch.Service)
-	c.menuOutlet.UpdateIDs()
+	c.primary().menuOutlet.AddService(c.airplaySwitch.Service)
+
+	// Mirror changes made from the WLED app back into HomeKit
+	for _, d := range c.devices {
+		d.listenForWledState()
+	}
+
+	// Components are started in this order and stopped in reverse
+	c.supervisor = lifecycle.NewSupervisor(lifecycle.Options{})
+	for _, d := range c.devices {
+		c.supervisor.Add(d.component("wled"), &wledService{dev: d})
+		c.supervisor.Add(d.component("presets"), d.presetHandler)
+		if d.miscHandler != nil {
+			c.supervisor.Add(d.component("selectors"), d.miscHandler)
+		}
+	}
+	c.supervisor.Add("bluetooth", c.airplayServer.Bluetooth())
+	if ledfx := c.airplayServer.LedFX(); ledfx != nil {
+		c.supervisor.Add("ledfx", ledfx)
+	}
+	c.supervisor.Add("airplay", c.airplayServer)
+	if c.effects != nil {
+		c.supervisor.Add("effects", c.effects)
+	}
+	c.supervisor.Add("homekit", &homekitService{core: c})
+	if c.config.APIAddress != "" {
+		c.supervisor.Add("api", restapi.NewServer(c, c.config.APIAddress, c.config.APIToken))
+	}
+	if c.config.MQTTBroker != "" {
+		c.supervisor.Add("mqtt", mqttbridge.NewBridge(c, mqttbridge.Options{
+			Broker:          c.config.MQTTBroker,
+			Username:        c.config.MQTTUsername,
+			Password:        c.config.MQTTPassword,
+			Topic:           c.config.MQTTTopic,
+			DiscoveryPrefix: c.config.MQTTDiscoveryPrefix,
+			Name:            c.config.BridgeName,
+		}))
+	}
 
 	return c, nil
 }
 
-func (c *Core) LoadPresetsFromWled() (err error) {
-	presets, err := apiconn.GetAllPresets(c.config.WledIP)
-	if err != nil {
-		return fmt.Errorf("error getting all presets: %v", err)
+// primary returns the device at wled_ip, which the HTTP API, the MQTT bridge
+// and the AirPlay switch act on.
+func (c *Core) primary() *Device {
+	return c.devices[0]
+}
+
+// applyDefaults sets the configured default speed and brightness on every
+// device.
+func (c *Core) applyDefaults(config *Config) {
+	for _, d := range c.devices {
+		d.applyDefaults(config)
 	}
-	for _, preset := range presets {
-		if preset.ID <= 0 {
-			continue
-		}
-		if err := c.AddWledPreset(preset.Name, preset.ID); err != nil {
-			return fmt.Errorf("error adding WLED preset: %v", err)
-		}
+}
+
+// currentConfig returns the running config, which ReloadConfig may replace.
+func (c *Core) currentConfig() *Config {
+	c.configMu.RLock()
+	defer c.configMu.RUnlock()
+	return c.config
+}
+
+// WledConnState reports whether HyperKit is currently connected to the WLED
+// controller at wled_ip.
+func (c *Core) WledConnState() wled.ConnState {
+	return c.primary().wled.ConnState()
+}
+
+func (c *Core) LoadPresetsFromWled() (err error) {
+	if _, err := c.SyncPresets(); err != nil {
+		return fmt.Errorf("error loading presets: %v", err)
 	}
 	return nil
 }
 
+// AddWledPreset adds a HomeKit service for the given preset of the WLED
+// controller at wled_ip and republishes the accessories if HomeKit is already
+// running.
 func (c *Core) AddWledPreset(name string, id int) error {
-	if id <= 0 {
-		return fmt.Errorf("preset ID must be greater than 0")
-	}
+	d := c.primary()
+	return c.changeServices(func() error {
+		d.presetMu.Lock()
+		defer d.presetMu.Unlock()
+		return d.addWledPreset(name, id)
+	})
+}
 
-	preset := service.NewOutlet()
-	presetName := characteristic.NewName()
-	presetName.Value = name
-	preset.AddCharacteristic(presetName.Characteristic)
-	c.presetHandler.InitPreset(id, preset)
+// Start starts every component, publishing the accessories over HomeKit
+// last, and blocks until Shutdown is called.
+func (c *Core) Start() (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+	if err := c.supervisor.Start(ctx); err != nil {
+		return err
+	}
+	c.printSetupCode()
 
-	c.menuOutlet.AddService(preset.Service)
-	c.menuOutlet.UpdateIDs()
+	c.supervisor.Go("preset-sync", c.watchPresets)
+	c.supervisor.Go("config-watch", c.watchConfig)
 
+	<-c.terminated
 	return nil
 }
 
-func (c *Core) Start() (err error) {
-	pin, err := util.PinArrayToString(c.homekitPin)
+// Subscribe returns a subscription to the given event types, or to every
+// type if none are given.
+func (c *Core) Subscribe(types ...events.Type) *events.Subscription {
+	return c.events.Subscribe(eventBuffer, types...)
+}
+
+// ComponentStates returns the health of every component, in start order.
+func (c *Core) ComponentStates() []lifecycle.ComponentStatus {
+	return c.supervisor.Status()
+}
+
+func (c *Core) startTransport() error {
+	c.transportMu.Lock()
+	defer c.transportMu.Unlock()
+	return c.publish()
+}
+
+// publish creates and starts the transport. Must be called with transportMu
+// held.
+func (c *Core) publish() error {
+	cfg, err := c.hcConfig()
 	if err != nil {
-		return fmt.Errorf("error converting pin array to string: %v", err)
+		return err
+	}
+
+	// The persistent IDs are assigned first, so the configuration number
+	// covers the IDs that are published
+	accs := append([]*accessory.Accessory{c.bridge.Accessory}, c.accessories()...)
+	if err := c.ids.Assign(accs...); err != nil {
+		return fmt.Errorf("error assigning HomeKit instance IDs: %v", err)
+	}
+	if err := updateConfigNumber(cfg.StoragePath, accs); err != nil {
+		return fmt.Errorf("error updating HomeKit configuration number: %v", err)
 	}
 
-	t, err := hc.NewIPTransport(hc.Config{Pin: pin}, c.bridge.Accessory, c.menuOutlet.Accessory, c.miscHandler.speedSelector.Accessory, c.miscHandler.brightnessSelector.Accessory)
+	t, err := hc.NewIPTransport(cfg, c.bridge.Accessory, c.accessories()...)
 	if err != nil {
 		return fmt.Errorf("error creating new transport: %v", err)
 	}
-
-	hc.OnTermination(func() {
-		<-t.Stop()
-	})
-	t.Start()
+	// NewIPTransport renumbers every service, so the persistent IDs have to be
+	// restored before the accessories are published.
+	if err := c.ids.Assign(accs...); err != nil {
+		return fmt.Errorf("error assigning HomeKit instance IDs: %v", err)
+	}
+	c.countWrites(accs)
+	c.transport = t
+	go t.Start()
 	return nil
 }
 
+func (c *Core) stopTransport() {
+	c.transportMu.Lock()
+	defer c.transportMu.Unlock()
+	if c.transport != nil {
+		<-c.transport.Stop()
+		c.transport = nil
+	}
+}
+
+// changeServices runs fn, which adds or removes services of the accessories
+// and calls unpublish before it does. The accessories are then republished,
+// which lets paired controllers know through the configuration number (c#)
+// that they changed.
+func (c *Core) changeServices(fn func() error) error {
+	c.transportMu.Lock()
+	defer c.transportMu.Unlock()
+	err := fn()
+	if !c.unpublished {
+		return err
+	}
+	c.unpublished = false
+	log.Infoln("Republishing HomeKit accessories...")
+	if perr := c.publish(); perr != nil {
+		errs := new(errorTypes.MultiError)
+		errs.Append(err)
+		errs.Append(fmt.Errorf("error republishing accessories: %w", perr))
+		return errs
+	}
+	return err
+}
+
+// unpublish stops the transport, if HomeKit is running, so that hc does not
+// serve the accessories while their services change. Must be called with
+// transportMu held, from within changeServices.
+func (c *Core) unpublish() {
+	if c.transport == nil {
+		return
+	}
+	<-c.transport.Stop()
+	c.transport = nil
+	c.unpublished = true
+}
+
+// countWrites counts the values HomeKit controllers write to the
+// characteristics of accs, and forgets the characteristics of services that
+// were removed since. Must be called with transportMu held.
+func (c *Core) countWrites(accs []*accessory.Accessory) {
+	published := make(map[*characteristic.Characteristic]bool, len(c.counted))
+	for _, acc := range accs {
+		for _, svc := range acc.GetServices() {
+			for _, char := range svc.GetCharacteristics() {
+				published[char] = true
+				if c.counted[char] {
+					continue
+				}
+				char.OnValueUpdateFromConn(func(_ net.Conn, char *characteristic.Characteristic, _, _ interface{}) {
+					metrics.CharacteristicWrites.WithLabelValues(char.Type).Inc()
+				})
+			}
+		}
+	}
+	c.counted = published
+}
+
+// accessories returns every accessory bridged by HyperKit.
+func (c *Core) accessories() []*accessory.Accessory {
+	var accs []*accessory.Accessory
+	for _, d := range c.devices {
+		accs = append(accs, d.accessories()...)
+	}
+	for _, g := range c.groups {
+		accs = append(accs, g.accessories()...)
+	}
+	return accs
+}
+
+// removeService returns services without svc.
+func removeService(services []*service.Service, svc *service.Service) []*service.Service {
+	kept := make([]*service.Service, 0, len(services))
+	for _, s := range services {
+		if s != svc {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
 /*func main() {
 	// [------ Preset Config ------]
 	presetHandler, err := NewPresetHandler(config.DefaultSolid)
@@ -0,0 +1,151 @@
+package core
+
+import (
+	"fmt"
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"hyperkit/core/wled"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Device is a WLED controller and the accessories that control it: the power
+// outlet with its presets, the light, the effect speed fan and, depending on
+// the config, the speed and brightness selectors or the preset television.
+type Device struct {
+	// Name identifies the device in groups and events, and names its
+	// accessories.
+	Name string
+
+	wled          *wled.Client
+	presetHandler *PresetHandler
+	lightHandler  *LightHandler
+	miscHandler   *MiscHandler
+	tvHandler     *TelevisionHandler
+	menuOutlet    *accessory.Outlet
+	presets       map[int]*Preset
+	presetMu      *sync.Mutex
+	published     publishedState
+	// groups are the groups the device is a member of
+	groups []*GroupHandler
+
+	// aids are the accessory IDs of the device by role
+	aids map[string]uint64
+	core *Core
+}
+
+// accessoryRoles are the accessories a device may have. IDs are reserved for
+// all of them, so switching preset_mode or the selectors on and off later
+// does not renumber the others.
+var accessoryRoles = []string{"menu", "light", "fan", "speed", "brightness", "tv"}
+
+// primaryAccessoryIDs are the accessory IDs of the controller at wled_ip.
+// They predate wled_devices and are kept so existing pairings keep working.
+var primaryAccessoryIDs = map[string]uint64{"menu": 2, "speed": 3, "brightness": 4, "light": 5, "fan": 6, "tv": 7}
+
+// newDevice connects to the WLED controller dev and builds its accessories.
+// The primary device is the one at wled_ip.
+func (c *Core) newDevice(dev WledDevice, primary bool) (d *Device, err error) {
+	name := dev.Name
+	d = &Device{
+		Name:     name,
+		presets:  make(map[int]*Preset),
+		presetMu: new(sync.Mutex),
+		aids:     primaryAccessoryIDs,
+		core:     c,
+	}
+	if !primary {
+		d.aids = make(map[string]uint64, len(accessoryRoles))
+		for _, role := range accessoryRoles {
+			if d.aids[role], err = c.ids.AccessoryID(fmt.Sprintf("device/%s/%s", deviceKey(name), role)); err != nil {
+				return nil, fmt.Errorf("error allocating accessory ID: %v", err)
+			}
+		}
+	}
+
+	// Create a power button
+	menuName := name
+	if primary {
+		menuName = "WLED-HyperKit"
+	}
+	d.menuOutlet = accessory.NewOutlet(d.info("menu", menuName))
+	powerName := characteristic.NewName()
+	powerName.Value = "Power"
+	d.menuOutlet.Outlet.Service.AddCharacteristic(powerName.Characteristic)
+
+	d.wled = InitWledClient(dev, c.config, c.events)
+
+	// Preset Handler (HomeKit)
+	if d.presetHandler, err = d.NewPresetHandler(); err != nil {
+		return nil, fmt.Errorf("error creating preset handler: %v", err)
+	}
+
+	// Television-style preset picker
+	if c.config.PresetMode == PresetModeTelevision {
+		d.tvHandler = d.NewTelevisionHandler()
+	}
+
+	// Lightbulb and effect speed controls
+	d.lightHandler = d.NewLightHandler()
+
+	// Legacy outlet selectors
+	if !c.config.DisableOutletSelectors {
+		d.miscHandler = d.NewMiscHandler()
+	}
+
+	// Set default speed and brightness
+	d.applyDefaults(c.config)
+	return d, nil
+}
+
+// info returns the accessory info of the accessory with the given role.
+func (d *Device) info(role, name string) accessory.Info {
+	return accessory.Info{
+		Name:             name,
+		Manufacturer:     "Carter Peel",
+		Model:            "HyperCube v1.0.0",
+		FirmwareRevision: "HyperKit v1.0.0",
+		ID:               d.aids[role],
+	}
+}
+
+// accessories returns the accessories of the device.
+func (d *Device) accessories() []*accessory.Accessory {
+	accs := []*accessory.Accessory{d.menuOutlet.Accessory, d.lightHandler.light.Accessory, d.lightHandler.speedFan}
+	if d.miscHandler != nil {
+		accs = append(accs, d.miscHandler.speedSelector.Accessory, d.miscHandler.brightnessSelector.Accessory)
+	}
+	if d.tvHandler != nil {
+		accs = append(accs, d.tvHandler.tv)
+	}
+	return accs
+}
+
+// component names a component of the device for the supervisor. The
+// components of the primary device keep their plain names.
+func (d *Device) component(name string) string {
+	if d == d.core.devices[0] {
+		return name
+	}
+	return name + "/" + deviceKey(d.Name)
+}
+
+// applyDefaults sets the configured default speed and brightness.
+func (d *Device) applyDefaults(config *Config) {
+	if d.miscHandler != nil {
+		d.miscHandler.SetSpeed(config.DefaultSpeed)
+		d.miscHandler.SetBrightness(config.DefaultBrightness)
+		return
+	}
+	d.lightHandler.setSpeed(config.DefaultSpeed)
+	d.lightHandler.setBrightness(config.DefaultBrightness)
+}
+
+var nonAlphanumeric = regexp.MustCompile(`[^a-z0-9]+`)
+
+// deviceKey normalises a device or group name, so that names differing only
+// in case or punctuation are treated as the same.
+func deviceKey(name string) string {
+	return strings.Trim(nonAlphanumeric.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hyperkit/core/audioreactive"
+	"hyperkit/core/realtime"
+	"net"
+	"time"
+)
+
+const (
+	// effectPresetBase is the preset ID of the first built-in effect. WLED
+	// preset IDs end at 250, so the two never collide.
+	effectPresetBase = 1000
+	// effectPresetPrefix sets the effect presets apart from WLED's own.
+	effectPresetPrefix = "Music "
+
+	// effectStopTimeout bounds waiting for an effect to stop.
+	effectStopTimeout = 5 * time.Second
+)
+
+// addEffectPresets adds a preset for every built-in effect, numbered from
+// effectPresetBase in the order of audioreactive.Effects.
+func (d *Device) addEffectPresets() error {
+	d.presetMu.Lock()
+	defer d.presetMu.Unlock()
+	for i, name := range audioreactive.Effects() {
+		id := effectPresetBase + i
+		if err := d.addWledPreset(effectPresetPrefix+name, id); err != nil {
+			return fmt.Errorf("error adding effect preset %d: %w", id, err)
+		}
+		d.presets[id].effect = name
+	}
+	return nil
+}
+
+// effectName returns the built-in effect the given preset ID stands for, or
+// "" if it is a WLED preset. It goes by the ID alone, so it can be called
+// with the handler locks held.
+func effectName(id int) string {
+	names := audioreactive.Effects()
+	if i := id - effectPresetBase; i >= 0 && i < len(names) {
+		return names[i]
+	}
+	return ""
+}
+
+// applyPreset switches WLED to the given preset, or plays the built-in
+// effect it stands for. Switching to a WLED preset stops the effect.
+func (d *Device) applyPreset(id int) error {
+	if name := effectName(id); name != "" {
+		return d.playEffect(name)
+	}
+	d.stopEffect()
+	return d.wled.Send(buildPresetState(id))
+}
+
+// playEffect streams the named effect to WLED with the effects_* config.
+func (d *Device) playEffect(name string) error {
+	effects := d.core.effects
+	if effects == nil {
+		return fmt.Errorf("audio effects are disabled")
+	}
+	config := d.core.currentConfig()
+	leds := config.EffectsLEDCount
+	if leds == 0 {
+		info, err := d.wled.Info()
+		if err != nil {
+			return fmt.Errorf("error getting LED count from WLED: %w", err)
+		}
+		leds = info.Leds.Count
+	}
+	// The realtime protocols have ports of their own
+	host := d.wled.Host()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	segments := make([]realtime.Segment, len(config.EffectsSegments))
+	for i, seg := range config.EffectsSegments {
+		segments[i] = realtime.Segment{Start: seg.Start, Length: seg.Length, Reverse: seg.Reverse}
+	}
+	if !d.presetHandler.musicIsActive() {
+		log.Infof("AirPlay is off, effect %s stays dark until it is switched on\n", name)
+	}
+	return effects.Play(name, realtime.Options{
+		Host:     host,
+		Protocol: realtime.Protocol(config.EffectsProtocol),
+		LEDCount: leds,
+		FPS:      config.EffectsFPS,
+		Segments: segments,
+	})
+}
+
+// stopEffect stops the built-in effect that plays, if any. WLED shows its own
+// effects again once its realtime timeout passes.
+func (d *Device) stopEffect() {
+	if !d.effectPlaying() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), effectStopTimeout)
+	defer cancel()
+	if err := d.core.effects.Off(ctx); err != nil {
+		log.Errorf("Error stopping effect: %v\n", err)
+	}
+}
+
+// effectPlaying reports whether a built-in effect plays on the device. While
+// one does, WLED keeps reporting the preset it showed before, which must not
+// switch the effect preset off in HomeKit.
+func (d *Device) effectPlaying() bool {
+	return d.core.effects != nil && d == d.core.primary() && d.core.effects.Playing() != ""
+}
@@ -0,0 +1,74 @@
+package errorTypes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MultiError collects the errors of steps that should all run even if some
+// of them fail, such as the steps of a shutdown.
+type MultiError struct {
+	Errors []error
+}
+
+// Append adds err, ignoring nil errors and flattening nested MultiErrors.
+func (m *MultiError) Append(err error) {
+	if err == nil {
+		return
+	}
+	var nested *MultiError
+	if errors.As(err, &nested) {
+		m.Errors = append(m.Errors, nested.Errors...)
+		return
+	}
+	m.Errors = append(m.Errors, err)
+}
+
+// ErrorOrNil returns m, or nil if no errors were appended.
+func (m *MultiError) ErrorOrNil() error {
+	if m == nil || len(m.Errors) == 0 {
+		return nil
+	}
+	return m
+}
+
+func (m *MultiError) Error() string {
+	if len(m.Errors) == 1 {
+		return m.Errors[0].Error()
+	}
+	msgs := make([]string, len(m.Errors))
+	for i, err := range m.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors occurred:\n  %s", len(m.Errors), strings.Join(msgs, "\n  "))
+}
+
+// Is reports whether any of the collected errors matches target.
+func (m *MultiError) Is(target error) bool {
+	for _, err := range m.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// RunWithContext runs fn and waits for it until ctx is done. fn keeps running
+// in the background if it outlives ctx. Errors are prefixed with what.
+func RunWithContext(ctx context.Context, what string, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("error %s: %w", what, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("error %s: %w", what, ctx.Err())
+	}
+}
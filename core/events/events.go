@@ -0,0 +1,178 @@
+// Package events is HyperKit's internal event bus. Components publish typed
+// events about what they are doing and subscribers, such as the HTTP event
+// stream, receive them in order.
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Type identifies the kind of an event and the type of its Data.
+type Type string
+
+const (
+	// PowerChanged carries Power.
+	PowerChanged Type = "power_changed"
+	// PresetChanged carries Preset.
+	PresetChanged Type = "preset_changed"
+	// BrightnessChanged and SpeedChanged carry Level.
+	BrightnessChanged Type = "brightness_changed"
+	SpeedChanged      Type = "speed_changed"
+	// AirPlaySessionStarted and AirPlaySessionEnded carry no data.
+	AirPlaySessionStarted Type = "airplay_session_started"
+	AirPlaySessionEnded   Type = "airplay_session_ended"
+	// TrackChanged carries Track.
+	TrackChanged Type = "track_changed"
+	// VolumeChanged carries Volume.
+	VolumeChanged Type = "volume_changed"
+	// BluetoothConnected and BluetoothDisconnected carry Bluetooth.
+	BluetoothConnected    Type = "bluetooth_connected"
+	BluetoothDisconnected Type = "bluetooth_disconnected"
+	// LedFXStateChanged carries LedFX.
+	LedFXStateChanged Type = "ledfx_state_changed"
+	// WledLinkUp and WledLinkDown carry WledLink.
+	WledLinkUp   Type = "wled_link_up"
+	WledLinkDown Type = "wled_link_down"
+)
+
+// Power, Preset and Level name the WLED device they are about, as set by
+// wled_name and wled_devices.
+type Power struct {
+	Device string `json:"device"`
+	On     bool   `json:"on"`
+}
+
+type Preset struct {
+	Device string `json:"device"`
+	// ID is the WLED preset ID, or -1 if no preset is active.
+	ID int `json:"id"`
+}
+
+// Level is a brightness or speed between 0 and 255.
+type Level struct {
+	Device string `json:"device"`
+	Value  uint8  `json:"value"`
+}
+
+type Track struct {
+	Album  string `json:"album"`
+	Artist string `json:"artist"`
+	Title  string `json:"title"`
+}
+
+// Volume is the AirPlay volume between 0 (muted) and 1.
+type Volume struct {
+	Volume float64 `json:"volume"`
+}
+
+type Bluetooth struct {
+	Device string `json:"device"`
+}
+
+type LedFX struct {
+	State string `json:"state"`
+}
+
+type WledLink struct {
+	Device string `json:"device"`
+	Host   string `json:"host"`
+}
+
+// Event is something that happened in HyperKit.
+type Event struct {
+	// ID increases by one with every event published on a Bus.
+	ID   uint64      `json:"id"`
+	Type Type        `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// Bus delivers published events to its subscribers. A nil *Bus drops every
+// event, so components work without one.
+type Bus struct {
+	mu     sync.Mutex
+	nextID uint64
+	subs   map[*Subscription]struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*Subscription]struct{})}
+}
+
+// Publish sends an event to every subscriber of its type. It never blocks:
+// subscribers whose buffer is full miss the event.
+func (b *Bus) Publish(typ Type, data interface{}) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	ev := Event{ID: b.nextID, Type: typ, Time: time.Now(), Data: data}
+	for sub := range b.subs {
+		if !sub.wants(typ) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// Subscribe returns a subscription to the given types, or to every type if
+// none are given. buffer is how many events may be queued before further
+// ones are dropped.
+func (b *Bus) Subscribe(buffer int, types ...Type) *Subscription {
+	ch := make(chan Event, buffer)
+	sub := &Subscription{C: ch, ch: ch, bus: b}
+	if len(types) > 0 {
+		sub.types = make(map[Type]bool, len(types))
+		for _, typ := range types {
+			sub.types[typ] = true
+		}
+	}
+	if b == nil {
+		return sub
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+// Subscription receives events from a Bus until it is closed.
+type Subscription struct {
+	// C receives the events. It is closed by Close.
+	C <-chan Event
+
+	ch      chan Event
+	bus     *Bus
+	types   map[Type]bool
+	dropped uint64
+	once    sync.Once
+}
+
+func (s *Subscription) wants(typ Type) bool {
+	return s.types == nil || s.types[typ]
+}
+
+// Dropped returns how many events were missed because the buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close unsubscribes and closes C.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		if s.bus != nil {
+			s.bus.mu.Lock()
+			delete(s.bus.subs, s)
+			s.bus.mu.Unlock()
+		}
+		close(s.ch)
+	})
+}
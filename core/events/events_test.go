@@ -0,0 +1,56 @@
+package events
+
+import (
+	"testing"
+)
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+	all := bus.Subscribe(4)
+	power := bus.Subscribe(4, PowerChanged)
+
+	bus.Publish(PowerChanged, Power{On: true})
+	bus.Publish(PresetChanged, Preset{ID: 3})
+
+	for _, want := range []Type{PowerChanged, PresetChanged} {
+		if ev := <-all.C; ev.Type != want {
+			t.Fatalf("Got %s, want %s\n", ev.Type, want)
+		}
+	}
+	ev := <-power.C
+	if ev.Type != PowerChanged || ev.Data != (Power{On: true}) || ev.ID != 1 {
+		t.Fatalf("Unexpected event %+v\n", ev)
+	}
+	select {
+	case ev := <-power.C:
+		t.Fatalf("Got unsubscribed event %+v\n", ev)
+	default:
+	}
+
+	all.Close()
+	if _, ok := <-all.C; ok {
+		t.Fatalf("Channel not closed after Close\n")
+	}
+	bus.Publish(PowerChanged, Power{})
+	all.Close()
+}
+
+func TestBusDropsWhenFull(t *testing.T) {
+	bus := NewBus()
+	sub := bus.Subscribe(1)
+	bus.Publish(PowerChanged, Power{On: true})
+	bus.Publish(PowerChanged, Power{On: false})
+	if got := sub.Dropped(); got != 1 {
+		t.Fatalf("Got %d dropped events, want 1\n", got)
+	}
+	if ev := <-sub.C; ev.Data != (Power{On: true}) {
+		t.Fatalf("Got %+v, want the first event\n", ev)
+	}
+}
+
+func TestNilBus(t *testing.T) {
+	var bus *Bus
+	bus.Publish(PowerChanged, Power{})
+	sub := bus.Subscribe(1)
+	sub.Close()
+}
@@ -0,0 +1,140 @@
+package core
+
+import (
+	"fmt"
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	log "github.com/sirupsen/logrus"
+	"hyperkit/core/errorTypes"
+	"sync"
+)
+
+// GroupHandler exposes a group of WLED devices as a Lightbulb and an effect
+// speed Fan. Every change is sent to each device of the group, and their own
+// accessories follow along.
+type GroupHandler struct {
+	Name    string
+	devices []*Device
+
+	light         *accessory.Lightbulb
+	brightness    *characteristic.Brightness
+	speedFan      *accessory.Accessory
+	speedService  *service.Fan
+	rotationSpeed *characteristic.RotationSpeed
+	lastSpeed     float64
+
+	mu *sync.Mutex
+}
+
+func (c *Core) NewGroupHandler(group WledGroup) (g *GroupHandler, err error) {
+	g = &GroupHandler{Name: group.Name, mu: new(sync.Mutex)}
+	for _, name := range group.Devices {
+		for _, d := range c.devices {
+			if deviceKey(d.Name) == deviceKey(name) {
+				g.devices = append(g.devices, d)
+				d.groups = append(d.groups, g)
+			}
+		}
+	}
+
+	info := func(role, name string) (accessory.Info, error) {
+		id, err := c.ids.AccessoryID(fmt.Sprintf("group/%s/%s", deviceKey(group.Name), role))
+		if err != nil {
+			return accessory.Info{}, fmt.Errorf("error allocating accessory ID: %v", err)
+		}
+		return accessory.Info{
+			Name:             name,
+			Manufacturer:     "Carter Peel",
+			Model:            "HyperCube Group v1.0.0",
+			FirmwareRevision: "HyperKit v1.0.0",
+			ID:               id,
+		}, nil
+	}
+	lightInfo, err := info("light", group.Name)
+	if err != nil {
+		return nil, err
+	}
+	fanInfo, err := info("fan", group.Name+" Effect Speed")
+	if err != nil {
+		return nil, err
+	}
+
+	g.light = accessory.NewLightbulb(lightInfo)
+	g.brightness = characteristic.NewBrightness()
+	bulb := g.light.Lightbulb
+	bulb.AddCharacteristic(g.brightness.Characteristic)
+	bulb.On.SetValue(true)
+	g.brightness.SetValue(byteToPercent(c.config.DefaultBrightness))
+	bulb.On.OnValueRemoteUpdate(func(on bool) {
+		g.each("switching power", func(d *Device) error { return d.setPower(on) })
+	})
+	g.brightness.OnValueRemoteUpdate(func(percent int) {
+		brightness := percentToByte(float64(percent))
+		g.each("setting brightness", func(d *Device) error { return d.setBrightness(brightness) })
+	})
+
+	g.speedFan = accessory.New(fanInfo, accessory.TypeFan)
+	g.speedService = service.NewFan()
+	g.rotationSpeed = characteristic.NewRotationSpeed()
+	speedName := characteristic.NewName()
+	speedName.Value = "Effect Speed"
+	g.speedService.AddCharacteristic(speedName.Characteristic)
+	g.speedService.AddCharacteristic(g.rotationSpeed.Characteristic)
+	g.speedService.On.SetValue(true)
+	g.lastSpeed = float64(byteToPercent(c.config.DefaultSpeed))
+	g.rotationSpeed.SetValue(g.lastSpeed)
+	g.speedService.On.OnValueRemoteUpdate(func(on bool) {
+		speed := uint8(0)
+		if on {
+			g.mu.Lock()
+			speed = percentToByte(g.lastSpeed)
+			g.rotationSpeed.SetValue(g.lastSpeed)
+			g.mu.Unlock()
+		}
+		g.each("setting speed", func(d *Device) error { return d.setSpeed(speed) })
+	})
+	g.rotationSpeed.OnValueRemoteUpdate(func(percent float64) {
+		if percent > 0 {
+			g.mu.Lock()
+			g.lastSpeed = percent
+			g.mu.Unlock()
+		}
+		speed := percentToByte(percent)
+		g.each("setting speed", func(d *Device) error { return d.setSpeed(speed) })
+	})
+	g.speedFan.AddService(g.speedService.Service)
+
+	return g, nil
+}
+
+// each runs fn for every device of the group, even if it fails for some of
+// them, and logs the errors.
+func (g *GroupHandler) each(action string, fn func(d *Device) error) {
+	errs := new(errorTypes.MultiError)
+	for _, d := range g.devices {
+		if err := fn(d); err != nil {
+			errs.Append(fmt.Errorf("%s: %w", d.Name, err))
+		}
+	}
+	if err := errs.ErrorOrNil(); err != nil {
+		log.Errorf("Error %s of group %s: %v\n", action, g.Name, err)
+	}
+}
+
+// sync shows the group as on while any of its devices is on.
+func (g *GroupHandler) sync() {
+	on := false
+	for _, d := range g.devices {
+		if d.menuOutlet.Outlet.On.GetValue() {
+			on = true
+		}
+	}
+	if g.light.Lightbulb.On.GetValue() != on {
+		g.light.Lightbulb.On.SetValue(on)
+	}
+}
+
+func (g *GroupHandler) accessories() []*accessory.Accessory {
+	return []*accessory.Accessory{g.light.Accessory, g.speedFan}
+}
@@ -0,0 +1,239 @@
+// Package iid keeps the HomeKit instance IDs of services and characteristics
+// stable across restarts.
+//
+// hc numbers services and characteristics sequentially every time
+// UpdateIDs is called, so adding a preset, or WLED returning presets in a
+// different order, shifts the IDs of everything after it and breaks the
+// automations and room assignments paired controllers have stored. The
+// Allocator instead remembers the ID handed out for every logical service
+// (e.g. "preset/3") and characteristic, and never reuses an ID once given out.
+package iid
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/service"
+	hcutil "github.com/brutella/hc/util"
+	"strconv"
+	"sync"
+)
+
+// storageKey is the key the ID table is stored under in the hc database.
+const storageKey = "iids"
+
+// accessoryKey is the key the accessory IDs are stored under.
+const accessoryKey = "aids"
+
+// FirstAccessoryID is the first ID handed out by AccessoryID. Lower ones are
+// left to accessories with fixed IDs.
+const FirstAccessoryID = 100
+
+type serviceIDs struct {
+	ID              uint64            `json:"iid"`
+	Characteristics map[string]uint64 `json:"characteristics"`
+}
+
+// reservedIDs are the accessory IDs handed out by AccessoryID.
+type reservedIDs struct {
+	Next uint64            `json:"next"`
+	IDs  map[string]uint64 `json:"ids"`
+}
+
+type accessoryIDs struct {
+	Next     uint64                 `json:"next"`
+	Services map[string]*serviceIDs `json:"services"`
+}
+
+// Allocator assigns persistent instance IDs to accessories.
+type Allocator struct {
+	storage hcutil.Storage
+	table   map[string]*accessoryIDs // keyed by accessory ID
+	keys    map[*service.Service]string
+	aids    reservedIDs
+
+	mu *sync.Mutex
+}
+
+// NewAllocator loads the ID table from the hc database at storagePath. The
+// table lives next to the pairings, so deleting the database to reset the
+// pairings also resets the IDs.
+func NewAllocator(storagePath string) (*Allocator, error) {
+	storage, err := hcutil.NewFileStorage(storagePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening storage %s: %w", storagePath, err)
+	}
+	return NewAllocatorWithStorage(storage)
+}
+
+// NewAllocatorWithStorage is NewAllocator for an already opened storage.
+func NewAllocatorWithStorage(storage hcutil.Storage) (*Allocator, error) {
+	a := &Allocator{
+		storage: storage,
+		table:   make(map[string]*accessoryIDs),
+		keys:    make(map[*service.Service]string),
+		aids:    reservedIDs{Next: FirstAccessoryID, IDs: make(map[string]uint64)},
+		mu:      new(sync.Mutex),
+	}
+	if b, err := storage.Get(accessoryKey); err == nil && len(b) > 0 {
+		if err := json.Unmarshal(b, &a.aids); err != nil {
+			return nil, fmt.Errorf("error decoding accessory IDs: %w", err)
+		}
+	}
+	b, err := storage.Get(storageKey)
+	if err != nil || len(b) == 0 {
+		// Nothing stored yet
+		return a, nil
+	}
+	if err := json.Unmarshal(b, &a.table); err != nil {
+		return nil, fmt.Errorf("error decoding instance IDs: %w", err)
+	}
+	return a, nil
+}
+
+// Name gives svc a logical key, such as "preset/3", which identifies it
+// across restarts. Services without a name are keyed by their type and their
+// position among the unnamed services of that type, which is only stable if
+// they are always added in the same order.
+func (a *Allocator) Name(svc *service.Service, key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys[svc] = key
+}
+
+// AccessoryID returns the accessory ID of the accessory with the given
+// logical key, such as "device/shelf/light", reserving a new one the first
+// time the key is seen. Like instance IDs, accessory IDs are never reused.
+func (a *Allocator) AccessoryID(key string) (uint64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if id, ok := a.aids.IDs[key]; ok {
+		return id, nil
+	}
+	id := a.aids.Next
+	a.aids.IDs[key] = id
+	a.aids.Next++
+	b, err := json.Marshal(a.aids)
+	if err != nil {
+		return 0, fmt.Errorf("error encoding accessory IDs: %w", err)
+	}
+	if err := a.storage.Set(accessoryKey, b); err != nil {
+		return 0, fmt.Errorf("error saving accessory IDs: %w", err)
+	}
+	return id, nil
+}
+
+// Forget drops the key of a removed service. The IDs it used stay reserved,
+// so a service added later under the same key gets them back.
+func (a *Allocator) Forget(svc *service.Service) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.keys, svc)
+}
+
+// Assign overwrites the service and characteristic IDs of the accessories
+// with their persistent IDs and saves any newly allocated ones. It has to run
+// after anything that calls UpdateIDs, e.g. hc.NewIPTransport.
+//
+// The first time an accessory is seen its current IDs are recorded as they
+// are, so upgrading does not renumber existing pairings.
+func (a *Allocator) Assign(accs ...*accessory.Accessory) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	changed := false
+	for _, acc := range accs {
+		if a.assign(acc) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	b, err := json.Marshal(a.table)
+	if err != nil {
+		return fmt.Errorf("error encoding instance IDs: %w", err)
+	}
+	if err := a.storage.Set(storageKey, b); err != nil {
+		return fmt.Errorf("error saving instance IDs: %w", err)
+	}
+	return nil
+}
+
+// slot is a service or characteristic ID to be assigned.
+type slot struct {
+	id    *uint64
+	saved uint64 // 0 if not yet allocated
+	save  func(uint64)
+}
+
+func (a *Allocator) assign(acc *accessory.Accessory) (changed bool) {
+	aid := strconv.FormatUint(acc.ID, 10)
+	ids, known := a.table[aid]
+	if !known {
+		ids = &accessoryIDs{Next: 1, Services: make(map[string]*serviceIDs)}
+		a.table[aid] = ids
+		changed = true
+	}
+
+	var slots []slot
+	unnamed := make(map[string]int)
+	for _, svc := range acc.GetServices() {
+		key, ok := a.keys[svc]
+		if !ok {
+			key = fmt.Sprintf("%s#%d", svc.Type, unnamed[svc.Type])
+			unnamed[svc.Type]++
+		}
+		sids, ok := ids.Services[key]
+		if !ok {
+			sids = &serviceIDs{Characteristics: make(map[string]uint64)}
+			ids.Services[key] = sids
+		}
+		slots = append(slots, slot{id: &svc.ID, saved: sids.ID, save: func(id uint64) { sids.ID = id }})
+
+		seen := make(map[string]int)
+		for _, c := range svc.GetCharacteristics() {
+			ckey := c.Type
+			if n := seen[c.Type]; n > 0 {
+				ckey = fmt.Sprintf("%s#%d", c.Type, n)
+			}
+			seen[c.Type]++
+			slots = append(slots, slot{id: &c.ID, saved: sids.Characteristics[ckey], save: func(id uint64) { sids.Characteristics[ckey] = id }})
+		}
+	}
+
+	used := make(map[uint64]bool)
+	for _, sids := range ids.Services {
+		used[sids.ID] = true
+		for _, id := range sids.Characteristics {
+			used[id] = true
+		}
+	}
+
+	// Keep the IDs hc gave a new accessory, as far as they are unique.
+	if !known {
+		for i, s := range slots {
+			if *s.id > 0 && !used[*s.id] {
+				used[*s.id] = true
+				s.save(*s.id)
+				slots[i].saved = *s.id
+			}
+		}
+	}
+	for id := range used {
+		if id >= ids.Next {
+			ids.Next = id + 1
+		}
+	}
+
+	for _, s := range slots {
+		if s.saved == 0 {
+			s.saved = ids.Next
+			ids.Next++
+			s.save(s.saved)
+			changed = true
+		}
+		*s.id = s.saved
+	}
+	return changed
+}
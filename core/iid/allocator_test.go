@@ -0,0 +1,181 @@
+package iid
+
+import (
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	hcutil "github.com/brutella/hc/util"
+	"testing"
+)
+
+func newPresetOutlet(name string) *service.Outlet {
+	outlet := service.NewOutlet()
+	nameChar := characteristic.NewName()
+	nameChar.Value = name
+	outlet.AddCharacteristic(nameChar.Characteristic)
+	return outlet
+}
+
+// buildAccessory builds an outlet accessory with one service per preset, in
+// the given order, the way core.AddWledPreset does.
+func buildAccessory(alloc *Allocator, presets ...string) (*accessory.Outlet, map[string]*service.Outlet) {
+	acc := accessory.NewOutlet(accessory.Info{Name: "Test", ID: 2})
+	services := make(map[string]*service.Outlet)
+	for _, p := range presets {
+		outlet := newPresetOutlet(p)
+		alloc.Name(outlet.Service, "preset/"+p)
+		acc.AddService(outlet.Service)
+		services[p] = outlet
+	}
+	acc.UpdateIDs()
+	return acc, services
+}
+
+type snapshot map[string][]uint64
+
+func ids(services map[string]*service.Outlet) snapshot {
+	s := make(snapshot)
+	for name, svc := range services {
+		s[name] = append(s[name], svc.ID)
+		for _, c := range svc.GetCharacteristics() {
+			s[name] = append(s[name], c.ID)
+		}
+	}
+	return s
+}
+
+func TestAssignStableAcrossOrder(t *testing.T) {
+	storage, err := hcutil.NewTempFileStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alloc, err := NewAllocatorWithStorage(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc, services := buildAccessory(alloc, "1", "2", "3")
+	if err := alloc.Assign(acc.Accessory); err != nil {
+		t.Fatal(err)
+	}
+	want := ids(services)
+	infoID := acc.Info.ID
+
+	// Restart with the presets in a different order and one removed
+	alloc, err = NewAllocatorWithStorage(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc, services = buildAccessory(alloc, "3", "1")
+	// Calling UpdateIDs repeatedly shifts every ID in hc
+	acc.UpdateIDs()
+	if err := alloc.Assign(acc.Accessory); err != nil {
+		t.Fatal(err)
+	}
+	got := ids(services)
+	for _, name := range []string{"1", "3"} {
+		if len(got[name]) != len(want[name]) {
+			t.Fatalf("preset %s: got %v, want %v", name, got[name], want[name])
+		}
+		for i := range got[name] {
+			if got[name][i] != want[name][i] {
+				t.Errorf("preset %s: got %v, want %v", name, got[name], want[name])
+				break
+			}
+		}
+	}
+	if acc.Info.ID != infoID {
+		t.Errorf("accessory information service: got %d, want %d", acc.Info.ID, infoID)
+	}
+
+	// A new preset must not reuse the IDs of the removed one
+	outlet := newPresetOutlet("4")
+	alloc.Name(outlet.Service, "preset/4")
+	acc.AddService(outlet.Service)
+	if err := alloc.Assign(acc.Accessory); err != nil {
+		t.Fatal(err)
+	}
+	reserved := make(map[uint64]bool)
+	for _, list := range want {
+		for _, id := range list {
+			reserved[id] = true
+		}
+	}
+	if reserved[outlet.ID] {
+		t.Errorf("new preset reused ID %d", outlet.ID)
+	}
+	for _, c := range outlet.GetCharacteristics() {
+		if reserved[c.ID] {
+			t.Errorf("new preset characteristic reused ID %d", c.ID)
+		}
+	}
+}
+
+func TestAssignUnique(t *testing.T) {
+	storage, err := hcutil.NewTempFileStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alloc, err := NewAllocatorWithStorage(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Unnamed services of the same type are keyed by position
+	acc, _ := buildAccessory(alloc)
+	for i := 0; i < 3; i++ {
+		acc.AddService(newPresetOutlet("unnamed").Service)
+	}
+	if err := alloc.Assign(acc.Accessory); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[uint64]bool)
+	for _, svc := range acc.GetServices() {
+		for _, id := range append([]uint64{svc.ID}, charIDs(svc)...) {
+			if id == 0 || seen[id] {
+				t.Fatalf("ID %d is zero or duplicated", id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func charIDs(svc *service.Service) (ids []uint64) {
+	for _, c := range svc.GetCharacteristics() {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+func TestAccessoryID(t *testing.T) {
+	storage, err := hcutil.NewTempFileStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alloc, err := NewAllocatorWithStorage(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shelf, err := alloc.AccessoryID("device/shelf/light")
+	if err != nil {
+		t.Fatal(err)
+	}
+	desk, err := alloc.AccessoryID("device/desk/light")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shelf != FirstAccessoryID || desk != FirstAccessoryID+1 {
+		t.Fatalf("Got IDs %d and %d, want %d and %d", shelf, desk, FirstAccessoryID, FirstAccessoryID+1)
+	}
+
+	// A new allocator on the same storage keeps the IDs and does not reuse them
+	alloc, err = NewAllocatorWithStorage(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := alloc.AccessoryID("device/desk/light"); id != desk {
+		t.Fatalf("Got ID %d after reloading, want %d", id, desk)
+	}
+	if id, _ := alloc.AccessoryID("device/hall/light"); id != FirstAccessoryID+2 {
+		t.Fatalf("Got ID %d for a new key, want %d", id, FirstAccessoryID+2)
+	}
+}
@@ -1,43 +1,87 @@
 package core
 
 import (
-	"fmt"
 	hclog "github.com/brutella/hc/log"
-	"github.com/gorilla/websocket"
-	"gopkg.in/yaml.v3"
+	log "github.com/sirupsen/logrus"
 	"hyperkit/core/airplayserver"
-	"io/ioutil"
+	"hyperkit/core/events"
+	"hyperkit/core/wled"
+	"io"
+	"os"
+	"time"
 )
 
-func InitConfig() (*Config, error) {
-	// Parse the config file
-	configBytes, err := ioutil.ReadFile("/etc/hyperkit.conf")
-	if err != nil {
-		return nil, fmt.Errorf("error reading config file: %v", err)
-	}
-
-	config := new(Config)
-	if err := yaml.Unmarshal(configBytes, config); err != nil {
-		return nil, fmt.Errorf("error parsing config file: %v", err)
-	}
+// initLogging sends the log to stdout and the configured log file, and turns
+// on debug logging, the metrics and the profiler if enabled.
+func initLogging(config *Config) {
+	setLogFile(config.LogFile)
+	setDebug(config.Debug)
+	setDebugServer(config)
+}
 
-	if len(config.WledIP) <= 0 {
-		return nil, fmt.Errorf("wled_ip must not be empty in /etc/hyperkit.conf")
+func setLogFile(path string) {
+	logFile, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Warnf("Error opening logfile, logging to stdout only: %v\n", err)
+		log.SetOutput(os.Stdout)
+		return
 	}
+	log.SetOutput(io.MultiWriter(os.Stdout, logFile))
+}
 
-	if config.Debug {
+func setDebug(debug bool) {
+	if debug {
+		log.SetLevel(log.DebugLevel)
 		hclog.Debug.Enable()
-		airplayserver.StartProfiler()
+		return
 	}
+	log.SetLevel(log.InfoLevel)
+	hclog.Debug.Disable()
+}
 
-	return config, nil
+// setDebugServer runs the server on :6060 while metrics or debug logging are
+// enabled. pprof is only served with debug logging.
+func setDebugServer(config *Config) {
+	if config.MetricsEnabled || config.Debug {
+		airplayserver.StartDebugServer(config.Debug)
+		return
+	}
+	airplayserver.StopDebugServer()
 }
 
-func InitWebSocket(wledIP string) (socket *websocket.Conn, err error) {
-	if socket, _, err = websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws", wledIP), nil); err != nil {
-		return nil, fmt.Errorf("error dialing 'ws://%s/ws': %v", wledIP, err)
+// InitWledClient starts a supervised connection to the WLED controller dev
+// and waits briefly for it to come up. A controller that is unreachable at
+// startup is not fatal; commands are queued or dropped until it connects. If
+// dev has a MAC or mDNS name, its address is looked up over mDNS whenever it
+// is unknown or the connection drops. The link going up and down is published
+// on bus.
+func InitWledClient(dev WledDevice, config *Config, bus *events.Bus) *wled.Client {
+	opts := wled.Options{QueueWhileDown: config.WledQueueCommands}
+	where := dev.IP
+	if match := dev.match(); !match.Empty() {
+		opts.Resolve = match.Resolve
+		if where == "" {
+			where = match.String()
+		}
+	}
+	client := wled.NewClient(dev.IP, opts)
+	up := false
+	client.OnConnState(func(s wled.ConnState) {
+		log.Infof("WLED link to %s at %s is %s\n", dev.Name, client.Host(), s)
+		switch {
+		case s == wled.Connected && !up:
+			up = true
+			bus.Publish(events.WledLinkUp, events.WledLink{Device: dev.Name, Host: client.Host()})
+		case s != wled.Connected && up:
+			up = false
+			bus.Publish(events.WledLinkDown, events.WledLink{Device: dev.Name, Host: client.Host()})
+		}
+	})
+	client.Start()
+	if !client.WaitConnected(5 * time.Second) {
+		log.Warnf("WLED %s at %s is not reachable yet, retrying in the background\n", dev.Name, where)
 	}
-	return socket, nil
+	return client
 }
 
 /*func init() {
@@ -116,12 +160,3 @@ func InitWebSocket(wledIP string) (socket *websocket.Conn, err error) {
 	hyperCube.Outlet.Service.AddCharacteristic(hyperCubeName.Characteristic)
 }
 */
-type Config struct {
-	WledIP            string `yaml:"wled_ip,omitempty"`
-	DefaultSolid      bool   `yaml:"use_default_solid,omitempty"`
-	DefaultSpeed      uint8  `yaml:"default_speed,omitempty"`
-	DefaultBrightness uint8  `yaml:"default_brightness,omitempty"`
-	Debug             bool   `yaml:"debug_logging,omitempty"`
-	LogFile           string `yaml:"logfile,omitempty"`
-	BtDeviceName      string `yaml:"bluetooth_device,omitempty"`
-}
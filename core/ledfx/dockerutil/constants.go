@@ -79,3 +79,15 @@ const (
 	StatePaused
 	StateUnknown
 )
+
+func (s State) String() string {
+	switch s {
+	case StateOnline:
+		return "online"
+	case StateOffline:
+		return "offline"
+	case StatePaused:
+		return "paused"
+	}
+	return "unknown"
+}
@@ -13,10 +13,13 @@ var (
 	dockerPath string
 )
 
+// init looks docker up once. Without it, LedFX cannot run, but HyperKit can
+// with the built-in audio effects, so every container operation fails
+// instead.
 func init() {
 	var err error
 	if dockerPath, err = CheckDocker(); err != nil {
-		log.Fatalf("could not find docker: %v\n", err)
+		log.Warnf("could not find docker, LedFX will not work: %v\n", err)
 	}
 }
 
@@ -31,29 +34,41 @@ func CheckDocker() (path string, err error) {
 	return absPath, nil
 }
 
+// docker runs docker with args and returns its output as the error if it
+// fails.
+func docker(args []string) error {
+	if dockerPath == "" {
+		return fmt.Errorf("could not find docker: %w", exec.ErrNotFound)
+	}
+	return util.FormatExecOutputToError(exec.Command(dockerPath, args...).CombinedOutput())
+}
+
 func PauseContainer() error {
-	return util.FormatExecOutputToError(exec.Command(dockerPath, LedFxContainerPauseArgs...).CombinedOutput())
+	return docker(LedFxContainerPauseArgs)
 }
 func ResumeContainer() error {
-	return util.FormatExecOutputToError(exec.Command(dockerPath, LedFxContainerUnpauseArgs...).CombinedOutput())
+	return docker(LedFxContainerUnpauseArgs)
 }
 
 func StartContainer() error {
-	return util.FormatExecOutputToError(exec.Command(dockerPath, LedFxContainerStartArgs...).CombinedOutput())
+	return docker(LedFxContainerStartArgs)
 }
 
 func RestartContainer() error {
-	return util.FormatExecOutputToError(exec.Command(dockerPath, LedFxContainerRestartArgs...).CombinedOutput())
+	return docker(LedFxContainerRestartArgs)
 }
 
 func CreateContainerIfNotExist() error {
 	if !ContainerExists() {
-		return util.FormatExecOutputToError(exec.Command(dockerPath, LedFxContainerCreateArgs...).CombinedOutput())
+		return docker(LedFxContainerCreateArgs)
 	}
 	return nil
 }
 
 func ContainerExists() bool {
+	if dockerPath == "" {
+		return false
+	}
 	cmd := exec.Command(dockerPath, LedFxContainerInspectArgs...)
 	_ = cmd.Start()
 	_ = cmd.Wait()
@@ -61,6 +76,9 @@ func ContainerExists() bool {
 }
 
 func ContainerState() State {
+	if dockerPath == "" {
+		return StateUnknown
+	}
 	out, err := exec.Command(dockerPath, LedFxContainerGetStateArgs...).Output()
 	if err != nil {
 		log.Errorf("Error getting container state: %v\n", err)
@@ -1,28 +1,57 @@
 package ledfx
 
 import (
+	"context"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"hyperkit/core/errorTypes"
+	"hyperkit/core/events"
 	"hyperkit/core/ledfx/dockerutil" //nolint:typecheck
+	"hyperkit/core/lifecycle"
+	"hyperkit/core/metrics"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Controller struct {
 	dockerPath string
+	status     lifecycle.Status
+	bus        *events.Bus
+
+	// state is the last container state published on bus.
+	stateMu  sync.Mutex
+	state    dockerutil.State
+	observed bool
+}
+
+func NewController(bus *events.Bus) (ctl *Controller) {
+	return &Controller{bus: bus}
 }
 
-func NewController() (ctl *Controller, err error) {
+// Start creates the LedFX container if needed and leaves it paused until
+// audio is played.
+func (ctl *Controller) Start(ctx context.Context) error {
+	ctl.status.Set(lifecycle.Starting, nil)
+	if err := errorTypes.RunWithContext(ctx, "starting LedFX container", ctl.start); err != nil {
+		ctl.status.Set(lifecycle.Failed, err)
+		return err
+	}
+	ctl.status.Set(lifecycle.Running, nil)
+	return nil
+}
+
+func (ctl *Controller) start() error {
 	if err := dockerutil.CreateContainerIfNotExist(); err != nil {
-		return nil, fmt.Errorf("error creating container if nonexistent: %w", err)
+		return fmt.Errorf("error creating container if nonexistent: %w", err)
 	}
 
 	switch dockerutil.ContainerState() {
 	case dockerutil.StatePaused:
-		return ctl, nil
+		return nil
 	case dockerutil.StateOffline:
 		if err := dockerutil.StartContainer(); err != nil {
-			return nil, fmt.Errorf("error starting container: %w", err)
+			return fmt.Errorf("error starting container: %w", err)
 		}
 		defer func() {
 			time.Sleep(3 * time.Second)
@@ -32,22 +61,71 @@ func NewController() (ctl *Controller, err error) {
 		}()
 	case dockerutil.StateOnline:
 		if err := ctl.Pause(); err != nil {
-			return nil, fmt.Errorf("error pausing container: %w", err)
+			return fmt.Errorf("error pausing container: %w", err)
 		}
 	case dockerutil.StateUnknown:
-		return nil, fmt.Errorf("unknown container state")
+		return fmt.Errorf("unknown container state")
 	}
 
-	return ctl, nil
+	return nil
+}
+
+// Stop pauses the container.
+func (ctl *Controller) Stop(ctx context.Context) error {
+	ctl.status.Set(lifecycle.Stopping, nil)
+	err := errorTypes.RunWithContext(ctx, "pausing LedFX", ctl.Pause)
+	ctl.status.Set(lifecycle.Stopped, err)
+	return err
+}
+
+// Health reports the container as failed once it is no longer running, so
+// that it is started again.
+func (ctl *Controller) Health() lifecycle.Health {
+	h := ctl.status.Health()
+	if h.State != lifecycle.Running && h.State != lifecycle.Degraded {
+		return h
+	}
+	state := dockerutil.ContainerState()
+	ctl.observe(state)
+	switch state {
+	case dockerutil.StateOffline:
+		ctl.status.Set(lifecycle.Failed, fmt.Errorf("container is not running"))
+	case dockerutil.StateUnknown:
+		ctl.status.Set(lifecycle.Degraded, fmt.Errorf("unknown container state"))
+	default:
+		ctl.status.Set(lifecycle.Running, nil)
+	}
+	return ctl.status.Health()
+}
+
+// State returns the state of the container.
+func (ctl *Controller) State() dockerutil.State {
+	state := dockerutil.ContainerState()
+	ctl.observe(state)
+	return state
+}
+
+// observe publishes the container state if it changed.
+func (ctl *Controller) observe(state dockerutil.State) {
+	ctl.stateMu.Lock()
+	defer ctl.stateMu.Unlock()
+	if ctl.observed && ctl.state == state {
+		return
+	}
+	ctl.state, ctl.observed = state, true
+	metrics.LedFXTransitions.WithLabelValues(state.String()).Inc()
+	ctl.bus.Publish(events.LedFXStateChanged, events.LedFX{State: state.String()})
 }
 
 func (ctl *Controller) Pause() error {
 	if err := dockerutil.PauseContainer(); err != nil {
 		if strings.Contains(err.Error(), "is already paused") {
+			ctl.observe(dockerutil.StatePaused)
 			return nil
 		}
 		return fmt.Errorf("error pausing container: %w", err)
 	}
+	ctl.observe(dockerutil.StatePaused)
 	return nil
 }
 
@@ -58,5 +136,6 @@ func (ctl *Controller) Resume() error {
 		}
 		return fmt.Errorf("error resuming container: %w", err)
 	}
+	ctl.observe(dockerutil.StateOnline)
 	return nil
 }
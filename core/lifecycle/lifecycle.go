@@ -0,0 +1,149 @@
+// Package lifecycle gives HyperKit's components a common way to be started,
+// stopped and health checked, and supervises them.
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Service is a long-running component.
+//
+// Start brings the component up and returns once it is running; ctx bounds
+// the startup only, work that outlives Start must be stopped by Stop. Stop
+// tears it down and returns once every goroutine it started has exited or ctx
+// is done. A stopped service can be started again.
+type Service interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+	Health() Health
+}
+
+// State is the state of a Service.
+type State uint8
+
+const (
+	Stopped State = iota
+	Starting
+	Running
+	// Degraded services run but cannot do all of their work yet, e.g. a
+	// connection that is being retried in the background.
+	Degraded
+	// Failed services have stopped working and need to be restarted.
+	Failed
+	Stopping
+)
+
+func (s State) String() string {
+	switch s {
+	case Stopped:
+		return "stopped"
+	case Starting:
+		return "starting"
+	case Running:
+		return "running"
+	case Degraded:
+		return "degraded"
+	case Failed:
+		return "failed"
+	case Stopping:
+		return "stopping"
+	}
+	return "unknown"
+}
+
+// MarshalText encodes the state as its name.
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Health is the state of a Service and the error that caused it, if any.
+type Health struct {
+	State State     `json:"state"`
+	Err   error     `json:"-"`
+	Since time.Time `json:"since"`
+}
+
+func (h Health) String() string {
+	if h.Err != nil {
+		return fmt.Sprintf("%s: %v", h.State, h.Err)
+	}
+	return h.State.String()
+}
+
+// Status holds the Health of a Service. It is safe for concurrent use; the
+// zero value is Stopped.
+type Status struct {
+	mu     sync.Mutex
+	health Health
+}
+
+// Set records a new state. The time is only updated if the state changed.
+func (s *Status) Set(state State, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.health.State != state || s.health.Since.IsZero() {
+		s.health.Since = time.Now()
+	}
+	s.health.State, s.health.Err = state, err
+}
+
+// Health returns the last recorded state.
+func (s *Status) Health() Health {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.health
+	if h.Since.IsZero() {
+		h.Since = time.Now()
+	}
+	return h
+}
+
+// Group tracks the goroutines of a Service so that Stop can wait for them,
+// and marks the Service Failed if one of them panics.
+type Group struct {
+	wg     sync.WaitGroup
+	status *Status
+}
+
+// NewGroup returns a Group that reports panics to status.
+func NewGroup(status *Status) *Group {
+	return &Group{status: status}
+}
+
+// Go runs fn in a tracked goroutine. A panic in fn is recovered, logged and
+// marks the Service Failed.
+func (g *Group) Go(name string, fn func()) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer func() {
+			if v := recover(); v != nil {
+				log.Errorf("Goroutine %s panicked: %v\n%s", name, v, debug.Stack())
+				if g.status != nil {
+					g.status.Set(Failed, fmt.Errorf("%s panicked: %v", name, v))
+				}
+			}
+		}()
+		fn()
+	}()
+}
+
+// Wait waits for every goroutine started with Go to return, or for ctx.
+func (g *Group) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("error waiting for goroutines: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,278 @@
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hyperkit/core/errorTypes"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Options tunes a Supervisor. Zero values are replaced with the defaults
+// below.
+type Options struct {
+	// CheckInterval is how often the health of the services is checked.
+	CheckInterval time.Duration
+	// MinBackoff and MaxBackoff bound the delay between restarts of a
+	// service or goroutine that keeps failing.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// RestartTimeout bounds stopping and starting a failed service.
+	RestartTimeout time.Duration
+}
+
+const (
+	DefaultCheckInterval  = 5 * time.Second
+	DefaultMinBackoff     = time.Second
+	DefaultMaxBackoff     = time.Minute
+	DefaultRestartTimeout = 30 * time.Second
+)
+
+// ComponentStatus is the health of a supervised service.
+type ComponentStatus struct {
+	Name     string    `json:"name"`
+	State    State     `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Since    time.Time `json:"since"`
+	Restarts int       `json:"restarts"`
+}
+
+type entry struct {
+	name        string
+	svc         Service
+	started     bool
+	restarts    int
+	backoff     time.Duration
+	nextRestart time.Time
+	lastState   State
+}
+
+// Supervisor starts services in the order they were added, stops them in
+// reverse order, and restarts services that report Failed.
+type Supervisor struct {
+	opts    Options
+	mu      sync.Mutex
+	entries []*entry
+	started bool
+
+	stop   chan struct{}
+	status Status
+	group  *Group
+}
+
+func NewSupervisor(opts Options) *Supervisor {
+	if opts.CheckInterval <= 0 {
+		opts.CheckInterval = DefaultCheckInterval
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = DefaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	if opts.RestartTimeout <= 0 {
+		opts.RestartTimeout = DefaultRestartTimeout
+	}
+	s := &Supervisor{opts: opts}
+	s.group = NewGroup(&s.status)
+	return s
+}
+
+// Add registers a service under name. Services have to be added before
+// Start.
+func (s *Supervisor) Add(name string, svc Service) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, &entry{name: name, svc: svc, backoff: s.opts.MinBackoff})
+}
+
+// Start starts the services in order. If one fails to start, the ones
+// already started are stopped again and the error is returned.
+func (s *Supervisor) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return fmt.Errorf("supervisor already started")
+	}
+	for i, e := range s.entries {
+		log.Infof("Starting %s...\n", e.name)
+		if err := e.svc.Start(ctx); err != nil {
+			stopErr := s.stopEntries(ctx, s.entries[:i])
+			if stopErr != nil {
+				log.Errorf("Error stopping services after failed start: %v\n", stopErr)
+			}
+			return fmt.Errorf("error starting %s: %w", e.name, err)
+		}
+		e.started = true
+	}
+	s.started = true
+	s.stop = make(chan struct{})
+	s.status.Set(Running, nil)
+	stop := s.stop
+	s.group.Go("supervisor", func() { s.monitor(stop) })
+	return nil
+}
+
+// Stop stops the supervised goroutines and then the services in reverse
+// order. Every service is stopped even if stopping another one fails.
+func (s *Supervisor) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.started {
+		s.mu.Unlock()
+		return nil
+	}
+	s.started = false
+	close(s.stop)
+	s.status.Set(Stopping, nil)
+	s.mu.Unlock()
+
+	errs := new(errorTypes.MultiError)
+	// The monitor may be restarting a service, so wait for it first.
+	errs.Append(s.group.Wait(ctx))
+
+	s.mu.Lock()
+	errs.Append(s.stopEntries(ctx, s.entries))
+	s.mu.Unlock()
+	s.status.Set(Stopped, nil)
+	return errs.ErrorOrNil()
+}
+
+// stopEntries stops entries in reverse order. Must be called with s.mu held.
+func (s *Supervisor) stopEntries(ctx context.Context, entries []*entry) error {
+	errs := new(errorTypes.MultiError)
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if !e.started {
+			continue
+		}
+		log.Infof("Stopping %s...\n", e.name)
+		if err := e.svc.Stop(ctx); err != nil {
+			errs.Append(fmt.Errorf("error stopping %s: %w", e.name, err))
+		}
+		e.started = false
+	}
+	return errs.ErrorOrNil()
+}
+
+// Go runs fn in a goroutine that is restarted with backoff if it panics,
+// until the supervisor is stopped. fn must return once stop is closed. It
+// can only be called after Start.
+func (s *Supervisor) Go(name string, fn func(stop <-chan struct{})) {
+	s.mu.Lock()
+	stop := s.stop
+	s.mu.Unlock()
+	if stop == nil {
+		log.Errorf("Cannot run %s before the supervisor is started\n", name)
+		return
+	}
+	s.group.Go(name, func() {
+		backoff := s.opts.MinBackoff
+		for {
+			if !s.runRecovered(name, fn, stop) {
+				return
+			}
+			log.Warnf("Restarting %s in %v\n", name, backoff)
+			select {
+			case <-stop:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > s.opts.MaxBackoff {
+				backoff = s.opts.MaxBackoff
+			}
+		}
+	})
+}
+
+// runRecovered runs fn and reports whether it panicked.
+func (s *Supervisor) runRecovered(name string, fn func(stop <-chan struct{}), stop <-chan struct{}) (panicked bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Errorf("Goroutine %s panicked: %v\n%s", name, v, debug.Stack())
+			panicked = true
+		}
+	}()
+	fn(stop)
+	return false
+}
+
+// Status returns the health of every service, in start order.
+func (s *Supervisor) Status() []ComponentStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]ComponentStatus, 0, len(s.entries))
+	for _, e := range s.entries {
+		h := e.svc.Health()
+		status := ComponentStatus{Name: e.name, State: h.State, Since: h.Since, Restarts: e.restarts}
+		if h.Err != nil {
+			status.Error = h.Err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func (s *Supervisor) monitor(stop chan struct{}) {
+	ticker := time.NewTicker(s.opts.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		entries := append([]*entry{}, s.entries...)
+		s.mu.Unlock()
+		for _, e := range entries {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.check(e)
+		}
+	}
+}
+
+// check logs state changes of e and restarts it if it failed. It only runs
+// on the monitor goroutine, and Stop waits for that to exit before stopping
+// the services, so s.mu is not held while restarting.
+func (s *Supervisor) check(e *entry) {
+	h := e.svc.Health()
+	if h.State != e.lastState {
+		log.Infof("Component %s is %s\n", e.name, h)
+		e.lastState = h.State
+	}
+	switch h.State {
+	case Running:
+		e.backoff = s.opts.MinBackoff
+		return
+	case Failed:
+	default:
+		return
+	}
+	if time.Now().Before(e.nextRestart) {
+		return
+	}
+
+	s.mu.Lock()
+	e.restarts++
+	restarts := e.restarts
+	s.mu.Unlock()
+	log.Warnf("Restarting %s (restart %d)...\n", e.name, restarts)
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.RestartTimeout)
+	defer cancel()
+	if err := e.svc.Stop(ctx); err != nil {
+		log.Warnf("Error stopping %s: %v\n", e.name, err)
+	}
+	if err := e.svc.Start(ctx); err != nil {
+		log.Errorf("Error restarting %s: %v\n", e.name, err)
+	}
+	e.nextRestart = time.Now().Add(e.backoff)
+	if e.backoff *= 2; e.backoff > s.opts.MaxBackoff {
+		e.backoff = s.opts.MaxBackoff
+	}
+}
@@ -0,0 +1,159 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeService records the order it was started and stopped in.
+type fakeService struct {
+	name     string
+	log      *[]string
+	logMu    *sync.Mutex
+	startErr error
+	status   Status
+}
+
+func (f *fakeService) record(event string) {
+	f.logMu.Lock()
+	defer f.logMu.Unlock()
+	*f.log = append(*f.log, event+" "+f.name)
+}
+
+func (f *fakeService) Start(context.Context) error {
+	f.record("start")
+	if f.startErr != nil {
+		return f.startErr
+	}
+	f.status.Set(Running, nil)
+	return nil
+}
+
+func (f *fakeService) Stop(context.Context) error {
+	f.record("stop")
+	f.status.Set(Stopped, nil)
+	return nil
+}
+
+func (f *fakeService) Health() Health {
+	return f.status.Health()
+}
+
+func newFakes(names ...string) ([]*fakeService, *[]string, *sync.Mutex) {
+	log, mu := new([]string), new(sync.Mutex)
+	fakes := make([]*fakeService, len(names))
+	for i, name := range names {
+		fakes[i] = &fakeService{name: name, log: log, logMu: mu}
+	}
+	return fakes, log, mu
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSupervisorOrder(t *testing.T) {
+	fakes, log, _ := newFakes("a", "b", "c")
+	s := NewSupervisor(Options{})
+	for _, f := range fakes {
+		s.Add(f.name, f)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("Error starting: %v\n", err)
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatalf("Error stopping: %v\n", err)
+	}
+	want := []string{"start a", "start b", "start c", "stop c", "stop b", "stop a"}
+	if !equal(*log, want) {
+		t.Fatalf("Got %v, want %v\n", *log, want)
+	}
+}
+
+func TestSupervisorFailedStart(t *testing.T) {
+	fakes, log, _ := newFakes("a", "b", "c")
+	fakes[1].startErr = errors.New("boom")
+	s := NewSupervisor(Options{})
+	for _, f := range fakes {
+		s.Add(f.name, f)
+	}
+	if err := s.Start(context.Background()); !errors.Is(err, fakes[1].startErr) {
+		t.Fatalf("Expected start error, got %v\n", err)
+	}
+	want := []string{"start a", "start b", "stop a"}
+	if !equal(*log, want) {
+		t.Fatalf("Got %v, want %v\n", *log, want)
+	}
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	fakes, log, mu := newFakes("a")
+	s := NewSupervisor(Options{CheckInterval: 5 * time.Millisecond, MinBackoff: time.Millisecond})
+	s.Add("a", fakes[0])
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("Error starting: %v\n", err)
+	}
+	defer s.Stop(context.Background())
+
+	fakes[0].status.Set(Failed, errors.New("crashed"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := s.Status()[0]
+		if status.Restarts == 1 && status.State == Running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for restart, status %+v\n", status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"start a", "stop a", "start a"}
+	if !equal(*log, want) {
+		t.Fatalf("Got %v, want %v\n", *log, want)
+	}
+}
+
+func TestSupervisorGo(t *testing.T) {
+	s := NewSupervisor(Options{MinBackoff: time.Millisecond})
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("Error starting: %v\n", err)
+	}
+	runs := make(chan int, 4)
+	n := 0
+	s.Go("panicky", func(stop <-chan struct{}) {
+		n++
+		runs <- n
+		if n == 1 {
+			panic("first run")
+		}
+		<-stop
+	})
+	for want := 1; want <= 2; want++ {
+		select {
+		case got := <-runs:
+			if got != want {
+				t.Fatalf("Got run %d, want %d\n", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for run %d\n", want)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatalf("Error stopping: %v\n", err)
+	}
+}
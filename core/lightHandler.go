@@ -0,0 +1,177 @@
+package core
+
+import (
+	"fmt"
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	log "github.com/sirupsen/logrus"
+	"hyperkit/core/util"
+	"hyperkit/core/wled"
+	"math"
+	"sync"
+)
+
+// LightHandler exposes WLED as a HomeKit Lightbulb with continuous brightness
+// and color, plus a Fan whose RotationSpeed controls the effect speed.
+type LightHandler struct {
+	light            *accessory.ColoredLightbulb
+	colorTemperature *characteristic.ColorTemperature
+
+	speedFan      *accessory.Accessory
+	speedService  *service.Fan
+	rotationSpeed *characteristic.RotationSpeed
+	lastSpeed     float64
+
+	mu  *sync.Mutex
+	dev *Device
+}
+
+func (d *Device) NewLightHandler() (l *LightHandler) {
+	l = &LightHandler{
+		dev:              d,
+		light:            accessory.NewColoredLightbulb(d.info("light", d.Name+" Light")),
+		colorTemperature: characteristic.NewColorTemperature(),
+		speedFan:         accessory.New(d.info("fan", d.Name+" Effect Speed"), accessory.TypeFan),
+		speedService:     service.NewFan(),
+		rotationSpeed:    characteristic.NewRotationSpeed(),
+		mu:               new(sync.Mutex),
+	}
+
+	bulb := l.light.Lightbulb
+	bulb.AddCharacteristic(l.colorTemperature.Characteristic)
+	bulb.On.SetValue(true)
+	bulb.Brightness.SetValue(byteToPercent(d.core.config.DefaultBrightness))
+	bulb.On.OnValueRemoteUpdate(d.presetHandler.SetPower)
+	bulb.Brightness.OnValueRemoteUpdate(func(percent int) {
+		l.setBrightness(percentToByte(float64(percent)))
+	})
+	bulb.Hue.OnValueRemoteUpdate(func(float64) { l.sendColor() })
+	bulb.Saturation.OnValueRemoteUpdate(func(float64) { l.sendColor() })
+	l.colorTemperature.OnValueRemoteUpdate(l.setColorTemperature)
+
+	speedName := characteristic.NewName()
+	speedName.Value = "Effect Speed"
+	l.speedService.AddCharacteristic(speedName.Characteristic)
+	l.speedService.AddCharacteristic(l.rotationSpeed.Characteristic)
+	l.speedService.On.SetValue(true)
+	l.lastSpeed = float64(byteToPercent(d.core.config.DefaultSpeed))
+	l.rotationSpeed.SetValue(l.lastSpeed)
+	l.speedService.On.OnValueRemoteUpdate(func(on bool) {
+		if !on {
+			l.setSpeed(0)
+			return
+		}
+		l.mu.Lock()
+		last := l.lastSpeed
+		l.mu.Unlock()
+		l.rotationSpeed.SetValue(last)
+		l.setSpeed(percentToByte(last))
+	})
+	l.rotationSpeed.OnValueRemoteUpdate(func(percent float64) {
+		if percent > 0 {
+			l.mu.Lock()
+			l.lastSpeed = percent
+			l.mu.Unlock()
+		}
+		l.setSpeed(percentToByte(percent))
+	})
+	l.speedFan.AddService(l.speedService.Service)
+
+	return l
+}
+
+func (l *LightHandler) setBrightness(brightness uint8) error {
+	if err := l.dev.wled.Send(buildBrightnessState(brightness)); err != nil {
+		log.Errorf("Error setting brightness to %d: %v\n", brightness, err)
+		return fmt.Errorf("error setting brightness: %w", err)
+	}
+	log.Infof("Set brightness to %d (%.2f%%)\n", brightness, (float64(brightness)/255)*100)
+	return nil
+}
+
+func (l *LightHandler) setSpeed(speed uint8) error {
+	if err := l.dev.wled.Send(buildSpeedState(speed)); err != nil {
+		log.Errorf("Error setting speed to %d: %v\n", speed, err)
+		return fmt.Errorf("error setting speed: %w", err)
+	}
+	log.Infof("Set speed to %d (%.2f%%)\n", speed, (float64(speed)/255)*100)
+	return nil
+}
+
+// sendColor sends the current hue and saturation as the primary color of the
+// main segment. Brightness is left to "bri", so the color is sent at full value.
+func (l *LightHandler) sendColor() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bulb := l.light.Lightbulb
+	r, g, b := util.HSVToRGB(bulb.Hue.GetValue(), bulb.Saturation.GetValue(), 100)
+	l.dev.stopEffect()
+	if err := l.dev.wled.Send(buildColorState(r, g, b)); err != nil {
+		log.Errorf("Error setting color to (%d, %d, %d): %v\n", r, g, b, err)
+		return
+	}
+	log.Infof("Set color to (%d, %d, %d)\n", r, g, b)
+}
+
+func (l *LightHandler) setColorTemperature(mired int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kelvin := util.MiredToKelvin(mired)
+	l.dev.stopEffect()
+	if err := l.dev.wled.Send(buildColorTemperatureState(kelvin)); err != nil {
+		log.Errorf("Error setting color temperature to %dK: %v\n", kelvin, err)
+		return
+	}
+	log.Infof("Set color temperature to %dK\n", kelvin)
+}
+
+// sync mirrors a state pushed by WLED onto the light and speed accessories
+// without sending anything back to WLED.
+func (l *LightHandler) sync(st *wled.State) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bulb := l.light.Lightbulb
+	if st.On != nil && bulb.On.GetValue() != st.On.Bool() {
+		bulb.On.SetValue(st.On.Bool())
+	}
+	if st.Brightness != nil {
+		if percent := byteToPercent(uint8(*st.Brightness)); bulb.Brightness.GetValue() != percent {
+			bulb.Brightness.SetValue(percent)
+		}
+	}
+	seg := mainSegment(st)
+	if seg == nil {
+		return
+	}
+	if len(seg.Colors) > 0 && len(seg.Colors[0]) >= 3 {
+		col := seg.Colors[0]
+		hue, sat, _ := util.RGBToHSV(col[0], col[1], col[2])
+		if math.Abs(bulb.Hue.GetValue()-hue) >= 1 {
+			bulb.Hue.SetValue(math.Round(hue))
+		}
+		if math.Abs(bulb.Saturation.GetValue()-sat) >= 1 {
+			bulb.Saturation.SetValue(math.Round(sat))
+		}
+	}
+	if seg.Speed != nil {
+		percent := float64(byteToPercent(uint8(*seg.Speed)))
+		if l.rotationSpeed.GetValue() != percent {
+			l.rotationSpeed.SetValue(percent)
+		}
+		if percent > 0 {
+			l.lastSpeed = percent
+		}
+		if l.speedService.On.GetValue() != (percent > 0) {
+			l.speedService.On.SetValue(percent > 0)
+		}
+	}
+}
+
+func byteToPercent(v uint8) int {
+	return int(math.Round(float64(v) * 100 / 255))
+}
+
+func percentToByte(percent float64) uint8 {
+	return uint8(math.Round(math.Max(0, math.Min(100, percent)) * 255 / 100))
+}
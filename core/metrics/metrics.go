@@ -0,0 +1,136 @@
+// Package metrics defines HyperKit's Prometheus metrics. Components update
+// them directly; Handler serves them on the debug server's /metrics.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+const namespace = "hyperkit"
+
+// Registry holds every HyperKit metric plus the Go runtime and process
+// collectors.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// Audio pipeline
+
+	PacketsDecoded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "audio", Name: "packets_decoded_total",
+		Help: "AirPlay audio packets decoded.",
+	})
+	DecodeErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "audio", Name: "decode_errors_total",
+		Help: "AirPlay audio packets that failed to decode.",
+	})
+	BytesWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "audio", Name: "written_bytes_total",
+		Help: "PCM bytes written, by output (fifo, oto or another audio sink).",
+	}, []string{"output"})
+	WriteLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Subsystem: "audio", Name: "write_duration_seconds",
+		Help:    "Time taken to write a decoded packet, by output (fifo, oto or another audio sink).",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+	}, []string{"output"})
+	DroppedFrames = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "audio", Name: "dropped_frames_total",
+		Help: "Audio packets that were not played, because decoding them failed.",
+	})
+	ConcealedPackets = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "audio", Name: "concealed_packets_total",
+		Help: "Audio packets that failed to decode and were replaced by a fade of the previous packet or silence.",
+	})
+	OutputDroppedPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "audio", Name: "output_dropped_packets_total",
+		Help: "Decoded packets an output skipped, because it fell behind or failed, by output.",
+	}, []string{"output"})
+	OutputOverruns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "audio", Name: "output_overruns_total",
+		Help: "Times an output fell further behind than the audio buffer holds, by output.",
+	}, []string{"output"})
+	OutputUnderruns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "audio", Name: "output_underruns_total",
+		Help: "Silent packets given to an output that ran out of audio, by output.",
+	}, []string{"output"})
+	OutputErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "audio", Name: "output_errors_total",
+		Help: "Times an output failed to open or write and was closed to be reopened, by output.",
+	}, []string{"output"})
+	OutputLatency = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "audio", Name: "output_latency_seconds",
+		Help: "How far an output plays behind the audio written to it, by output.",
+	}, []string{"output"})
+	Volume = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "airplay", Name: "volume",
+		Help: "Current AirPlay volume between 0 and 1.",
+	})
+	ActiveSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "airplay", Name: "active_sessions",
+		Help: "AirPlay sessions currently streaming.",
+	})
+
+	// WLED
+
+	WledReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "wled", Name: "reconnects_total",
+		Help: "Times the WLED websocket was connected again after the first connection, by controller.",
+	}, []string{"host"})
+	WledConnected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "wled", Name: "connected",
+		Help: "Whether the WLED websocket is connected (1) or not (0), by controller.",
+	}, []string{"host"})
+	WledCommandLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Subsystem: "wled", Name: "command_duration_seconds",
+		Help:    "Time taken to send a command to WLED, by controller and transport (ws or http).",
+		Buckets: prometheus.ExponentialBuckets(0.001, 3, 8),
+	}, []string{"host", "transport"})
+	RealtimeFrames = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "wled", Name: "realtime_frames_total",
+		Help: "Pixel frames streamed to WLED, by protocol and result (sent, failed, or coalesced into a later frame by the FPS limit).",
+	}, []string{"protocol", "result"})
+
+	// HomeKit
+
+	CharacteristicWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "homekit", Name: "characteristic_writes_total",
+		Help: "Characteristic values written by HomeKit controllers, by characteristic type.",
+	}, []string{"type"})
+
+	// Bluetooth and LedFX
+
+	BluetoothConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "bluetooth", Name: "connected",
+		Help: "Whether the Bluetooth audio device is connected (1) or not (0).",
+	})
+	LedFXTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "ledfx", Name: "state_transitions_total",
+		Help: "Times the LedFX container changed into each state.",
+	}, []string{"state"})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		PacketsDecoded, DecodeErrors, BytesWritten, WriteLatency, DroppedFrames, ConcealedPackets,
+		OutputDroppedPackets, OutputOverruns, OutputUnderruns, OutputErrors, OutputLatency, Volume, ActiveSessions,
+		WledReconnects, WledConnected, WledCommandLatency, RealtimeFrames,
+		CharacteristicWrites,
+		BluetoothConnected, LedFXTransitions,
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Bool converts a state to a gauge value.
+func Bool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,29 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	PacketsDecoded.Inc()
+	BytesWritten.WithLabelValues("fifo").Add(1024)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Got status %d\n", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"hyperkit_audio_packets_decoded_total 1",
+		`hyperkit_audio_written_bytes_total{output="fifo"} 1024`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("Metrics do not contain %q:\n%s", want, body)
+		}
+	}
+}
@@ -1,12 +1,13 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"github.com/brutella/hc/accessory"
 	"github.com/brutella/hc/characteristic"
 	"github.com/brutella/hc/service"
-	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
+	"hyperkit/core/lifecycle"
 	"sync"
 )
 
@@ -19,26 +20,15 @@ type MiscHandler struct {
 	brightnessSelector *accessory.Outlet
 	brightnessServices map[uint8]*service.Outlet
 	mu                 *sync.Mutex
-	core               *Core
+	dev                *Device
+	status             lifecycle.Status
 }
 
-func (c *Core) NewMiscHandler() (m *MiscHandler) {
+func (d *Device) NewMiscHandler() (m *MiscHandler) {
 	m = &MiscHandler{
-		core: c,
-		speedSelector: accessory.NewOutlet(accessory.Info{
-			Name:             "HyperCube Speed",
-			Manufacturer:     "Carter Peel",
-			Model:            "HyperCube v1.0.0",
-			FirmwareRevision: "HyperKit v1.0.0",
-			ID:               3,
-		}),
-		brightnessSelector: accessory.NewOutlet(accessory.Info{
-			Name:             "HyperCube Brightness",
-			Manufacturer:     "Carter Peel",
-			Model:            "HyperCube v1.0.0",
-			FirmwareRevision: "HyperKit v1.0.0",
-			ID:               4,
-		}),
+		dev:                d,
+		speedSelector:      accessory.NewOutlet(d.info("speed", d.Name+" Speed")),
+		brightnessSelector: accessory.NewOutlet(d.info("brightness", d.Name+" Brightness")),
 		speedServices:      make(map[uint8]*service.Outlet),
 		brightnessServices: make(map[uint8]*service.Outlet),
 		mu:                 new(sync.Mutex),
@@ -77,6 +67,7 @@ func (c *Core) NewMiscHandler() (m *MiscHandler) {
 		name := characteristic.NewName()
 		name.Value = fmt.Sprintf("%d", speed)
 		newOutlet.AddCharacteristic(name.Characteristic)
+		d.core.ids.Name(newOutlet.Service, fmt.Sprintf("speed/%d", speed))
 
 		newOutlet.AddLinkedService(m.speedSelector.Outlet.Service)
 		m.speedSelector.Outlet.AddLinkedService(newOutlet.Service)
@@ -102,6 +93,7 @@ func (c *Core) NewMiscHandler() (m *MiscHandler) {
 		name := characteristic.NewName()
 		name.Value = fmt.Sprintf("%d", brightness)
 		newOutlet.AddCharacteristic(name.Characteristic)
+		d.core.ids.Name(newOutlet.Service, fmt.Sprintf("brightness/%d", brightness))
 
 		newOutlet.AddLinkedService(m.brightnessSelector.Outlet.Service)
 		m.brightnessSelector.Outlet.AddLinkedService(newOutlet.Service)
@@ -124,11 +116,27 @@ func (c *Core) NewMiscHandler() (m *MiscHandler) {
 	return m
 }
 
+// Start and Stop only track the state; the selectors are driven by HomeKit
+// and have nothing running in the background.
+func (sph *MiscHandler) Start(context.Context) error {
+	sph.status.Set(lifecycle.Running, nil)
+	return nil
+}
+
+func (sph *MiscHandler) Stop(context.Context) error {
+	sph.status.Set(lifecycle.Stopped, nil)
+	return nil
+}
+
+func (sph *MiscHandler) Health() lifecycle.Health {
+	return sph.status.Health()
+}
+
 func (sph *MiscHandler) SetSpeed(speed uint8) {
 	sph.mu.Lock()
 	defer sph.mu.Unlock()
 	sph.curSpeed = speed
-	if err := sph.core.socket.WriteMessage(websocket.TextMessage, buildSpeedJson(speed)); err != nil {
+	if err := sph.dev.wled.Send(buildSpeedState(speed)); err != nil {
 		log.Errorf("Error setting speed to %d (%.2f%%): %v\n", speed, (float64(speed)/255)*100, err)
 		return
 	}
@@ -139,9 +147,46 @@ func (sph *MiscHandler) SetBrightness(brightness uint8) {
 	sph.mu.Lock()
 	defer sph.mu.Unlock()
 	sph.curBrightness = brightness
-	if err := sph.core.socket.WriteMessage(websocket.TextMessage, buildBrightnessJson(brightness)); err != nil {
+	if err := sph.dev.wled.Send(buildBrightnessState(brightness)); err != nil {
 		log.Errorf("Error setting brightness to %d (%.2f%%): %v\n", brightness, (float64(brightness)/255)*100, err)
 		return
 	}
 	log.Infof("Set brightness to %d (%.2f%%)\n", brightness, (float64(brightness)/255)*100)
 }
+
+// syncSpeed records a speed reported by WLED and selects the closest speed
+// outlet without sending anything back to WLED.
+func (sph *MiscHandler) syncSpeed(speed uint8) {
+	sph.mu.Lock()
+	defer sph.mu.Unlock()
+	sph.curSpeed = speed
+	selectNearest(sph.speedServices, speed)
+}
+
+// syncBrightness records a brightness reported by WLED and selects the
+// closest brightness outlet without sending anything back to WLED.
+func (sph *MiscHandler) syncBrightness(brightness uint8) {
+	sph.mu.Lock()
+	defer sph.mu.Unlock()
+	sph.curBrightness = brightness
+	selectNearest(sph.brightnessServices, brightness)
+}
+
+func selectNearest(services map[uint8]*service.Outlet, value uint8) {
+	var nearest uint8
+	bestDist := -1
+	for level := range services {
+		dist := int(level) - int(value)
+		if dist < 0 {
+			dist = -dist
+		}
+		if bestDist < 0 || dist < bestDist || (dist == bestDist && level < nearest) {
+			nearest, bestDist = level, dist
+		}
+	}
+	for level, svc := range services {
+		if svc.On.GetValue() != (level == nearest) {
+			svc.On.SetValue(level == nearest)
+		}
+	}
+}
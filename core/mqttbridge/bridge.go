@@ -0,0 +1,347 @@
+// Package mqttbridge connects HyperKit to an MQTT broker and announces it to
+// Home Assistant with MQTT discovery. It publishes the state of the lights
+// and passes the commands it receives to a Controller.
+package mqttbridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+	"hyperkit/core/events"
+	"hyperkit/core/lifecycle"
+	"hyperkit/core/restapi"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// publishTimeout bounds waiting for the broker to acknowledge a message.
+	publishTimeout = 5 * time.Second
+
+	online  = "online"
+	offline = "offline"
+)
+
+// Controller is what the bridge controls, implemented by core.Core.
+type Controller interface {
+	State() restapi.State
+	SetPower(on bool) error
+	SetBrightness(brightness uint8) error
+	SetSpeed(speed uint8) error
+	Presets() []restapi.Preset
+	ActivatePreset(id int) error
+	SetAirPlay(enabled bool) error
+	LedFXStatus() restapi.LedFX
+	BluetoothStatus() restapi.Bluetooth
+	Subscribe(types ...events.Type) *events.Subscription
+}
+
+// Options configure a Bridge.
+type Options struct {
+	// Broker is the broker URL, e.g. "tcp://localhost:1883".
+	Broker   string
+	Username string
+	Password string
+	// Topic prefixes the state and command topics. It also names the
+	// client and the Home Assistant device.
+	Topic string
+	// DiscoveryPrefix is the Home Assistant discovery prefix, usually
+	// "homeassistant".
+	DiscoveryPrefix string
+	// Name is the device name shown in Home Assistant.
+	Name string
+}
+
+// Bridge publishes the state of the lights and handles commands. It
+// implements lifecycle.Service.
+type Bridge struct {
+	ctl    Controller
+	opts   Options
+	nodeID string
+
+	client mqtt.Client
+	status lifecycle.Status
+	group  *lifecycle.Group
+	stop   chan struct{}
+
+	// effects are the preset names last announced to Home Assistant, which
+	// have to be announced again when the presets change.
+	mu      sync.Mutex
+	effects []string
+}
+
+// NewBridge returns a bridge for ctl.
+func NewBridge(ctl Controller, opts Options) *Bridge {
+	b := &Bridge{ctl: ctl, opts: opts, nodeID: nodeID(opts.Topic)}
+	b.group = lifecycle.NewGroup(&b.status)
+	return b
+}
+
+var unsafeID = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// nodeID turns the topic into a Home Assistant node ID.
+func nodeID(topic string) string {
+	return unsafeID.ReplaceAllString(topic, "_")
+}
+
+// Start connects to the broker in the background. The bridge is Degraded
+// until the connection is up, and while it is retried after being lost.
+func (b *Bridge) Start(context.Context) error {
+	opts := mqtt.NewClientOptions().
+		AddBroker(b.opts.Broker).
+		SetClientID(b.nodeID).
+		SetUsername(b.opts.Username).
+		SetPassword(b.opts.Password).
+		SetWill(b.topic("availability"), offline, 1, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5 * time.Second).
+		SetMaxReconnectInterval(time.Minute).
+		// Commands may wait on WLED, which must not hold up the client.
+		SetOrderMatters(false).
+		SetOnConnectHandler(b.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Warnf("Lost connection to MQTT broker: %v\n", err)
+			b.status.Set(lifecycle.Degraded, fmt.Errorf("lost connection to broker: %w", err))
+		})
+	b.client = mqtt.NewClient(opts)
+	b.stop = make(chan struct{})
+	b.status.Set(lifecycle.Degraded, fmt.Errorf("connecting to %s", b.opts.Broker))
+	b.client.Connect()
+
+	sub := b.ctl.Subscribe()
+	stop := b.stop
+	b.group.Go("mqtt-state", func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-sub.C:
+				// Publish once for a burst of events
+				for drained := false; !drained; {
+					select {
+					case <-sub.C:
+					default:
+						drained = true
+					}
+				}
+				b.publishState()
+			}
+		}
+	})
+	return nil
+}
+
+// Stop marks HyperKit offline in Home Assistant and disconnects.
+func (b *Bridge) Stop(ctx context.Context) error {
+	if b.stop == nil {
+		return nil
+	}
+	b.status.Set(lifecycle.Stopping, nil)
+	close(b.stop)
+	b.stop = nil
+	if b.client.IsConnectionOpen() {
+		b.publish(b.topic("availability"), true, offline)
+	}
+	b.client.Disconnect(250)
+	err := b.group.Wait(ctx)
+	b.status.Set(lifecycle.Stopped, nil)
+	return err
+}
+
+func (b *Bridge) Health() lifecycle.Health {
+	return b.status.Health()
+}
+
+// onConnect runs on every connection. The session is clean, so the command
+// topics are subscribed again and everything is published again.
+func (b *Bridge) onConnect(client mqtt.Client) {
+	log.Infof("Connected to MQTT broker %s\n", b.opts.Broker)
+	for topic, handler := range map[string]mqtt.MessageHandler{
+		b.topic("light/set"):               b.handleLight,
+		b.topic("speed/set"):               b.handleSpeed,
+		b.topic("airplay/set"):             b.handleAirPlay,
+		b.opts.DiscoveryPrefix + "/status": b.handleHomeAssistantStatus,
+	} {
+		if err := wait(client.Subscribe(topic, 1, handler)); err != nil {
+			b.status.Set(lifecycle.Degraded, fmt.Errorf("error subscribing to %s: %w", topic, err))
+			return
+		}
+	}
+	b.status.Set(lifecycle.Running, nil)
+	b.announce()
+	b.publish(b.topic("availability"), true, online)
+	b.publishState()
+}
+
+func (b *Bridge) topic(name string) string {
+	return b.opts.Topic + "/" + name
+}
+
+// publish sends a message and logs if the broker did not accept it. Messages
+// lost with the connection are not logged, since everything is published
+// again on reconnect.
+func (b *Bridge) publish(topic string, retained bool, payload interface{}) {
+	if err := wait(b.client.Publish(topic, 1, retained, payload)); err != nil && b.client.IsConnectionOpen() {
+		log.Warnf("Error publishing to %s: %v\n", topic, err)
+	}
+}
+
+func (b *Bridge) publishJSON(topic string, retained bool, v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("Error encoding message for %s: %v\n", topic, err)
+		return
+	}
+	b.publish(topic, retained, payload)
+}
+
+func wait(t mqtt.Token) error {
+	if !t.WaitTimeout(publishTimeout) {
+		return errors.New("timed out")
+	}
+	return t.Error()
+}
+
+// lightState is the state of the light in Home Assistant's JSON schema.
+type lightState struct {
+	State      string `json:"state"`
+	Brightness uint8  `json:"brightness"`
+	Effect     string `json:"effect,omitempty"`
+}
+
+func onOff(on bool) string {
+	if on {
+		return "ON"
+	}
+	return "OFF"
+}
+
+// publishState publishes the state of every entity, and announces the light
+// again if the presets changed.
+func (b *Bridge) publishState() {
+	if !b.client.IsConnectionOpen() {
+		return
+	}
+	presets := b.ctl.Presets()
+	effects := effectList(presets)
+	b.mu.Lock()
+	changed := !equal(b.effects, effects)
+	b.mu.Unlock()
+	if changed {
+		b.announceLight(presets)
+	}
+
+	st := b.ctl.State()
+	light := lightState{State: onOff(st.On), Brightness: st.Brightness}
+	for i, p := range presets {
+		if p.ID == st.Preset {
+			light.Effect = effects[i]
+		}
+	}
+	b.publishJSON(b.topic("light/state"), true, light)
+	b.publish(b.topic("speed/state"), true, strconv.Itoa(int(st.Speed)))
+	b.publish(b.topic("airplay/state"), true, onOff(st.AirPlay))
+	b.publishJSON(b.topic("bluetooth/state"), true, b.ctl.BluetoothStatus())
+	b.publishJSON(b.topic("ledfx/state"), true, b.ctl.LedFXStatus())
+}
+
+// handleLight applies a light command in Home Assistant's JSON schema. An
+// effect activates the preset of that name, which also switches the lights
+// on.
+func (b *Bridge) handleLight(_ mqtt.Client, msg mqtt.Message) {
+	defer b.publishState()
+	var cmd struct {
+		State      string `json:"state"`
+		Brightness *uint8 `json:"brightness"`
+		Effect     string `json:"effect"`
+	}
+	if err := json.Unmarshal(msg.Payload(), &cmd); err != nil {
+		log.Warnf("Invalid light command %q: %v\n", msg.Payload(), err)
+		return
+	}
+	if cmd.State == "OFF" {
+		logError("switching the lights off", b.ctl.SetPower(false))
+		return
+	}
+	if cmd.Effect != "" {
+		id, ok := b.presetID(cmd.Effect)
+		if !ok {
+			log.Warnf("Light command for unknown effect %q\n", cmd.Effect)
+			return
+		}
+		logError("activating preset", b.ctl.ActivatePreset(id))
+	} else if cmd.State == "ON" {
+		logError("switching the lights on", b.ctl.SetPower(true))
+	}
+	if cmd.Brightness != nil {
+		logError("setting brightness", b.ctl.SetBrightness(*cmd.Brightness))
+	}
+}
+
+// presetID returns the ID of the preset announced as the effect name.
+func (b *Bridge) presetID(name string) (int, bool) {
+	presets := b.ctl.Presets()
+	for i, effect := range effectList(presets) {
+		if effect == name {
+			return presets[i].ID, true
+		}
+	}
+	return 0, false
+}
+
+func (b *Bridge) handleSpeed(_ mqtt.Client, msg mqtt.Message) {
+	defer b.publishState()
+	speed, err := strconv.ParseUint(strings.TrimSpace(string(msg.Payload())), 10, 8)
+	if err != nil {
+		log.Warnf("Invalid speed command %q: must be between 0 and 255\n", msg.Payload())
+		return
+	}
+	logError("setting speed", b.ctl.SetSpeed(uint8(speed)))
+}
+
+func (b *Bridge) handleAirPlay(_ mqtt.Client, msg mqtt.Message) {
+	defer b.publishState()
+	switch string(msg.Payload()) {
+	case "ON":
+		logError("enabling AirPlay", b.ctl.SetAirPlay(true))
+	case "OFF":
+		logError("disabling AirPlay", b.ctl.SetAirPlay(false))
+	default:
+		log.Warnf("Invalid AirPlay command %q: must be ON or OFF\n", msg.Payload())
+	}
+}
+
+// handleHomeAssistantStatus announces HyperKit again when Home Assistant
+// comes online, in case the broker does not retain the announcements.
+func (b *Bridge) handleHomeAssistantStatus(_ mqtt.Client, msg mqtt.Message) {
+	if string(msg.Payload()) == online {
+		b.announce()
+		b.publishState()
+	}
+}
+
+func logError(action string, err error) {
+	if err != nil {
+		log.Errorf("Error %s from MQTT: %v\n", action, err)
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,215 @@
+package mqttbridge
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/eclipse/paho.mqtt.golang"
+	"hyperkit/core/events"
+	"hyperkit/core/restapi"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeController records the changes made over MQTT.
+type fakeController struct {
+	mu      sync.Mutex
+	state   restapi.State
+	presets []restapi.Preset
+	bus     *events.Bus
+}
+
+func (f *fakeController) State() restapi.State {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state
+}
+
+func (f *fakeController) SetPower(on bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state.On = on
+	return nil
+}
+
+func (f *fakeController) SetBrightness(brightness uint8) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state.Brightness = brightness
+	return nil
+}
+
+func (f *fakeController) SetSpeed(speed uint8) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state.Speed = speed
+	return nil
+}
+
+func (f *fakeController) Presets() []restapi.Preset {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]restapi.Preset(nil), f.presets...)
+}
+
+func (f *fakeController) ActivatePreset(id int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state.On, f.state.Preset = true, id
+	return nil
+}
+
+func (f *fakeController) SetAirPlay(enabled bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state.AirPlay = enabled
+	return nil
+}
+
+func (f *fakeController) LedFXStatus() restapi.LedFX { return restapi.LedFX{Container: "paused"} }
+
+func (f *fakeController) BluetoothStatus() restapi.Bluetooth {
+	return restapi.Bluetooth{Device: "speaker", Connected: true}
+}
+
+func (f *fakeController) Subscribe(types ...events.Type) *events.Subscription {
+	return f.bus.Subscribe(8, types...)
+}
+
+// homeAssistant is an MQTT client that keeps the last message of every topic.
+type homeAssistant struct {
+	client mqtt.Client
+
+	mu       sync.Mutex
+	messages map[string][]byte
+	changed  chan struct{}
+}
+
+func connectHomeAssistant(t *testing.T, broker *broker) *homeAssistant {
+	ha := &homeAssistant{messages: make(map[string][]byte), changed: make(chan struct{}, 1)}
+	ha.client = mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker.url()).SetClientID("homeassistant"))
+	if err := wait(ha.client.Connect()); err != nil {
+		t.Fatalf("Error connecting: %v\n", err)
+	}
+	t.Cleanup(func() { ha.client.Disconnect(0) })
+	err := wait(ha.client.Subscribe("#", 0, func(_ mqtt.Client, msg mqtt.Message) {
+		ha.mu.Lock()
+		ha.messages[msg.Topic()] = msg.Payload()
+		ha.mu.Unlock()
+		select {
+		case ha.changed <- struct{}{}:
+		default:
+		}
+	}))
+	if err != nil {
+		t.Fatalf("Error subscribing: %v\n", err)
+	}
+	return ha
+}
+
+// waitFor waits until the last message of topic satisfies ok.
+func (ha *homeAssistant) waitFor(t *testing.T, topic string, ok func(payload []byte) bool) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		ha.mu.Lock()
+		payload, found := ha.messages[topic]
+		ha.mu.Unlock()
+		if found && ok(payload) {
+			return
+		}
+		select {
+		case <-ha.changed:
+		case <-timeout:
+			t.Fatalf("Timed out waiting for %s, last message %q\n", topic, payload)
+		}
+	}
+}
+
+func (ha *homeAssistant) publish(t *testing.T, topic, payload string) {
+	t.Helper()
+	if err := wait(ha.client.Publish(topic, 0, false, payload)); err != nil {
+		t.Fatalf("Error publishing to %s: %v\n", topic, err)
+	}
+}
+
+func startBridge(t *testing.T, broker *broker, ctl *fakeController) *Bridge {
+	b := NewBridge(ctl, Options{Broker: broker.url(), Topic: "hyperkit", DiscoveryPrefix: "homeassistant", Name: "HyperBridge"})
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatalf("Error starting bridge: %v\n", err)
+	}
+	t.Cleanup(func() { b.Stop(context.Background()) })
+	return b
+}
+
+func is(want string) func([]byte) bool {
+	return func(payload []byte) bool { return string(payload) == want }
+}
+
+func TestDiscovery(t *testing.T) {
+	broker := newBroker(t)
+	ha := connectHomeAssistant(t, broker)
+	ctl := &fakeController{presets: []restapi.Preset{{ID: 1, Name: "Aurora"}}, bus: events.NewBus()}
+	b := startBridge(t, broker, ctl)
+
+	var light entity
+	ha.waitFor(t, "homeassistant/light/hyperkit/light/config", func(payload []byte) bool {
+		return json.Unmarshal(payload, &light) == nil
+	})
+	if light.CommandTopic != "hyperkit/light/set" || light.Schema != "json" || !light.Brightness || len(light.EffectList) != 1 || light.EffectList[0] != "Aurora" {
+		t.Fatalf("Unexpected light config %+v\n", light)
+	}
+	for _, topic := range []string{
+		"homeassistant/number/hyperkit/speed/config",
+		"homeassistant/switch/hyperkit/airplay/config",
+		"homeassistant/binary_sensor/hyperkit/bluetooth/config",
+		"homeassistant/sensor/hyperkit/ledfx/config",
+	} {
+		ha.waitFor(t, topic, func([]byte) bool { return true })
+	}
+	ha.waitFor(t, "hyperkit/availability", is(online))
+	ha.waitFor(t, "hyperkit/bluetooth/state", func(payload []byte) bool {
+		var bt struct{ Connected bool }
+		return json.Unmarshal(payload, &bt) == nil && bt.Connected
+	})
+	if h := b.Health(); h.State.String() != "running" {
+		t.Fatalf("Got health %s, want running\n", h)
+	}
+
+	// A new preset is announced with the next state change
+	ctl.mu.Lock()
+	ctl.presets = append(ctl.presets, restapi.Preset{ID: 2, Name: "Flow"})
+	ctl.mu.Unlock()
+	ctl.bus.Publish(events.PowerChanged, events.Power{})
+	ha.waitFor(t, "homeassistant/light/hyperkit/light/config", func(payload []byte) bool {
+		return json.Unmarshal(payload, &light) == nil && len(light.EffectList) == 2
+	})
+
+	b.Stop(context.Background())
+	ha.waitFor(t, "hyperkit/availability", is(offline))
+}
+
+func TestCommands(t *testing.T) {
+	broker := newBroker(t)
+	ha := connectHomeAssistant(t, broker)
+	ctl := &fakeController{state: restapi.State{Preset: -1}, presets: []restapi.Preset{{ID: 3, Name: "Aurora"}, {ID: 5, Name: "Flow"}, {ID: 6, Name: "Flow"}}, bus: events.NewBus()}
+	startBridge(t, broker, ctl)
+	ha.waitFor(t, "hyperkit/availability", is(online))
+
+	ha.publish(t, "hyperkit/light/set", `{"state":"ON","brightness":128,"effect":"Aurora"}`)
+	ha.waitFor(t, "hyperkit/light/state", is(`{"state":"ON","brightness":128,"effect":"Aurora"}`))
+	// Presets sharing a name are told apart by their ID
+	ha.publish(t, "hyperkit/light/set", `{"effect":"Flow (6)"}`)
+	ha.waitFor(t, "hyperkit/light/state", is(`{"state":"ON","brightness":128,"effect":"Flow (6)"}`))
+	ha.publish(t, "hyperkit/speed/set", "200")
+	ha.waitFor(t, "hyperkit/speed/state", is("200"))
+	ha.publish(t, "hyperkit/airplay/set", "ON")
+	ha.waitFor(t, "hyperkit/airplay/state", is("ON"))
+	ha.publish(t, "hyperkit/light/set", `{"state":"OFF"}`)
+	ha.waitFor(t, "hyperkit/light/state", is(`{"state":"OFF","brightness":128,"effect":"Flow (6)"}`))
+
+	want := restapi.State{On: false, Brightness: 128, Speed: 200, Preset: 6, AirPlay: true}
+	if got := ctl.State(); got != want {
+		t.Fatalf("Got state %+v, want %+v\n", got, want)
+	}
+}
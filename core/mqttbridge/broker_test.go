@@ -0,0 +1,214 @@
+package mqttbridge
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// broker is a minimal in-process MQTT 3.1.1 broker. It delivers every
+// message at QoS 0 and keeps retained messages, which is all the bridge and
+// Home Assistant rely on.
+type broker struct {
+	l net.Listener
+
+	mu       sync.Mutex
+	clients  map[*brokerConn]bool
+	retained map[string][]byte
+}
+
+type brokerConn struct {
+	conn    net.Conn
+	mu      sync.Mutex
+	filters []string
+}
+
+func newBroker(t *testing.T) *broker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v\n", err)
+	}
+	b := &broker{l: l, clients: make(map[*brokerConn]bool), retained: make(map[string][]byte)}
+	go b.serve()
+	t.Cleanup(b.close)
+	return b
+}
+
+func (b *broker) url() string {
+	return "tcp://" + b.l.Addr().String()
+}
+
+func (b *broker) close() {
+	b.l.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		c.conn.Close()
+	}
+}
+
+func (b *broker) serve() {
+	for {
+		conn, err := b.l.Accept()
+		if err != nil {
+			return
+		}
+		c := &brokerConn{conn: conn}
+		b.mu.Lock()
+		b.clients[c] = true
+		b.mu.Unlock()
+		go b.handle(c)
+	}
+}
+
+func (b *broker) handle(c *brokerConn) {
+	defer func() {
+		b.mu.Lock()
+		delete(b.clients, c)
+		b.mu.Unlock()
+		c.conn.Close()
+	}()
+	r := bufio.NewReader(c.conn)
+	for {
+		header, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case 1: // CONNECT
+			c.write(0x20, []byte{0, 0})
+		case 3: // PUBLISH
+			qos := header >> 1 & 3
+			n := int(binary.BigEndian.Uint16(body))
+			topic, rest := string(body[2:2+n]), body[2+n:]
+			if qos > 0 {
+				c.write(0x40, rest[:2])
+				rest = rest[2:]
+			}
+			b.publish(topic, rest, header&1 == 1)
+		case 8: // SUBSCRIBE
+			id, rest := body[:2], body[2:]
+			var filters []string
+			granted := append([]byte(nil), id...)
+			for len(rest) > 0 {
+				n := int(binary.BigEndian.Uint16(rest))
+				filters = append(filters, string(rest[2:2+n]))
+				rest = rest[3+n:]
+				granted = append(granted, 0)
+			}
+			c.mu.Lock()
+			c.filters = append(c.filters, filters...)
+			c.mu.Unlock()
+			c.write(0x90, granted)
+			b.mu.Lock()
+			for topic, payload := range b.retained {
+				for _, filter := range filters {
+					if match(filter, topic) {
+						c.write(0x31, publishBody(topic, payload))
+						break
+					}
+				}
+			}
+			b.mu.Unlock()
+		case 10: // UNSUBSCRIBE
+			c.write(0xb0, body[:2])
+		case 12: // PINGREQ
+			c.write(0xd0, nil)
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+func (b *broker) publish(topic string, payload []byte, retain bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if retain {
+		if len(payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = payload
+		}
+	}
+	for c := range b.clients {
+		if c.wants(topic) {
+			c.write(0x30, publishBody(topic, payload))
+		}
+	}
+}
+
+func (c *brokerConn) wants(topic string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, filter := range c.filters {
+		if match(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *brokerConn) write(header byte, body []byte) {
+	packet := []byte{header}
+	for n := len(body); ; {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.Write(append(packet, body...))
+}
+
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, shift := 0, 0
+	for {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(digit&0x7f) << shift
+		if digit&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+func publishBody(topic string, payload []byte) []byte {
+	body := make([]byte, 2, 2+len(topic)+len(payload))
+	binary.BigEndian.PutUint16(body, uint16(len(topic)))
+	return append(append(body, topic...), payload...)
+}
+
+// match reports whether topic matches filter, which may contain the + and #
+// wildcards.
+func match(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
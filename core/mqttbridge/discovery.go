@@ -0,0 +1,123 @@
+package mqttbridge
+
+import (
+	"fmt"
+	"hyperkit/core/restapi"
+)
+
+// device groups the entities in Home Assistant.
+type device struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	SwVersion    string   `json:"sw_version"`
+}
+
+// entity is the discovery config of a Home Assistant entity. Only the
+// fields its component uses are set.
+type entity struct {
+	Name                string   `json:"name"`
+	UniqueID            string   `json:"unique_id"`
+	Device              device   `json:"device"`
+	AvailabilityTopic   string   `json:"availability_topic"`
+	StateTopic          string   `json:"state_topic"`
+	CommandTopic        string   `json:"command_topic,omitempty"`
+	ValueTemplate       string   `json:"value_template,omitempty"`
+	JSONAttributesTopic string   `json:"json_attributes_topic,omitempty"`
+	DeviceClass         string   `json:"device_class,omitempty"`
+	Icon                string   `json:"icon,omitempty"`
+	Schema              string   `json:"schema,omitempty"`
+	Brightness          bool     `json:"brightness,omitempty"`
+	Effect              bool     `json:"effect,omitempty"`
+	EffectList          []string `json:"effect_list,omitempty"`
+	Min                 *int     `json:"min,omitempty"`
+	Max                 *int     `json:"max,omitempty"`
+}
+
+// discoveryTopic is where the config of an entity is announced.
+func (b *Bridge) discoveryTopic(component, object string) string {
+	return b.opts.DiscoveryPrefix + "/" + component + "/" + b.nodeID + "/" + object + "/config"
+}
+
+// entity returns the fields every entity shares.
+func (b *Bridge) entity(object, name, state string) entity {
+	return entity{
+		Name:     b.opts.Name + " " + name,
+		UniqueID: b.nodeID + "_" + object,
+		Device: device{
+			Identifiers:  []string{b.nodeID},
+			Name:         b.opts.Name,
+			Manufacturer: "Carter Peel",
+			Model:        "HyperCube v1.0.0",
+			SwVersion:    "HyperKit v1.0.0",
+		},
+		AvailabilityTopic: b.topic("availability"),
+		StateTopic:        b.topic(state),
+	}
+}
+
+// announce publishes the discovery config of every entity.
+func (b *Bridge) announce() {
+	b.announceLight(b.ctl.Presets())
+
+	zero, max := 0, 255
+	speed := b.entity("speed", "Speed", "speed/state")
+	speed.CommandTopic = b.topic("speed/set")
+	speed.Icon = "mdi:speedometer"
+	speed.Min, speed.Max = &zero, &max
+	b.publishJSON(b.discoveryTopic("number", "speed"), true, speed)
+
+	airplay := b.entity("airplay", "AirPlay", "airplay/state")
+	airplay.CommandTopic = b.topic("airplay/set")
+	airplay.Icon = "mdi:music"
+	b.publishJSON(b.discoveryTopic("switch", "airplay"), true, airplay)
+
+	bluetooth := b.entity("bluetooth", "Bluetooth", "bluetooth/state")
+	bluetooth.DeviceClass = "connectivity"
+	bluetooth.ValueTemplate = "{{ 'ON' if value_json.connected else 'OFF' }}"
+	bluetooth.JSONAttributesTopic = bluetooth.StateTopic
+	b.publishJSON(b.discoveryTopic("binary_sensor", "bluetooth"), true, bluetooth)
+
+	ledfx := b.entity("ledfx", "LedFX", "ledfx/state")
+	ledfx.Icon = "mdi:docker"
+	ledfx.ValueTemplate = "{{ value_json.container }}"
+	ledfx.JSONAttributesTopic = ledfx.StateTopic
+	b.publishJSON(b.discoveryTopic("sensor", "ledfx"), true, ledfx)
+}
+
+// announceLight publishes the discovery config of the light, whose effects
+// are the presets.
+func (b *Bridge) announceLight(presets []restapi.Preset) {
+	effects := effectList(presets)
+	light := b.entity("light", "Light", "light/state")
+	light.CommandTopic = b.topic("light/set")
+	light.Schema = "json"
+	light.Brightness = true
+	light.Effect = len(effects) > 0
+	light.EffectList = effects
+	b.publishJSON(b.discoveryTopic("light", "light"), true, light)
+
+	b.mu.Lock()
+	b.effects = effects
+	b.mu.Unlock()
+}
+
+// effectList returns the names of the presets, in the order they are given.
+// Home Assistant selects effects by name, so presets sharing a name get their
+// ID appended.
+func effectList(presets []restapi.Preset) []string {
+	count := make(map[string]int, len(presets))
+	for _, p := range presets {
+		count[p.Name]++
+	}
+	effects := make([]string, 0, len(presets))
+	for _, p := range presets {
+		if count[p.Name] > 1 {
+			effects = append(effects, fmt.Sprintf("%s (%d)", p.Name, p.ID))
+		} else {
+			effects = append(effects, p.Name)
+		}
+	}
+	return effects
+}
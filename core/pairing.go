@@ -0,0 +1,118 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/brutella/hc"
+	"github.com/brutella/hc/accessory"
+	hcutil "github.com/brutella/hc/util"
+	log "github.com/sirupsen/logrus"
+	"github.com/skip2/go-qrcode"
+	"hyperkit/core/util"
+	"os"
+	"strconv"
+)
+
+// hcConfig returns the transport config for the configured pairing settings.
+func (c *Core) hcConfig() (hc.Config, error) {
+	pin, err := util.PinArrayToString(c.homekitPin)
+	if err != nil {
+		return hc.Config{}, fmt.Errorf("error converting pin array to string: %v", err)
+	}
+	config := c.currentConfig()
+	cfg := hc.Config{
+		Pin:         pin,
+		SetupId:     config.HomeKitSetupID,
+		StoragePath: config.HomeKitStoragePath,
+	}
+	if config.HomeKitPort > 0 {
+		cfg.Port = strconv.Itoa(config.HomeKitPort)
+	}
+	return cfg, nil
+}
+
+// accessoryHashKey is the key the hash of the published accessories is
+// stored under in the hc database.
+const accessoryHashKey = "accessoryHash"
+
+// updateConfigNumber increments the configuration number (c#) in the hc
+// database at storagePath if accs changed since they were last published, so
+// that paired controllers fetch them again. hc does the same in
+// NewIPTransport, but hashes the accessories after renumbering them and
+// before their persistent IDs are assigned, so its hash misses IDs that
+// changed. Its hash is dropped, which keeps it from changing the number.
+func updateConfigNumber(storagePath string, accs []*accessory.Accessory) error {
+	storage, err := hcutil.NewFileStorage(storagePath)
+	if err != nil {
+		return fmt.Errorf("error opening storage %s: %v", storagePath, err)
+	}
+	hash := (&accessory.Container{Accessories: accs}).ContentHash()
+	if old, err := storage.Get(accessoryHashKey); err == nil && len(old) > 0 && !bytes.Equal(old, hash) {
+		version := int64(1)
+		if b, err := storage.Get("version"); err == nil && len(b) > 0 {
+			if version, err = strconv.ParseInt(string(b), 10, 64); err != nil {
+				return fmt.Errorf("error parsing configuration number: %v", err)
+			}
+		}
+		if err := storage.Set("version", []byte(strconv.FormatInt(version+1, 10))); err != nil {
+			return fmt.Errorf("error saving configuration number: %v", err)
+		}
+	}
+	if err := storage.Delete("configHash"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error deleting configuration hash: %v", err)
+	}
+	if err := storage.Set(accessoryHashKey, hash); err != nil {
+		return fmt.Errorf("error saving accessory hash: %v", err)
+	}
+	return nil
+}
+
+// SetupURI returns the X-HM:// URI encoded in the HomeKit setup QR code.
+func (c *Core) SetupURI() (string, error) {
+	pin, err := util.PinArrayToString(c.homekitPin)
+	if err != nil {
+		return "", err
+	}
+	return hcutil.XHMURI(pin, c.currentConfig().HomeKitSetupID, uint8(accessory.TypeBridge), []hcutil.SetupFlag{hcutil.SetupFlagIP})
+}
+
+// printSetupCode prints the setup code and a QR code that can be scanned
+// with the Home app to add the bridge.
+func (c *Core) printSetupCode() {
+	uri, err := c.SetupURI()
+	if err != nil {
+		log.Errorf("Error generating HomeKit setup URI: %v\n", err)
+		return
+	}
+	log.Infof("HomeKit setup code: %s (%s)\n", util.FormatPin(c.homekitPin), uri)
+	qr, err := qrcode.New(uri, qrcode.Medium)
+	if err != nil {
+		log.Errorf("Error generating HomeKit setup QR code: %v\n", err)
+		return
+	}
+	fmt.Fprint(os.Stdout, qr.ToSmallString(false))
+}
+
+// ResetPairings removes every paired controller and the bridge's identity
+// from the HomeKit database at storagePath, so the bridge shows up as a new
+// accessory that can be added again. Instance IDs are kept.
+func ResetPairings(storagePath string) error {
+	storage, err := hcutil.NewFileStorage(storagePath)
+	if err != nil {
+		return fmt.Errorf("error opening storage %s: %v", storagePath, err)
+	}
+	keys, err := storage.KeysWithSuffix(".entity")
+	if err != nil {
+		return fmt.Errorf("error listing pairings: %v", err)
+	}
+	// The bridge's uuid is its HomeKit device ID; a new one makes controllers
+	// treat it as a different accessory.
+	keys = append(keys, "uuid", "version", "configHash", accessoryHashKey)
+	for _, key := range keys {
+		if err := storage.Delete(key); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error deleting %s: %v", key, err)
+		}
+	}
+	log.Infof("Reset HomeKit pairings in %s\n", storagePath)
+	return nil
+}
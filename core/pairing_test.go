@@ -0,0 +1,46 @@
+package core
+
+import (
+	"github.com/brutella/hc/accessory"
+	hcutil "github.com/brutella/hc/util"
+	"testing"
+)
+
+func TestUpdateConfigNumber(t *testing.T) {
+	path := t.TempDir()
+	storage, err := hcutil.NewFileStorage(path)
+	if err != nil {
+		t.Fatalf("Error opening storage: %v\n", err)
+	}
+	outlet := accessory.NewOutlet(accessory.Info{Name: "HyperCube", ID: 2})
+	outlet.UpdateIDs()
+	accs := []*accessory.Accessory{outlet.Accessory}
+
+	for _, tt := range []struct {
+		name   string
+		change func()
+		want   string
+	}{
+		{name: "first publish", change: func() {}, want: ""},
+		{name: "unchanged", change: func() {}, want: ""},
+		{name: "instance ID changed", change: func() { outlet.Outlet.On.ID += 100 }, want: "2"},
+		{name: "value changed", change: func() { outlet.Outlet.On.SetValue(true) }, want: "2"},
+		{name: "service added", change: func() { outlet.AddService(accessory.NewOutlet(accessory.Info{}).Outlet.Service) }, want: "3"},
+	} {
+		// hc stores the hash of the accessories as it numbered them
+		if err := storage.Set("configHash", []byte("hc")); err != nil {
+			t.Fatalf("Error saving configuration hash: %v\n", err)
+		}
+		tt.change()
+		if err := updateConfigNumber(path, accs); err != nil {
+			t.Fatalf("%s: error updating configuration number: %v\n", tt.name, err)
+		}
+		version, _ := storage.Get("version")
+		if string(version) != tt.want {
+			t.Fatalf("%s: configuration number is %q, want %q\n", tt.name, version, tt.want)
+		}
+		if _, err := storage.Get("configHash"); err == nil {
+			t.Fatalf("%s: hc's configuration hash was kept\n", tt.name)
+		}
+	}
+}
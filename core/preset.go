@@ -1,9 +1,16 @@
 package core
 
-import "github.com/brutella/hc/service"
+import (
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+)
 
 type Preset struct {
 	service      *service.Service
+	nameChar     *characteristic.Name
 	name         string
 	wledPresetId int
+	// effect is the built-in effect the preset plays, or "" for a WLED
+	// preset.
+	effect string
 }
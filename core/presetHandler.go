@@ -1,11 +1,15 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/brutella/hc/service"
-	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 	"hyperkit/core/airplayserver"
+	"hyperkit/core/errorTypes"
+	"hyperkit/core/lifecycle"
+	"hyperkit/core/wled"
 	"sync"
 	"sync/atomic"
 )
@@ -19,41 +23,76 @@ type PresetHandler struct {
 	ledFxBridge  *airplayserver.AirplayServer
 	ledFxSwitch  *service.Outlet
 	musicEnabled uint32
-	core         *Core
+	dev          *Device
+	status       lifecycle.Status
 }
 
-func (c *Core) NewPresetHandler() (p *PresetHandler, err error) {
+func (d *Device) NewPresetHandler() (p *PresetHandler, err error) {
 	p = &PresetHandler{
 		Presets:    make(map[int]*service.Outlet, 0),
 		lastActive: -1, // Should be -1 by default
 		mu:         &sync.Mutex{},
-		core:       c,
+		dev:        d,
 	}
 
-	if err := c.socket.WriteMessage(websocket.TextMessage, []byte(`{"bri":255, "ps":69}`)); err != nil {
-		return nil, fmt.Errorf("error booting WLED: %v", err)
+	d.menuOutlet.Outlet.On.OnValueRemoteUpdate(p.SetPower)
+	return p, nil
+}
+
+// Start boots WLED into the startup preset. A WLED that is not connected yet
+// is not an error; the preset sync catches up once it is.
+func (p *PresetHandler) Start(ctx context.Context) error {
+	err := errorTypes.RunWithContext(ctx, "booting WLED", func() error {
+		return p.dev.wled.Send(&wled.State{Brightness: wled.Int(255), Preset: wled.Int(69)})
+	})
+	if err != nil {
+		if !errors.Is(err, wled.ErrDisconnected) {
+			p.status.Set(lifecycle.Failed, err)
+			return fmt.Errorf("error booting WLED: %w", err)
+		}
+		log.Warnf("Could not boot WLED: %v\n", err)
 	}
+	p.dev.menuOutlet.Outlet.On.SetValue(true)
+	p.status.Set(lifecycle.Running, nil)
+	return nil
+}
 
-	c.menuOutlet.Outlet.On.SetValue(true)
+func (p *PresetHandler) Stop(context.Context) error {
+	p.status.Set(lifecycle.Stopped, nil)
+	return nil
+}
 
-	c.menuOutlet.Outlet.On.OnValueRemoteUpdate(func(b bool) {
-		p.togglePower()
-		if !b {
-			for id, preset := range p.Presets {
-				if preset.On.Value.(bool) == true {
-					p.lastActive = id
-				}
-				go preset.On.SetValue(false)
-			}
-		} else if b {
-			if p.lastActive > -1 {
-				go p.enablePresetByID(p.lastActive)
+func (p *PresetHandler) Health() lifecycle.Health {
+	return p.status.Health()
+}
+
+// SetPower switches WLED on or off. Switching off remembers the active preset
+// so that it is restored when switching back on.
+func (p *PresetHandler) SetPower(b bool) {
+	_ = p.switchPower(b)
+}
+
+// switchPower is SetPower, returning the error of switching WLED.
+func (p *PresetHandler) switchPower(b bool) error {
+	err := p.setPower(b)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dev.menuOutlet.Outlet.On.SetValue(b)
+	if !b {
+		for id, preset := range p.Presets {
+			if preset.On.GetValue() {
+				p.lastActive = id
 			}
+			preset.On.SetValue(false)
 		}
-	})
-	return p, nil
+	} else if p.lastActive > -1 {
+		go p.enablePresetByID(p.lastActive)
+	}
+	return err
 }
 
+// InitPreset adds the outlet of the given WLED preset and links it with the
+// outlets of the other presets.
 func (p *PresetHandler) InitPreset(wledPresetID int, preset *service.Outlet) {
 	preset.On.OnValueRemoteUpdate(func(b bool) {
 		if !b {
@@ -61,18 +100,10 @@ func (p *PresetHandler) InitPreset(wledPresetID int, preset *service.Outlet) {
 			log.Println("Switching to solid color WLED preset...")
 			return
 		}
-		if !p.core.menuOutlet.Outlet.On.Value.(bool) {
-			go p.togglePower()
-			log.Println("Turning on HyperCube...")
-			p.core.menuOutlet.Outlet.On.SetValue(true)
-		}
-		p.enablePresetByID(wledPresetID)
-		for _, linkedPreset := range p.Presets {
-			if linkedPreset != preset {
-				linkedPreset.On.SetValue(false)
-			}
-		}
+		p.activatePreset(wledPresetID)
 	})
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	p.Presets[wledPresetID] = preset
 	for _, v := range p.Presets {
 		if v != preset {
@@ -82,13 +113,55 @@ func (p *PresetHandler) InitPreset(wledPresetID int, preset *service.Outlet) {
 	}
 }
 
-func (p *PresetHandler) togglePower() {
+// RemovePreset unlinks and forgets the outlet of the given WLED preset. The
+// caller removes the service from its accessory.
+func (p *PresetHandler) RemovePreset(wledPresetID int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	preset, ok := p.Presets[wledPresetID]
+	if !ok {
+		return fmt.Errorf("preset %d does not exist", wledPresetID)
+	}
+	delete(p.Presets, wledPresetID)
+	for _, v := range p.Presets {
+		v.Linked = removeService(v.Linked, preset.Service)
+	}
+	if p.lastActive == wledPresetID {
+		p.lastActive = -1
+	}
+	return nil
+}
+
+// activatePreset switches to the given preset, turning WLED on first if
+// needed, and switches off the outlets of the other presets.
+func (p *PresetHandler) activatePreset(wledPresetID int) {
+	if !p.dev.menuOutlet.Outlet.On.Value.(bool) {
+		go p.setPower(true)
+		log.Printf("Turning on %s...\n", p.dev.Name)
+		p.dev.menuOutlet.Outlet.On.SetValue(true)
+	}
+	p.enablePresetByID(wledPresetID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, linkedPreset := range p.Presets {
+		if id != wledPresetID {
+			linkedPreset.On.SetValue(false)
+		}
+	}
+}
+
+func (p *PresetHandler) setPower(on bool) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	log.Println("Toggling HyperCube power...")
-	if err := p.core.socket.WriteMessage(websocket.TextMessage, []byte(TogglePowerJson)); err != nil {
-		log.Printf("Error turning off HyperCube: %v\n", err)
+	log.Printf("Switching %s power (on=%v)...\n", p.dev.Name, on)
+	if !on {
+		p.dev.stopEffect()
 	}
+	if err := p.dev.wled.Send(buildPowerState(on)); err != nil {
+		log.Printf("Error switching %s power: %v\n", p.dev.Name, err)
+		return fmt.Errorf("error switching power: %w", err)
+	}
+	return nil
 }
 
 func (p *PresetHandler) enablePresetByID(id int) {
@@ -104,8 +177,8 @@ func (p *PresetHandler) enablePresetByID(id int) {
 	if id > -1 {
 		preset.On.SetValue(true)
 	}
-	if err := p.core.socket.WriteMessage(websocket.TextMessage, buildPresetJson(id)); err != nil {
-		log.Printf("Error turning off LEDs: %v\n", err)
+	if err := p.dev.applyPreset(id); err != nil {
+		log.Printf("Error switching to preset %d: %v\n", id, err)
 	}
 }
 
@@ -113,27 +186,78 @@ func (p *PresetHandler) AddLedFXBridge(br *airplayserver.AirplayServer, toggleSw
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	p.ledFxBridge, p.ledFxSwitch = br, toggleSwitch
 	toggleSwitch.On.SetValue(false)
 
 	toggleSwitch.On.OnValueRemoteUpdate(func(b bool) {
-		if !b {
-			defer atomic.StoreUint32(&p.musicEnabled, 0)
-			toggleSwitch.On.SetValue(false)
-			log.Printf("Stopping AirPlayBT bridge...")
-			if err := br.Stop(); err != nil {
-				log.Printf("Error stopping AirPlay BT bridge: %v\n", err)
-			}
-		} else if b {
-			atomic.StoreUint32(&p.musicEnabled, 1)
-			toggleSwitch.On.SetValue(true)
-			log.Printf("Starting AirPlayBT bridge...")
-			if err := br.Start(); err != nil {
-				log.Printf("Error starting bridge: %v\n", err)
-			}
+		if err := p.setMusic(b); err != nil {
+			log.Printf("%v\n", err)
 		}
 	})
 }
 
+// setMusic enables or disables the AirPlay bridge and updates its switch.
+func (p *PresetHandler) setMusic(on bool) error {
+	if !on {
+		defer atomic.StoreUint32(&p.musicEnabled, 0)
+		p.ledFxSwitch.On.SetValue(false)
+		log.Printf("Stopping AirPlayBT bridge...")
+		if err := p.ledFxBridge.Disable(); err != nil {
+			return fmt.Errorf("error stopping AirPlay BT bridge: %w", err)
+		}
+		return nil
+	}
+	atomic.StoreUint32(&p.musicEnabled, 1)
+	p.ledFxSwitch.On.SetValue(true)
+	log.Printf("Starting AirPlayBT bridge...")
+	if err := p.ledFxBridge.Enable(); err != nil {
+		return fmt.Errorf("error starting bridge: %w", err)
+	}
+	return nil
+}
+
 func (p *PresetHandler) musicIsActive() bool {
 	return atomic.LoadUint32(&p.musicEnabled) > 0
 }
+
+// syncPower mirrors a power change reported by WLED onto HomeKit without
+// sending anything back to WLED.
+func (p *PresetHandler) syncPower(on bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.dev.menuOutlet.Outlet.On.GetValue() == on {
+		return
+	}
+	log.Infof("WLED power changed externally (on=%v)\n", on)
+	p.dev.menuOutlet.Outlet.On.SetValue(on)
+	if on {
+		return
+	}
+	p.dev.stopEffect()
+	for id, preset := range p.Presets {
+		if preset.On.GetValue() {
+			p.lastActive = id
+		}
+		preset.On.SetValue(false)
+	}
+}
+
+// syncPreset mirrors the active WLED preset onto the HomeKit preset outlets
+// without sending anything back to WLED.
+func (p *PresetHandler) syncPreset(id int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.dev.effectPlaying() {
+		return
+	}
+	on := p.dev.menuOutlet.Outlet.On.GetValue()
+	for presetID, preset := range p.Presets {
+		active := on && presetID == id
+		if preset.On.GetValue() != active {
+			preset.On.SetValue(active)
+		}
+	}
+	if _, ok := p.Presets[id]; ok {
+		p.lastActive = id
+	}
+}
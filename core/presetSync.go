@@ -0,0 +1,226 @@
+package core
+
+import (
+	"fmt"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	log "github.com/sirupsen/logrus"
+	"hyperkit/core/apiconn"
+	"hyperkit/core/errorTypes"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// PresetChanges summarises what a preset sync did.
+type PresetChanges struct {
+	Added   []int `json:"added"`
+	Renamed []int `json:"renamed"`
+	Removed []int `json:"removed"`
+}
+
+// SyncPresets syncs the presets of every device with WLED and republishes
+// the accessories once if services were added or removed. A device that
+// fails to sync does not keep the others from syncing. The changes are keyed
+// by device name.
+func (c *Core) SyncPresets() (map[string]*PresetChanges, error) {
+	errs := new(errorTypes.MultiError)
+	wanted := make(map[*Device]map[int]string, len(c.devices))
+	for _, d := range c.devices {
+		presets, err := d.fetchPresets()
+		if err != nil {
+			errs.Append(fmt.Errorf("%s: %w", d.Name, err))
+			continue
+		}
+		wanted[d] = presets
+	}
+
+	all := make(map[string]*PresetChanges, len(wanted))
+	errs.Append(c.changeServices(func() error {
+		for _, d := range c.devices {
+			presets, ok := wanted[d]
+			if !ok {
+				continue
+			}
+			changes, err := d.syncPresets(presets)
+			all[d.Name] = changes
+			if err != nil {
+				errs.Append(fmt.Errorf("%s: %w", d.Name, err))
+			}
+		}
+		return nil
+	}))
+	return all, errs.ErrorOrNil()
+}
+
+// fetchPresets returns the names of the presets of WLED by ID.
+func (d *Device) fetchPresets() (map[int]string, error) {
+	presets, err := apiconn.GetAllPresets(d.wled.Host())
+	if err != nil {
+		return nil, fmt.Errorf("error getting all presets: %w", err)
+	}
+	wanted := make(map[int]string)
+	for _, preset := range presets {
+		if preset.ID > 0 {
+			wanted[preset.ID] = preset.Name
+		}
+	}
+	return wanted, nil
+}
+
+// syncPresets adds, renames and removes the HomeKit preset services to match
+// the wanted presets. Must be called from within Core.changeServices.
+func (d *Device) syncPresets(wanted map[int]string) (*PresetChanges, error) {
+	d.presetMu.Lock()
+	defer d.presetMu.Unlock()
+	changes := &PresetChanges{}
+	// Add presets in ID order so the resulting services are laid out the same
+	// way regardless of the order WLED returned them in.
+	ids := make([]int, 0, len(wanted))
+	for id := range wanted {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		name := wanted[id]
+		cur, ok := d.presets[id]
+		switch {
+		case !ok:
+			if err := d.addWledPreset(name, id); err != nil {
+				return changes, fmt.Errorf("error adding WLED preset %d: %w", id, err)
+			}
+			log.Infof("Added WLED preset %d (%s) of %s\n", id, name, d.Name)
+			changes.Added = append(changes.Added, id)
+		case cur.name != name:
+			d.renameWledPreset(cur, name)
+			log.Infof("Renamed WLED preset %d of %s to %s\n", id, d.Name, name)
+			changes.Renamed = append(changes.Renamed, id)
+		}
+	}
+	for id, preset := range d.presets {
+		if _, ok := wanted[id]; ok || preset.effect != "" {
+			continue
+		}
+		if err := d.removeWledPreset(id); err != nil {
+			return changes, fmt.Errorf("error removing WLED preset %d: %w", id, err)
+		}
+		log.Infof("Removed WLED preset %d of %s\n", id, d.Name)
+		changes.Removed = append(changes.Removed, id)
+	}
+	sort.Ints(changes.Removed)
+	return changes, nil
+}
+
+// addWledPreset adds a HomeKit service for the given WLED preset. Must be
+// called from within Core.changeServices.
+func (d *Device) addWledPreset(name string, id int) error {
+	if id <= 0 {
+		return fmt.Errorf("preset ID must be greater than 0")
+	}
+	if _, ok := d.presets[id]; ok {
+		return fmt.Errorf("preset %d already exists", id)
+	}
+
+	d.core.unpublish()
+	if d.tvHandler != nil {
+		d.tvHandler.AddPreset(id, name)
+		d.presets[id] = &Preset{name: name, wledPresetId: id}
+		return nil
+	}
+
+	preset := service.NewOutlet()
+	presetName := characteristic.NewName()
+	presetName.Value = name
+	preset.AddCharacteristic(presetName.Characteristic)
+	d.core.ids.Name(preset.Service, fmt.Sprintf("preset/%d", id))
+	d.presetHandler.InitPreset(id, preset)
+
+	d.menuOutlet.AddService(preset.Service)
+
+	d.presets[id] = &Preset{service: preset.Service, nameChar: presetName, name: name, wledPresetId: id}
+	return nil
+}
+
+// RemoveWledPreset removes the HomeKit service of the given preset of the
+// WLED controller at wled_ip and republishes the accessories if HomeKit is
+// already running.
+func (c *Core) RemoveWledPreset(id int) error {
+	d := c.primary()
+	return c.changeServices(func() error {
+		d.presetMu.Lock()
+		defer d.presetMu.Unlock()
+		return d.removeWledPreset(id)
+	})
+}
+
+// removeWledPreset removes the HomeKit service of the given WLED preset. Must
+// be called from within Core.changeServices.
+func (d *Device) removeWledPreset(id int) error {
+	preset, ok := d.presets[id]
+	if !ok {
+		return fmt.Errorf("preset %d does not exist", id)
+	}
+	d.core.unpublish()
+	if d.tvHandler != nil {
+		if err := d.tvHandler.RemovePreset(id); err != nil {
+			return err
+		}
+	} else {
+		if err := d.presetHandler.RemovePreset(id); err != nil {
+			return err
+		}
+		d.menuOutlet.Services = removeService(d.menuOutlet.Services, preset.service)
+		d.core.ids.Forget(preset.service)
+	}
+	delete(d.presets, id)
+	return nil
+}
+
+func (d *Device) renameWledPreset(preset *Preset, name string) {
+	preset.name = name
+	if d.tvHandler != nil {
+		d.tvHandler.AddPreset(preset.wledPresetId, name)
+		return
+	}
+	preset.nameChar.SetValue(name)
+}
+
+// watchPresets re-syncs the presets every PresetSyncInterval and whenever
+// HyperKit receives SIGUSR1.
+func (c *Core) watchPresets(stop <-chan struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	defer signal.Stop(sigs)
+
+	for {
+		// The interval is re-read every round, as a config reload may change it
+		var tick <-chan time.Time
+		var timer *time.Timer
+		if interval := c.currentConfig().PresetSyncInterval; interval > 0 {
+			timer = time.NewTimer(interval)
+			tick = timer.C
+		}
+
+		sync := true
+		select {
+		case <-stop:
+			return
+		case <-c.configChanged:
+			sync = false
+		case <-sigs:
+			log.Infoln("Received SIGUSR1, syncing presets...")
+		case <-tick:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if !sync {
+			continue
+		}
+		if _, err := c.SyncPresets(); err != nil {
+			log.Errorf("Error syncing presets: %v\n", err)
+		}
+	}
+}
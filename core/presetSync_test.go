@@ -0,0 +1,119 @@
+package core
+
+import (
+	"fmt"
+	"github.com/brutella/hc/accessory"
+	"hyperkit/core/iid"
+	"hyperkit/core/wled"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestDevice returns a core with a single device in outlet mode, whose
+// WLED serves its presets from host and is not connected.
+func newTestDevice(t *testing.T, host string) (*Core, *Device) {
+	ids, err := iid.NewAllocator(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating instance ID allocator: %v\n", err)
+	}
+	c := &Core{ids: ids, transportMu: new(sync.Mutex), config: &Config{}, configMu: new(sync.RWMutex)}
+	d := &Device{
+		Name:     "HyperCube",
+		wled:     wled.NewClient(host, wled.Options{}),
+		presets:  make(map[int]*Preset),
+		presetMu: new(sync.Mutex),
+		aids:     primaryAccessoryIDs,
+		core:     c,
+	}
+	d.menuOutlet = accessory.NewOutlet(d.info("menu", "WLED-HyperKit"))
+	if d.presetHandler, err = d.NewPresetHandler(); err != nil {
+		t.Fatalf("Error creating preset handler: %v\n", err)
+	}
+	c.devices = []*Device{d}
+	return c, d
+}
+
+func TestSyncPresetsConcurrently(t *testing.T) {
+	// Every other sync adds one preset and removes another
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1)%2 == 0 {
+			fmt.Fprint(w, `{"1":{"n":"Aurora"},"2":{"n":"Flow"}}`)
+		} else {
+			fmt.Fprint(w, `{"1":{"n":"Aurora"},"3":{"n":"Candy"}}`)
+		}
+	}))
+	defer srv.Close()
+	c, d := newTestDevice(t, strings.TrimPrefix(srv.URL, "http://"))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			d.presetHandler.syncPreset(i % 4)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			d.presetHandler.SetPower(i%2 == 0)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if _, err := c.SyncPresets(); err != nil {
+			t.Fatalf("Error syncing presets: %v\n", err)
+		}
+	}
+	wg.Wait()
+
+	d.presetMu.Lock()
+	defer d.presetMu.Unlock()
+	if len(d.presets) != 2 || d.presets[1] == nil {
+		t.Fatalf("Presets after syncing are %v\n", d.presets)
+	}
+}
+
+// fakeTransport records being stopped.
+type fakeTransport struct {
+	stopped bool
+}
+
+func (f *fakeTransport) Start() {}
+
+func (f *fakeTransport) Stop() <-chan struct{} {
+	f.stopped = true
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+func TestRemoveWledPresetRepublishes(t *testing.T) {
+	c, d := newTestDevice(t, "")
+	c.config.HomeKitStoragePath = t.TempDir()
+	c.homekitPin = [8]uint{6, 9, 6, 9, 4, 2, 0, 0}
+	c.bridge = accessory.NewBridge(accessory.Info{Name: "HyperBridge", ID: 1})
+	d.lightHandler = d.NewLightHandler()
+	if err := c.changeServices(func() error { return d.addWledPreset("Aurora", 1) }); err != nil {
+		t.Fatalf("Error adding preset: %v\n", err)
+	}
+
+	old := &fakeTransport{}
+	c.transport = old
+	if err := c.RemoveWledPreset(1); err != nil {
+		t.Fatalf("Error removing preset: %v\n", err)
+	}
+	defer c.stopTransport()
+	if !old.stopped || c.transport == nil || c.transport == old {
+		t.Fatalf("Accessories were not republished after removing a preset\n")
+	}
+	for _, svc := range d.menuOutlet.Services {
+		if svc.ID == 0 {
+			t.Fatalf("Service %s is published without an instance ID\n", svc.Type)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package realtime
+
+import (
+	"encoding/binary"
+)
+
+const (
+	ddpPort = 4048
+	// ddpMaxData keeps packets below the usual MTU; it is a multiple of 3
+	// so that pixels are not split across packets.
+	ddpMaxData   = 1440
+	ddpHeaderLen = 10
+
+	ddpVersion1 = 0x40
+	ddpPush     = 0x01
+	// ddpTypeRGB8 is RGB with 8 bits per channel.
+	ddpTypeRGB8 = 0x0b
+	ddpDisplay  = 1
+)
+
+// ddpEncoder encodes frames as DDP packets. The last packet of a frame has
+// the push flag set, which makes WLED show the frame.
+type ddpEncoder struct {
+	seq uint8
+	buf []byte
+}
+
+func (e *ddpEncoder) encode(strip []byte, write func([]byte) error) error {
+	// Sequence numbers run from 1 to 15; 0 would disable them
+	e.seq = e.seq%15 + 1
+	if e.buf == nil {
+		e.buf = make([]byte, ddpHeaderLen+ddpMaxData)
+	}
+	for offset := 0; offset < len(strip); offset += ddpMaxData {
+		data := strip[offset:minInt(offset+ddpMaxData, len(strip))]
+		flags := byte(ddpVersion1)
+		if offset+len(data) == len(strip) {
+			flags |= ddpPush
+		}
+		packet := e.buf[:ddpHeaderLen+len(data)]
+		packet[0], packet[1], packet[2], packet[3] = flags, e.seq, ddpTypeRGB8, ddpDisplay
+		binary.BigEndian.PutUint32(packet[4:], uint32(offset))
+		binary.BigEndian.PutUint16(packet[8:], uint16(len(data)))
+		copy(packet[ddpHeaderLen:], data)
+		if err := write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,94 @@
+package realtime
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	e131Port = 5568
+	// e131PixelsPerUniverse fit into the 512 DMX channels of a universe.
+	e131PixelsPerUniverse = 170
+	e131HeaderLen         = 126
+	e131Priority          = 100
+	e131SourceName        = "HyperKit"
+)
+
+var acnPacketIdentifier = []byte("ASC-E1.17\x00\x00\x00")
+
+// e131Encoder encodes frames as E1.31 data packets, one per universe.
+type e131Encoder struct {
+	universe int
+	cid      [16]byte
+	seq      map[int]uint8
+	buf      []byte
+}
+
+func newE131Encoder(universe int) (*e131Encoder, error) {
+	if universe < 1 || universe > 63999 {
+		return nil, fmt.Errorf("E1.31 universe must be between 1 and 63999, got %d", universe)
+	}
+	e := &e131Encoder{universe: universe, seq: make(map[int]uint8), buf: make([]byte, e131HeaderLen+3*e131PixelsPerUniverse)}
+	// The CID identifies the sender; a random one per output is enough
+	if _, err := rand.Read(e.cid[:]); err != nil {
+		return nil, fmt.Errorf("error generating E1.31 CID: %w", err)
+	}
+	return e, nil
+}
+
+func (e *e131Encoder) encode(strip []byte, write func([]byte) error) error {
+	const perPacket = 3 * e131PixelsPerUniverse
+	for i, offset := 0, 0; offset < len(strip); i, offset = i+1, offset+perPacket {
+		data := strip[offset:minInt(offset+perPacket, len(strip))]
+		universe := e.universe + i
+		e.seq[universe]++
+		packet := e.buf[:e131HeaderLen+len(data)]
+		e.header(packet, universe, e.seq[universe])
+		copy(packet[e131HeaderLen:], data)
+		if err := write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// header fills in the root, framing and DMP layers of packet, whose length
+// includes the DMX data.
+func (e *e131Encoder) header(packet []byte, universe int, seq uint8) {
+	n := len(packet)
+	be := binary.BigEndian
+	// Root layer
+	be.PutUint16(packet[0:], 0x0010)
+	be.PutUint16(packet[2:], 0x0000)
+	copy(packet[4:16], acnPacketIdentifier)
+	be.PutUint16(packet[16:], flagsAndLength(n-16))
+	be.PutUint32(packet[18:], 0x00000004)
+	copy(packet[22:38], e.cid[:])
+	// Framing layer
+	be.PutUint16(packet[38:], flagsAndLength(n-38))
+	be.PutUint32(packet[40:], 0x00000002)
+	name := packet[44:108]
+	for i := range name {
+		name[i] = 0
+	}
+	copy(name, e131SourceName)
+	packet[108] = e131Priority
+	be.PutUint16(packet[109:], 0)
+	packet[111] = seq
+	packet[112] = 0
+	be.PutUint16(packet[113:], uint16(universe))
+	// DMP layer
+	be.PutUint16(packet[115:], flagsAndLength(n-115))
+	packet[117] = 0x02
+	packet[118] = 0xa1
+	be.PutUint16(packet[119:], 0)
+	be.PutUint16(packet[121:], 1)
+	// The property values are the DMX start code and the channels
+	be.PutUint16(packet[123:], uint16(n-e131HeaderLen+1))
+	packet[125] = 0
+}
+
+func flagsAndLength(length int) uint16 {
+	return 0x7000 | uint16(length)
+}
@@ -0,0 +1,329 @@
+// Package realtime streams pixel frames to WLED over its realtime protocols:
+// DDP, E1.31 (sACN) and WLED's own UDP protocol. While frames arrive, WLED
+// shows them instead of its effects; once they stop, it goes back to the
+// effects after its realtime timeout.
+package realtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hyperkit/core/lifecycle"
+	"hyperkit/core/metrics"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrStopped is returned by Send while the output is not running.
+var ErrStopped = errors.New("realtime output is not running")
+
+// Protocol is a realtime protocol WLED understands.
+type Protocol string
+
+const (
+	DDP  Protocol = "ddp"
+	E131 Protocol = "e131"
+	// UDP is WLED's own realtime protocol, DRGB or DNRGB depending on the
+	// number of LEDs.
+	UDP Protocol = "udp"
+)
+
+// ParseProtocol returns the protocol named s.
+func ParseProtocol(s string) (Protocol, error) {
+	switch p := Protocol(s); p {
+	case DDP, E131, UDP:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown realtime protocol %q, must be %q, %q or %q", s, DDP, E131, UDP)
+}
+
+// RGB is the color of one pixel.
+type RGB struct {
+	R, G, B uint8
+}
+
+// Segment is a run of LEDs on the strip that a part of every frame is shown
+// on.
+type Segment struct {
+	// Start is the index of the first LED of the segment on the strip.
+	Start int
+	// Length is the number of LEDs in the segment.
+	Length int
+	// Reverse shows the pixels from the last LED of the segment to the
+	// first.
+	Reverse bool
+}
+
+// Options configure an Output.
+type Options struct {
+	// Host is the address of the controller. The default port of the
+	// protocol is used unless it includes one.
+	Host     string
+	Protocol Protocol
+	// LEDCount is the number of LEDs on the strip.
+	LEDCount int
+	// FPS caps the frames sent per second; frames sent faster are
+	// coalesced. Defaults to 60.
+	FPS int
+	// Segments lay the pixels of a frame out on the strip: the first
+	// pixels go to the first segment, the next ones to the second and so
+	// on. LEDs outside of every segment stay dark. Without segments, a
+	// frame covers the strip from its first LED.
+	Segments []Segment
+	// Timeout is how long WLED stays in realtime mode after the last Send.
+	// Until then the last frame is repeated, so a frame that does not
+	// change holds. Defaults to 5 seconds.
+	Timeout time.Duration
+	// Universe is the first E1.31 universe; the strip spans as many
+	// universes as it needs from there. Defaults to 1.
+	Universe int
+}
+
+const (
+	DefaultFPS     = 60
+	DefaultTimeout = 5 * time.Second
+
+	// keepAlive is how often an unchanged frame is repeated. WLED's own
+	// realtime timeout defaults to 2.5 seconds.
+	keepAlive = time.Second
+)
+
+// encoder splits the RGB bytes of the whole strip into packets.
+type encoder interface {
+	encode(strip []byte, write func(packet []byte) error) error
+}
+
+// Output sends frames to a WLED controller. It implements lifecycle.Service;
+// frames can only be sent while it runs.
+type Output struct {
+	opts   Options
+	addr   string
+	pixels int
+
+	status lifecycle.Status
+	group  *lifecycle.Group
+
+	mu        sync.Mutex
+	stop      chan struct{}
+	ready     chan struct{}
+	next      []RGB
+	pending   bool
+	lastFrame time.Time
+
+	// encMu guards the sequence numbers of enc, which a goroutine left
+	// running by a Stop that timed out shares with the next one.
+	encMu sync.Mutex
+	enc   encoder
+}
+
+// NewOutput validates opts and returns an output for them.
+func NewOutput(opts Options) (*Output, error) {
+	if opts.FPS <= 0 {
+		opts.FPS = DefaultFPS
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Universe <= 0 {
+		opts.Universe = 1
+	}
+	if opts.Host == "" {
+		return nil, errors.New("host must be set")
+	}
+	if opts.LEDCount <= 0 {
+		return nil, fmt.Errorf("LED count must be positive, got %d", opts.LEDCount)
+	}
+	if len(opts.Segments) == 0 {
+		opts.Segments = []Segment{{Start: 0, Length: opts.LEDCount}}
+	}
+	pixels := 0
+	for i, seg := range opts.Segments {
+		if seg.Start < 0 || seg.Length <= 0 || seg.Start+seg.Length > opts.LEDCount {
+			return nil, fmt.Errorf("segment %d (LEDs %d to %d) is outside of the %d LEDs of the strip", i+1, seg.Start, seg.Start+seg.Length-1, opts.LEDCount)
+		}
+		pixels += seg.Length
+	}
+
+	o := &Output{opts: opts, pixels: pixels}
+	o.group = lifecycle.NewGroup(&o.status)
+	port := 0
+	switch opts.Protocol {
+	case DDP:
+		o.enc, port = new(ddpEncoder), ddpPort
+	case E131:
+		enc, err := newE131Encoder(opts.Universe)
+		if err != nil {
+			return nil, err
+		}
+		o.enc, port = enc, e131Port
+	case UDP:
+		o.enc, port = &udpEncoder{timeout: udpTimeout(opts.Timeout)}, udpPort
+	default:
+		_, err := ParseProtocol(string(opts.Protocol))
+		return nil, err
+	}
+	o.addr = opts.Host
+	if _, _, err := net.SplitHostPort(opts.Host); err != nil {
+		o.addr = net.JoinHostPort(opts.Host, strconv.Itoa(port))
+	}
+	return o, nil
+}
+
+// Pixels returns the number of pixels in a frame, the LEDs of all segments.
+func (o *Output) Pixels() int {
+	return o.pixels
+}
+
+func (o *Output) Start(context.Context) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stop != nil {
+		return nil
+	}
+	o.status.Set(lifecycle.Starting, nil)
+	conn, err := net.Dial("udp", o.addr)
+	if err != nil {
+		o.status.Set(lifecycle.Failed, err)
+		return fmt.Errorf("error opening %s output to %s: %w", o.opts.Protocol, o.addr, err)
+	}
+	o.stop = make(chan struct{})
+	o.ready = make(chan struct{}, 1)
+	o.next = make([]RGB, o.pixels)
+	o.pending = false
+	stop, ready := o.stop, o.ready
+	o.group.Go("realtime output", func() { o.run(stop, ready, conn) })
+	o.status.Set(lifecycle.Running, nil)
+	return nil
+}
+
+func (o *Output) Stop(ctx context.Context) error {
+	o.mu.Lock()
+	stop := o.stop
+	o.stop = nil
+	o.mu.Unlock()
+	if stop == nil {
+		return nil
+	}
+	o.status.Set(lifecycle.Stopping, nil)
+	// run closes the connection once it returned, so a goroutine that
+	// outlives ctx never writes to a closed one
+	close(stop)
+	err := o.group.Wait(ctx)
+	o.status.Set(lifecycle.Stopped, nil)
+	return err
+}
+
+func (o *Output) Health() lifecycle.Health {
+	return o.status.Health()
+}
+
+// Send queues frame to be sent. A frame that is still waiting for its turn
+// because of the FPS limit is replaced. Pixels missing from the end of frame
+// are dark.
+func (o *Output) Send(frame []RGB) error {
+	if len(frame) > o.pixels {
+		return fmt.Errorf("frame has %d pixels, the output only %d", len(frame), o.pixels)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stop == nil {
+		return ErrStopped
+	}
+	if o.pending {
+		metrics.RealtimeFrames.WithLabelValues(string(o.opts.Protocol), "coalesced").Inc()
+	}
+	n := copy(o.next, frame)
+	for i := n; i < len(o.next); i++ {
+		o.next[i] = RGB{}
+	}
+	o.pending = true
+	o.lastFrame = time.Now()
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// run sends the queued frames to conn no faster than the FPS limit, and
+// repeats the last one until the timeout passed. It closes conn when stop is
+// closed.
+func (o *Output) run(stop, ready <-chan struct{}, conn net.Conn) {
+	defer conn.Close()
+	strip := make([]byte, 3*o.opts.LEDCount)
+	interval := time.Second / time.Duration(o.opts.FPS)
+	repeat := time.NewTicker(keepAlive)
+	defer repeat.Stop()
+	var sent time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case <-repeat.C:
+			o.mu.Lock()
+			active := time.Since(o.lastFrame) < o.opts.Timeout
+			o.mu.Unlock()
+			if active && time.Since(sent) >= keepAlive {
+				o.flush(conn, strip)
+				sent = time.Now()
+			}
+			continue
+		case <-ready:
+		}
+		if wait := interval - time.Since(sent); wait > 0 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(wait):
+			}
+		}
+		o.mu.Lock()
+		o.layout(strip)
+		o.pending = false
+		o.mu.Unlock()
+		o.flush(conn, strip)
+		sent = time.Now()
+	}
+}
+
+// layout copies the queued frame onto strip. Must be called with o.mu held.
+func (o *Output) layout(strip []byte) {
+	i := 0
+	for _, seg := range o.opts.Segments {
+		for j := 0; j < seg.Length; j++ {
+			led := seg.Start + j
+			if seg.Reverse {
+				led = seg.Start + seg.Length - 1 - j
+			}
+			p := o.next[i]
+			strip[3*led], strip[3*led+1], strip[3*led+2] = p.R, p.G, p.B
+			i++
+		}
+	}
+}
+
+// flush sends strip to the controller over conn.
+func (o *Output) flush(conn net.Conn, strip []byte) {
+	o.encMu.Lock()
+	err := o.enc.encode(strip, func(packet []byte) error {
+		_, err := conn.Write(packet)
+		return err
+	})
+	o.encMu.Unlock()
+	proto := string(o.opts.Protocol)
+	if err != nil {
+		metrics.RealtimeFrames.WithLabelValues(proto, "failed").Inc()
+		if o.status.Health().State != lifecycle.Degraded {
+			log.Warnf("Error sending %s frame to %s: %v\n", proto, o.addr, err)
+		}
+		o.status.Set(lifecycle.Degraded, err)
+		return
+	}
+	metrics.RealtimeFrames.WithLabelValues(proto, "sent").Inc()
+	if o.status.Health().State == lifecycle.Degraded {
+		o.status.Set(lifecycle.Running, nil)
+	}
+}
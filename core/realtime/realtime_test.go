@@ -0,0 +1,188 @@
+package realtime
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// packets collects the packets an encoder writes.
+func packets(t *testing.T, enc encoder, strip []byte) [][]byte {
+	var out [][]byte
+	err := enc.encode(strip, func(packet []byte) error {
+		out = append(out, append([]byte(nil), packet...))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error encoding: %v\n", err)
+	}
+	return out
+}
+
+func TestDDP(t *testing.T) {
+	strip := bytes.Repeat([]byte{1, 2, 3}, 500)
+	out := packets(t, new(ddpEncoder), strip)
+	if len(out) != 2 || len(out[0]) != ddpHeaderLen+1440 || len(out[1]) != ddpHeaderLen+60 {
+		t.Fatalf("Unexpected packets of %d LEDs: %d\n", 500, len(out))
+	}
+	if out[0][0] != ddpVersion1 || out[1][0] != ddpVersion1|ddpPush {
+		t.Fatalf("Only the last packet must push, got flags %#x and %#x\n", out[0][0], out[1][0])
+	}
+	if out[0][1] != 1 || out[0][2] != ddpTypeRGB8 || out[0][3] != ddpDisplay {
+		t.Fatalf("Unexpected header %v\n", out[0][:4])
+	}
+	if offset := binary.BigEndian.Uint32(out[1][4:]); offset != 1440 {
+		t.Fatalf("Got offset %d, want 1440\n", offset)
+	}
+	if length := binary.BigEndian.Uint16(out[1][8:]); length != 60 {
+		t.Fatalf("Got length %d, want 60\n", length)
+	}
+}
+
+func TestE131(t *testing.T) {
+	enc, err := newE131Encoder(3)
+	if err != nil {
+		t.Fatalf("Error creating encoder: %v\n", err)
+	}
+	strip := bytes.Repeat([]byte{9, 8, 7}, 200)
+	out := packets(t, enc, strip)
+	if len(out) != 2 || len(out[0]) != e131HeaderLen+510 || len(out[1]) != e131HeaderLen+90 {
+		t.Fatalf("Unexpected packets of %d LEDs: %d\n", 200, len(out))
+	}
+	p := out[1]
+	if !bytes.Equal(p[4:16], acnPacketIdentifier) {
+		t.Fatalf("Unexpected packet identifier %q\n", p[4:16])
+	}
+	if universe := binary.BigEndian.Uint16(p[113:]); universe != 4 {
+		t.Fatalf("Got universe %d, want 4\n", universe)
+	}
+	if fl := binary.BigEndian.Uint16(p[16:]); fl != 0x7000|uint16(len(p)-16) {
+		t.Fatalf("Unexpected root flags and length %#x\n", fl)
+	}
+	if count := binary.BigEndian.Uint16(p[123:]); count != 91 {
+		t.Fatalf("Got property value count %d, want 91\n", count)
+	}
+	if p[111] != 1 || p[108] != e131Priority || string(p[44:52]) != e131SourceName {
+		t.Fatalf("Unexpected framing layer %v\n", p[38:115])
+	}
+	if out := packets(t, enc, strip); out[0][111] != 2 {
+		t.Fatalf("Sequence number did not advance: %d\n", out[0][111])
+	}
+	if _, err := newE131Encoder(0); err == nil {
+		t.Fatalf("Expected universe 0 to be rejected\n")
+	}
+}
+
+func TestUDP(t *testing.T) {
+	enc := &udpEncoder{timeout: udpTimeout(1500 * time.Millisecond)}
+	out := packets(t, enc, bytes.Repeat([]byte{1, 2, 3}, 100))
+	if len(out) != 1 || out[0][0] != udpDRGB || out[0][1] != 2 || len(out[0]) != 302 {
+		t.Fatalf("Unexpected DRGB packets: %d\n", len(out))
+	}
+	out = packets(t, enc, bytes.Repeat([]byte{1, 2, 3}, 600))
+	if len(out) != 2 || out[1][0] != udpDNRGB || len(out[1]) != 4+3*111 {
+		t.Fatalf("Unexpected DNRGB packets: %d\n", len(out))
+	}
+	if start := int(out[1][2])<<8 | int(out[1][3]); start != udpMaxLEDsIndexed {
+		t.Fatalf("Got start index %d, want %d\n", start, udpMaxLEDsIndexed)
+	}
+}
+
+func TestNewOutput(t *testing.T) {
+	for _, opts := range []Options{
+		{Protocol: DDP, LEDCount: 10},
+		{Host: "wled", Protocol: DDP},
+		{Host: "wled", Protocol: "artnet", LEDCount: 10},
+		{Host: "wled", Protocol: DDP, LEDCount: 10, Segments: []Segment{{Start: 5, Length: 6}}},
+	} {
+		if _, err := NewOutput(opts); err == nil {
+			t.Errorf("Expected %+v to be rejected\n", opts)
+		}
+	}
+	o, err := NewOutput(Options{Host: "wled", Protocol: E131, LEDCount: 10, Segments: []Segment{{Start: 0, Length: 3}, {Start: 6, Length: 4}}})
+	if err != nil {
+		t.Fatalf("Error creating output: %v\n", err)
+	}
+	if o.addr != "wled:5568" || o.Pixels() != 7 {
+		t.Fatalf("Got address %s and %d pixels\n", o.addr, o.Pixels())
+	}
+}
+
+func TestOutput(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v\n", err)
+	}
+	defer l.Close()
+
+	o, err := NewOutput(Options{
+		Host:     l.LocalAddr().String(),
+		Protocol: DDP,
+		LEDCount: 5,
+		Segments: []Segment{{Start: 0, Length: 2}, {Start: 2, Length: 2, Reverse: true}},
+	})
+	if err != nil {
+		t.Fatalf("Error creating output: %v\n", err)
+	}
+	if err := o.Send([]RGB{{R: 1}}); err != ErrStopped {
+		t.Fatalf("Expected ErrStopped before starting, got %v\n", err)
+	}
+	if err := o.Start(context.Background()); err != nil {
+		t.Fatalf("Error starting output: %v\n", err)
+	}
+	defer o.Stop(context.Background())
+	if err := o.Send(make([]RGB, 5)); err == nil {
+		t.Fatalf("Expected a frame larger than the output to be rejected\n")
+	}
+	if err := o.Send([]RGB{{R: 1}, {R: 2}, {R: 3}, {R: 4}}); err != nil {
+		t.Fatalf("Error sending frame: %v\n", err)
+	}
+
+	buf := make([]byte, 1500)
+	_ = l.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := l.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Error reading packet: %v\n", err)
+	}
+	want := []byte{1, 0, 0, 2, 0, 0, 4, 0, 0, 3, 0, 0, 0, 0, 0}
+	if got := buf[ddpHeaderLen:n]; !bytes.Equal(got, want) {
+		t.Fatalf("Got strip %v, want %v\n", got, want)
+	}
+	if h := o.Health(); h.State.String() != "running" {
+		t.Fatalf("Got health %s, want running\n", h)
+	}
+}
+
+func TestOutputRestartAfterStopTimedOut(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v\n", err)
+	}
+	defer l.Close()
+	o, err := NewOutput(Options{Host: l.LocalAddr().String(), Protocol: E131, LEDCount: 200, FPS: 1000})
+	if err != nil {
+		t.Fatalf("Error creating output: %v\n", err)
+	}
+
+	// Stopping with an expired context leaves the goroutine running while
+	// the output is started again
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 100; i++ {
+		if err := o.Start(context.Background()); err != nil {
+			t.Fatalf("Error starting output: %v\n", err)
+		}
+		for j := 0; j < 5; j++ {
+			if err := o.Send([]RGB{{R: uint8(j)}}); err != nil {
+				t.Fatalf("Error sending frame: %v\n", err)
+			}
+		}
+		_ = o.Stop(expired)
+	}
+	if err := o.group.Wait(context.Background()); err != nil {
+		t.Fatalf("Error waiting for the output: %v\n", err)
+	}
+}
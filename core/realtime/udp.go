@@ -0,0 +1,62 @@
+package realtime
+
+import (
+	"time"
+)
+
+const (
+	udpPort = 21324
+
+	udpDRGB  = 2
+	udpDNRGB = 4
+	// udpMaxLEDs is the most LEDs a DRGB packet holds, udpMaxLEDsIndexed
+	// the most a DNRGB packet holds after its start index.
+	udpMaxLEDs        = 490
+	udpMaxLEDsIndexed = 489
+)
+
+// udpEncoder encodes frames for WLED's UDP realtime protocol: DRGB while the
+// strip fits into one packet, DNRGB with a start index per packet otherwise.
+type udpEncoder struct {
+	// timeout is the number of seconds WLED waits after the last packet
+	// before it leaves realtime mode.
+	timeout byte
+	buf     []byte
+}
+
+// udpTimeout converts d into whole seconds for the timeout byte, which is
+// 1 to 254; 255 would keep WLED in realtime mode forever.
+func udpTimeout(d time.Duration) byte {
+	seconds := (d + time.Second - 1) / time.Second
+	switch {
+	case seconds < 1:
+		return 1
+	case seconds > 254:
+		return 254
+	}
+	return byte(seconds)
+}
+
+func (e *udpEncoder) encode(strip []byte, write func([]byte) error) error {
+	if e.buf == nil {
+		e.buf = make([]byte, 4+3*udpMaxLEDs)
+	}
+	if len(strip) <= 3*udpMaxLEDs {
+		packet := e.buf[:2+len(strip)]
+		packet[0], packet[1] = udpDRGB, e.timeout
+		copy(packet[2:], strip)
+		return write(packet)
+	}
+	const perPacket = 3 * udpMaxLEDsIndexed
+	for offset := 0; offset < len(strip); offset += perPacket {
+		data := strip[offset:minInt(offset+perPacket, len(strip))]
+		start := offset / 3
+		packet := e.buf[:4+len(data)]
+		packet[0], packet[1], packet[2], packet[3] = udpDNRGB, e.timeout, byte(start>>8), byte(start)
+		copy(packet[4:], data)
+		if err := write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package core
+
+import (
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// restartKeys are the config keys that only take effect on restart, because
+// they shape the published HomeKit accessories, the audio pipeline, the HTTP
+// API listener or the MQTT connection.
+var restartKeys = []string{
+	"wled_mac",
+	"wled_mdns_name",
+	"wled_name",
+	"wled_devices",
+	"wled_groups",
+	"use_default_solid",
+	"bluetooth_device",
+	"airplay_name",
+	"audio_pipe_path",
+	"wled_queue_commands",
+	"disable_outlet_selectors",
+	"preset_mode",
+	"homekit_pin",
+	"homekit_setup_id",
+	"homekit_storage_path",
+	"homekit_port",
+	"bridge_name",
+	"api_address",
+	"api_token",
+	"mqtt_broker",
+	"mqtt_username",
+	"mqtt_password",
+	"mqtt_topic",
+	"mqtt_discovery_prefix",
+	"audio_effects",
+	"disable_ledfx",
+}
+
+// reloadDelay coalesces the burst of events editors cause when saving.
+const reloadDelay = 250 * time.Millisecond
+
+// ReloadConfig loads the config again and applies what changed without
+// restarting. An invalid config is rejected and the running one is kept.
+func (c *Core) ReloadConfig() error {
+	prev := c.currentConfig()
+	next, err := prev.Reload()
+	if err != nil {
+		return fmt.Errorf("rejected config: %w", err)
+	}
+
+	// Keep running with the current value of anything that needs a restart,
+	// so that e.g. republishing the accessories does not pick it up halfway.
+	prevFields, nextFields := prev.fields(), next.fields()
+	for i, f := range nextFields {
+		for _, key := range restartKeys {
+			if f.key == key && !reflect.DeepEqual(f.value.Interface(), prevFields[i].value.Interface()) {
+				log.Warnf("Config change of %s takes effect after a restart\n", key)
+				f.value.Set(prevFields[i].value)
+			}
+		}
+	}
+
+	c.configMu.Lock()
+	c.config = next
+	c.configMu.Unlock()
+
+	// Without wled_ip the controller keeps the address mDNS found
+	if next.WledIP != prev.WledIP && next.WledIP != "" {
+		log.Infof("Switching WLED controller %s from %s to %s\n", next.WledName, prev.WledIP, next.WledIP)
+		c.primary().wled.SetHost(next.WledIP)
+	}
+	if next.LogFile != prev.LogFile {
+		setLogFile(next.LogFile)
+	}
+	if next.Debug != prev.Debug {
+		setDebug(next.Debug)
+	}
+	if next.Debug != prev.Debug || next.MetricsEnabled != prev.MetricsEnabled {
+		setDebugServer(next)
+	}
+	if next.DefaultSpeed != prev.DefaultSpeed || next.DefaultBrightness != prev.DefaultBrightness {
+		c.applyDefaults(next)
+	}
+	if next.bufferOptions() != prev.bufferOptions() {
+		if err := c.airplayServer.SetBufferOptions(next.bufferOptions()); err != nil {
+			log.Errorf("Error configuring audio buffer: %v\n", err)
+		} else {
+			log.Infoln("Audio buffer changes take effect with the next AirPlay stream")
+		}
+	}
+	if next.PresetSyncInterval != prev.PresetSyncInterval {
+		select {
+		case c.configChanged <- struct{}{}:
+		default:
+		}
+	}
+	log.Infoln("Reloaded config")
+	return nil
+}
+
+// watchConfig reloads the config whenever its file changes or HyperKit
+// receives SIGHUP.
+func (c *Core) watchConfig(stop <-chan struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	path := c.currentConfig().Path()
+	if path != "" {
+		path = filepath.Clean(path)
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			log.Errorf("Error watching config file, reload with SIGHUP instead: %v\n", err)
+		} else {
+			defer watcher.Close()
+			// Watch the directory, as editors and config management often
+			// replace the file rather than writing to it.
+			if err := watcher.Add(filepath.Dir(path)); err != nil {
+				log.Errorf("Error watching config file, reload with SIGHUP instead: %v\n", err)
+			}
+			events, errs = watcher.Events, watcher.Errors
+		}
+	}
+
+	var pending <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case <-sigs:
+			log.Infoln("Received SIGHUP, reloading config...")
+		case ev := <-events:
+			if filepath.Clean(ev.Name) == path && ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				pending = time.After(reloadDelay)
+			}
+			continue
+		case err := <-errs:
+			log.Errorf("Error watching config file: %v\n", err)
+			continue
+		case <-pending:
+			pending = nil
+			log.Infof("%s changed, reloading config...\n", path)
+		}
+		if err := c.ReloadConfig(); err != nil {
+			log.Errorf("Error reloading config: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,444 @@
+// Package restapi serves a local HTTP API to script HyperKit. Requests are
+// authenticated with an optional bearer token and passed to a Controller.
+package restapi
+
+import (
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hyperkit/core/events"
+	"hyperkit/core/lifecycle"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix is the path every endpoint is served under.
+const Prefix = "/api/v1"
+
+//go:embed openapi.yaml
+var openAPI []byte
+
+// ErrNotFound is returned by a Controller for presets that do not exist.
+var ErrNotFound = errors.New("not found")
+
+// Controller is what the API controls, implemented by core.Core.
+type Controller interface {
+	State() State
+	SetPower(on bool) error
+	SetBrightness(brightness uint8) error
+	SetSpeed(speed uint8) error
+	Presets() []Preset
+	ActivatePreset(id int) error
+	AirPlayEnabled() bool
+	SetAirPlay(enabled bool) error
+	LedFXStatus() LedFX
+	BluetoothStatus() Bluetooth
+	AudioBuffer() AudioBuffer
+	ConfigValues() map[string]interface{}
+	ReloadConfig() error
+	ComponentStates() []lifecycle.ComponentStatus
+	Subscribe(types ...events.Type) *events.Subscription
+}
+
+// State is the state of the lights.
+type State struct {
+	On         bool  `json:"on"`
+	Brightness uint8 `json:"brightness"`
+	Speed      uint8 `json:"speed"`
+	// Preset is the ID of the active WLED preset, or -1 if none is.
+	Preset  int    `json:"preset"`
+	AirPlay bool   `json:"airplay"`
+	Wled    string `json:"wled"`
+}
+
+type Preset struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+}
+
+// LedFX is the state of the LedFX container.
+type LedFX struct {
+	Container string          `json:"container"`
+	Health    lifecycle.State `json:"health"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// Bluetooth is the state of the Bluetooth audio device.
+type Bluetooth struct {
+	Device    string          `json:"device"`
+	Connected bool            `json:"connected"`
+	Health    lifecycle.State `json:"health"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// AudioBuffer is the state of the buffer between decoding the AirPlay audio
+// and the outputs.
+type AudioBuffer struct {
+	// Depth is the number of packets the buffer holds.
+	Depth   int           `json:"depth"`
+	Written uint64        `json:"written"`
+	Outputs []AudioOutput `json:"outputs"`
+}
+
+// AudioOutput are the counters of an audio output.
+type AudioOutput struct {
+	Name      string `json:"name"`
+	Buffered  int    `json:"buffered"`
+	Played    uint64 `json:"played"`
+	Dropped   uint64 `json:"dropped"`
+	Overruns  uint64 `json:"overruns"`
+	Underruns uint64 `json:"underruns"`
+	Errors    uint64 `json:"errors"`
+}
+
+// Server serves the API. It implements lifecycle.Service.
+type Server struct {
+	ctl   Controller
+	addr  string
+	token string
+
+	srv    *http.Server
+	status lifecycle.Status
+	group  *lifecycle.Group
+
+	// stopping is closed by Stop to end the event streams, which would
+	// otherwise keep Shutdown waiting.
+	stopMu   sync.Mutex
+	stopping chan struct{}
+}
+
+// NewServer returns a server for ctl listening on addr. If token is not
+// empty, every request but the OpenAPI document has to carry it as a bearer
+// token.
+func NewServer(ctl Controller, addr, token string) *Server {
+	s := &Server{ctl: ctl, addr: addr, token: token}
+	s.group = lifecycle.NewGroup(&s.status)
+	return s
+}
+
+// Start listens on the address and serves in the background.
+func (s *Server) Start(context.Context) error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		err = fmt.Errorf("error listening on %s: %w", s.addr, err)
+		s.status.Set(lifecycle.Failed, err)
+		return err
+	}
+	srv := &http.Server{Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	s.srv = srv
+	s.stopMu.Lock()
+	s.stopping = make(chan struct{})
+	s.stopMu.Unlock()
+	s.status.Set(lifecycle.Running, nil)
+	log.Infof("Serving HTTP API on %s\n", l.Addr())
+	s.group.Go("http-api", func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.status.Set(lifecycle.Failed, err)
+		}
+	})
+	return nil
+}
+
+// Stop lets in-flight requests finish until ctx is done.
+func (s *Server) Stop(ctx context.Context) error {
+	if s.srv == nil {
+		return nil
+	}
+	s.status.Set(lifecycle.Stopping, nil)
+	s.stopMu.Lock()
+	close(s.stopping)
+	s.stopMu.Unlock()
+	err := s.srv.Shutdown(ctx)
+	if err != nil {
+		_ = s.srv.Close()
+	}
+	s.srv = nil
+	if waitErr := s.group.Wait(ctx); err == nil {
+		err = waitErr
+	}
+	s.status.Set(lifecycle.Stopped, nil)
+	return err
+}
+
+func (s *Server) Health() lifecycle.Health {
+	return s.status.Health()
+}
+
+// Handler returns the API handler.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(Prefix+"/openapi.yaml", s.openAPI)
+	mux.Handle(Prefix+"/state", s.auth(methods{http.MethodGet: s.getState}))
+	mux.Handle(Prefix+"/power", s.auth(methods{http.MethodPut: s.putPower}))
+	mux.Handle(Prefix+"/brightness", s.auth(methods{http.MethodPut: s.putBrightness}))
+	mux.Handle(Prefix+"/speed", s.auth(methods{http.MethodPut: s.putSpeed}))
+	mux.Handle(Prefix+"/presets", s.auth(methods{http.MethodGet: s.getPresets}))
+	mux.Handle(Prefix+"/presets/", s.auth(methods{http.MethodPost: s.activatePreset}))
+	mux.Handle(Prefix+"/airplay", s.auth(methods{http.MethodGet: s.getAirPlay, http.MethodPut: s.putAirPlay}))
+	mux.Handle(Prefix+"/ledfx", s.auth(methods{http.MethodGet: s.getLedFX}))
+	mux.Handle(Prefix+"/bluetooth", s.auth(methods{http.MethodGet: s.getBluetooth}))
+	mux.Handle(Prefix+"/audio", s.auth(methods{http.MethodGet: s.getAudio}))
+	mux.Handle(Prefix+"/config", s.auth(methods{http.MethodGet: s.getConfig}))
+	mux.Handle(Prefix+"/config/reload", s.auth(methods{http.MethodPost: s.reloadConfig}))
+	mux.Handle(Prefix+"/components", s.auth(methods{http.MethodGet: s.getComponents}))
+	mux.Handle(Prefix+"/events", s.auth(methods{http.MethodGet: s.streamEvents}))
+	return mux
+}
+
+// methods routes a request by its method.
+type methods map[string]http.HandlerFunc
+
+func (m methods) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h, ok := m[r.Method]; ok {
+		h(w, r)
+		return
+	}
+	allowed := make([]string, 0, len(m))
+	for method := range m {
+		allowed = append(allowed, method)
+	}
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+}
+
+func (s *Server) auth(next http.Handler) http.Handler {
+	if s.token == "" {
+		return next
+	}
+	want := []byte("Bearer " + s.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hyperkit"`)
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) openAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	_, _ = w.Write(openAPI)
+}
+
+func (s *Server) getState(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.ctl.State())
+}
+
+func (s *Server) putPower(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		On *bool `json:"on"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.On == nil {
+		writeError(w, http.StatusBadRequest, errors.New("on must be set"))
+		return
+	}
+	s.apply(w, s.ctl.SetPower(*req.On))
+}
+
+func (s *Server) putBrightness(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Brightness *uint8 `json:"brightness"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Brightness == nil {
+		writeError(w, http.StatusBadRequest, errors.New("brightness must be set"))
+		return
+	}
+	s.apply(w, s.ctl.SetBrightness(*req.Brightness))
+}
+
+func (s *Server) putSpeed(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Speed *uint8 `json:"speed"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Speed == nil {
+		writeError(w, http.StatusBadRequest, errors.New("speed must be set"))
+		return
+	}
+	s.apply(w, s.ctl.SetSpeed(*req.Speed))
+}
+
+func (s *Server) getPresets(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.ctl.Presets())
+}
+
+// activatePreset handles POST /presets/{id}/activate.
+func (s *Server) activatePreset(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, Prefix+"/presets/")
+	idStr := strings.TrimSuffix(rest, "/activate")
+	if idStr == rest || strings.Contains(idStr, "/") {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+		return
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid preset ID %q", idStr))
+		return
+	}
+	s.apply(w, s.ctl.ActivatePreset(id))
+}
+
+func (s *Server) getAirPlay(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]bool{"enabled": s.ctl.AirPlayEnabled()})
+}
+
+func (s *Server) putAirPlay(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Enabled == nil {
+		writeError(w, http.StatusBadRequest, errors.New("enabled must be set"))
+		return
+	}
+	if err := s.ctl.SetAirPlay(*req.Enabled); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.getAirPlay(w, r)
+}
+
+func (s *Server) getLedFX(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.ctl.LedFXStatus())
+}
+
+func (s *Server) getBluetooth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.ctl.BluetoothStatus())
+}
+
+func (s *Server) getAudio(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.ctl.AudioBuffer())
+}
+
+func (s *Server) getConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.ctl.ConfigValues())
+}
+
+func (s *Server) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if err := s.ctl.ReloadConfig(); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	s.getConfig(w, r)
+}
+
+func (s *Server) getComponents(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.ctl.ComponentStates())
+}
+
+// keepAliveInterval is how often a comment is sent on idle event streams, so
+// that proxies do not close them.
+const keepAliveInterval = 15 * time.Second
+
+// streamEvents streams events as server-sent events until the client goes
+// away. The types query parameter is a comma separated list of event types to
+// receive; all are sent if it is empty.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+	var types []events.Type
+	if param := r.URL.Query().Get("types"); param != "" {
+		for _, typ := range strings.Split(param, ",") {
+			types = append(types, events.Type(strings.TrimSpace(typ)))
+		}
+	}
+	sub := s.ctl.Subscribe(types...)
+	defer sub.Close()
+
+	s.stopMu.Lock()
+	stopping := s.stopping
+	s.stopMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-stopping:
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case ev, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Errorf("Error encoding event: %v\n", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// apply responds with the new state, or the error of the change.
+func (s *Server) apply(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, s.ctl.State())
+	}
+}
+
+// maxBodySize bounds request bodies, which are all small JSON objects.
+const maxBodySize = 1 << 16
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debugf("Error writing HTTP API response: %v\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,175 @@
+package restapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hyperkit/core/events"
+	"hyperkit/core/lifecycle"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeController records the changes made through the API.
+type fakeController struct {
+	state   State
+	presets []Preset
+	bus     *events.Bus
+}
+
+func (f *fakeController) State() State { return f.state }
+
+func (f *fakeController) SetPower(on bool) error {
+	f.state.On = on
+	return nil
+}
+
+func (f *fakeController) SetBrightness(brightness uint8) error {
+	f.state.Brightness = brightness
+	return nil
+}
+
+func (f *fakeController) SetSpeed(speed uint8) error {
+	f.state.Speed = speed
+	return nil
+}
+
+func (f *fakeController) Presets() []Preset { return f.presets }
+
+func (f *fakeController) ActivatePreset(id int) error {
+	for _, p := range f.presets {
+		if p.ID == id {
+			f.state.Preset = id
+			return nil
+		}
+	}
+	return fmt.Errorf("preset %d: %w", id, ErrNotFound)
+}
+
+func (f *fakeController) AirPlayEnabled() bool { return f.state.AirPlay }
+
+func (f *fakeController) SetAirPlay(enabled bool) error {
+	f.state.AirPlay = enabled
+	return nil
+}
+
+func (f *fakeController) LedFXStatus() LedFX { return LedFX{Container: "paused"} }
+
+func (f *fakeController) BluetoothStatus() Bluetooth { return Bluetooth{Device: "speaker"} }
+
+func (f *fakeController) AudioBuffer() AudioBuffer {
+	return AudioBuffer{Depth: 32, Outputs: []AudioOutput{{Name: "oto", Played: 10}}}
+}
+
+func (f *fakeController) ConfigValues() map[string]interface{} {
+	return map[string]interface{}{"wled_ip": "wled.local"}
+}
+
+func (f *fakeController) ReloadConfig() error { return nil }
+
+func (f *fakeController) ComponentStates() []lifecycle.ComponentStatus { return nil }
+
+func (f *fakeController) Subscribe(types ...events.Type) *events.Subscription {
+	return f.bus.Subscribe(8, types...)
+}
+
+func do(t *testing.T, h http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAuth(t *testing.T) {
+	h := NewServer(&fakeController{}, "", "secret").Handler()
+
+	if rec := do(t, h, http.MethodGet, Prefix+"/state", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Got %d without a token, want %d\n", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := do(t, h, http.MethodGet, Prefix+"/state", "wrong", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Got %d with a wrong token, want %d\n", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := do(t, h, http.MethodGet, Prefix+"/state", "secret", ""); rec.Code != http.StatusOK {
+		t.Fatalf("Got %d with the token, want %d\n", rec.Code, http.StatusOK)
+	}
+	if rec := do(t, h, http.MethodGet, Prefix+"/openapi.yaml", "", ""); rec.Code != http.StatusOK || !strings.HasPrefix(rec.Body.String(), "openapi:") {
+		t.Fatalf("Got %d for the OpenAPI document without a token, want %d\n", rec.Code, http.StatusOK)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	ctl := &fakeController{state: State{Preset: -1}, presets: []Preset{{ID: 3, Name: "Aurora"}}}
+	h := NewServer(ctl, "", "").Handler()
+
+	for _, tc := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{http.MethodPut, "/power", `{"on":true}`, http.StatusOK},
+		{http.MethodPut, "/brightness", `{"brightness":128}`, http.StatusOK},
+		{http.MethodPut, "/speed", `{"speed":200}`, http.StatusOK},
+		{http.MethodPost, "/presets/3/activate", "", http.StatusOK},
+		{http.MethodPut, "/airplay", `{"enabled":true}`, http.StatusOK},
+		{http.MethodPost, "/presets/4/activate", "", http.StatusNotFound},
+		{http.MethodPost, "/presets/x/activate", "", http.StatusBadRequest},
+		{http.MethodPut, "/brightness", `{"brightness":256}`, http.StatusBadRequest},
+		{http.MethodPut, "/power", `{}`, http.StatusBadRequest},
+		{http.MethodPost, "/power", `{"on":false}`, http.StatusMethodNotAllowed},
+	} {
+		rec := do(t, h, tc.method, Prefix+tc.path, "", tc.body)
+		if rec.Code != tc.code {
+			t.Fatalf("%s %s: got %d, want %d: %s\n", tc.method, tc.path, rec.Code, tc.code, rec.Body)
+		}
+	}
+
+	want := State{On: true, Brightness: 128, Speed: 200, Preset: 3, AirPlay: true}
+	if ctl.state != want {
+		t.Fatalf("Got state %+v, want %+v\n", ctl.state, want)
+	}
+
+	rec := do(t, h, http.MethodGet, Prefix+"/state", "", "")
+	var got State
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("Error decoding state: %v\n", err)
+	}
+	if got != want {
+		t.Fatalf("Got state %+v, want %+v\n", got, want)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	ctl := &fakeController{bus: events.NewBus()}
+	srv := httptest.NewServer(NewServer(ctl, "", "").Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + Prefix + "/events?types=power_changed")
+	if err != nil {
+		t.Fatalf("Error opening event stream: %v\n", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Got content type %q\n", ct)
+	}
+
+	// The subscription exists once the headers were sent
+	ctl.bus.Publish(events.PresetChanged, events.Preset{ID: 3})
+	ctl.bus.Publish(events.PowerChanged, events.Power{On: true})
+
+	lines := bufio.NewScanner(resp.Body)
+	var got []string
+	for len(got) < 3 && lines.Scan() {
+		got = append(got, lines.Text())
+	}
+	want := []string{"id: 2", "event: power_changed", `data: {"id":2,"type":"power_changed","time":`}
+	for i := range want {
+		if i >= len(got) || !strings.HasPrefix(got[i], want[i]) {
+			t.Fatalf("Got %q, want %q\n", got, want)
+		}
+	}
+}
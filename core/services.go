@@ -0,0 +1,79 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hyperkit/core/errorTypes"
+	"hyperkit/core/lifecycle"
+	"hyperkit/core/wled"
+)
+
+// wledService runs the websocket client of a device under the supervisor.
+// The client reconnects on its own, so a lost connection is only Degraded.
+type wledService struct {
+	dev    *Device
+	status lifecycle.Status
+}
+
+func (w *wledService) Start(context.Context) error {
+	w.dev.wled.Start()
+	w.status.Set(lifecycle.Starting, nil)
+	return nil
+}
+
+// Stop turns WLED off first if wled_off_on_shutdown is set.
+func (w *wledService) Stop(ctx context.Context) error {
+	errs := new(errorTypes.MultiError)
+	if w.dev.core.currentConfig().WledOffOnShutdown {
+		log.Infof("Turning %s off...\n", w.dev.Name)
+		errs.Append(errorTypes.RunWithContext(ctx, "turning "+w.dev.Name+" off", func() error {
+			_, err := w.dev.wled.SetState(buildPowerState(false))
+			return err
+		}))
+	}
+	errs.Append(errorTypes.RunWithContext(ctx, "closing WLED connection", w.dev.wled.Close))
+	w.status.Set(lifecycle.Stopped, nil)
+	return errs.ErrorOrNil()
+}
+
+func (w *wledService) Health() lifecycle.Health {
+	if w.status.Health().State == lifecycle.Stopped {
+		return w.status.Health()
+	}
+	if s := w.dev.wled.ConnState(); s != wled.Connected {
+		w.status.Set(lifecycle.Degraded, fmt.Errorf("WLED %s is %s", w.dev.Name, s))
+	} else {
+		w.status.Set(lifecycle.Running, nil)
+	}
+	return w.status.Health()
+}
+
+// homekitService publishes the accessories over HomeKit.
+type homekitService struct {
+	core   *Core
+	status lifecycle.Status
+}
+
+func (h *homekitService) Start(context.Context) error {
+	if err := h.core.startTransport(); err != nil {
+		h.status.Set(lifecycle.Failed, err)
+		return err
+	}
+	h.status.Set(lifecycle.Running, nil)
+	return nil
+}
+
+func (h *homekitService) Stop(ctx context.Context) error {
+	h.status.Set(lifecycle.Stopping, nil)
+	err := errorTypes.RunWithContext(ctx, "stopping HomeKit transport", func() error {
+		h.core.stopTransport()
+		return nil
+	})
+	h.status.Set(lifecycle.Stopped, err)
+	return err
+}
+
+func (h *homekitService) Health() lifecycle.Health {
+	return h.status.Health()
+}
@@ -0,0 +1,38 @@
+package core
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"hyperkit/core/errorTypes"
+	"time"
+)
+
+// Shutdown stops the background watchers and then every component in reverse
+// start order: HomeKit first so no new commands come in, then the AirPlay
+// pipeline (RAOP server and named pipe, LedFX, Bluetooth), and finally the
+// connection to WLED, which is optionally turned off first. Every component
+// is stopped even if an earlier one fails or times out; the errors are
+// returned together. Start returns once Shutdown has been called.
+func (c *Core) Shutdown(ctx context.Context) error {
+	errs := new(errorTypes.MultiError)
+
+	c.terminate.Do(func() { close(c.terminated) })
+
+	errs.Append(c.supervisor.Stop(ctx))
+	// The WLED clients are started before the supervisor, so they still have
+	// to be closed if Start failed or never ran.
+	for _, d := range c.devices {
+		errs.Append(errorTypes.RunWithContext(ctx, "closing WLED connection to "+d.Name, d.wled.Close))
+	}
+
+	if err := errs.ErrorOrNil(); err != nil {
+		return err
+	}
+	log.Infoln("Shut down HyperKit")
+	return nil
+}
+
+// ShutdownTimeout returns how long Shutdown may take, from the config.
+func (c *Core) ShutdownTimeout() time.Duration {
+	return c.currentConfig().ShutdownTimeout
+}
@@ -0,0 +1,160 @@
+package core
+
+import (
+	"fmt"
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	log "github.com/sirupsen/logrus"
+	"hyperkit/core/wled"
+	"sync"
+)
+
+const (
+	PresetModeOutlets    = "outlets"
+	PresetModeTelevision = "television"
+)
+
+// TelevisionHandler presents the WLED presets as the inputs of a HomeKit
+// Television, so the Home app shows them in a single picker. Input identifiers
+// are the WLED preset IDs, which keeps them stable across restarts.
+type TelevisionHandler struct {
+	tv         *accessory.Accessory
+	television *service.Television
+	inputs     map[int]*service.InputSource
+	lastActive int
+
+	mu  *sync.Mutex
+	dev *Device
+}
+
+func (d *Device) NewTelevisionHandler() (t *TelevisionHandler) {
+	t = &TelevisionHandler{
+		tv:         accessory.New(d.info("tv", d.Name+" Presets"), accessory.TypeTelevision),
+		television: service.NewTelevision(),
+		inputs:     make(map[int]*service.InputSource),
+		lastActive: -1,
+		mu:         new(sync.Mutex),
+		dev:        d,
+	}
+	t.television.ConfiguredName.SetValue(d.Name)
+	t.television.SleepDiscoveryMode.SetValue(characteristic.SleepDiscoveryModeAlwaysDiscoverable)
+	t.television.Active.SetValue(characteristic.ActiveActive)
+	t.television.Primary = true
+	t.tv.AddService(t.television.Service)
+
+	t.television.Active.OnValueRemoteUpdate(func(active int) {
+		t.setActive(active == characteristic.ActiveActive)
+	})
+	t.television.ActiveIdentifier.OnValueRemoteUpdate(t.activatePreset)
+
+	return t
+}
+
+// AddPreset adds an input for the given WLED preset, or renames it if it
+// already exists.
+func (t *TelevisionHandler) AddPreset(id int, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if input, ok := t.inputs[id]; ok {
+		if input.ConfiguredName.GetValue() != name {
+			input.ConfiguredName.SetValue(name)
+			input.Name.SetValue(name)
+		}
+		return
+	}
+
+	input := service.NewInputSource()
+	input.Identifier.SetValue(id)
+	input.ConfiguredName.SetValue(name)
+	input.Name.SetValue(name)
+	input.InputSourceType.SetValue(characteristic.InputSourceTypeOther)
+	input.IsConfigured.SetValue(characteristic.IsConfiguredConfigured)
+	input.CurrentVisibilityState.SetValue(characteristic.CurrentVisibilityStateShown)
+	input.TargetVisibilityState.OnValueRemoteUpdate(func(state int) {
+		input.CurrentVisibilityState.SetValue(state)
+	})
+
+	t.inputs[id] = input
+	t.dev.core.ids.Name(input.Service, fmt.Sprintf("input/%d", id))
+	t.television.AddLinkedService(input.Service)
+	t.tv.AddService(input.Service)
+}
+
+// RemovePreset removes the input of the given WLED preset.
+func (t *TelevisionHandler) RemovePreset(id int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	input, ok := t.inputs[id]
+	if !ok {
+		return fmt.Errorf("preset %d does not exist", id)
+	}
+	delete(t.inputs, id)
+	t.television.Linked = removeService(t.television.Linked, input.Service)
+	t.tv.Services = removeService(t.tv.Services, input.Service)
+	t.dev.core.ids.Forget(input.Service)
+	if t.lastActive == id {
+		t.lastActive = -1
+	}
+	return nil
+}
+
+func (t *TelevisionHandler) setActive(on bool) {
+	t.dev.presetHandler.setPower(on)
+	t.dev.menuOutlet.Outlet.On.SetValue(on)
+	if !on {
+		return
+	}
+	t.mu.Lock()
+	last := t.lastActive
+	t.mu.Unlock()
+	if last > -1 {
+		go t.activatePreset(last)
+	}
+}
+
+func (t *TelevisionHandler) activatePreset(id int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.inputs[id]; !ok {
+		log.Printf("Preset %d does not exist!\n", id)
+		return
+	}
+	t.lastActive = id
+	t.television.ActiveIdentifier.SetValue(id)
+	if t.television.Active.GetValue() != characteristic.ActiveActive {
+		t.television.Active.SetValue(characteristic.ActiveActive)
+		t.dev.menuOutlet.Outlet.On.SetValue(true)
+	}
+	log.Printf("Switching to WLED preset with id: %d\n", id)
+	if err := t.dev.applyPreset(id); err != nil {
+		log.Printf("Error switching to preset %d: %v\n", id, err)
+	}
+}
+
+// sync mirrors a state pushed by WLED onto the television without sending
+// anything back to WLED.
+func (t *TelevisionHandler) sync(st *wled.State) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if st.On != nil {
+		active := characteristic.ActiveInactive
+		if st.On.Bool() {
+			active = characteristic.ActiveActive
+		}
+		if t.television.Active.GetValue() != active {
+			t.television.Active.SetValue(active)
+		}
+	}
+	if st.Preset == nil || t.dev.effectPlaying() {
+		return
+	}
+	if _, ok := t.inputs[*st.Preset]; ok {
+		t.lastActive = *st.Preset
+		if t.television.ActiveIdentifier.GetValue() != *st.Preset {
+			t.television.ActiveIdentifier.SetValue(*st.Preset)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package util
+
+import (
+	"math"
+)
+
+// HSVToRGB converts a hue (0-360), saturation (0-100) and value (0-100) as used
+// by HomeKit into 8-bit RGB channels.
+func HSVToRGB(hue, saturation, value float64) (r, g, b int) {
+	h := math.Mod(hue, 360) / 60
+	s := clamp(saturation/100, 0, 1)
+	v := clamp(value/100, 0, 1)
+
+	c := v * s
+	x := c * (1 - math.Abs(math.Mod(h, 2)-1))
+	m := v - c
+
+	var rf, gf, bf float64
+	switch {
+	case h < 1:
+		rf, gf, bf = c, x, 0
+	case h < 2:
+		rf, gf, bf = x, c, 0
+	case h < 3:
+		rf, gf, bf = 0, c, x
+	case h < 4:
+		rf, gf, bf = 0, x, c
+	case h < 5:
+		rf, gf, bf = x, 0, c
+	default:
+		rf, gf, bf = c, 0, x
+	}
+	return to8Bit(rf + m), to8Bit(gf + m), to8Bit(bf + m)
+}
+
+// RGBToHSV is the inverse of HSVToRGB.
+func RGBToHSV(r, g, b int) (hue, saturation, value float64) {
+	rf, gf, bf := float64(r)/255, float64(g)/255, float64(b)/255
+	max := math.Max(rf, math.Max(gf, bf))
+	min := math.Min(rf, math.Min(gf, bf))
+	d := max - min
+
+	switch {
+	case d == 0:
+		hue = 0
+	case max == rf:
+		hue = 60 * math.Mod((gf-bf)/d, 6)
+	case max == gf:
+		hue = 60 * ((bf-rf)/d + 2)
+	default:
+		hue = 60 * ((rf-gf)/d + 4)
+	}
+	if hue < 0 {
+		hue += 360
+	}
+	if max > 0 {
+		saturation = d / max * 100
+	}
+	return hue, saturation, max * 100
+}
+
+// MiredToKelvin converts a HomeKit color temperature in mireds to Kelvin.
+func MiredToKelvin(mired int) int {
+	if mired <= 0 {
+		return 0
+	}
+	return int(math.Round(1e6 / float64(mired)))
+}
+
+// KelvinToRGB approximates the RGB color of a black body at the given
+// temperature, for strips without a dedicated white channel.
+func KelvinToRGB(kelvin int) (r, g, b int) {
+	t := clamp(float64(kelvin), 1000, 40000) / 100
+
+	var rf, gf, bf float64
+	if t <= 66 {
+		rf = 255
+		gf = 99.4708025861*math.Log(t) - 161.1195681661
+	} else {
+		rf = 329.698727446 * math.Pow(t-60, -0.1332047592)
+		gf = 288.1221695283 * math.Pow(t-60, -0.0755148492)
+	}
+	switch {
+	case t >= 66:
+		bf = 255
+	case t <= 19:
+		bf = 0
+	default:
+		bf = 138.5177312231*math.Log(t-10) - 305.0447927307
+	}
+	return int(clamp(rf, 0, 255)), int(clamp(gf, 0, 255)), int(clamp(bf, 0, 255))
+}
+
+func to8Bit(f float64) int {
+	return int(math.Round(clamp(f, 0, 1) * 255))
+}
+
+func clamp(v, lo, hi float64) float64 {
+	return math.Max(lo, math.Min(hi, v))
+}
@@ -0,0 +1,41 @@
+package util
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHSVToRGB(t *testing.T) {
+	for _, tc := range []struct {
+		h, s, v float64
+		r, g, b int
+	}{
+		{0, 100, 100, 255, 0, 0},
+		{120, 100, 100, 0, 255, 0},
+		{240, 100, 100, 0, 0, 255},
+		{60, 50, 100, 255, 255, 128},
+		{0, 0, 100, 255, 255, 255},
+		{300, 100, 0, 0, 0, 0},
+	} {
+		r, g, b := HSVToRGB(tc.h, tc.s, tc.v)
+		if r != tc.r || g != tc.g || b != tc.b {
+			t.Errorf("HSVToRGB(%v, %v, %v) = (%d, %d, %d), want (%d, %d, %d)\n", tc.h, tc.s, tc.v, r, g, b, tc.r, tc.g, tc.b)
+		}
+		if tc.v == 0 {
+			continue
+		}
+		h, s, _ := RGBToHSV(r, g, b)
+		if tc.s > 0 && math.Abs(h-tc.h) > 1 || math.Abs(s-tc.s) > 1 {
+			t.Errorf("RGBToHSV(%d, %d, %d) = (%.1f, %.1f), want (%v, %v)\n", r, g, b, h, s, tc.h, tc.s)
+		}
+	}
+}
+
+func TestKelvinToRGB(t *testing.T) {
+	if r, g, b := KelvinToRGB(MiredToKelvin(500)); r != 255 || g >= 160 || b >= 60 {
+		t.Errorf("2000K should be a deep orange, got (%d, %d, %d)\n", r, g, b)
+	}
+	if r, g, b := KelvinToRGB(6600); r != 255 || g < 240 || b != 255 {
+		t.Errorf("6600K should be close to white, got (%d, %d, %d)\n", r, g, b)
+	}
+}
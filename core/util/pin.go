@@ -0,0 +1,61 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+// disallowedPins are the setup codes the HomeKit Accessory Protocol
+// specification forbids because they are trivial to guess.
+var disallowedPins = map[string]bool{
+	"00000000": true,
+	"11111111": true,
+	"22222222": true,
+	"33333333": true,
+	"44444444": true,
+	"55555555": true,
+	"66666666": true,
+	"77777777": true,
+	"88888888": true,
+	"99999999": true,
+	"12345678": true,
+	"87654321": true,
+}
+
+// ParsePin parses a HomeKit setup code written as "12345678" or "123-45-678"
+// and validates it.
+func ParsePin(s string) (pin [8]uint, err error) {
+	digits := strings.ReplaceAll(strings.TrimSpace(s), "-", "")
+	if len(digits) != len(pin) {
+		return pin, fmt.Errorf("pin must have 8 digits, got %q", s)
+	}
+	for i, r := range digits {
+		if r < '0' || r > '9' {
+			return pin, fmt.Errorf("pin must only contain digits, got %q", s)
+		}
+		pin[i] = uint(r - '0')
+	}
+	return pin, ValidatePin(pin)
+}
+
+// ValidatePin rejects setup codes that HomeKit does not accept.
+func ValidatePin(pin [8]uint) error {
+	str, err := PinArrayToString(pin)
+	if err != nil {
+		return err
+	}
+	if disallowedPins[str] {
+		return fmt.Errorf("pin %s is not allowed by HomeKit, choose a less predictable one", str)
+	}
+	return nil
+}
+
+// FormatPin formats a setup code the way the Home app displays it
+// ("123-45-678").
+func FormatPin(pin [8]uint) string {
+	str, err := PinArrayToString(pin)
+	if err != nil {
+		return ""
+	}
+	return str[:3] + "-" + str[3:5] + "-" + str[5:]
+}
@@ -0,0 +1,32 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestParsePin(t *testing.T) {
+	for _, tc := range []struct {
+		in    string
+		valid bool
+	}{
+		{"69694200", true},
+		{"696-94-200", true},
+		{"031-45-154", true},
+		{"12345678", false},
+		{"87654321", false},
+		{"00000000", false},
+		{"555-55-555", false},
+		{"1234567", false},
+		{"1234567a", false},
+		{"", false},
+	} {
+		pin, err := ParsePin(tc.in)
+		if (err == nil) != tc.valid {
+			t.Errorf("ParsePin(%q) error = %v, want valid=%v\n", tc.in, err, tc.valid)
+			continue
+		}
+		if tc.valid && FormatPin(pin) != tc.in && FormatPin(pin) != tc.in[:3]+"-"+tc.in[3:5]+"-"+tc.in[5:] {
+			t.Errorf("FormatPin(ParsePin(%q)) = %s\n", tc.in, FormatPin(pin))
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package wled
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"hyperkit/core/metrics"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Client talks to a single WLED controller. State changes are written over a
+// supervised websocket that is redialed whenever it drops; everything else
+// goes through the HTTP JSON API.
+type Client struct {
+	host string
+	opts Options
+	http *http.Client
+
+	mu        sync.Mutex
+	conn      *websocket.Conn
+	connState ConnState
+	desired   *State
+	power     *Power
+	stateFns  []func(*StateInfo)
+	connFns   []func(ConnState)
+
+	stop          chan struct{}
+	done          chan struct{}
+	redial        chan struct{}
+	connected     chan struct{}
+	connectedOnce sync.Once
+}
+
+// Options tunes the websocket supervision of a Client. Zero values are
+// replaced with the defaults below.
+type Options struct {
+	// MinBackoff and MaxBackoff bound the exponential delay between dials.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// PingInterval is how often the connection is pinged, and PongTimeout how
+	// long after a ping the connection is considered dead without traffic.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	// WriteTimeout bounds writing a state to the websocket.
+	WriteTimeout time.Duration
+	// QueueWhileDown makes Send coalesce states issued while disconnected
+	// and deliver them on reconnect instead of returning ErrDisconnected.
+	QueueWhileDown bool
+	// Resolve, if set, looks up the current address of the controller. It
+	// is called before dialing without a host, and after a failed dial or a
+	// dropped connection, so a controller that moved is followed.
+	Resolve func(ctx context.Context) (string, error)
+	// ResolveTimeout bounds each call to Resolve.
+	ResolveTimeout time.Duration
+}
+
+const (
+	DefaultMinBackoff   = 500 * time.Millisecond
+	DefaultMaxBackoff   = 30 * time.Second
+	DefaultPingInterval = 15 * time.Second
+	DefaultPongTimeout  = 10 * time.Second
+	DefaultWriteTimeout = 5 * time.Second
+	// DefaultResolveTimeout leaves mDNS enough time for a few queries.
+	DefaultResolveTimeout = 5 * time.Second
+)
+
+func NewClient(host string, opts Options) *Client {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = DefaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	if opts.PingInterval <= 0 {
+		opts.PingInterval = DefaultPingInterval
+	}
+	if opts.PongTimeout <= 0 {
+		opts.PongTimeout = DefaultPongTimeout
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = DefaultWriteTimeout
+	}
+	if opts.ResolveTimeout <= 0 {
+		opts.ResolveTimeout = DefaultResolveTimeout
+	}
+	return &Client{
+		host:      host,
+		opts:      opts,
+		http:      &http.Client{Timeout: 10 * time.Second},
+		connected: make(chan struct{}),
+		redial:    make(chan struct{}, 1),
+	}
+}
+
+// Host returns the address of the controller.
+func (c *Client) Host() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.host
+}
+
+// SetHost points the client at another controller. The websocket is redialed
+// right away and the desired state is replayed to the new controller.
+func (c *Client) SetHost(host string) {
+	conn, changed := c.switchHost(host)
+	if !changed {
+		return
+	}
+	select {
+	case c.redial <- struct{}{}:
+	default:
+	}
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
+
+// switchHost sets the host and returns the connection to the old one, if
+// any, and whether the host changed.
+func (c *Client) switchHost(host string) (*websocket.Conn, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.host == host {
+		return nil, false
+	}
+	metrics.WledConnected.DeleteLabelValues(c.host)
+	c.host = host
+	// The last reported power belongs to the old controller
+	c.power = nil
+	return c.conn, true
+}
+
+// State fetches the current state from /json/state.
+func (c *Client) State() (s *State, err error) {
+	s = new(State)
+	if err := c.get("/json/state", s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetState validates s and posts it to /json/state, returning the resulting
+// state of the controller.
+func (c *Client) SetState(s *State) (*State, error) {
+	if err := s.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid state: %w", err)
+	}
+	req := *s
+	req.Verbose = Bool(true)
+	body, err := json.Marshal(&req)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling state: %w", err)
+	}
+	start := time.Now()
+	resp, err := c.http.Post(c.url("/json/state"), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to WLED API: %w", err)
+	}
+	res := new(State)
+	err = decodeResponse(resp, res)
+	metrics.WledCommandLatency.WithLabelValues(c.Host(), "http").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Info fetches /json/info.
+func (c *Client) Info() (i *Info, err error) {
+	i = new(Info)
+	if err := c.get("/json/info", i); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// Effects fetches the effect names from /json/effects. The index of each
+// name is its effect ID.
+func (c *Client) Effects() (fx []string, err error) {
+	if err := c.get("/json/effects", &fx); err != nil {
+		return nil, err
+	}
+	return fx, nil
+}
+
+// Palettes fetches the palette names from /json/palettes. The index of each
+// name is its palette ID.
+func (c *Client) Palettes() (pal []string, err error) {
+	if err := c.get("/json/palettes", &pal); err != nil {
+		return nil, err
+	}
+	return pal, nil
+}
+
+// All fetches state, info, effects and palettes in one request from /json.
+func (c *Client) All() (si *StateInfo, err error) {
+	si = new(StateInfo)
+	if err := c.get("/json", si); err != nil {
+		return nil, err
+	}
+	return si, nil
+}
+
+func (c *Client) url(path string) string {
+	return fmt.Sprintf("http://%s%s", c.Host(), path)
+}
+
+func (c *Client) get(path string, v interface{}) error {
+	resp, err := c.http.Get(c.url(path))
+	if err != nil {
+		return fmt.Errorf("error connecting to WLED API: %w", err)
+	}
+	return decodeResponse(resp, v)
+}
+
+func decodeResponse(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading data from response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from %s: %s", resp.Request.URL, resp.Status)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("error unmarshalling response body: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,420 @@
+package wled
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, received chan<- map[string]interface{}) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/json/state", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			body := make(map[string]interface{})
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Errorf("Error decoding posted state: %v\n", err)
+			}
+			received <- body
+		}
+		_, _ = w.Write([]byte(`{"on":true,"bri":128,"ps":3,"seg":[{"id":0,"sx":200,"col":[[255,0,0],[0,0,0],[0,0,0]]}]}`))
+	})
+	mux.HandleFunc("/json/info", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"ver":"0.13.0","name":"HyperCube","leds":{"count":120,"rgbw":false},"mac":"aabbccddeeff"}`))
+	})
+	mux.HandleFunc("/json/effects", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`["Solid","Blink","Breathe"]`))
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Error upgrading websocket: %v\n", err)
+			return
+		}
+		defer conn.Close()
+		body := make(map[string]interface{})
+		if err := conn.ReadJSON(&body); err != nil {
+			return
+		}
+		received <- body
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestClientHTTP(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	srv := newTestServer(t, received)
+	defer srv.Close()
+	c := NewClient(strings.TrimPrefix(srv.URL, "http://"), Options{})
+
+	st, err := c.State()
+	if err != nil {
+		t.Fatalf("Error getting state: %v\n", err)
+	}
+	if !st.On.Bool() || *st.Brightness != 128 || *st.Preset != 3 || *st.Segments[0].Speed != 200 {
+		t.Fatalf("Unexpected state: %s\n", st)
+	}
+
+	info, err := c.Info()
+	if err != nil {
+		t.Fatalf("Error getting info: %v\n", err)
+	}
+	if info.Name != "HyperCube" || info.Leds.Count != 120 {
+		t.Fatalf("Unexpected info: %+v\n", info)
+	}
+
+	fx, err := c.Effects()
+	if err != nil {
+		t.Fatalf("Error getting effects: %v\n", err)
+	}
+	if len(fx) != 3 || fx[2] != "Breathe" {
+		t.Fatalf("Unexpected effects: %v\n", fx)
+	}
+
+	if _, err := c.SetState(&State{On: PowerPtr(PowerToggle), Brightness: Int(10)}); err != nil {
+		t.Fatalf("Error setting state: %v\n", err)
+	}
+	body := <-received
+	if body["on"] != "t" || body["bri"] != float64(10) || body["v"] != true {
+		t.Fatalf("Unexpected posted state: %v\n", body)
+	}
+}
+
+func TestClientSend(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	srv := newTestServer(t, received)
+	defer srv.Close()
+	c := NewClient(strings.TrimPrefix(srv.URL, "http://"), Options{})
+
+	if err := c.Send(&State{Preset: Int(1)}); !errors.Is(err, ErrDisconnected) {
+		t.Fatalf("Expected ErrDisconnected sending before connecting, got %v\n", err)
+	}
+	c.Start()
+	defer c.Close()
+	if !c.WaitConnected(5 * time.Second) {
+		t.Fatalf("Timed out connecting\n")
+	}
+	if err := c.Send(&State{Segments: []Segment{{ID: Int(0), Speed: Int(42)}}}); err != nil {
+		t.Fatalf("Error sending state: %v\n", err)
+	}
+	body := <-received
+	seg := body["seg"].([]interface{})[0].(map[string]interface{})
+	if seg["id"] != float64(0) || seg["sx"] != float64(42) {
+		t.Fatalf("Unexpected sent state: %v\n", body)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		state *State
+		valid bool
+	}{
+		{"empty", &State{}, true},
+		{"full", &State{On: PowerPtr(PowerOn), Brightness: Int(255), Preset: Int(-1), Transition: Int(7)}, true},
+		{"brightness", &State{Brightness: Int(256)}, false},
+		{"preset", &State{Preset: Int(251)}, false},
+		{"speed", &State{Segments: []Segment{{Speed: Int(-1)}}}, false},
+		{"color", &State{Segments: []Segment{{Colors: []Color{{255, 0}}}}}, false},
+		{"color channel", &State{Segments: []Segment{{Colors: []Color{{255, 0, 300}}}}}, false},
+		{"kelvin", &State{Segments: []Segment{{CCT: Int(2700)}}}, true},
+		{"kelvin range", &State{Segments: []Segment{{CCT: Int(1000)}}}, false},
+		{"nightlight", &State{Nightlight: &Nightlight{Duration: Int(0)}}, false},
+		{"playlist", &State{Playlist: &Playlist{}}, false},
+	} {
+		err := tc.state.Validate()
+		if tc.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v\n", tc.name, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%s: expected validation error\n", tc.name)
+		}
+	}
+
+	var rangeErr *RangeError
+	if err := (&State{Brightness: Int(300)}).Validate(); !errors.As(err, &rangeErr) || rangeErr.Field != "bri" {
+		t.Fatalf("Expected RangeError for bri, got %v\n", err)
+	}
+}
+
+func TestClientOnState(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Error upgrading websocket: %v\n", err)
+			return
+		}
+		defer conn.Close()
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"success":true}`))
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"state":{"on":false,"bri":5,"ps":2},"info":{"name":"HyperCube"}}`))
+		_, _, _ = conn.ReadMessage()
+	}))
+	defer srv.Close()
+	c := NewClient(strings.TrimPrefix(srv.URL, "http://"), Options{})
+	states := make(chan *StateInfo, 2)
+	c.OnState(func(si *StateInfo) { states <- si })
+	c.Start()
+	defer c.Close()
+
+	select {
+	case si := <-states:
+		if st := si.State; st.On.Bool() || *st.Brightness != 5 || *st.Preset != 2 || si.Info.Name != "HyperCube" {
+			t.Fatalf("Unexpected state push: %s\n", st)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for state push\n")
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	received := make(chan map[string]interface{}, 8)
+	conns := make(chan *websocket.Conn, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Error upgrading websocket: %v\n", err)
+			return
+		}
+		conns <- conn
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"state":{"on":true}}`))
+		for {
+			body := make(map[string]interface{})
+			if err := conn.ReadJSON(&body); err != nil {
+				return
+			}
+			received <- body
+		}
+	}))
+	defer srv.Close()
+
+	c := NewClient(strings.TrimPrefix(srv.URL, "http://"), Options{
+		MinBackoff:     10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+		QueueWhileDown: true,
+	})
+	states := make(chan ConnState, 16)
+	c.OnConnState(func(s ConnState) { states <- s })
+	pushed := make(chan struct{}, 4)
+	c.OnState(func(*StateInfo) { pushed <- struct{}{} })
+	c.Start()
+	defer c.Close()
+	if !c.WaitConnected(5 * time.Second) {
+		t.Fatalf("Timed out connecting\n")
+	}
+	<-pushed
+
+	if err := c.Send(&State{Brightness: Int(40)}); err != nil {
+		t.Fatalf("Error sending state: %v\n", err)
+	}
+	if body := <-received; body["bri"] != float64(40) {
+		t.Fatalf("Unexpected sent state: %v\n", body)
+	}
+	// WLED reported on=true, so the toggle must be resolved to an explicit off.
+	if err := c.Send(&State{On: PowerPtr(PowerToggle)}); err != nil {
+		t.Fatalf("Error sending state: %v\n", err)
+	}
+	if body := <-received; body["on"] != false {
+		t.Fatalf("Expected toggle to be resolved to off, got %v\n", body)
+	}
+
+	// Drop the connection and wait for the client to notice.
+	_ = (<-conns).Close()
+	waitFor := func(want ConnState) {
+		for {
+			select {
+			case s := <-states:
+				if s == want {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for %v\n", want)
+			}
+		}
+	}
+	waitFor(Disconnected)
+	waitFor(Connected)
+
+	// The desired state is replayed on reconnect.
+	select {
+	case body := <-received:
+		if body["bri"] != float64(40) || body["on"] != false {
+			t.Fatalf("Unexpected replayed state: %v\n", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for replay\n")
+	}
+	if c.ConnState() != Connected {
+		t.Fatalf("Expected to be connected, got %v\n", c.ConnState())
+	}
+}
+
+func TestClientToggleNotSent(t *testing.T) {
+	c := NewClient("", Options{})
+	c.power = PowerPtr(PowerOn)
+	if err := c.Send(&State{On: PowerPtr(PowerToggle)}); !errors.Is(err, ErrDisconnected) {
+		t.Fatalf("Expected ErrDisconnected, got %v\n", err)
+	}
+	if *c.power != PowerOn {
+		t.Fatalf("Rejected toggle switched the power to %v\n", *c.power)
+	}
+
+	c.opts.QueueWhileDown = true
+	if err := c.Send(&State{On: PowerPtr(PowerToggle)}); err != nil {
+		t.Fatalf("Error queueing toggle: %v\n", err)
+	}
+	if *c.power != PowerOff || *c.desired.On != PowerOff {
+		t.Fatalf("Queued toggle left the power at %v\n", *c.power)
+	}
+}
+
+func TestClientReplaysPushedState(t *testing.T) {
+	received := make(chan map[string]interface{}, 8)
+	conns := make(chan *websocket.Conn, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Error upgrading websocket: %v\n", err)
+			return
+		}
+		conns <- conn
+		for {
+			body := make(map[string]interface{})
+			if err := conn.ReadJSON(&body); err != nil {
+				return
+			}
+			received <- body
+		}
+	}))
+	defer srv.Close()
+
+	c := NewClient(strings.TrimPrefix(srv.URL, "http://"), Options{
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+	})
+	pushed := make(chan struct{}, 4)
+	c.OnState(func(*StateInfo) { pushed <- struct{}{} })
+	c.Start()
+	defer c.Close()
+	if !c.WaitConnected(5 * time.Second) {
+		t.Fatalf("Timed out connecting\n")
+	}
+	conn := <-conns
+
+	if err := c.Send(&State{Brightness: Int(40), Preset: Int(2)}); err != nil {
+		t.Fatalf("Error sending state: %v\n", err)
+	}
+	<-received
+	// The brightness is changed in the WLED app afterwards
+	_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"state":{"on":true,"bri":50,"ps":-1,"lor":1,"nl":{"on":true,"dur":60},"seg":[{"id":0,"fx":9}]}}`))
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for state push\n")
+	}
+	_ = conn.Close()
+
+	select {
+	case body := <-received:
+		seg := body["seg"].([]interface{})[0].(map[string]interface{})
+		if body["bri"] != float64(50) || body["on"] != true || seg["fx"] != float64(9) {
+			t.Fatalf("Replayed state does not match the pushed one: %v\n", body)
+		}
+		for _, key := range []string{"ps", "lor", "nl"} {
+			if _, ok := body[key]; ok {
+				t.Fatalf("Replayed state has %s: %v\n", key, body)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for replay\n")
+	}
+}
+
+func TestClientSetHost(t *testing.T) {
+	received := make(chan map[string]interface{}, 8)
+	first := newTestServer(t, received)
+	defer first.Close()
+	moved := make(chan map[string]interface{}, 8)
+	second := newTestServer(t, moved)
+	defer second.Close()
+
+	c := NewClient(strings.TrimPrefix(first.URL, "http://"), Options{
+		MinBackoff:     10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+		QueueWhileDown: true,
+	})
+	c.Start()
+	defer c.Close()
+	if !c.WaitConnected(5 * time.Second) {
+		t.Fatalf("Timed out connecting\n")
+	}
+	if err := c.Send(&State{Brightness: Int(40)}); err != nil {
+		t.Fatalf("Error sending state: %v\n", err)
+	}
+	<-received
+
+	// The desired state is replayed to the new controller.
+	c.SetHost(strings.TrimPrefix(second.URL, "http://"))
+	if c.Host() != strings.TrimPrefix(second.URL, "http://") {
+		t.Fatalf("Unexpected host %s\n", c.Host())
+	}
+	select {
+	case body := <-moved:
+		if body["bri"] != float64(40) {
+			t.Fatalf("Unexpected replayed state: %v\n", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for replay to the new host\n")
+	}
+}
+
+func TestClientResolve(t *testing.T) {
+	received := make(chan map[string]interface{}, 8)
+	srv := newTestServer(t, received)
+	defer srv.Close()
+
+	resolved := make(chan struct{}, 8)
+	c := NewClient("", Options{
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+		Resolve: func(ctx context.Context) (string, error) {
+			resolved <- struct{}{}
+			return strings.TrimPrefix(srv.URL, "http://"), nil
+		},
+	})
+	c.Start()
+	defer c.Close()
+	if !c.WaitConnected(5 * time.Second) {
+		t.Fatalf("Timed out connecting\n")
+	}
+	if c.Host() != strings.TrimPrefix(srv.URL, "http://") {
+		t.Fatalf("Unexpected host %s\n", c.Host())
+	}
+	if len(resolved) != 1 {
+		t.Fatalf("Resolved %d times before connecting, want 1\n", len(resolved))
+	}
+}
+
+func TestStateMerge(t *testing.T) {
+	s := &State{Brightness: Int(10), Segments: []Segment{{ID: Int(0), Speed: Int(5)}}}
+	s.Merge(&State{Segments: []Segment{{ID: Int(0), Intensity: Int(7)}, {ID: Int(1), Speed: Int(9)}}, Verbose: Bool(true)})
+	if len(s.Segments) != 2 || *s.Segments[0].Speed != 5 || *s.Segments[0].Intensity != 7 || *s.Segments[1].Speed != 9 {
+		t.Fatalf("Unexpected merged segments: %s\n", s)
+	}
+	if s.Verbose != nil {
+		t.Fatalf("One-shot fields must not be merged: %s\n", s)
+	}
+	s.Merge(&State{Preset: Int(3)})
+	if s.Brightness != nil || s.Segments != nil || *s.Preset != 3 {
+		t.Fatalf("Preset must supersede earlier settings: %s\n", s)
+	}
+	s.Merge(&State{Brightness: Int(99)})
+	steps := s.replaySteps()
+	if len(steps) != 2 || *steps[0].Preset != 3 || steps[0].Brightness != nil || *steps[1].Brightness != 99 {
+		t.Fatalf("Unexpected replay steps: %v\n", steps)
+	}
+}
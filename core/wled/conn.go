@@ -0,0 +1,387 @@
+package wled
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"hyperkit/core/metrics"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// ErrDisconnected is returned by Send when the websocket is down and the
+// client is not queueing commands.
+var ErrDisconnected = errors.New("websocket is not connected")
+
+// ConnState is the state of the supervised websocket connection.
+type ConnState uint8
+
+const (
+	Disconnected ConnState = iota
+	Connecting
+	Connected
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case Disconnected:
+		return "disconnected"
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	}
+	return "unknown"
+}
+
+// Start launches the goroutine that dials the websocket and keeps it alive.
+// It returns immediately; use ConnState or OnConnState to follow progress.
+func (c *Client) Start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop != nil {
+		return
+	}
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go c.supervise(c.stop, c.done)
+}
+
+// Close stops the supervisor and closes the websocket connection, if any.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	stop, done, conn := c.stop, c.done, c.conn
+	c.stop, c.done = nil, nil
+	c.mu.Unlock()
+	if stop == nil {
+		return nil
+	}
+	close(stop)
+	var err error
+	if conn != nil {
+		err = conn.Close()
+	}
+	<-done
+	return err
+}
+
+// WaitConnected blocks until the websocket has connected at least once or
+// timeout elapses, and reports whether it connected.
+func (c *Client) WaitConnected(timeout time.Duration) bool {
+	select {
+	case <-c.connected:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// ConnState returns the current state of the websocket connection.
+func (c *Client) ConnState() ConnState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connState
+}
+
+// OnState registers fn to be called with every state WLED pushes over the
+// websocket. Callbacks run on the reader goroutine.
+func (c *Client) OnState(fn func(*StateInfo)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stateFns = append(c.stateFns, fn)
+}
+
+// OnConnState registers fn to be called whenever the connection state changes.
+func (c *Client) OnConnState(fn func(ConnState)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connFns = append(c.connFns, fn)
+}
+
+// Send validates s and writes it to the controller over the websocket. Every
+// sent state is also merged into the desired state which is replayed after a
+// reconnect, as are the states WLED pushes. While disconnected, s is either coalesced into that desired
+// state or rejected with ErrDisconnected, depending on Options.QueueWhileDown.
+func (c *Client) Send(s *State) error {
+	if err := s.Validate(); err != nil {
+		return fmt.Errorf("invalid state: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s = c.resolveToggle(s)
+	if c.conn == nil {
+		if !c.opts.QueueWhileDown {
+			return fmt.Errorf("error sending state to %s: %w", c.host, ErrDisconnected)
+		}
+		c.remember(s)
+		log.Debugf("WLED websocket is down, queued state: %s\n", s)
+		return nil
+	}
+	start := time.Now()
+	_ = c.conn.SetWriteDeadline(start.Add(c.opts.WriteTimeout))
+	err := c.conn.WriteJSON(s)
+	metrics.WledCommandLatency.WithLabelValues(c.host, "ws").Observe(time.Since(start).Seconds())
+	if err != nil {
+		// The connection is unusable after a failed write; closing it makes
+		// the supervisor redial
+		_ = c.conn.Close()
+		return fmt.Errorf("error writing state to websocket: %w", err)
+	}
+	c.remember(s)
+	return nil
+}
+
+// resolveToggle replaces a power toggle with the explicit value it will
+// result in, so that the desired state can be replayed safely. Must be
+// called with c.mu held.
+func (c *Client) resolveToggle(s *State) *State {
+	if s.On == nil || *s.On != PowerToggle || c.power == nil {
+		return s
+	}
+	resolved := *s
+	if c.power.Bool() {
+		resolved.On = PowerPtr(PowerOff)
+	} else {
+		resolved.On = PowerPtr(PowerOn)
+	}
+	return &resolved
+}
+
+// remember merges s, once written or queued, into the desired state and
+// takes its power as the current one. Must be called with c.mu held.
+func (c *Client) remember(s *State) {
+	if c.desired == nil {
+		c.desired = new(State)
+	}
+	c.desired.Merge(s)
+	if s.On != nil && *s.On != PowerToggle {
+		c.power = PowerPtr(*s.On)
+	}
+}
+
+func (c *Client) supervise(stop, done chan struct{}) {
+	defer close(done)
+	attempt := 0
+	resolve := c.Host() == ""
+	for {
+		if resolve && c.opts.Resolve != nil {
+			c.resolve(stop)
+		}
+		host := c.Host()
+		c.setConnState(Connecting)
+		conn, _, err := c.dial(host)
+		if err != nil {
+			c.setConnState(Disconnected)
+			delay := c.backoff(attempt)
+			attempt++
+			log.Warnf("Error dialing 'ws://%s/ws' (retrying in %v): %v\n", host, delay, err)
+			if !c.wait(stop, delay) {
+				return
+			}
+			resolve = true
+			continue
+		}
+		attempt = 0
+		resolve = false
+
+		if err := c.attach(conn); err != nil {
+			log.Warnf("Error replaying desired state to %s: %v\n", host, err)
+		}
+		log.Infof("Connected to WLED websocket at %s\n", host)
+
+		err = c.read(conn, stop)
+		c.detach(conn)
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		log.Warnf("Lost WLED websocket connection to %s: %v\n", host, err)
+		if !c.wait(stop, c.backoff(0)) {
+			return
+		}
+		resolve = true
+	}
+}
+
+func (c *Client) dial(host string) (*websocket.Conn, *http.Response, error) {
+	if host == "" {
+		return nil, nil, errors.New("address of the controller is unknown")
+	}
+	return websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws", host), nil)
+}
+
+// resolve looks up the current address of the controller with
+// Options.Resolve and switches to it if the controller moved.
+func (c *Client) resolve(stop chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.ResolveTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	host, err := c.opts.Resolve(ctx)
+	if err != nil {
+		log.Warnf("Error resolving the address of the WLED controller: %v\n", err)
+		return
+	}
+	old := c.Host()
+	if _, changed := c.switchHost(host); !changed {
+		return
+	}
+	if old == "" {
+		log.Infof("Found WLED controller at %s\n", host)
+	} else {
+		log.Infof("WLED controller moved from %s to %s\n", old, host)
+	}
+}
+
+// wait sleeps for delay, or until SetHost asks for an immediate redial. It
+// returns false if the client was closed.
+func (c *Client) wait(stop chan struct{}, delay time.Duration) bool {
+	select {
+	case <-stop:
+		return false
+	case <-c.redial:
+	case <-time.After(delay):
+	}
+	return true
+}
+
+// attach makes conn the active connection and replays the desired state
+// before any other Send can go through.
+func (c *Client) attach(conn *websocket.Conn) error {
+	c.mu.Lock()
+	c.conn = conn
+	var err error
+	if c.desired != nil && !c.desired.empty() {
+		log.Infof("Replaying desired state to %s: %s\n", c.host, c.desired)
+		for _, step := range c.desired.replaySteps() {
+			_ = conn.SetWriteDeadline(time.Now().Add(c.opts.WriteTimeout))
+			if err = conn.WriteJSON(step); err != nil {
+				break
+			}
+		}
+	}
+	host := c.host
+	c.mu.Unlock()
+	select {
+	case <-c.connected:
+		metrics.WledReconnects.WithLabelValues(host).Inc()
+	default:
+	}
+	c.connectedOnce.Do(func() { close(c.connected) })
+	c.setConnState(Connected)
+	return err
+}
+
+func (c *Client) detach(conn *websocket.Conn) {
+	c.mu.Lock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	c.mu.Unlock()
+	_ = conn.Close()
+	c.setConnState(Disconnected)
+}
+
+// read consumes pushed states until the connection fails. A ping is sent every
+// PingInterval; any message or pong extends the read deadline.
+func (c *Client) read(conn *websocket.Conn, stop chan struct{}) error {
+	timeout := c.opts.PingInterval + c.opts.PongTimeout
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(timeout))
+	})
+
+	pingDone := make(chan struct{})
+	defer close(pingDone)
+	go func() {
+		ticker := time.NewTicker(c.opts.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pingDone:
+				return
+			case <-stop:
+				_ = conn.Close()
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.opts.PongTimeout)); err != nil {
+					log.Debugf("Error pinging WLED websocket: %v\n", err)
+				}
+			}
+		}
+	}()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+
+		si := new(StateInfo)
+		if err := json.Unmarshal(msg, si); err != nil {
+			// WLED also answers with {"success":true} and the like; only
+			// full state pushes are of interest here.
+			continue
+		}
+		if si.State == nil {
+			continue
+		}
+		c.mu.Lock()
+		if si.State.On != nil {
+			c.power = PowerPtr(*si.State.On)
+		}
+		// Changes made on WLED itself, e.g. in the WLED app, supersede the
+		// earlier commands and are replayed in their place
+		if c.desired == nil {
+			c.desired = new(State)
+		}
+		c.desired.mergePushed(si.State)
+		fns := append([]func(*StateInfo){}, c.stateFns...)
+		c.mu.Unlock()
+		for _, fn := range fns {
+			fn(si)
+		}
+	}
+}
+
+func (c *Client) setConnState(s ConnState) {
+	c.mu.Lock()
+	if c.connState == s {
+		c.mu.Unlock()
+		return
+	}
+	c.connState = s
+	metrics.WledConnected.WithLabelValues(c.host).Set(metrics.Bool(s == Connected))
+	fns := append([]func(ConnState){}, c.connFns...)
+	c.mu.Unlock()
+	for _, fn := range fns {
+		fn(s)
+	}
+}
+
+// backoff returns the delay before dial attempt n, doubling from MinBackoff up
+// to MaxBackoff with ±20% jitter.
+func (c *Client) backoff(n int) time.Duration {
+	d := c.opts.MinBackoff
+	for i := 0; i < n && d < c.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.opts.MaxBackoff {
+		d = c.opts.MaxBackoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(d)/5*2+1)) - d/5
+	return d + jitter
+}
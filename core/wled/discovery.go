@@ -0,0 +1,157 @@
+package wled
+
+import (
+	"context"
+	"fmt"
+	"github.com/grandcat/zeroconf"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Service is the DNS-SD service type WLED advertises itself as.
+const Service = "_wled._tcp"
+
+// Controller is a WLED controller found over mDNS.
+type Controller struct {
+	// Instance is the mDNS name of the controller, e.g. "wled-1a2b3c".
+	Instance string
+	// Host is the address to reach the controller at, as accepted by
+	// NewClient.
+	Host string
+	// MAC is the MAC address the controller advertises, normalised with
+	// NormalizeMAC. It is empty for firmware that does not advertise it.
+	MAC string
+}
+
+// Browse looks for WLED controllers until ctx is done, calling found for
+// every controller that answers.
+func Browse(ctx context.Context, found func(Controller)) error {
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		return fmt.Errorf("error creating mDNS resolver: %w", err)
+	}
+	entries := make(chan *zeroconf.ServiceEntry)
+	if err := resolver.Browse(ctx, Service, "", entries); err != nil {
+		return fmt.Errorf("error browsing for %s: %w", Service, err)
+	}
+	// The resolver closes entries once ctx is done, and blocks until each
+	// entry is received, so keep draining even after found lost interest.
+	for entry := range entries {
+		if c, ok := controllerFromEntry(entry); ok {
+			found(c)
+		}
+	}
+	return nil
+}
+
+// Find browses for the first controller m matches, until ctx is done.
+func Find(ctx context.Context, m Match) (Controller, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var match *Controller
+	err := Browse(ctx, func(c Controller) {
+		if match == nil && m.Matches(c) {
+			match = &c
+			cancel()
+		}
+	})
+	if err != nil {
+		return Controller{}, err
+	}
+	if match == nil {
+		return Controller{}, fmt.Errorf("no WLED controller with %s found", m)
+	}
+	return *match, nil
+}
+
+func controllerFromEntry(entry *zeroconf.ServiceEntry) (c Controller, ok bool) {
+	c.Instance = entry.Instance
+	switch {
+	case len(entry.AddrIPv4) > 0 && (entry.Port == 0 || entry.Port == 80):
+		c.Host = entry.AddrIPv4[0].String()
+	case len(entry.AddrIPv4) > 0:
+		c.Host = net.JoinHostPort(entry.AddrIPv4[0].String(), strconv.Itoa(entry.Port))
+	case len(entry.AddrIPv6) > 0:
+		// IPv6 addresses need the brackets of host:port in URLs
+		port := entry.Port
+		if port == 0 {
+			port = 80
+		}
+		c.Host = net.JoinHostPort(entry.AddrIPv6[0].String(), strconv.Itoa(port))
+	default:
+		return c, false
+	}
+	for _, txt := range entry.Text {
+		if strings.HasPrefix(txt, "mac=") {
+			c.MAC, _ = NormalizeMAC(strings.TrimPrefix(txt, "mac="))
+		}
+	}
+	return c, true
+}
+
+// Match selects controllers by mDNS name, MAC address or both. Fields that
+// are empty match any controller.
+type Match struct {
+	// Name is the mDNS name of the controller, with or without ".local".
+	Name string
+	// MAC is the MAC address of the controller in any common notation.
+	MAC string
+}
+
+// Empty reports whether m has nothing to match on.
+func (m Match) Empty() bool {
+	return m.Name == "" && m.MAC == ""
+}
+
+// Matches reports whether c is the controller m describes.
+func (m Match) Matches(c Controller) bool {
+	if m.Empty() {
+		return false
+	}
+	if m.Name != "" && !strings.EqualFold(strings.TrimSuffix(m.Name, ".local"), c.Instance) {
+		return false
+	}
+	if m.MAC != "" {
+		mac, err := NormalizeMAC(m.MAC)
+		if err != nil || mac != c.MAC {
+			return false
+		}
+	}
+	return true
+}
+
+// Resolve finds the controller m describes and returns its current address.
+// It can be used as Options.Resolve.
+func (m Match) Resolve(ctx context.Context) (string, error) {
+	c, err := Find(ctx, m)
+	if err != nil {
+		return "", err
+	}
+	return c.Host, nil
+}
+
+func (m Match) String() string {
+	switch {
+	case m.Name != "" && m.MAC != "":
+		return fmt.Sprintf("mDNS name %s and MAC %s", m.Name, m.MAC)
+	case m.MAC != "":
+		return fmt.Sprintf("MAC %s", m.MAC)
+	}
+	return fmt.Sprintf("mDNS name %s", m.Name)
+}
+
+// NormalizeMAC returns mac as the 12 lowercase hex digits WLED uses, e.g.
+// "AA:BB:CC:DD:EE:FF" becomes "aabbccddeeff".
+func NormalizeMAC(mac string) (string, error) {
+	normalized := strings.ToLower(strings.NewReplacer(":", "", "-", "", ".", "").Replace(mac))
+	if len(normalized) != 12 {
+		return "", fmt.Errorf("invalid MAC address %q", mac)
+	}
+	for _, r := range normalized {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return "", fmt.Errorf("invalid MAC address %q", mac)
+		}
+	}
+	return normalized, nil
+}
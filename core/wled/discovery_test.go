@@ -0,0 +1,65 @@
+package wled
+
+import (
+	"github.com/grandcat/zeroconf"
+	"net"
+	"testing"
+)
+
+func TestControllerFromEntry(t *testing.T) {
+	entry := zeroconf.NewServiceEntry("wled-1a2b3c", Service, "local.")
+	entry.Port = 80
+	entry.Text = []string{"mac=AABBCC1A2B3C"}
+	if _, ok := controllerFromEntry(entry); ok {
+		t.Fatalf("Expected an entry without addresses to be skipped\n")
+	}
+	entry.AddrIPv4 = []net.IP{net.ParseIP("192.168.1.40")}
+	c, ok := controllerFromEntry(entry)
+	if !ok || c.Instance != "wled-1a2b3c" || c.Host != "192.168.1.40" || c.MAC != "aabbcc1a2b3c" {
+		t.Fatalf("Unexpected controller %+v\n", c)
+	}
+	entry.Port = 8080
+	if c, _ := controllerFromEntry(entry); c.Host != "192.168.1.40:8080" {
+		t.Fatalf("Unexpected host %s\n", c.Host)
+	}
+	entry.AddrIPv4 = nil
+	entry.AddrIPv6 = []net.IP{net.ParseIP("fe80::1")}
+	entry.Port = 80
+	if c, _ := controllerFromEntry(entry); c.Host != "[fe80::1]:80" {
+		t.Fatalf("Unexpected host %s\n", c.Host)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	c := Controller{Instance: "wled-1a2b3c", Host: "192.168.1.40", MAC: "aabbcc1a2b3c"}
+	for _, tc := range []struct {
+		match Match
+		want  bool
+	}{
+		{Match{}, false},
+		{Match{Name: "wled-1a2b3c"}, true},
+		{Match{Name: "WLED-1A2B3C.local"}, true},
+		{Match{Name: "wled-ffffff"}, false},
+		{Match{MAC: "AA:BB:CC:1A:2B:3C"}, true},
+		{Match{MAC: "aa-bb-cc-1a-2b-3d"}, false},
+		{Match{Name: "wled-1a2b3c", MAC: "aabbcc1a2b3c"}, true},
+		{Match{Name: "wled-ffffff", MAC: "aabbcc1a2b3c"}, false},
+	} {
+		if got := tc.match.Matches(c); got != tc.want {
+			t.Errorf("%s: got %v, want %v\n", tc.match, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeMAC(t *testing.T) {
+	for _, mac := range []string{"aabbccddeeff", "AA:BB:CC:DD:EE:FF", "aa-bb-cc-dd-ee-ff", "aabb.ccdd.eeff"} {
+		if got, err := NormalizeMAC(mac); err != nil || got != "aabbccddeeff" {
+			t.Errorf("%s: got %q, %v\n", mac, got, err)
+		}
+	}
+	for _, mac := range []string{"", "aabbccddee", "aabbccddeegg"} {
+		if _, err := NormalizeMAC(mac); err == nil {
+			t.Errorf("%s: expected an error\n", mac)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package wled
+
+// Info mirrors the WLED /json/info object.
+type Info struct {
+	Version      string   `json:"ver"`
+	VersionID    int      `json:"vid"`
+	Leds         LedInfo  `json:"leds"`
+	SyncToggle   bool     `json:"str"`
+	Name         string   `json:"name"`
+	UDPPort      int      `json:"udpport"`
+	Live         bool     `json:"live"`
+	LiveMode     string   `json:"lm"`
+	LiveIP       string   `json:"lip"`
+	WSClients    int      `json:"ws"`
+	EffectCount  int      `json:"fxcount"`
+	PaletteCount int      `json:"palcount"`
+	WiFi         WiFiInfo `json:"wifi"`
+	Arch         string   `json:"arch"`
+	Core         string   `json:"core"`
+	FreeHeap     int      `json:"freeheap"`
+	Uptime       int      `json:"uptime"`
+	Brand        string   `json:"brand"`
+	Product      string   `json:"product"`
+	MAC          string   `json:"mac"`
+	IP           string   `json:"ip"`
+}
+
+// LedInfo mirrors the "leds" object of /json/info.
+type LedInfo struct {
+	Count       int  `json:"count"`
+	RGBW        bool `json:"rgbw"`
+	WhiteValue  bool `json:"wv"`
+	CCT         bool `json:"cct"`
+	Power       int  `json:"pwr"`
+	FPS         int  `json:"fps"`
+	MaxPower    int  `json:"maxpwr"`
+	MaxSegments int  `json:"maxseg"`
+}
+
+// WiFiInfo mirrors the "wifi" object of /json/info.
+type WiFiInfo struct {
+	BSSID   string `json:"bssid"`
+	RSSI    int    `json:"rssi"`
+	Signal  int    `json:"signal"`
+	Channel int    `json:"channel"`
+}
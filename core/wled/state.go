@@ -0,0 +1,315 @@
+package wled
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Power is the value of a WLED "on" field. Besides true and false, WLED
+// accepts "t" to flip the current value.
+type Power uint8
+
+const (
+	PowerOff Power = iota
+	PowerOn
+	PowerToggle
+)
+
+func (p Power) MarshalJSON() ([]byte, error) {
+	switch p {
+	case PowerOff:
+		return []byte("false"), nil
+	case PowerOn:
+		return []byte("true"), nil
+	case PowerToggle:
+		return []byte(`"t"`), nil
+	}
+	return nil, fmt.Errorf("invalid power value %d", p)
+}
+
+func (p *Power) UnmarshalJSON(b []byte) error {
+	switch string(b) {
+	case "false":
+		*p = PowerOff
+	case "true":
+		*p = PowerOn
+	case `"t"`:
+		*p = PowerToggle
+	default:
+		return fmt.Errorf("invalid power value %s", string(b))
+	}
+	return nil
+}
+
+// Bool reports whether p is PowerOn. PowerToggle reports false since the
+// resulting value is only known to the controller.
+func (p Power) Bool() bool {
+	return p == PowerOn
+}
+
+// Color is a single RGB or RGBW color as used in a segment's "col" array.
+type Color []int
+
+// State mirrors the WLED /json/state object. Every field is optional so the
+// same type is used for full state responses and partial update requests.
+type State struct {
+	On             *Power      `json:"on,omitempty"`
+	Brightness     *int        `json:"bri,omitempty"`
+	Transition     *int        `json:"transition,omitempty"`
+	TransitionOnce *int        `json:"tt,omitempty"`
+	Preset         *int        `json:"ps,omitempty"`
+	SavePreset     *int        `json:"psave,omitempty"`
+	Playlist       *Playlist   `json:"playlist,omitempty"`
+	PlaylistID     *int        `json:"pl,omitempty"`
+	Nightlight     *Nightlight `json:"nl,omitempty"`
+	UDPSync        *UDPSync    `json:"udpn,omitempty"`
+	LiveOverride   *int        `json:"lor,omitempty"`
+	MainSegment    *int        `json:"mainseg,omitempty"`
+	Segments       []Segment   `json:"seg,omitempty"`
+	Verbose        *bool       `json:"v,omitempty"`
+	Reboot         *bool       `json:"rb,omitempty"`
+}
+
+// Segment mirrors an entry of the WLED "seg" array.
+type Segment struct {
+	ID         *int    `json:"id,omitempty"`
+	Start      *int    `json:"start,omitempty"`
+	Stop       *int    `json:"stop,omitempty"`
+	Length     *int    `json:"len,omitempty"`
+	Grouping   *int    `json:"grp,omitempty"`
+	Spacing    *int    `json:"spc,omitempty"`
+	Offset     *int    `json:"of,omitempty"`
+	Colors     []Color `json:"col,omitempty"`
+	Effect     *int    `json:"fx,omitempty"`
+	Speed      *int    `json:"sx,omitempty"`
+	Intensity  *int    `json:"ix,omitempty"`
+	Palette    *int    `json:"pal,omitempty"`
+	Selected   *bool   `json:"sel,omitempty"`
+	Reverse    *bool   `json:"rev,omitempty"`
+	Mirror     *bool   `json:"mi,omitempty"`
+	On         *bool   `json:"on,omitempty"`
+	Brightness *int    `json:"bri,omitempty"`
+	CCT        *int    `json:"cct,omitempty"`
+	Name       *string `json:"n,omitempty"`
+	Freeze     *bool   `json:"frz,omitempty"`
+}
+
+// Nightlight mirrors the WLED "nl" object.
+type Nightlight struct {
+	On               *bool `json:"on,omitempty"`
+	Duration         *int  `json:"dur,omitempty"`
+	Mode             *int  `json:"mode,omitempty"`
+	TargetBrightness *int  `json:"tbri,omitempty"`
+	Remaining        *int  `json:"rem,omitempty"`
+}
+
+// UDPSync mirrors the WLED "udpn" object.
+type UDPSync struct {
+	Send    *bool `json:"send,omitempty"`
+	Receive *bool `json:"recv,omitempty"`
+}
+
+// Playlist mirrors the WLED "playlist" object used to start a playlist.
+type Playlist struct {
+	Presets    []int `json:"ps"`
+	Durations  []int `json:"dur,omitempty"`
+	Transition []int `json:"transition,omitempty"`
+	Repeat     *int  `json:"repeat,omitempty"`
+	End        *int  `json:"end,omitempty"`
+}
+
+// StateInfo is the combined object WLED returns from /json and pushes over
+// its websocket.
+type StateInfo struct {
+	State    *State   `json:"state,omitempty"`
+	Info     *Info    `json:"info,omitempty"`
+	Effects  []string `json:"effects,omitempty"`
+	Palettes []string `json:"palettes,omitempty"`
+}
+
+// Int returns a pointer to v, for filling optional State fields.
+func Int(v int) *int {
+	return &v
+}
+
+// Bool returns a pointer to v, for filling optional State fields.
+func Bool(v bool) *bool {
+	return &v
+}
+
+// String returns a pointer to v, for filling optional State fields.
+func String(v string) *string {
+	return &v
+}
+
+// PowerPtr returns a pointer to p, for filling State.On.
+func PowerPtr(p Power) *Power {
+	return &p
+}
+
+func (s *State) String() string {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Sprintf("<invalid state: %v>", err)
+	}
+	return string(b)
+}
+
+// Merge copies every field set in o onto s. Segments are merged by ID. One-shot
+// fields (v, rb, psave, tt) are not copied, and applying a preset or playlist
+// discards the brightness and segment settings it supersedes.
+func (s *State) Merge(o *State) {
+	if o.Preset != nil || o.PlaylistID != nil || o.Playlist != nil {
+		s.Brightness = nil
+		s.Segments = nil
+		s.Preset, s.PlaylistID, s.Playlist = nil, nil, nil
+	}
+	if o.On != nil {
+		s.On = PowerPtr(*o.On)
+	}
+	if o.Brightness != nil {
+		s.Brightness = Int(*o.Brightness)
+	}
+	if o.Transition != nil {
+		s.Transition = Int(*o.Transition)
+	}
+	if o.Preset != nil {
+		s.Preset = Int(*o.Preset)
+	}
+	if o.PlaylistID != nil {
+		s.PlaylistID = Int(*o.PlaylistID)
+	}
+	if o.Playlist != nil {
+		pl := *o.Playlist
+		s.Playlist = &pl
+	}
+	if o.Nightlight != nil {
+		nl := *o.Nightlight
+		s.Nightlight = &nl
+	}
+	if o.UDPSync != nil {
+		udpn := *o.UDPSync
+		s.UDPSync = &udpn
+	}
+	if o.LiveOverride != nil {
+		s.LiveOverride = Int(*o.LiveOverride)
+	}
+	if o.MainSegment != nil {
+		s.MainSegment = Int(*o.MainSegment)
+	}
+	for _, seg := range o.Segments {
+		s.mergeSegment(seg)
+	}
+}
+
+// mergePushed merges a state pushed by WLED into s. As WLED pushes its whole
+// state, the preset or playlist it reports replaces that of s, even if none
+// is active. Timers, sync and live overrides are left out, as they are not
+// worth restoring.
+func (s *State) mergePushed(o *State) {
+	p := &State{On: o.On, Brightness: o.Brightness, Transition: o.Transition, MainSegment: o.MainSegment, Segments: o.Segments}
+	if o.Preset != nil || o.PlaylistID != nil {
+		s.Preset, s.PlaylistID, s.Playlist = nil, nil, nil
+	}
+	if o.PlaylistID != nil && *o.PlaylistID > 0 {
+		p.PlaylistID = o.PlaylistID
+	} else if o.Preset != nil && *o.Preset > 0 {
+		p.Preset = o.Preset
+	}
+	s.Merge(p)
+}
+
+func (s *State) mergeSegment(seg Segment) {
+	for i := range s.Segments {
+		cur := &s.Segments[i]
+		if (cur.ID == nil && seg.ID == nil) || (cur.ID != nil && seg.ID != nil && *cur.ID == *seg.ID) {
+			cur.merge(&seg)
+			return
+		}
+	}
+	s.Segments = append(s.Segments, seg)
+}
+
+func (seg *Segment) merge(o *Segment) {
+	merged := *seg
+	if o.Start != nil {
+		merged.Start = o.Start
+	}
+	if o.Stop != nil {
+		merged.Stop = o.Stop
+	}
+	if o.Length != nil {
+		merged.Length = o.Length
+	}
+	if o.Grouping != nil {
+		merged.Grouping = o.Grouping
+	}
+	if o.Spacing != nil {
+		merged.Spacing = o.Spacing
+	}
+	if o.Offset != nil {
+		merged.Offset = o.Offset
+	}
+	if o.Colors != nil {
+		merged.Colors = o.Colors
+	}
+	if o.Effect != nil {
+		merged.Effect = o.Effect
+	}
+	if o.Speed != nil {
+		merged.Speed = o.Speed
+	}
+	if o.Intensity != nil {
+		merged.Intensity = o.Intensity
+	}
+	if o.Palette != nil {
+		merged.Palette = o.Palette
+	}
+	if o.Selected != nil {
+		merged.Selected = o.Selected
+	}
+	if o.Reverse != nil {
+		merged.Reverse = o.Reverse
+	}
+	if o.Mirror != nil {
+		merged.Mirror = o.Mirror
+	}
+	if o.On != nil {
+		merged.On = o.On
+	}
+	if o.Brightness != nil {
+		merged.Brightness = o.Brightness
+	}
+	if o.CCT != nil {
+		merged.CCT = o.CCT
+	}
+	if o.Name != nil {
+		merged.Name = o.Name
+	}
+	if o.Freeze != nil {
+		merged.Freeze = o.Freeze
+	}
+	*seg = merged
+}
+
+// replaySteps splits s into the messages used to restore it on a controller.
+// A preset or playlist is applied first so that the settings made on top of
+// it are not overwritten when it loads.
+func (s *State) replaySteps() []*State {
+	if s.Preset == nil && s.PlaylistID == nil && s.Playlist == nil {
+		return []*State{s}
+	}
+	first := &State{On: s.On, Preset: s.Preset, PlaylistID: s.PlaylistID, Playlist: s.Playlist}
+	rest := *s
+	rest.Preset, rest.PlaylistID, rest.Playlist = nil, nil, nil
+	if rest.empty() {
+		return []*State{first}
+	}
+	return []*State{first, &rest}
+}
+
+// empty reports whether no field of s is set.
+func (s *State) empty() bool {
+	b, err := json.Marshal(s)
+	return err == nil && string(b) == "{}"
+}
@@ -0,0 +1,161 @@
+package wled
+
+import (
+	"fmt"
+)
+
+const (
+	MaxPresetID   = 250
+	MaxTransition = 65535
+	MaxSegmentID  = 31
+)
+
+// RangeError is returned by Validate when a field is outside of the range
+// accepted by WLED.
+type RangeError struct {
+	Field    string
+	Value    int
+	Min, Max int
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("%s must be between %d and %d, got %d", e.Field, e.Min, e.Max, e.Value)
+}
+
+func checkRange(field string, v *int, min, max int) error {
+	if v == nil {
+		return nil
+	}
+	if *v < min || *v > max {
+		return &RangeError{Field: field, Value: *v, Min: min, Max: max}
+	}
+	return nil
+}
+
+// Validate checks every set field of s against the ranges documented for the
+// WLED JSON API.
+func (s *State) Validate() error {
+	checks := []error{
+		checkRange("bri", s.Brightness, 0, 255),
+		checkRange("transition", s.Transition, 0, MaxTransition),
+		checkRange("tt", s.TransitionOnce, 0, MaxTransition),
+		checkRange("ps", s.Preset, -1, MaxPresetID),
+		checkRange("psave", s.SavePreset, 1, MaxPresetID),
+		checkRange("pl", s.PlaylistID, -1, MaxPresetID),
+		checkRange("lor", s.LiveOverride, 0, 2),
+		checkRange("mainseg", s.MainSegment, 0, MaxSegmentID),
+	}
+	for _, err := range checks {
+		if err != nil {
+			return err
+		}
+	}
+	if s.Nightlight != nil {
+		if err := s.Nightlight.validate(); err != nil {
+			return fmt.Errorf("nl: %w", err)
+		}
+	}
+	if s.Playlist != nil {
+		if err := s.Playlist.validate(); err != nil {
+			return fmt.Errorf("playlist: %w", err)
+		}
+	}
+	for i := range s.Segments {
+		if err := s.Segments[i].validate(); err != nil {
+			return fmt.Errorf("seg[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (seg *Segment) validate() error {
+	checks := []error{
+		checkRange("id", seg.ID, 0, MaxSegmentID),
+		checkRange("start", seg.Start, 0, 65535),
+		checkRange("stop", seg.Stop, 0, 65535),
+		checkRange("len", seg.Length, 0, 65535),
+		checkRange("grp", seg.Grouping, 0, 255),
+		checkRange("spc", seg.Spacing, 0, 255),
+		checkRange("fx", seg.Effect, 0, 255),
+		checkRange("sx", seg.Speed, 0, 255),
+		checkRange("ix", seg.Intensity, 0, 255),
+		checkRange("pal", seg.Palette, 0, 255),
+		checkRange("bri", seg.Brightness, 0, 255),
+	}
+	for _, err := range checks {
+		if err != nil {
+			return err
+		}
+	}
+	if seg.Start != nil && seg.Stop != nil && *seg.Stop < *seg.Start {
+		return fmt.Errorf("stop (%d) must not be less than start (%d)", *seg.Stop, *seg.Start)
+	}
+	// WLED takes cct either as a relative value (0-255) or in Kelvin.
+	if seg.CCT != nil && *seg.CCT > 255 {
+		if err := checkRange("cct", seg.CCT, 1900, 10091); err != nil {
+			return err
+		}
+	} else if err := checkRange("cct", seg.CCT, 0, 255); err != nil {
+		return err
+	}
+	if len(seg.Colors) > 3 {
+		return fmt.Errorf("col must contain at most 3 colors, got %d", len(seg.Colors))
+	}
+	for i, c := range seg.Colors {
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("col[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (c Color) validate() error {
+	if len(c) != 3 && len(c) != 4 {
+		return fmt.Errorf("color must have 3 (RGB) or 4 (RGBW) channels, got %d", len(c))
+	}
+	for i, v := range c {
+		if v < 0 || v > 255 {
+			return &RangeError{Field: fmt.Sprintf("channel %d", i), Value: v, Min: 0, Max: 255}
+		}
+	}
+	return nil
+}
+
+func (nl *Nightlight) validate() error {
+	checks := []error{
+		checkRange("dur", nl.Duration, 1, 255),
+		checkRange("mode", nl.Mode, 0, 3),
+		checkRange("tbri", nl.TargetBrightness, 0, 255),
+	}
+	for _, err := range checks {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pl *Playlist) validate() error {
+	if len(pl.Presets) == 0 {
+		return fmt.Errorf("ps must contain at least one preset")
+	}
+	for i := range pl.Presets {
+		if err := checkRange(fmt.Sprintf("ps[%d]", i), &pl.Presets[i], 1, MaxPresetID); err != nil {
+			return err
+		}
+	}
+	for i := range pl.Durations {
+		if err := checkRange(fmt.Sprintf("dur[%d]", i), &pl.Durations[i], 0, MaxTransition); err != nil {
+			return err
+		}
+	}
+	for i := range pl.Transition {
+		if err := checkRange(fmt.Sprintf("transition[%d]", i), &pl.Transition[i], 0, MaxTransition); err != nil {
+			return err
+		}
+	}
+	if err := checkRange("repeat", pl.Repeat, 0, 127); err != nil {
+		return err
+	}
+	return checkRange("end", pl.End, 0, MaxPresetID)
+}
@@ -0,0 +1,104 @@
+package core
+
+import (
+	log "github.com/sirupsen/logrus"
+	"hyperkit/core/events"
+	"hyperkit/core/wled"
+	"sync"
+)
+
+// listenForWledState keeps HomeKit in sync with changes made outside of
+// HyperKit, e.g. from the WLED app or a physical button. States pushed before
+// the handlers existed are covered by fetching the current state once.
+func (d *Device) listenForWledState() {
+	d.wled.OnState(d.syncFromWled)
+	st, err := d.wled.State()
+	if err != nil {
+		log.Warnf("Error fetching initial WLED state of %s: %v\n", d.Name, err)
+		return
+	}
+	d.syncFromWled(&wled.StateInfo{State: st})
+}
+
+// syncFromWled applies a state pushed by WLED to the HomeKit characteristics.
+// Only SetValue is used here, which does not trigger the OnValueRemoteUpdate
+// handlers, so nothing is sent back to WLED.
+func (d *Device) syncFromWled(si *wled.StateInfo) {
+	st := si.State
+	log.Debugf("Received WLED state of %s: %s\n", d.Name, st)
+	d.publishState(st)
+
+	if st.On != nil {
+		d.presetHandler.syncPower(st.On.Bool())
+	}
+	if st.Preset != nil {
+		d.presetHandler.syncPreset(*st.Preset)
+	}
+	d.lightHandler.sync(st)
+	if d.tvHandler != nil {
+		d.tvHandler.sync(st)
+	}
+	for _, g := range d.groups {
+		g.sync()
+	}
+	if d.miscHandler == nil {
+		return
+	}
+	if st.Brightness != nil {
+		d.miscHandler.syncBrightness(uint8(*st.Brightness))
+	}
+	if seg := mainSegment(st); seg != nil && seg.Speed != nil {
+		d.miscHandler.syncSpeed(uint8(*seg.Speed))
+	}
+}
+
+// publishedState is the WLED state last published on the event bus. WLED
+// pushes its whole state on every change, so only what changed is published.
+type publishedState struct {
+	mu         sync.Mutex
+	on         *bool
+	preset     *int
+	brightness *int
+	speed      *int
+}
+
+func (d *Device) publishState(st *wled.State) {
+	p := &d.published
+	bus := d.core.events
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if st.On != nil && (p.on == nil || *p.on != st.On.Bool()) {
+		on := st.On.Bool()
+		p.on = &on
+		bus.Publish(events.PowerChanged, events.Power{Device: d.Name, On: on})
+	}
+	if st.Preset != nil && (p.preset == nil || *p.preset != *st.Preset) {
+		preset := *st.Preset
+		p.preset = &preset
+		bus.Publish(events.PresetChanged, events.Preset{Device: d.Name, ID: preset})
+	}
+	if st.Brightness != nil && (p.brightness == nil || *p.brightness != *st.Brightness) {
+		brightness := *st.Brightness
+		p.brightness = &brightness
+		bus.Publish(events.BrightnessChanged, events.Level{Device: d.Name, Value: uint8(brightness)})
+	}
+	if seg := mainSegment(st); seg != nil && seg.Speed != nil && (p.speed == nil || *p.speed != *seg.Speed) {
+		speed := *seg.Speed
+		p.speed = &speed
+		bus.Publish(events.SpeedChanged, events.Level{Device: d.Name, Value: uint8(speed)})
+	}
+}
+
+func mainSegment(st *wled.State) *wled.Segment {
+	id := 0
+	if st.MainSegment != nil {
+		id = *st.MainSegment
+	}
+	for i := range st.Segments {
+		seg := &st.Segments[i]
+		if seg.ID == nil || *seg.ID == id {
+			return seg
+		}
+	}
+	return nil
+}